@@ -0,0 +1,79 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltr.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltr.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
+)
+
+// bundleExporter export the app as a registry bundle, the ram app spec along
+// with every component and plugin image in the OCI image layout of the
+// package, so that the images are pushed to a registry without a container runtime
+type bundleExporter struct {
+	logger      *logrus.Logger
+	ram         v1alpha1.WutongApplicationConfig
+	imageClient image.Client
+	homePath    string
+	exportPath  string
+	opts        options
+}
+
+func (b *bundleExporter) Export() (*Result, error) {
+	b.logger.Infof("start export app %s to registry bundle", b.ram.AppName)
+	if err := PrepareExportDir(b.exportPath); err != nil {
+		b.logger.Errorf("prepare export dir failure %s", err.Error())
+		return nil, err
+	}
+	// the images are what the bundle is for
+	b.ram.WithImageData = true
+	if err := saveComponentImages(b.ram, b.imageClient, b.exportPath, b.logger, []string{}, b.opts); err != nil {
+		return nil, err
+	}
+	if err := savePluginImages(b.ram, b.imageClient, b.exportPath, b.logger, b.opts); err != nil {
+		return nil, err
+	}
+	b.logger.Infof("success save images")
+	r := &ramExporter{logger: b.logger, ram: b.ram, mode: "offline", exportPath: b.exportPath}
+	if err := r.writeMetaFile(); err != nil {
+		return nil, err
+	}
+	// leave out what the baseline package ships
+	if err := writeDelta(b.exportPath, b.opts.baseline); err != nil {
+		b.logger.Errorf("write delta package failure %s", err.Error())
+		return nil, err
+	}
+	// write package manifest and sign it
+	if err := sign.SignDir(b.exportPath, b.opts.signer); err != nil {
+		b.logger.Errorf("sign package failure %s", err.Error())
+		return nil, err
+	}
+	packageName := fmt.Sprintf("%s-%s-bundle.tar.gz", b.ram.AppName, b.ram.AppVersion)
+	res, err := packageApp(packageName, b.homePath, b.exportPath, b.opts)
+	if err != nil {
+		err = fmt.Errorf("failed to package app %s: %s", packageName, err.Error())
+		b.logger.Error(err)
+		return nil, err
+	}
+	b.logger.Infof("success export app " + b.ram.AppName)
+	return res, nil
+}
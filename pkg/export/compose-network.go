@@ -0,0 +1,87 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"fmt"
+	"strings"
+)
+
+// composeNetworkName the app scoped network of the compose project
+func composeNetworkName(appName string) string {
+	name := k8sName(composeName(appName))
+	if name == "" {
+		return "app"
+	}
+	return name
+}
+
+// isLoopbackHost whether the connection info value points to the local host,
+// which is only true for the legacy host network mode
+func isLoopbackHost(value string) bool {
+	switch value {
+	case "127.0.0.1", "localhost", "0.0.0.0":
+		return true
+	}
+	return false
+}
+
+// composePort published port in the compose short syntax
+func composePort(hostPort, containerPort int, protocol string) string {
+	port := fmt.Sprintf("%d:%d", hostPort, containerPort)
+	if strings.ToLower(protocol) == "udp" {
+		port += "/udp"
+	}
+	return port
+}
+
+// portAllocator host port assignment with conflict detection
+type portAllocator struct {
+	mapping  map[string]int
+	reserved map[string]string
+}
+
+func newPortAllocator(mapping map[string]int) *portAllocator {
+	return &portAllocator{mapping: mapping, reserved: make(map[string]string)}
+}
+
+// hostPort the configured host port of the component port, the container
+// port is published as is when no mapping is configured
+func (p *portAllocator) hostPort(containerPort int, names ...string) int {
+	for _, name := range names {
+		if port, ok := p.mapping[hostPortKey(name, containerPort)]; ok {
+			return port
+		}
+	}
+	return containerPort
+}
+
+// reserve reserve the host port for the service, an error is returned if it is taken
+func (p *portAllocator) reserve(serviceName string, hostPort, containerPort int, protocol string) error {
+	key := fmt.Sprintf("%d/%s", hostPort, strings.ToLower(k8sProtocol(protocol)))
+	if owner, exists := p.reserved[key]; exists {
+		return fmt.Errorf("host port %s of service %s (container port %d) conflicts with %s, configure another host port", key, serviceName, containerPort, owner)
+	}
+	p.reserved[key] = fmt.Sprintf("service %s (container port %d)", serviceName, containerPort)
+	return nil
+}
+
+func hostPortKey(component string, containerPort int) string {
+	return fmt.Sprintf("%s:%d", component, containerPort)
+}
@@ -0,0 +1,183 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+)
+
+// composeHealthcheck the healthcheck of the component probes, the readiness
+// probe is preferred since dependents wait for the service to be healthy
+func composeHealthcheck(probes []v1alpha1.ComponentProbe) *Healthcheck {
+	var probe *v1alpha1.ComponentProbe
+	for i := range probes {
+		if !probes[i].IsUsed || probes[i].Validation() != nil {
+			continue
+		}
+		if probe == nil || (probes[i].Mode == "readiness" && probe.Mode != "readiness") {
+			probe = &probes[i]
+		}
+	}
+	if probe == nil {
+		return nil
+	}
+	var test string
+	switch {
+	case probe.Cmd != "":
+		test = probe.Cmd
+	case strings.ToLower(probe.Scheme) == "http":
+		url := fmt.Sprintf("http://localhost:%d/%s", probe.Port, strings.TrimPrefix(probe.Path, "/"))
+		// the image may ship either curl or wget
+		test = fmt.Sprintf("curl -fs -o /dev/null %s%s || wget -q -O /dev/null %s%s", curlHeaders(probe.HTTPHeader), url, wgetHeaders(probe.HTTPHeader), url)
+	default:
+		test = fmt.Sprintf("nc -z localhost %d || bash -c 'echo > /dev/tcp/localhost/%d'", probe.Port, probe.Port)
+	}
+	hc := &Healthcheck{
+		// $ is interpolated by compose
+		Test:    []string{"CMD-SHELL", strings.ReplaceAll(test, "$", "$$")},
+		Retries: probe.FailureThreshold,
+	}
+	if probe.PeriodSecond > 0 {
+		hc.Interval = fmt.Sprintf("%ds", probe.PeriodSecond)
+	}
+	if probe.TimeoutSecond > 0 {
+		hc.Timeout = fmt.Sprintf("%ds", probe.TimeoutSecond)
+	}
+	if probe.InitialDelaySecond > 0 {
+		hc.StartPeriod = fmt.Sprintf("%ds", probe.InitialDelaySecond)
+	}
+	return hc
+}
+
+// probeHeaders parse the probe http header, formatted as name=value,name=value
+func probeHeaders(header string) [][2]string {
+	var headers [][2]string
+	for _, item := range strings.Split(header, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			continue
+		}
+		headers = append(headers, [2]string{strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])})
+	}
+	return headers
+}
+
+func curlHeaders(header string) string {
+	var b strings.Builder
+	for _, h := range probeHeaders(header) {
+		fmt.Fprintf(&b, "-H '%s: %s' ", h[0], h[1])
+	}
+	return b.String()
+}
+
+func wgetHeaders(header string) string {
+	var b strings.Builder
+	for _, h := range probeHeaders(header) {
+		fmt.Fprintf(&b, "--header '%s: %s' ", h[0], h[1])
+	}
+	return b.String()
+}
+
+// composeDeploy resource limits of the component, memory in MB and cpu in millicores
+func composeDeploy(memory, cpu int) *Deploy {
+	if memory <= 0 && cpu <= 0 {
+		return nil
+	}
+	deploy := &Deploy{}
+	if memory > 0 {
+		deploy.Resources.Limits.Memory = fmt.Sprintf("%dM", memory)
+	}
+	if cpu > 0 {
+		deploy.Resources.Limits.CPUs = strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", float64(cpu)/1000), "0"), ".")
+	}
+	return deploy
+}
+
+// composeConfigGroupFile the env_file of the app config group
+func composeConfigGroupFile(group string) string {
+	return "./" + path.Join("config-groups", k8sName(group)+".env")
+}
+
+// composeSidecar the plugin sidecar of the component service, it shares the
+// network namespace of the component as the plugin container does in the pod
+func composeSidecar(plugin *v1alpha1.Plugin, config v1alpha1.ComponentPluginConfig, serviceName string, service *Service) *Service {
+	image := plugin.ShareImage
+	if image == "" {
+		image = plugin.Image
+	}
+	envs := pluginConfigEnvs(plugin, config)
+	envs["SERVICE_NAME"] = serviceName
+	envs["PLUGIN_ID"] = plugin.PluginID
+	sidecar := &Service{
+		Image:       image,
+		Restart:     "always",
+		NetworkMode: "service:" + serviceName,
+		Volumes:     service.Volumes,
+		Environment: envs,
+		EnvFile:     service.EnvFile,
+		Deploy:      composeDeploy(config.MemoryRequired, config.CPURequired),
+		DependsOn:   map[string]DependsOn{serviceName: {Condition: "service_started"}},
+	}
+	if service.NetworkMode == "host" {
+		sidecar.NetworkMode = "host"
+	}
+	sidecar.Loggin = service.Loggin
+	return sidecar
+}
+
+// pluginConfigEnvs the plugin config attrs, the defaults of the env injected
+// config groups are overridden by the attrs configured on the component
+func pluginConfigEnvs(plugin *v1alpha1.Plugin, config v1alpha1.ComponentPluginConfig) map[string]string {
+	envs := make(map[string]string)
+	for _, group := range plugin.ConfigGroups {
+		if group.Injection != "" && group.Injection != "env" {
+			continue
+		}
+		for _, option := range group.Options {
+			if option.AttrName != "" {
+				envs[option.AttrName] = option.AttrDefaultValue
+			}
+		}
+	}
+	for _, attr := range config.Attr {
+		// the attrs of a config group are stored as a json object
+		switch attrs := attr["attrs"].(type) {
+		case string:
+			var kv map[string]interface{}
+			if err := json.Unmarshal([]byte(attrs), &kv); err == nil {
+				for k, v := range kv {
+					envs[k] = fmt.Sprint(v)
+				}
+			}
+		case map[string]interface{}:
+			for k, v := range attrs {
+				envs[k] = fmt.Sprint(v)
+			}
+		}
+		if name, ok := attr["attr_name"].(string); ok && name != "" {
+			envs[name] = fmt.Sprint(attr["attr_value"])
+		}
+	}
+	return envs
+}
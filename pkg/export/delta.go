@@ -0,0 +1,290 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
+	"github.com/wutong-paas/wutong-oam/pkg/util/zip"
+)
+
+// DeltaFileName the description of a delta package in the package root dir
+const DeltaFileName = "delta.json"
+
+// Delta the files and image layers a delta package leaves out because the
+// baseline package ships them
+type Delta struct {
+	Baseline DeltaBaseline     `json:"baseline"`
+	Files    []sign.FileDigest `json:"files,omitempty"`
+	Layers   []DeltaLayer      `json:"layers,omitempty"`
+}
+
+// DeltaBaseline the package the delta applies to
+type DeltaBaseline struct {
+	Package        string `json:"package"`
+	ManifestSHA256 string `json:"manifest_sha256"`
+}
+
+// DeltaLayer a layer left out of an image archive of the package
+type DeltaLayer struct {
+	Archive string `json:"archive"`
+	Layer   string `json:"layer"`
+	Digest  string `json:"digest"`
+	// Image a baseline image that contains the layer
+	Image string `json:"image"`
+}
+
+// ReadDelta read the delta description of the package dir, nil if the package is not a delta
+func ReadDelta(dir string) (*Delta, error) {
+	body, err := os.ReadFile(path.Join(dir, DeltaFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var delta Delta
+	if err := json.Unmarshal(body, &delta); err != nil {
+		return nil, fmt.Errorf("parse delta file failure %s", err.Error())
+	}
+	return &delta, nil
+}
+
+// writeDelta remove the files and strip the image layers the baseline ships,
+// what is left out is recorded in the delta file. Nothing is done without baseline.
+func writeDelta(exportPath, baseline string) error {
+	if baseline == "" {
+		return nil
+	}
+	pkg, manifest, body, baselineDelta, err := loadBaseline(baseline)
+	if err != nil {
+		return fmt.Errorf("load baseline %s failure %s", baseline, err.Error())
+	}
+	sum := sha256.Sum256(body)
+	delta := &Delta{Baseline: DeltaBaseline{Package: pkg, ManifestSHA256: hex.EncodeToString(sum[:])}}
+	// files left out of a delta baseline are shipped by its own baseline, they are still known
+	files := make(map[string]string)
+	for _, f := range manifest.Files {
+		files[f.Path] = f.SHA256
+	}
+	if baselineDelta != nil {
+		for _, f := range baselineDelta.Files {
+			files[f.Path] = f.SHA256
+		}
+	}
+	layers := make(map[string]string)
+	for _, img := range manifest.Images {
+		for _, layer := range img.Layers {
+			if _, ok := layers[layer]; !ok {
+				layers[layer] = img.Name
+			}
+		}
+	}
+	current, err := sign.BuildManifest(exportPath)
+	if err != nil {
+		return err
+	}
+	strip := func(archive string) error {
+		stripped, err := image.StripArchive(path.Join(exportPath, archive), func(layer string, d digest.Digest) bool {
+			_, ok := layers[d.String()]
+			return ok
+		})
+		if err != nil {
+			return fmt.Errorf("strip image archive %s failure %s", archive, err.Error())
+		}
+		for layer, d := range stripped {
+			delta.Layers = append(delta.Layers, DeltaLayer{Archive: archive, Layer: layer, Digest: d.String(), Image: layers[d.String()]})
+		}
+		return nil
+	}
+	// the blobs of the image layout are stripped as layers, not as files
+	if image.IsLayout(path.Join(exportPath, ImagesDir)) {
+		if err := strip(ImagesDir); err != nil {
+			return err
+		}
+	}
+	for _, f := range current.Files {
+		file := path.Join(exportPath, f.Path)
+		if strings.HasPrefix(f.Path, ImagesDir+"/") {
+			continue
+		}
+		if archive, err := image.OpenArchive(file); err == nil {
+			archive.Close()
+			if err := strip(f.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		// the importer reads the app metadata before applying the delta
+		if f.Path == "metadata.json" || files[f.Path] != f.SHA256 {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		delta.Files = append(delta.Files, f)
+	}
+	sort.Slice(delta.Layers, func(i, j int) bool {
+		if delta.Layers[i].Archive != delta.Layers[j].Archive {
+			return delta.Layers[i].Archive < delta.Layers[j].Archive
+		}
+		return delta.Layers[i].Layer < delta.Layers[j].Layer
+	})
+	content, err := json.MarshalIndent(delta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(exportPath, DeltaFileName), content, 0644)
+}
+
+// loadBaseline read the manifest of the baseline, which is a package, an unpacked
+// package dir or the package manifest file. The delta of a delta baseline is
+// returned if the baseline is not a bare manifest.
+func loadBaseline(baseline string) (string, *sign.Manifest, []byte, *Delta, error) {
+	info, err := os.Stat(baseline)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	var body, deltaBody []byte
+	pkg := filepath.Base(baseline)
+	switch {
+	case info.IsDir():
+		if body, err = os.ReadFile(path.Join(baseline, sign.ManifestFileName)); err != nil {
+			return "", nil, nil, nil, err
+		}
+		deltaBody, _ = os.ReadFile(path.Join(baseline, DeltaFileName))
+	case strings.HasSuffix(baseline, ".json"):
+		pkg = filepath.Base(filepath.Dir(baseline))
+		if body, err = os.ReadFile(baseline); err != nil {
+			return "", nil, nil, nil, err
+		}
+	default:
+		files, err := readPackageFiles(baseline, sign.ManifestFileName, DeltaFileName)
+		if err != nil {
+			return "", nil, nil, nil, err
+		}
+		if body = files[sign.ManifestFileName]; body == nil {
+			return "", nil, nil, nil, fmt.Errorf("%s is not found in the package, the package is exported before manifests are written", sign.ManifestFileName)
+		}
+		deltaBody = files[DeltaFileName]
+	}
+	var manifest sign.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return "", nil, nil, nil, fmt.Errorf("parse package manifest failure %s", err.Error())
+	}
+	var delta *Delta
+	if deltaBody != nil {
+		delta = &Delta{}
+		if err := json.Unmarshal(deltaBody, delta); err != nil {
+			return "", nil, nil, nil, fmt.Errorf("parse delta file failure %s", err.Error())
+		}
+	}
+	return pkg, &manifest, body, delta, nil
+}
+
+// readPackageFiles stream the package, plain or gzipped tar or zip, and read
+// the named files of the package root dir
+func readPackageFiles(pkg string, names ...string) (map[string][]byte, error) {
+	if strings.HasSuffix(pkg, ".zip") {
+		return readZipPackageFiles(pkg, names...)
+	}
+	f, err := os.Open(pkg)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	res := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for len(res) < len(names) {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := packageRootFile(hdr.Name)
+		if !containsString(names, name) {
+			continue
+		}
+		if res[name], err = io.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func readZipPackageFiles(pkg string, names ...string) (map[string][]byte, error) {
+	zr, err := zip.OpenReader(pkg)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	res := make(map[string][]byte)
+	for _, f := range zr.File {
+		name := packageRootFile(f.Name)
+		if !containsString(names, name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		res[name], err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// packageRootFile the name of the entry in the package root dir, empty for deeper entries
+func packageRootFile(entry string) string {
+	parts := strings.Split(strings.Trim(path.Clean("/"+entry), "/"), "/")
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[1]
+}
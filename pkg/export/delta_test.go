@@ -0,0 +1,116 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
+)
+
+// writeImageArchive write a docker-archive of one image with the layers
+func writeImageArchive(t *testing.T, file, name string, layers ...string) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	write := func(name string, content []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(content)
+	}
+	var config ocispec.Image
+	var entries []string
+	for _, layer := range layers {
+		entry := digest.FromString(layer).Encoded()[:12] + "/layer.tar"
+		write(entry, []byte(layer))
+		entries = append(entries, entry)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.FromString(layer))
+	}
+	body, _ := json.Marshal(config)
+	write("config.json", body)
+	body, _ = json.Marshal([]map[string]interface{}{{"Config": "config.json", "RepoTags": []string{name}, "Layers": entries}})
+	write("manifest.json", body)
+	tw.Close()
+}
+
+func TestWriteDelta(t *testing.T) {
+	home := t.TempDir()
+	baselineDir := path.Join(home, "demo-1.0-ram")
+	os.MkdirAll(baselineDir, 0755)
+	os.WriteFile(path.Join(baselineDir, "metadata.json"), []byte("v1"), 0644)
+	os.WriteFile(path.Join(baselineDir, "README"), []byte("readme"), 0644)
+	writeImageArchive(t, path.Join(baselineDir, "component-images.tar"), "demo/web:v1", "base", "app-v1")
+	if err := sign.SignDir(baselineDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Packaging("demo-1.0-ram.tar.gz", home, baselineDir); err != nil {
+		t.Fatal(err)
+	}
+
+	exportDir := path.Join(home, "demo-2.0-ram")
+	os.MkdirAll(exportDir, 0755)
+	os.WriteFile(path.Join(exportDir, "metadata.json"), []byte("v2"), 0644)
+	os.WriteFile(path.Join(exportDir, "README"), []byte("readme"), 0644)
+	writeImageArchive(t, path.Join(exportDir, "component-images.tar"), "demo/web:v2", "base", "app-v2")
+	if err := writeDelta(exportDir, path.Join(home, "demo-1.0-ram.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+	delta, err := ReadDelta(exportDir)
+	if err != nil || delta == nil {
+		t.Fatalf("read delta failure %v", err)
+	}
+	if delta.Baseline.Package != "demo-1.0-ram.tar.gz" || delta.Baseline.ManifestSHA256 == "" {
+		t.Errorf("unexpected baseline %+v", delta.Baseline)
+	}
+	if len(delta.Files) != 1 || delta.Files[0].Path != "README" || CheckFileExist(path.Join(exportDir, "README")) {
+		t.Errorf("unexpected delta files %+v", delta.Files)
+	}
+	if len(delta.Layers) != 1 || delta.Layers[0].Digest != digest.FromString("base").String() || delta.Layers[0].Image != "demo/web:v1" {
+		t.Errorf("unexpected delta layers %+v", delta.Layers)
+	}
+	archive, err := image.OpenArchive(path.Join(exportDir, "component-images.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if archive.HasEntry(delta.Layers[0].Layer) {
+		t.Error("the baseline layer is not stripped")
+	}
+	// the manifest of the delta package still lists every layer, so that it can be a baseline
+	if err := sign.SignDir(exportDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _, err := sign.ReadManifest(exportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Images) != 1 || len(manifest.Images[0].Layers) != 2 {
+		t.Errorf("unexpected manifest images %+v", manifest.Images)
+	}
+}
@@ -0,0 +1,38 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// availableSpace the disk space available to the user under dir,
+// the nearest existing parent is used if dir does not exist yet
+func availableSpace(dir string) (int64, error) {
+	dirPtr, err := syscall.UTF16PtrFromString(existingParent(dir))
+	if err != nil {
+		return 0, err
+	}
+	proc := syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+	var available int64
+	if ret, _, err := proc.Call(uintptr(unsafe.Pointer(dirPtr)), uintptr(unsafe.Pointer(&available)), 0, 0); ret == 0 {
+		return 0, err
+	}
+	return available, nil
+}
@@ -22,12 +22,14 @@ import (
 	"fmt"
 	"os"
 	"path"
-	"time"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
 	"github.com/wutong-paas/wutong-oam/pkg/util"
 	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
 	"gopkg.in/yaml.v2"
 )
 
@@ -37,6 +39,7 @@ type dockerComposeExporter struct {
 	imageClient image.Client
 	homePath    string
 	exportPath  string
+	opts        options
 }
 
 func (d *dockerComposeExporter) Export() (*Result, error) {
@@ -54,6 +57,13 @@ func (d *dockerComposeExporter) Export() (*Result, error) {
 		return nil, err
 	}
 	d.logger.Infof("success save components")
+	// Save plugin attachments
+	if len(d.ram.Plugins) > 0 {
+		if err := savePluginImages(d.ram, d.imageClient, d.exportPath, d.logger, d.opts); err != nil {
+			return nil, err
+		}
+		d.logger.Infof("success save plugins")
+	}
 	// build docker-compose.yaml
 	if err := d.buildDockerComposeYaml(); err != nil {
 		return nil, err
@@ -64,24 +74,36 @@ func (d *dockerComposeExporter) Export() (*Result, error) {
 		return nil, err
 	}
 	d.logger.Infof("success build start script")
+	if err := d.opts.secrets.WriteFile(path.Join(d.exportPath, secret.FileName)); err != nil {
+		d.logger.Errorf("write secrets file failure %s", err.Error())
+		return nil, err
+	}
+	// leave out what the baseline package ships
+	if err := writeDelta(d.exportPath, d.opts.baseline); err != nil {
+		d.logger.Errorf("write delta package failure %s", err.Error())
+		return nil, err
+	}
+	// write package manifest and sign it
+	if err := sign.SignDir(d.exportPath, d.opts.signer); err != nil {
+		d.logger.Errorf("sign package failure %s", err.Error())
+		return nil, err
+	}
 	// packaging
 	packageName := fmt.Sprintf("%s-%s-dockercompose.tar.gz", d.ram.AppName, d.ram.AppVersion)
-	name, err := Packaging(packageName, d.homePath, d.exportPath)
+	res, err := packageApp(packageName, d.homePath, d.exportPath, d.opts)
 	if err != nil {
 		err = fmt.Errorf("failed to package app %s: %s", packageName, err.Error())
 		d.logger.Error(err)
 		return nil, err
 	}
 	d.logger.Infof("success export app " + d.ram.AppName)
-	return &Result{PackagePath: path.Join(d.homePath, name), PackageName: name}, nil
+	return res, nil
 }
 
-// saveComponents Bulk export of mirrored mode, lower disk footprint for the entire package
-func (d *dockerComposeExporter) saveComponents() error {
+// writeConfigFiles write the config file volumes of the components to the service dirs
+func (d *dockerComposeExporter) writeConfigFiles() error {
 	dockerCompose := newDockerCompose(d.ram)
-	var componentImageNames []string
 	for _, component := range d.ram.Components {
-		componentName := component.ServiceCname
 		volumes := component.ServiceVolumeMapList
 		if len(volumes) > 0 {
 			componentEnName := dockerCompose.GetServiceName(component.ServiceShareID)
@@ -97,35 +119,86 @@ func (d *dockerComposeExporter) saveComponents() error {
 				}
 			}
 		}
-		if d.ram.WithImageData && component.ShareImage != "" {
-			// app is image type
-			_, err := d.imageClient.ImagePull(component.ShareImage, component.AppImage.HubUser, component.AppImage.HubPassword, 30)
-			if err != nil {
-				return err
-			}
-			d.logger.Infof("pull component %s image success", componentName)
-			componentImageNames = append(componentImageNames, component.ShareImage)
-		}
 	}
-	if d.ram.WithImageData && len(componentImageNames) > 0 {
-		start := time.Now()
-		err := d.imageClient.ImageSave(fmt.Sprintf("%s/component-images.tar", d.exportPath), componentImageNames)
-		if err != nil {
-			logrus.Errorf("Failed to save image(%v) : %s", componentImageNames, err)
+	return nil
+}
+
+// saveComponents Bulk export of mirrored mode, lower disk footprint for the entire package
+func (d *dockerComposeExporter) saveComponents() error {
+	if err := d.writeConfigFiles(); err != nil {
+		return err
+	}
+	var dependentImages []string
+	if hasGatewayRoutes(d.ram) {
+		dependentImages = append(dependentImages, gatewayImage)
+	}
+	return saveComponentImages(d.ram, d.imageClient, d.exportPath, d.logger, dependentImages, d.opts)
+}
+
+func (d *dockerComposeExporter) buildDockerComposeYaml() error {
+	if err := d.writeConfigGroups(); err != nil {
+		d.logger.Errorf("write config groups failure %s", err.Error())
+		return err
+	}
+	y, err := d.buildComposeProject()
+	if err != nil {
+		d.logger.Errorf("build docker compose project failure %s", err.Error())
+		return err
+	}
+	for name, content := range y.files {
+		file := path.Join(d.exportPath, name)
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, content, 0644); err != nil {
+			d.logger.Errorf("write %s failure %s", name, err.Error())
 			return err
 		}
-		d.logger.Infof("save component images success, Take %s time", time.Since(start))
+	}
+	content, err := yaml.Marshal(y)
+	if err != nil {
+		d.logger.Error("Failed to build yaml file: ", err)
+		return err
+	}
+
+	err = os.WriteFile(fmt.Sprintf("%s/docker-compose.yaml", d.exportPath), content, 0644)
+	if err != nil {
+		d.logger.Error("Failed to create yaml file: ", err)
+		return err
 	}
 	return nil
 }
 
-func (d *dockerComposeExporter) buildDockerComposeYaml() error {
+// buildComposeProject build the compose project of the app, services join an
+// app scoped bridge network unless host networking is enabled
+func (d *dockerComposeExporter) buildComposeProject() (*DockerComposeYaml, error) {
 	y := &DockerComposeYaml{
-		Version:  "3.1",
+		Name:     composeNetworkName(d.ram.AppName),
 		Volumes:  make(map[string]GlobalVolume, 5),
 		Services: make(map[string]*Service, 5),
 	}
 	dockerCompose := newDockerCompose(d.ram)
+	network := composeNetworkName(d.ram.AppName)
+	if !d.opts.composeHostNetwork {
+		y.Networks = map[string]Network{network: {Driver: "bridge"}}
+	}
+	ports := newPortAllocator(d.opts.hostPorts)
+	dependencies := make(map[string][]string)
+	configGroups := make(map[string][]string)
+	for _, group := range d.ram.AppConfigGroups {
+		for _, key := range group.ComponentKeys {
+			configGroups[key] = append(configGroups[key], composeConfigGroupFile(group.Name))
+		}
+	}
+	plugins := make(map[string]*v1alpha1.Plugin, len(d.ram.Plugins))
+	for _, plugin := range d.ram.Plugins {
+		plugins[plugin.PluginKey] = plugin
+	}
+	// the sidecars take names no component service has
+	serviceNames := make(map[string]struct{}, len(d.ram.Components))
+	for _, app := range d.ram.Components {
+		serviceNames[dockerCompose.GetServiceName(app.ServiceShareID)] = struct{}{}
+	}
 
 	for _, app := range d.ram.Components {
 		shareImage := app.ShareImage
@@ -145,25 +218,32 @@ func (d *dockerComposeExporter) buildDockerComposeYaml() error {
 		}
 		envs["MEMORY_SIZE"] = GetMemoryType(app.ExtendMethodRule.InitMemory)
 		for _, item := range append(app.Envs, app.ServiceConnectInfoMapList...) {
-			envs[item.AttrName] = item.AttrValue
-			if item.AttrValue == "**None**" {
-				envs[item.AttrName] = util.NewUUID()[:8]
+			value, _, err := d.opts.secrets.Resolve(app.ComponentKey, item.AttrName, item.AttrValue)
+			if err != nil {
+				return nil, err
 			}
+			envs[item.AttrName] = value
 		}
 		var depServices []string
 		for _, item := range app.DepServiceMapList {
 			serviceKey := item.DepServiceKey
-			depEnvs := getPublicEnvByKey(serviceKey, d.ram.Components)
-			for k, v := range depEnvs {
-				if v == "**None**" {
-					v = util.NewUUID()[:8]
-				}
-				envs[k] = v
-			}
+			var depService string
 			for _, app := range d.ram.Components {
 				if serviceKey == app.ComponentKey || serviceKey == app.ServiceShareID {
-					depServices = append(depServices, dockerCompose.GetServiceName(app.ServiceShareID))
+					depService = dockerCompose.GetServiceName(app.ServiceShareID)
+					depServices = append(depServices, depService)
+				}
+			}
+			depEnvs, err := getPublicEnvByKey(serviceKey, d.ram.Components, d.opts.secrets)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range depEnvs {
+				// the dependency is reached by its service name on the app network
+				if !d.opts.composeHostNetwork && depService != "" && isLoopbackHost(v) {
+					v = depService
 				}
+				envs[k] = v
 			}
 		}
 
@@ -176,32 +256,226 @@ func (d *dockerComposeExporter) buildDockerComposeYaml() error {
 			Image:         shareImage,
 			ContainerName: appName,
 			Restart:       "always",
-			NetworkMode:   "host",
 			Volumes:       volumes,
 			Command:       app.Cmd,
 			Environment:   envs,
+			EnvFile:       configGroups[app.ComponentKey],
+			Healthcheck:   composeHealthcheck(app.Probes),
+			Deploy:        composeDeploy(app.Memory, app.CPU),
+			component:     app,
+		}
+		if d.opts.composeHostNetwork {
+			service.NetworkMode = "host"
+			// every container port is bound on the host, collisions are only reported
+			for _, port := range app.Ports {
+				if err := ports.reserve(appName, port.ContainerPort, port.ContainerPort, port.Protocol); err != nil {
+					d.logger.Warningf("host network mode: %s", err.Error())
+				}
+			}
+		} else {
+			service.Networks = []string{network}
+			for _, port := range app.Ports {
+				if !port.IsOuter {
+					service.Expose = append(service.Expose, fmt.Sprintf("%d", port.ContainerPort))
+					continue
+				}
+				hostPort := ports.hostPort(port.ContainerPort, appName, app.ComponentKey, app.ServiceCname)
+				if err := ports.reserve(appName, hostPort, port.ContainerPort, port.Protocol); err != nil {
+					return nil, err
+				}
+				service.Ports = append(service.Ports, composePort(hostPort, port.ContainerPort, port.Protocol))
+			}
 		}
 		service.Loggin.Driver = "json-file"
 		service.Loggin.Options.MaxSize = "5m"
 		service.Loggin.Options.MaxFile = "2"
-		if len(depServices) > 0 {
-			service.DependsOn = depServices
-		}
+		dependencies[appName] = depServices
 
 		y.Services[appName] = service
+
+		// plugin sidecars
+		for _, config := range app.ServicePluginConfigs {
+			plugin, ok := plugins[config.PluginKey]
+			if !ok || !config.PluginStatus {
+				continue
+			}
+			name := uniqueName(appName+"-"+composeName(plugin.PluginName), app.ComponentKey+"/"+config.PluginKey, serviceNames)
+			y.Services[name] = composeSidecar(plugin, config, appName, service)
+		}
+	}
+	// wait for the dependencies to be healthy if they have a healthcheck
+	for name, depServices := range dependencies {
+		for _, dep := range depServices {
+			depService, ok := y.Services[dep]
+			if !ok {
+				continue
+			}
+			condition := "service_started"
+			if depService.Healthcheck != nil {
+				condition = "service_healthy"
+			}
+			if y.Services[name].DependsOn == nil {
+				y.Services[name].DependsOn = make(map[string]DependsOn)
+			}
+			y.Services[name].DependsOn[dep] = DependsOn{Condition: condition}
+		}
+	}
+
+	if hasGatewayRoutes(d.ram) {
+		if err := d.buildGateway(y, dockerCompose, ports, network); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := d.buildMonitoring(y, dockerCompose); err != nil {
+		return nil, err
 	}
 
 	y.Volumes = dockerCompose.GetGlobalVolumes()
-	content, err := yaml.Marshal(y)
+	return y, nil
+}
+
+// buildMonitoring add the prometheus scrape config of the component monitors and
+// the grafana dashboard of the component graphs to the project files
+func (d *dockerComposeExporter) buildMonitoring(y *DockerComposeYaml, dockerCompose *dockerCompose) error {
+	var config PrometheusConfig
+	for _, cpt := range d.ram.Components {
+		name := dockerCompose.GetServiceName(cpt.ServiceShareID)
+		host := name
+		if d.opts.composeHostNetwork {
+			host = "127.0.0.1"
+		}
+		jobs := make(map[string]struct{})
+		for _, monitor := range cpt.ComponentMonitor {
+			if monitor.Port <= 0 {
+				continue
+			}
+			suffix := composeName(monitor.Name)
+			if suffix == "" {
+				suffix = fmt.Sprint(monitor.Port)
+			}
+			job := name + "-" + suffix
+			if _, exists := jobs[job]; exists {
+				job = fmt.Sprintf("%s-%d", job, len(jobs))
+			}
+			jobs[job] = struct{}{}
+			metricsPath := monitor.Path
+			if metricsPath == "" {
+				metricsPath = defaultMetricsPath
+			}
+			config.ScrapeConfigs = append(config.ScrapeConfigs, ScrapeConfig{
+				JobName:        job,
+				MetricsPath:    metricsPath,
+				ScrapeInterval: monitorInterval(monitor.Interval),
+				StaticConfigs: []StaticConfig{{
+					Targets: []string{fmt.Sprintf("%s:%d", host, monitor.Port)},
+					Labels:  map[string]string{"app": d.ram.AppName, "service": name},
+				}},
+			})
+		}
+	}
+	dashboard, err := grafanaDashboardJSON(d.ram)
 	if err != nil {
-		d.logger.Error("Failed to build yaml file: ", err)
 		return err
 	}
+	if len(config.ScrapeConfigs) == 0 && dashboard == nil {
+		return nil
+	}
+	if y.files == nil {
+		y.files = make(map[string][]byte)
+	}
+	if len(config.ScrapeConfigs) > 0 {
+		content, err := yaml.Marshal(config)
+		if err != nil {
+			return err
+		}
+		y.files["prometheus/prometheus.yml"] = content
+	}
+	if dashboard != nil {
+		y.files[path.Join("grafana", grafanaDashboardFile(d.ram))] = dashboard
+	}
+	return nil
+}
 
-	err = os.WriteFile(fmt.Sprintf("%s/docker-compose.yaml", d.exportPath), content, 0644)
+// buildGateway add the gateway service serving the ingress routes of the app
+func (d *dockerComposeExporter) buildGateway(y *DockerComposeYaml, dockerCompose *dockerCompose, ports *portAllocator, network string) error {
+	if _, exists := y.Services[gatewayServiceName]; exists {
+		return fmt.Errorf("service name %s is taken by a component", gatewayServiceName)
+	}
+	hosts := make(map[string]string, len(d.ram.Components))
+	for _, cpt := range d.ram.Components {
+		hosts[cpt.ComponentKey] = dockerCompose.GetServiceName(cpt.ServiceShareID)
+		if d.opts.composeHostNetwork {
+			hosts[cpt.ComponentKey] = "127.0.0.1"
+		}
+	}
+	config := newGatewayConfig(d.ram, hosts)
+	conf, err := config.render()
 	if err != nil {
-		d.logger.Error("Failed to create yaml file: ", err)
-		return err
+		return fmt.Errorf("render gateway config failure %s", err.Error())
+	}
+	service := &Service{
+		Image:         gatewayImage,
+		ContainerName: gatewayServiceName,
+		Restart:       "always",
+		Volumes:       []string{"./gateway/nginx.conf:/etc/nginx/nginx.conf:ro"},
+		DependsOn:     make(map[string]DependsOn),
+	}
+	y.files = map[string][]byte{"gateway/nginx.conf": conf}
+	if config.hasSSL() {
+		service.Volumes = append(service.Volumes, "./gateway/ssl:/etc/nginx/ssl:ro")
+		y.files["gateway/ssl/README"] = []byte(gatewaySSLReadme)
+	}
+	for _, port := range config.ports() {
+		if d.opts.composeHostNetwork {
+			if err := ports.reserve(gatewayServiceName, port.Port, port.Port, port.Protocol); err != nil {
+				d.logger.Warningf("host network mode: %s", err.Error())
+			}
+			continue
+		}
+		hostPort := ports.hostPort(port.Port, gatewayServiceName)
+		if err := ports.reserve(gatewayServiceName, hostPort, port.Port, port.Protocol); err != nil {
+			return err
+		}
+		service.Ports = append(service.Ports, composePort(hostPort, port.Port, port.Protocol))
+	}
+	if d.opts.composeHostNetwork {
+		service.NetworkMode = "host"
+	} else {
+		service.Networks = []string{network}
+	}
+	for _, cpt := range d.ram.Components {
+		name := dockerCompose.GetServiceName(cpt.ServiceShareID)
+		if !routedComponent(d.ram, cpt.ComponentKey) {
+			continue
+		}
+		condition := "service_started"
+		if y.Services[name].Healthcheck != nil {
+			condition = "service_healthy"
+		}
+		service.DependsOn[name] = DependsOn{Condition: condition}
+	}
+	service.Loggin.Driver = "json-file"
+	service.Loggin.Options.MaxSize = "5m"
+	service.Loggin.Options.MaxFile = "2"
+	y.Services[gatewayServiceName] = service
+	return nil
+}
+
+// writeConfigGroups write the app config groups as env files shared by the
+// components, the env files hold single line values only
+func (d *dockerComposeExporter) writeConfigGroups() error {
+	for _, group := range d.ram.AppConfigGroups {
+		if keys := multilineKeys(group.ConfigItems); len(keys) > 0 {
+			return fmt.Errorf("the values of %s in config group %s span multiple lines, env files hold single line values", strings.Join(keys, ", "), group.Name)
+		}
+		file := path.Join(d.exportPath, composeConfigGroupFile(group.Name))
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, envFileContent(group.ConfigItems), 0644); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -216,21 +490,54 @@ func (d *dockerComposeExporter) buildStartScript() error {
 
 // DockerComposeYaml -
 type DockerComposeYaml struct {
-	Version  string                  `yaml:"version"`
+	Version  string                  `yaml:"version,omitempty"`
+	Name     string                  `yaml:"name,omitempty"`
 	Volumes  map[string]GlobalVolume `yaml:"volumes,omitempty"`
+	Networks map[string]Network      `yaml:"networks,omitempty"`
 	Services map[string]*Service     `yaml:"services,omitempty"`
+	Configs  map[string]StackFile    `yaml:"configs,omitempty"`
+	Secrets  map[string]StackFile    `yaml:"secrets,omitempty"`
+	// files extra files of the project, relative to the export dir
+	files map[string][]byte
+}
+
+// PrometheusConfig the prometheus config scraping the services of the project
+type PrometheusConfig struct {
+	ScrapeConfigs []ScrapeConfig `yaml:"scrape_configs"`
+}
+
+// ScrapeConfig -
+type ScrapeConfig struct {
+	JobName        string         `yaml:"job_name"`
+	MetricsPath    string         `yaml:"metrics_path,omitempty"`
+	ScrapeInterval string         `yaml:"scrape_interval,omitempty"`
+	StaticConfigs  []StaticConfig `yaml:"static_configs"`
+}
+
+// StaticConfig -
+type StaticConfig struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels,omitempty"`
 }
 
 // Service service
 type Service struct {
-	Image         string            `yaml:"image"`
-	ContainerName string            `yaml:"container_name,omitempty"`
-	Restart       string            `yaml:"restart,omitempty"`
-	NetworkMode   string            `yaml:"network_mode,omitempty"`
-	Volumes       []string          `yaml:"volumes,omitempty"`
-	Command       string            `yaml:"command,omitempty"`
-	Environment   map[string]string `yaml:"environment,omitempty"`
-	DependsOn     []string          `yaml:"depends_on,omitempty"`
+	Image         string               `yaml:"image"`
+	ContainerName string               `yaml:"container_name,omitempty"`
+	Restart       string               `yaml:"restart,omitempty"`
+	NetworkMode   string               `yaml:"network_mode,omitempty"`
+	Networks      []string             `yaml:"networks,omitempty"`
+	Ports         []string             `yaml:"ports,omitempty"`
+	Expose        []string             `yaml:"expose,omitempty"`
+	Volumes       []string             `yaml:"volumes,omitempty"`
+	Command       string               `yaml:"command,omitempty"`
+	Environment   map[string]string    `yaml:"environment,omitempty"`
+	EnvFile       []string             `yaml:"env_file,omitempty"`
+	DependsOn     map[string]DependsOn `yaml:"depends_on,omitempty"`
+	Healthcheck   *Healthcheck         `yaml:"healthcheck,omitempty"`
+	Deploy        *Deploy              `yaml:"deploy,omitempty"`
+	Configs       []ServiceFile        `yaml:"configs,omitempty"`
+	Secrets       []ServiceFile        `yaml:"secrets,omitempty"`
 	Loggin        struct {
 		Driver  string `yaml:"driver,omitempty"`
 		Options struct {
@@ -238,6 +545,63 @@ type Service struct {
 			MaxFile string `yaml:"max-file,omitempty"`
 		}
 	} `yaml:"logging,omitempty"`
+	// component the component of the service, nil for the gateway and the sidecars
+	component *v1alpha1.Component
+}
+
+// DependsOn -
+type DependsOn struct {
+	Condition string `yaml:"condition"`
+}
+
+// Healthcheck -
+type Healthcheck struct {
+	Test        []string `yaml:"test"`
+	Interval    string   `yaml:"interval,omitempty"`
+	Timeout     string   `yaml:"timeout,omitempty"`
+	Retries     int      `yaml:"retries,omitempty"`
+	StartPeriod string   `yaml:"start_period,omitempty"`
+}
+
+// Deploy -
+type Deploy struct {
+	Replicas  *int `yaml:"replicas,omitempty"`
+	Resources struct {
+		Limits struct {
+			CPUs   string `yaml:"cpus,omitempty"`
+			Memory string `yaml:"memory,omitempty"`
+		} `yaml:"limits,omitempty"`
+	} `yaml:"resources,omitempty"`
+	Placement     *Placement     `yaml:"placement,omitempty"`
+	RestartPolicy *RestartPolicy `yaml:"restart_policy,omitempty"`
+}
+
+// Placement -
+type Placement struct {
+	Constraints []string `yaml:"constraints,omitempty"`
+}
+
+// RestartPolicy -
+type RestartPolicy struct {
+	Condition string `yaml:"condition"`
+}
+
+// Network -
+type Network struct {
+	Driver     string `yaml:"driver,omitempty"`
+	Attachable bool   `yaml:"attachable,omitempty"`
+}
+
+// StackFile swarm config or secret created from a file of the package
+type StackFile struct {
+	File string `yaml:"file"`
+}
+
+// ServiceFile swarm config or secret mounted into the service
+type ServiceFile struct {
+	Source string `yaml:"source"`
+	Target string `yaml:"target"`
+	Mode   *int   `yaml:"mode,omitempty"`
 }
 
 // GlobalVolume -
@@ -364,17 +728,23 @@ func (d *dockerCompose) GetServiceName(shareServiceUUID string) string {
 // 	return volume
 // }
 
-func getPublicEnvByKey(serviceKey string, apps []*v1alpha1.Component) map[string]string {
+// getPublicEnvByKey the connection info of the component, the placeholders are
+// replaced by the secrets of the component
+func getPublicEnvByKey(serviceKey string, apps []*v1alpha1.Component, secrets *secret.Store) (map[string]string, error) {
 	envs := make(map[string]string, 5)
 	for _, app := range apps {
 		if app.ComponentKey == serviceKey || app.ServiceShareID == serviceKey {
 			for _, item := range app.ServiceConnectInfoMapList {
-				envs[item.AttrName] = item.AttrValue
+				value, _, err := secrets.Resolve(app.ComponentKey, item.AttrName, item.AttrValue)
+				if err != nil {
+					return nil, err
+				}
+				envs[item.AttrName] = value
 			}
 			break
 		}
 	}
-	return envs
+	return envs, nil
 }
 
 var runScritShell = `#!/bin/bash
@@ -402,7 +772,7 @@ check::dependency() {
     iprint 'successful install docker!'
   }
 
-  which docker-compose &>/dev/null || {
+  docker compose version &>/dev/null || which docker-compose &>/dev/null || {
     eprint 'Not found docker-compose command!'
 
     install::docker-compose || {
@@ -425,22 +795,41 @@ install::docker() {
 }
 
 install::docker-compose() {
-  curl -L "https://github.com/docker/compose/releases/download/1.24.0/docker-compose-$(uname -s)-$(uname -m)" -o /usr/local/bin/docker-compose
-  chmod +x /usr/local/bin/docker-compose
-  which docker-compose &>/dev/null
+  mkdir -p /usr/local/lib/docker/cli-plugins
+  curl -L "https://github.com/docker/compose/releases/download/v2.29.7/docker-compose-$(uname -s)-$(uname -m)" -o /usr/local/lib/docker/cli-plugins/docker-compose
+  chmod +x /usr/local/lib/docker/cli-plugins/docker-compose
+  docker compose version &>/dev/null
+}
+
+compose() {
+  if docker compose version &>/dev/null; then
+    docker compose "$@"
+  else
+    docker-compose "$@"
+  fi
 }
 
 import::image() {
-  docker load -i component-images.tar
+  [[ -d images ]] || return 0
+  tar -cC images . | docker load
+}
+
+gateway::cert() {
+  [[ -d gateway/ssl ]] || return 0
+  [[ -f gateway/ssl/server.crt ]] && return 0
+  iprint 'generate a self-signed placeholder certificate for the gateway'
+  openssl req -x509 -nodes -newkey rsa:2048 -days 365 -subj "/CN=localhost" \
+    -keyout gateway/ssl/server.key -out gateway/ssl/server.crt
 }
 
 start() {
   import::image
-  docker-compose -f docker-compose.yaml up -d
+  gateway::cert || exit $?
+  compose -f docker-compose.yaml up -d
 }
 
 stop() {
-  docker-compose -f docker-compose.yaml down
+  compose -f docker-compose.yaml down
 }
 
 main() {
@@ -0,0 +1,233 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+)
+
+func TestComposeBridgeNetwork(t *testing.T) {
+	ram := testRAM()
+	ram.Components[1].ServiceConnectInfoMapList = append(ram.Components[1].ServiceConnectInfoMapList,
+		v1alpha1.ComponentEnv{AttrName: "MYSQL_ADDR", AttrValue: "127.0.0.1"})
+	d := &dockerComposeExporter{logger: logrus.New(), ram: ram, opts: newOptions(WithHostPort("web-key", 8080, 18080))}
+	y, err := d.buildComposeProject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := y.Networks["demo"]; !ok {
+		t.Errorf("app network not found in %v", y.Networks)
+	}
+	web, mysql := y.Services["web"], y.Services["mysql"]
+	if web.NetworkMode != "" || !reflect.DeepEqual(web.Networks, []string{"demo"}) {
+		t.Errorf("web is not in the app network")
+	}
+	if !reflect.DeepEqual(web.Ports, []string{"18080:8080"}) {
+		t.Errorf("unexpected web ports %v", web.Ports)
+	}
+	if len(mysql.Ports) != 0 || !reflect.DeepEqual(mysql.Expose, []string{"3306"}) {
+		t.Errorf("inner port of mysql is published: %v", mysql.Ports)
+	}
+	if web.Environment["MYSQL_PASSWORD"] != mysql.Environment["MYSQL_PASSWORD"] || web.Environment["MYSQL_PASSWORD"] == "**None**" {
+		t.Errorf("expect the generated password shared with the dependent")
+	}
+	if web.Environment["MYSQL_ADDR"] != "mysql" {
+		t.Errorf("expect dependency reached by service name, got %s", web.Environment["MYSQL_ADDR"])
+	}
+}
+
+func TestComposePortConflict(t *testing.T) {
+	ram := testRAM()
+	ram.Components[1].Ports[0].IsOuter = true
+	d := &dockerComposeExporter{logger: logrus.New(), ram: ram, opts: newOptions(WithHostPort("mysql", 3306, 8080))}
+	if _, err := d.buildComposeProject(); err == nil || !strings.Contains(err.Error(), "conflicts") {
+		t.Errorf("expect host port conflict, got %v", err)
+	}
+
+	d.opts = newOptions(WithComposeHostNetwork())
+	y, err := d.buildComposeProject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if y.Networks != nil || y.Services["web"].NetworkMode != "host" || y.Services["web"].Ports != nil {
+		t.Errorf("unexpected host network project")
+	}
+}
+
+func TestComposeHealthcheckAndLimits(t *testing.T) {
+	ram := testRAM()
+	ram.Components[1].Probes = []v1alpha1.ComponentProbe{
+		{Cmd: "mysqladmin ping -p$MYSQL_PASSWORD", Mode: "liveness", IsUsed: true, PeriodSecond: 5},
+	}
+	d := &dockerComposeExporter{logger: logrus.New(), ram: ram, opts: newOptions()}
+	y, err := d.buildComposeProject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, mysql := y.Services["web"], y.Services["mysql"]
+	if web.Healthcheck == nil || !strings.Contains(web.Healthcheck.Test[1], "http://localhost:8080/healthz") || web.Healthcheck.Retries != 3 {
+		t.Errorf("unexpected web healthcheck %+v", web.Healthcheck)
+	}
+	if mysql.Healthcheck == nil || mysql.Healthcheck.Test[1] != "mysqladmin ping -p$$MYSQL_PASSWORD" || mysql.Healthcheck.Interval != "5s" {
+		t.Errorf("unexpected mysql healthcheck %+v", mysql.Healthcheck)
+	}
+	if !reflect.DeepEqual(web.DependsOn, map[string]DependsOn{"mysql": {Condition: "service_healthy"}}) {
+		t.Errorf("unexpected depends_on %v", web.DependsOn)
+	}
+	if web.Deploy == nil || web.Deploy.Resources.Limits.Memory != "512M" || web.Deploy.Resources.Limits.CPUs != "0.25" {
+		t.Errorf("unexpected web resource limits %+v", web.Deploy)
+	}
+}
+
+func TestComposeSidecarsAndConfigGroups(t *testing.T) {
+	ram := testRAM()
+	ram.Plugins = []*v1alpha1.Plugin{{
+		PluginKey:  "log-key",
+		PluginName: "log",
+		ShareImage: "hub.example.com/plugins/log:v1",
+		ConfigGroups: []v1alpha1.PluginConfigGroup{{
+			Injection: "env",
+			Options:   []v1alpha1.PluginConfigGroupOption{{AttrName: "LEVEL", AttrDefaultValue: "info"}},
+		}},
+	}}
+	ram.Components[0].ServicePluginConfigs = []v1alpha1.ComponentPluginConfig{{
+		PluginKey:      "log-key",
+		PluginStatus:   true,
+		MemoryRequired: 64,
+		Attr:           []map[string]interface{}{{"attrs": `{"LEVEL":"debug"}`}},
+	}}
+	d := &dockerComposeExporter{logger: logrus.New(), ram: ram, opts: newOptions()}
+	y, err := d.buildComposeProject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecar, ok := y.Services["web-log"]
+	if !ok {
+		t.Fatalf("sidecar not found in %v", y.Services)
+	}
+	if sidecar.NetworkMode != "service:web" || sidecar.Environment["LEVEL"] != "debug" || sidecar.Deploy.Resources.Limits.Memory != "64M" {
+		t.Errorf("unexpected sidecar %+v", sidecar)
+	}
+	if !reflect.DeepEqual(y.Services["web"].EnvFile, []string{"./config-groups/base.env"}) {
+		t.Errorf("unexpected web env files %v", y.Services["web"].EnvFile)
+	}
+	if y.Services["mysql"].EnvFile != nil {
+		t.Errorf("config group attached to mysql")
+	}
+}
+
+func TestComposeGateway(t *testing.T) {
+	ram := testRAM()
+	ram.IngressHTTPRoutes = append(ram.IngressHTTPRoutes, &v1alpha1.IngressHTTPRoute{
+		Location:             "/ws",
+		SSL:                  true,
+		Websocket:            true,
+		RequestTimeout:       30,
+		RequestBodySizeLimit: 10,
+		Headers:              map[string]string{"X-Env": "prod"},
+		TargetComponent:      v1alpha1.TargetComponent{ComponentKey: "web-key", Port: 8080},
+	})
+	ram.IngressSreamRoutes = []*v1alpha1.IngressSreamRoute{
+		{Protocol: "tcp", ConnectionTimeout: 5, TargetComponent: v1alpha1.TargetComponent{ComponentKey: "mysql-key", Port: 3306}},
+	}
+	d := &dockerComposeExporter{logger: logrus.New(), ram: ram, opts: newOptions(WithHostPort("web", 8080, 18080))}
+	y, err := d.buildComposeProject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway, ok := y.Services["gateway"]
+	if !ok {
+		t.Fatal("gateway service not found")
+	}
+	if !reflect.DeepEqual(gateway.Ports, []string{"80:80", "443:443", "3306:3306"}) {
+		t.Errorf("unexpected gateway ports %v", gateway.Ports)
+	}
+	if len(gateway.DependsOn) != 2 {
+		t.Errorf("unexpected gateway depends_on %v", gateway.DependsOn)
+	}
+	conf := string(y.files["gateway/nginx.conf"])
+	for _, expect := range []string{
+		"proxy_pass http://web:8080;",
+		"listen 443 ssl;",
+		"return 301 https://$host$request_uri;",
+		"proxy_set_header Upgrade $http_upgrade;",
+		"proxy_send_timeout 30s;",
+		"client_max_body_size 10m;",
+		`if ($http_x_env != "prod")`,
+		"proxy_pass mysql:3306;",
+	} {
+		if !strings.Contains(conf, expect) {
+			t.Errorf("%q not found in nginx.conf:\n%s", expect, conf)
+		}
+	}
+	if _, ok := y.files["gateway/ssl/README"]; !ok {
+		t.Error("ssl placeholder not found")
+	}
+}
+
+func TestComposeSidecarNameConflict(t *testing.T) {
+	ram := testRAM()
+	ram.Plugins = []*v1alpha1.Plugin{{PluginKey: "log-key", PluginName: "log", ShareImage: "hub.example.com/plugins/log:v1"}}
+	ram.Components[0].ServicePluginConfigs = []v1alpha1.ComponentPluginConfig{{PluginKey: "log-key", PluginStatus: true}}
+	// a component added after web takes the name of its sidecar
+	ram.Components = append(ram.Components, &v1alpha1.Component{
+		ServiceCname:   "web-log",
+		ServiceShareID: "web-log-share-id",
+		ComponentKey:   "web-log-key",
+		ShareImage:     "hub.example.com/demo/web-log:v1",
+	})
+	sidecars := func() []string {
+		d := &dockerComposeExporter{logger: logrus.New(), ram: ram, opts: newOptions()}
+		y, err := d.buildComposeProject()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if y.Services["web-log"].Image != "hub.example.com/demo/web-log:v1" {
+			t.Errorf("the component web-log is replaced by %+v", y.Services["web-log"])
+		}
+		var names []string
+		for name, service := range y.Services {
+			if service.Image == "hub.example.com/plugins/log:v1" {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	first := sidecars()
+	if len(first) != 1 || !strings.HasPrefix(first[0], "web-log-") {
+		t.Fatalf("unexpected sidecars %v", first)
+	}
+	if second := sidecars(); !reflect.DeepEqual(first, second) {
+		t.Errorf("sidecar names differ between exports: %v and %v", first, second)
+	}
+}
+
+func TestComposeMultilineConfigGroup(t *testing.T) {
+	ram := testRAM()
+	ram.AppConfigGroups[0].ConfigItems["CERT"] = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----"
+	d := &dockerComposeExporter{logger: logrus.New(), ram: ram, exportPath: t.TempDir(), opts: newOptions()}
+	if err := d.writeConfigGroups(); err == nil || !strings.Contains(err.Error(), "CERT") {
+		t.Errorf("expect the multi-line value rejected, got %v", err)
+	}
+}
@@ -39,6 +39,10 @@ type Result struct {
 	PackagePath   string
 	PackageName   string
 	PackageFormat string
+	// Location where the package is delivered, set when it is streamed to a destination
+	Location string
+	// Plan the plan of a dry run export
+	Plan *Plan
 }
 
 // AppFormat app spec format
@@ -55,15 +59,42 @@ var (
 	HELM AppFormat = "helm-chart"
 	//YAML -
 	YAML AppFormat = "k8s-yaml"
+	//KUSTOMIZE -
+	KUSTOMIZE AppFormat = "kustomize"
+	//BUNDLE the ram app spec with the images in an OCI image layout, imported without a container runtime
+	BUNDLE AppFormat = "registry-bundle"
+	//NOMAD the nomad job of the app, in hcl or json
+	NOMAD AppFormat = "nomad-job"
+	//QUADLET podman quadlet units of the app, run by systemd without docker
+	QUADLET AppFormat = "podman-quadlet"
+	//SWARM docker swarm stack of the app
+	SWARM AppFormat = "docker-swarm"
+	//GITOPS gitops repository layout of the app for argo cd or flux
+	GITOPS AppFormat = "gitops"
 )
 
 // New new exporter
-func New(format AppFormat, homePath string, ram v1alpha1.WutongApplicationConfig, containerdCli *containerd.Client, dockerCli *dockercli.Client, logger *logrus.Logger) (AppLocalExport, error) {
+func New(format AppFormat, homePath string, ram v1alpha1.WutongApplicationConfig, containerdCli *containerd.Client, dockerCli *dockercli.Client, logger *logrus.Logger, opts ...Option) (AppLocalExport, error) {
 	imageClient, err := image.NewClient(containerdCli, dockerCli)
 	if err != nil {
 		logger.Errorf("create image client error: %v", err)
 		return nil, err
 	}
+	o := newOptions(opts...)
+	if o.dryRun {
+		if _, ok := formatSuffixes[format]; !ok {
+			return nil, fmt.Errorf("not support app format %s", format)
+		}
+		return &planExporter{
+			logger:      logger,
+			ram:         ram,
+			imageClient: imageClient,
+			format:      format,
+			homePath:    homePath,
+			exportPath:  path.Join(homePath, fmt.Sprintf("%s-%s-%s", ram.AppName, ram.AppVersion, formatSuffixes[format])),
+			opts:        o,
+		}, nil
+	}
 	switch format {
 	case RAM:
 		return &ramExporter{
@@ -73,6 +104,7 @@ func New(format AppFormat, homePath string, ram v1alpha1.WutongApplicationConfig
 			mode:        "offline",
 			homePath:    homePath,
 			exportPath:  path.Join(homePath, fmt.Sprintf("%s-%s-ram", ram.AppName, ram.AppVersion)),
+			opts:        o,
 		}, nil
 	case DC:
 		return &dockerComposeExporter{
@@ -81,6 +113,7 @@ func New(format AppFormat, homePath string, ram v1alpha1.WutongApplicationConfig
 			imageClient: imageClient,
 			homePath:    homePath,
 			exportPath:  path.Join(homePath, fmt.Sprintf("%s-%s-dockercompose", ram.AppName, ram.AppVersion)),
+			opts:        o,
 		}, nil
 	case SLG:
 		return &slugExporter{
@@ -90,6 +123,7 @@ func New(format AppFormat, homePath string, ram v1alpha1.WutongApplicationConfig
 			mode:        "offline",
 			homePath:    homePath,
 			exportPath:  path.Join(homePath, fmt.Sprintf("%s-%s-slug", ram.AppName, ram.AppVersion)),
+			opts:        o,
 		}, nil
 	case HELM:
 		return &helmChartExporter{
@@ -99,6 +133,7 @@ func New(format AppFormat, homePath string, ram v1alpha1.WutongApplicationConfig
 			mode:        "offline",
 			homePath:    homePath,
 			exportPath:  path.Join(homePath, fmt.Sprintf("%s-%s-helm", ram.AppName, ram.AppVersion)),
+			opts:        o,
 		}, nil
 	case YAML:
 		return &k8sYamlExporter{
@@ -108,6 +143,62 @@ func New(format AppFormat, homePath string, ram v1alpha1.WutongApplicationConfig
 			mode:        "offline",
 			homePath:    homePath,
 			exportPath:  path.Join(homePath, fmt.Sprintf("%s-%s-yaml", ram.AppName, ram.AppVersion)),
+			opts:        o,
+		}, nil
+	case KUSTOMIZE:
+		return &kustomizeExporter{
+			logger:      logger,
+			ram:         ram,
+			imageClient: imageClient,
+			mode:        "offline",
+			homePath:    homePath,
+			exportPath:  path.Join(homePath, fmt.Sprintf("%s-%s-kustomize", ram.AppName, ram.AppVersion)),
+			opts:        o,
+		}, nil
+	case BUNDLE:
+		return &bundleExporter{
+			logger:      logger,
+			ram:         ram,
+			imageClient: imageClient,
+			homePath:    homePath,
+			exportPath:  path.Join(homePath, fmt.Sprintf("%s-%s-bundle", ram.AppName, ram.AppVersion)),
+			opts:        o,
+		}, nil
+	case NOMAD:
+		return &nomadExporter{
+			logger:      logger,
+			ram:         ram,
+			imageClient: imageClient,
+			homePath:    homePath,
+			exportPath:  path.Join(homePath, fmt.Sprintf("%s-%s-nomad", ram.AppName, ram.AppVersion)),
+			opts:        o,
+		}, nil
+	case QUADLET:
+		return &quadletExporter{
+			logger:      logger,
+			ram:         ram,
+			imageClient: imageClient,
+			homePath:    homePath,
+			exportPath:  path.Join(homePath, fmt.Sprintf("%s-%s-quadlet", ram.AppName, ram.AppVersion)),
+			opts:        o,
+		}, nil
+	case SWARM:
+		return &swarmExporter{
+			logger:      logger,
+			ram:         ram,
+			imageClient: imageClient,
+			homePath:    homePath,
+			exportPath:  path.Join(homePath, fmt.Sprintf("%s-%s-swarm", ram.AppName, ram.AppVersion)),
+			opts:        o,
+		}, nil
+	case GITOPS:
+		return &gitOpsExporter{
+			logger:      logger,
+			ram:         ram,
+			imageClient: imageClient,
+			homePath:    homePath,
+			exportPath:  path.Join(homePath, fmt.Sprintf("%s-%s-gitops", ram.AppName, ram.AppVersion)),
+			opts:        o,
 		}, nil
 	default:
 		panic("not support app format")
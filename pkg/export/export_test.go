@@ -0,0 +1,115 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/destination"
+)
+
+// testRAM a web component depending on a stateful mysql component
+func testRAM() v1alpha1.WutongApplicationConfig {
+	mode := 0644
+	return v1alpha1.WutongApplicationConfig{
+		AppName:    "demo",
+		AppVersion: "1.0",
+		AppConfigGroups: []*v1alpha1.AppConfigGroup{
+			{Name: "base", ConfigItems: map[string]string{"TZ": "Asia/Shanghai"}, ComponentKeys: []string{"web-key"}},
+		},
+		IngressHTTPRoutes: []*v1alpha1.IngressHTTPRoute{
+			{Location: "/", TargetComponent: v1alpha1.TargetComponent{ComponentKey: "web-key", Port: 8080}},
+		},
+		Components: []*v1alpha1.Component{
+			{
+				ServiceCname:   "web",
+				ServiceShareID: "web-share-id",
+				ComponentKey:   "web-key",
+				ShareImage:     "hub.example.com/demo/web:v1",
+				Memory:         512,
+				CPU:            250,
+				Cmd:            "run --port 8080",
+				Ports: []v1alpha1.ComponentPort{
+					{PortAlias: "WEB", ContainerPort: 8080, Protocol: "http", IsOuter: true},
+				},
+				Envs: []v1alpha1.ComponentEnv{
+					{AttrName: "DB_USER", AttrValue: "root"},
+				},
+				DepServiceMapList: []v1alpha1.ComponentDep{{DepServiceKey: "mysql-key"}},
+				ServiceVolumeMapList: v1alpha1.ComponentVolumeList{
+					{VolumeName: "conf", VolumeType: v1alpha1.ConfigFileVolumeType, VolumeMountPath: "/etc/web/app.conf", FileConent: "listen={{port}}", Mode: &mode},
+					{VolumeName: "data", VolumeType: v1alpha1.ShareFileVolumeType, VolumeMountPath: "/data", VolumeCapacity: 5},
+				},
+				ExtendMethodRule: v1alpha1.ComponentExtendMethodRule{MinNode: 2},
+				Probes: []v1alpha1.ComponentProbe{
+					{Scheme: "http", Port: 8080, Path: "/healthz", Mode: "readiness", IsUsed: true, PeriodSecond: 10, TimeoutSecond: 5, FailureThreshold: 3},
+				},
+			},
+			{
+				ServiceCname:   "mysql",
+				ServiceShareID: "mysql-share-id",
+				ComponentKey:   "mysql-key",
+				ShareImage:     "mysql:5.7",
+				DeployType:     v1alpha1.StateSingletonDeployType,
+				Ports: []v1alpha1.ComponentPort{
+					{PortAlias: "MYSQL", ContainerPort: 3306, Protocol: "mysql", IsInner: true},
+				},
+				ServiceConnectInfoMapList: []v1alpha1.ComponentEnv{
+					{AttrName: "MYSQL_PASSWORD", AttrValue: "**None**"},
+					{AttrName: "MYSQL_HOST", AttrValue: "127.0.0.1"},
+				},
+				ServiceVolumeMapList: v1alpha1.ComponentVolumeList{
+					{VolumeName: "mysqldata", VolumeType: v1alpha1.LocalVolumeType, VolumeMountPath: "/var/lib/mysql", VolumeCapacity: 10},
+				},
+			},
+		},
+	}
+}
+
+func TestDeliverPackageRemovesExportDir(t *testing.T) {
+	homePath := t.TempDir()
+	exportPath := filepath.Join(homePath, "demo-1.0")
+	if err := os.MkdirAll(exportPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(exportPath, "metadata.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	o := newOptions()
+	o.zipPackage = true
+	o.destination = destination.NewWriter(&buf)
+	res, err := packageApp("demo-1.0.tar.gz", homePath, exportPath, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.PackageName != "demo-1.0.zip" || buf.Len() == 0 {
+		t.Errorf("expect the zip package delivered, got %s of %d bytes", res.PackageName, buf.Len())
+	}
+	if _, err := os.Stat(exportPath); !os.IsNotExist(err) {
+		t.Errorf("expect the export dir removed after the delivery, got %v", err)
+	}
+	if entries, _ := os.ReadDir(homePath); len(entries) != 0 {
+		t.Errorf("expect nothing left under the home path, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,313 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+)
+
+// gatewayImage the image of the gateway service of the docker compose app
+const gatewayImage = "nginx:1.25-alpine"
+
+// gatewayServiceName the compose service name of the gateway
+const gatewayServiceName = "gateway"
+
+type gatewayLocation struct {
+	Path           string
+	Upstream       string
+	Redirect       bool
+	Websocket      bool
+	ConnectTimeout int
+	SendTimeout    int
+	ReadTimeout    int
+	BodySizeLimit  int
+	ProxyBuffer    bool
+	BufferSize     int
+	BufferNumbers  int
+	ProxyHeaders   [][2]string
+	// Conditions nginx variables and the values they must match
+	Conditions [][2]string
+}
+
+type gatewayServer struct {
+	Listen    int
+	SSL       bool
+	Locations []*gatewayLocation
+}
+
+type gatewayStream struct {
+	Listen         int
+	UDP            bool
+	Upstream       string
+	ConnectTimeout int
+}
+
+type gatewayConfig struct {
+	Servers []*gatewayServer
+	Streams []*gatewayStream
+}
+
+// hasGatewayRoutes whether the app needs a gateway
+func hasGatewayRoutes(ram v1alpha1.WutongApplicationConfig) bool {
+	return len(ram.IngressHTTPRoutes) > 0 || len(ram.IngressSreamRoutes) > 0
+}
+
+// newGatewayConfig build the gateway config from the ingress routes, hosts
+// are the upstream hosts of the components by component key
+func newGatewayConfig(ram v1alpha1.WutongApplicationConfig, hosts map[string]string) *gatewayConfig {
+	http := &gatewayServer{Listen: 80}
+	https := &gatewayServer{Listen: 443, SSL: true}
+	paths := make(map[string]struct{})
+	for _, route := range ram.IngressHTTPRoutes {
+		host, ok := hosts[route.ComponentKey]
+		if !ok {
+			logrus.Warningf("[gateway] component %s of http route %s not found", route.ComponentKey, route.Location)
+			continue
+		}
+		location := route.Location
+		if location == "" {
+			location = "/"
+		}
+		if _, exists := paths[location]; exists {
+			logrus.Warningf("[gateway] duplicate http route %s is ignored", location)
+			continue
+		}
+		paths[location] = struct{}{}
+		loc := &gatewayLocation{
+			Path:           location,
+			Upstream:       fmt.Sprintf("%s:%d", host, route.Port),
+			Websocket:      route.Websocket,
+			ConnectTimeout: route.ConnectionTimeout,
+			SendTimeout:    route.RequestTimeout,
+			ReadTimeout:    route.ResponseTimeout,
+			BodySizeLimit:  route.RequestBodySizeLimit,
+			ProxyBuffer:    route.ProxyBuffer,
+			BufferSize:     route.ProxyBufferSize,
+			BufferNumbers:  route.ProxyBufferNumbers,
+			ProxyHeaders:   sortedPairs(route.ProxyHeader, nil),
+		}
+		loc.Conditions = append(sortedPairs(route.Headers, func(name string) string {
+			return "$http_" + strings.ReplaceAll(strings.ToLower(name), "-", "_")
+		}), sortedPairs(route.Cookies, func(name string) string {
+			return "$cookie_" + name
+		})...)
+		if route.SSL {
+			https.Locations = append(https.Locations, loc)
+			http.Locations = append(http.Locations, &gatewayLocation{Path: location, Redirect: true})
+			continue
+		}
+		http.Locations = append(http.Locations, loc)
+	}
+	config := &gatewayConfig{}
+	if len(http.Locations) > 0 {
+		config.Servers = append(config.Servers, http)
+	}
+	if len(https.Locations) > 0 {
+		config.Servers = append(config.Servers, https)
+	}
+	for _, route := range ram.IngressSreamRoutes {
+		host, ok := hosts[route.ComponentKey]
+		if !ok {
+			logrus.Warningf("[gateway] component %s of stream route %d not found", route.ComponentKey, route.Port)
+			continue
+		}
+		config.Streams = append(config.Streams, &gatewayStream{
+			Listen:         int(route.Port),
+			UDP:            strings.ToLower(route.Protocol) == "udp",
+			Upstream:       fmt.Sprintf("%s:%d", host, route.Port),
+			ConnectTimeout: route.ConnectionTimeout,
+		})
+	}
+	return config
+}
+
+// hasSSL whether a placeholder certificate is required
+func (g *gatewayConfig) hasSSL() bool {
+	for _, server := range g.Servers {
+		if server.SSL {
+			return true
+		}
+	}
+	return false
+}
+
+// ports the ports the gateway listens on
+func (g *gatewayConfig) ports() []k8sPort {
+	var ports []k8sPort
+	for _, server := range g.Servers {
+		ports = append(ports, k8sPort{Port: server.Listen, Protocol: "TCP"})
+	}
+	for _, stream := range g.Streams {
+		protocol := "TCP"
+		if stream.UDP {
+			protocol = "UDP"
+		}
+		ports = append(ports, k8sPort{Port: stream.Listen, Protocol: protocol})
+	}
+	return ports
+}
+
+func (g *gatewayConfig) render() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := nginxConfTemplate.Execute(&buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sortedPairs map entries sorted by key, the keys are converted by fn if not nil
+func sortedPairs(m map[string]string, fn func(string) string) [][2]string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([][2]string, 0, len(keys))
+	for _, k := range keys {
+		name := k
+		if fn != nil {
+			name = fn(k)
+		}
+		pairs = append(pairs, [2]string{name, m[k]})
+	}
+	return pairs
+}
+
+var gatewaySSLReadme = `Place the certificate of the domain here as server.crt and its private key
+as server.key. run.sh generates a self-signed placeholder certificate if none
+is present.
+`
+
+var nginxConfTemplate = template.Must(template.New("nginx.conf").Parse(`worker_processes auto;
+
+events {
+    worker_connections 4096;
+}
+{{- if .Servers}}
+
+http {
+    include /etc/nginx/mime.types;
+    default_type application/octet-stream;
+    sendfile on;
+    keepalive_timeout 65;
+
+    map $http_upgrade $connection_upgrade {
+        default upgrade;
+        '' close;
+    }
+{{- range .Servers}}
+
+    server {
+        listen {{.Listen}}{{if .SSL}} ssl{{end}};
+        server_name _;
+{{- if .SSL}}
+        ssl_certificate /etc/nginx/ssl/server.crt;
+        ssl_certificate_key /etc/nginx/ssl/server.key;
+{{- end}}
+{{- range .Locations}}
+
+        location {{.Path}} {
+{{- if .Redirect}}
+            return 301 https://$host$request_uri;
+{{- else}}
+{{- range .Conditions}}
+            if ({{index . 0}} != "{{index . 1}}") {
+                return 404;
+            }
+{{- end}}
+            proxy_pass http://{{.Upstream}};
+            proxy_set_header Host $host;
+            proxy_set_header X-Real-IP $remote_addr;
+            proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+            proxy_set_header X-Forwarded-Proto $scheme;
+{{- range .ProxyHeaders}}
+            proxy_set_header {{index . 0}} "{{index . 1}}";
+{{- end}}
+{{- if .Websocket}}
+            proxy_http_version 1.1;
+            proxy_set_header Upgrade $http_upgrade;
+            proxy_set_header Connection $connection_upgrade;
+{{- end}}
+{{- if .ConnectTimeout}}
+            proxy_connect_timeout {{.ConnectTimeout}}s;
+{{- end}}
+{{- if .SendTimeout}}
+            proxy_send_timeout {{.SendTimeout}}s;
+{{- end}}
+{{- if .ReadTimeout}}
+            proxy_read_timeout {{.ReadTimeout}}s;
+{{- end}}
+{{- if .BodySizeLimit}}
+            client_max_body_size {{.BodySizeLimit}}m;
+{{- end}}
+{{- if .ProxyBuffer}}
+            proxy_buffering on;
+{{- if .BufferSize}}
+            proxy_buffer_size {{.BufferSize}}k;
+{{- if .BufferNumbers}}
+            proxy_buffers {{.BufferNumbers}} {{.BufferSize}}k;
+{{- end}}
+{{- end}}
+{{- else}}
+            proxy_buffering off;
+{{- end}}
+{{- end}}
+        }
+{{- end}}
+    }
+{{- end}}
+}
+{{- end}}
+{{- if .Streams}}
+
+stream {
+{{- range .Streams}}
+    server {
+        listen {{.Listen}}{{if .UDP}} udp{{end}};
+        proxy_pass {{.Upstream}};
+{{- if .ConnectTimeout}}
+        proxy_connect_timeout {{.ConnectTimeout}}s;
+{{- end}}
+    }
+{{- end}}
+}
+{{- end}}
+`))
+
+// routedComponent whether the component is the target of an ingress route
+func routedComponent(ram v1alpha1.WutongApplicationConfig, componentKey string) bool {
+	for _, route := range ram.IngressHTTPRoutes {
+		if route.ComponentKey == componentKey {
+			return true
+		}
+	}
+	for _, route := range ram.IngressSreamRoutes {
+		if route.ComponentKey == componentKey {
+			return true
+		}
+	}
+	return false
+}
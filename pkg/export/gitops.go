@@ -0,0 +1,426 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltr.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltr.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// GitOpsArgoCD deploy the app with argo cd applications
+	GitOpsArgoCD = "argocd"
+	// GitOpsFlux deploy the app with flux kustomizations or helm releases
+	GitOpsFlux = "flux"
+)
+
+// argoSyncWaveAnnotation the annotation ordering the resources argo cd syncs
+const argoSyncWaveAnnotation = "argocd.argoproj.io/sync-wave"
+
+// gitOpsLayoutFile the layout config at the root of the repository
+const gitOpsLayoutFile = "gitops.yaml"
+
+// GitOpsConfig the repository the layout is committed to and the tool syncing it
+type GitOpsConfig struct {
+	// Tool argocd or flux, argocd by default
+	Tool     string `json:"tool"`
+	RepoURL  string `json:"repo_url"`
+	Revision string `json:"revision,omitempty"`
+	// Helm lay out the helm chart and the values of the environments instead
+	// of the kustomize base and overlays
+	Helm bool `json:"helm,omitempty"`
+	// Namespace of the argo cd applications or the flux objects
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// gitOpsLayout the layout config, where the app and the deployments of the environments are
+type gitOpsLayout struct {
+	App          string              `json:"app"`
+	Version      string              `json:"version"`
+	Tool         string              `json:"tool"`
+	Source       string              `json:"source"`
+	Path         string              `json:"path"`
+	Environments []gitOpsEnvironment `json:"environments"`
+	SyncWaves    map[string]int      `json:"syncWaves,omitempty"`
+	// Secrets the Secrets of the generated secrets the workloads reference,
+	// they are not committed and have to be created in the namespaces of the
+	// environments, eg. as sealed or external secrets, from the SecretsFile
+	Secrets []gitOpsSecret `json:"secrets,omitempty"`
+	// SecretsFile the secrets file written next to the package
+	SecretsFile string `json:"secretsFile,omitempty"`
+}
+
+type gitOpsSecret struct {
+	Name string   `json:"name"`
+	Keys []string `json:"keys"`
+}
+
+type gitOpsEnvironment struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Path of the overlay or the values file of the environment
+	Path string `json:"path"`
+	// Deploy the argo cd application or flux objects of the environment
+	Deploy string `json:"deploy"`
+}
+
+type gitOpsExporter struct {
+	logger      *logrus.Logger
+	ram         v1alpha1.WutongApplicationConfig
+	imageClient image.Client
+	homePath    string
+	exportPath  string
+	opts        options
+}
+
+func (g *gitOpsExporter) Export() (*Result, error) {
+	g.logger.Infof("start export app %s to gitops layout", g.ram.AppName)
+	// Delete the old application group directory and then regenerate the application package
+	if err := PrepareExportDir(g.exportPath); err != nil {
+		g.logger.Errorf("prepare export dir failure %s", err.Error())
+		return nil, err
+	}
+	g.logger.Infof("success prepare export dir")
+	if err := g.writeLayout(); err != nil {
+		g.logger.Errorf("write gitops layout failure %s", err.Error())
+		return nil, err
+	}
+	g.logger.Infof("success write gitops layout")
+	// the images are pulled by the cluster, the layout is committed as it is
+	// and the secrets are kept out of it
+	if err := g.opts.secrets.WriteFile(path.Join(g.homePath, gitOpsSecretsFile(g.ram))); err != nil {
+		g.logger.Errorf("write secrets file failure %s", err.Error())
+		return nil, err
+	}
+	// the manifest and its signature are written next to the package, the
+	// checkout of the layout is verified with them
+	manifestFile, signatureFile := gitOpsManifestFiles(g.ram)
+	if err := sign.SignDirTo(g.exportPath, path.Join(g.homePath, manifestFile), path.Join(g.homePath, signatureFile), g.opts.signer); err != nil {
+		g.logger.Errorf("sign package failure %s", err.Error())
+		return nil, err
+	}
+	packageName := fmt.Sprintf("%s-%s-gitops.tar.gz", g.ram.AppName, g.ram.AppVersion)
+	res, err := packageApp(packageName, g.homePath, g.exportPath, g.opts)
+	if err != nil {
+		err = fmt.Errorf("failed to package app %s: %s", packageName, err.Error())
+		g.logger.Error(err)
+		return nil, err
+	}
+	g.logger.Infof("success export app " + g.ram.AppName)
+	return res, nil
+}
+
+// writeLayout write the app under apps/<app>, the deployments of the
+// environments under clusters/<environment> and the layout config
+func (g *gitOpsExporter) writeLayout() error {
+	config := g.opts.gitops
+	if config.RepoURL == "" {
+		return fmt.Errorf("the repository url of the gitops layout is required")
+	}
+	if config.Tool == "" {
+		config.Tool = GitOpsArgoCD
+	}
+	if config.Tool != GitOpsArgoCD && config.Tool != GitOpsFlux {
+		return fmt.Errorf("not support gitops tool %s", config.Tool)
+	}
+	if g.opts.baseline != "" {
+		return fmt.Errorf("the gitops layout is committed as a whole, a delta against baseline %s is not supported", g.opts.baseline)
+	}
+	if config.Revision == "" {
+		config.Revision = "main"
+	}
+	if config.Namespace == "" {
+		config.Namespace = map[string]string{GitOpsArgoCD: "argocd", GitOpsFlux: "flux-system"}[config.Tool]
+	}
+	app := systemdName(g.ram.AppName)
+	appPath := path.Join("apps", app)
+	profiles := g.opts.environmentProfiles
+	if len(profiles) == 0 {
+		profiles = []EnvironmentProfile{{Name: "default"}}
+	}
+	components, groups, err := newK8sComponents(g.ram, g.opts.secrets)
+	if err != nil {
+		return err
+	}
+	waves := syncWaves(g.ram)
+	layout := gitOpsLayout{
+		App:       app,
+		Version:   g.ram.AppVersion,
+		Tool:      config.Tool,
+		Source:    "kustomize",
+		Path:      appPath,
+		SyncWaves: make(map[string]int, len(components)),
+	}
+	for _, kc := range components {
+		layout.SyncWaves[kc.Name] = waves[kc.Component.ComponentKey]
+		if len(kc.SecretEnvs) > 0 {
+			layout.Secrets = append(layout.Secrets, gitOpsSecret{Name: kc.Name + "-secrets", Keys: kc.SecretEnvs})
+			layout.SecretsFile = gitOpsSecretsFile(g.ram)
+		}
+	}
+	if config.Helm {
+		layout.Source = "helm"
+		h := &helmChartExporter{logger: g.logger, ram: g.ram, mode: "offline", exportPath: g.exportPath, opts: g.opts, externalSecrets: true}
+		if _, err := h.writeChart(path.Join(g.exportPath, appPath, "chart"), components, groups); err != nil {
+			return err
+		}
+	} else {
+		k := &kustomizeExporter{logger: g.logger, ram: g.ram, mode: "offline", exportPath: g.exportPath, opts: g.opts, syncWaves: waves, externalSecrets: true}
+		images, err := k.writeBase(path.Join(g.exportPath, appPath, "base"), components, groups)
+		if err != nil {
+			return err
+		}
+		if err := k.writeOverlays(path.Join(g.exportPath, appPath), components, images); err != nil {
+			return err
+		}
+	}
+	for _, profile := range profiles {
+		env := gitOpsEnvironment{
+			Name:      k8sName(profile.Name),
+			Namespace: profile.Namespace,
+			Path:      path.Join(appPath, "overlays", k8sName(profile.Name)),
+			Deploy:    path.Join("clusters", k8sName(profile.Name), app+".yaml"),
+		}
+		if env.Namespace == "" {
+			env.Namespace = app
+		}
+		if config.Helm {
+			env.Path = path.Join(appPath, "values", env.Name+".yaml")
+			values, err := g.helmValues(profile, components, waves)
+			if err != nil {
+				return err
+			}
+			if err := writeLayoutFile(g.exportPath, env.Path, values); err != nil {
+				return err
+			}
+		}
+		var objects []interface{}
+		if config.Tool == GitOpsArgoCD {
+			objects = append(objects, argoApplication(config, app, appPath, env))
+		} else {
+			objects = append(objects, fluxObjects(config, app, appPath, env)...)
+		}
+		var content []byte
+		for i, obj := range objects {
+			body, err := yaml.Marshal(obj)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				content = append(content, []byte("---\n")...)
+			}
+			content = append(content, body...)
+		}
+		if err := os.MkdirAll(path.Dir(path.Join(g.exportPath, env.Deploy)), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path.Join(g.exportPath, env.Deploy), content, 0644); err != nil {
+			return err
+		}
+		layout.Environments = append(layout.Environments, env)
+	}
+	return writeLayoutFile(g.exportPath, gitOpsLayoutFile, layout)
+}
+
+// gitOpsSecretsFile the name of the secrets file written next to the package
+func gitOpsSecretsFile(ram v1alpha1.WutongApplicationConfig) string {
+	return fmt.Sprintf("%s-%s-gitops-%s", ram.AppName, ram.AppVersion, secret.FileName)
+}
+
+// gitOpsManifestFiles the names of the package manifest and its signature
+// written next to the package
+func gitOpsManifestFiles(ram v1alpha1.WutongApplicationConfig) (string, string) {
+	prefix := fmt.Sprintf("%s-%s-gitops-", ram.AppName, ram.AppVersion)
+	return prefix + sign.ManifestFileName, prefix + sign.SignatureFileName
+}
+
+// helmValues the values of the environment, the sync waves keyed by the
+// component key are set as the annotations of the workloads
+func (g *gitOpsExporter) helmValues(profile EnvironmentProfile, components []*k8sComponent, waves map[string]int) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	if profile.StorageClass != "" {
+		values["global"] = map[string]interface{}{"storageClass": profile.StorageClass}
+	}
+	componentValues := make(map[string]interface{}, len(components))
+	for _, kc := range components {
+		cv := map[string]interface{}{
+			"annotations": map[string]interface{}{argoSyncWaveAnnotation: fmt.Sprint(waves[kc.Component.ComponentKey])},
+		}
+		if replicas, ok := lookupComponent(profile.Replicas, kc); ok {
+			cv["replicas"] = replicas
+		}
+		if res, ok := lookupComponent(profile.Resources, kc); ok {
+			cv["resources"] = resourceRequirements(res.Memory, res.CPU)
+		}
+		if profile.ImageRegistry != "" {
+			repository, err := rewriteRegistry(kc.Repository, profile.ImageRegistry)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite image %s registry failure %s", kc.Repository, err.Error())
+			}
+			cv["image"] = map[string]interface{}{"repository": repository}
+		}
+		componentValues[kc.Name] = cv
+	}
+	values["components"] = componentValues
+	return values, nil
+}
+
+// syncWaves the sync wave of every component keyed by the component key, the
+// components without dependencies come first and a component is synced after
+// all of its dependencies
+func syncWaves(ram v1alpha1.WutongApplicationConfig) map[string]int {
+	keys := make(map[string]*v1alpha1.Component, len(ram.Components))
+	for _, cpt := range ram.Components {
+		keys[cpt.ComponentKey] = cpt
+		keys[cpt.ServiceShareID] = cpt
+	}
+	waves := make(map[string]int, len(ram.Components))
+	visiting := make(map[string]bool)
+	var wave func(cpt *v1alpha1.Component) int
+	wave = func(cpt *v1alpha1.Component) int {
+		if w, ok := waves[cpt.ComponentKey]; ok {
+			return w
+		}
+		// a dependency cycle is cut where it closes
+		if visiting[cpt.ComponentKey] {
+			return -1
+		}
+		visiting[cpt.ComponentKey] = true
+		w := 0
+		for _, dep := range cpt.DepServiceMapList {
+			if d, ok := keys[dep.DepServiceKey]; ok && d != cpt {
+				w = max(w, wave(d)+1)
+			}
+		}
+		visiting[cpt.ComponentKey] = false
+		waves[cpt.ComponentKey] = w
+		return w
+	}
+	for _, cpt := range ram.Components {
+		wave(cpt)
+	}
+	return waves
+}
+
+// argoApplication the argo cd application of the environment
+func argoApplication(config GitOpsConfig, app, appPath string, env gitOpsEnvironment) map[string]interface{} {
+	source := map[string]interface{}{
+		"repoURL":        config.RepoURL,
+		"targetRevision": config.Revision,
+		"path":           env.Path,
+	}
+	if config.Helm {
+		source["path"] = path.Join(appPath, "chart")
+		source["helm"] = map[string]interface{}{
+			"releaseName": app,
+			"valueFiles":  []string{path.Join("..", "values", path.Base(env.Path))},
+		}
+	}
+	return map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Application",
+		"metadata": map[string]interface{}{
+			"name":       app + "-" + env.Name,
+			"namespace":  config.Namespace,
+			"finalizers": []string{"resources-finalizer.argocd.argoproj.io"},
+		},
+		"spec": map[string]interface{}{
+			"project": "default",
+			"source":  source,
+			"destination": map[string]interface{}{
+				"server":    "https://kubernetes.default.svc",
+				"namespace": env.Namespace,
+			},
+			"syncPolicy": map[string]interface{}{
+				"automated":   map[string]interface{}{"prune": true, "selfHeal": true},
+				"syncOptions": []string{"CreateNamespace=true"},
+			},
+		},
+	}
+}
+
+// fluxObjects the flux source of the repository and the kustomization or
+// helm release of the environment. Flux has no sync waves, the kustomization
+// waits for the resources to be ready.
+func fluxObjects(config GitOpsConfig, app, appPath string, env gitOpsEnvironment) []interface{} {
+	sourceRef := map[string]interface{}{"kind": "GitRepository", "name": app}
+	repository := map[string]interface{}{
+		"apiVersion": "source.toolkit.fluxcd.io/v1",
+		"kind":       "GitRepository",
+		"metadata":   map[string]interface{}{"name": app, "namespace": config.Namespace},
+		"spec": map[string]interface{}{
+			"interval": "1m",
+			"url":      config.RepoURL,
+			"ref":      map[string]interface{}{"branch": config.Revision},
+		},
+	}
+	if config.Helm {
+		return []interface{}{repository, map[string]interface{}{
+			"apiVersion": "helm.toolkit.fluxcd.io/v2",
+			"kind":       "HelmRelease",
+			"metadata":   map[string]interface{}{"name": app + "-" + env.Name, "namespace": config.Namespace},
+			"spec": map[string]interface{}{
+				"interval":         "10m",
+				"releaseName":      app,
+				"targetNamespace":  env.Namespace,
+				"storageNamespace": env.Namespace,
+				"install":          map[string]interface{}{"createNamespace": true},
+				"chart": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"chart":       "./" + path.Join(appPath, "chart"),
+						"sourceRef":   sourceRef,
+						"valuesFiles": []string{"./" + env.Path},
+					},
+				},
+			},
+		}}
+	}
+	return []interface{}{repository, map[string]interface{}{
+		"apiVersion": "kustomize.toolkit.fluxcd.io/v1",
+		"kind":       "Kustomization",
+		"metadata":   map[string]interface{}{"name": app + "-" + env.Name, "namespace": config.Namespace},
+		"spec": map[string]interface{}{
+			"interval":        "10m",
+			"path":            "./" + env.Path,
+			"prune":           true,
+			"wait":            true,
+			"targetNamespace": env.Namespace,
+			"sourceRef":       sourceRef,
+		},
+	}}
+}
+
+func writeLayoutFile(root, name string, obj interface{}) error {
+	content, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	file := path.Join(root, name)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, content, 0644)
+}
@@ -0,0 +1,222 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltr.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltr.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
+	"sigs.k8s.io/yaml"
+)
+
+func TestSyncWaves(t *testing.T) {
+	ram := testRAM()
+	ram.Components = append(ram.Components, &v1alpha1.Component{
+		ServiceCname:      "worker",
+		ComponentKey:      "worker-key",
+		DepServiceMapList: []v1alpha1.ComponentDep{{DepServiceKey: "web-key"}, {DepServiceKey: "mysql-key"}},
+	})
+	waves := syncWaves(ram)
+	if !reflect.DeepEqual(waves, map[string]int{"mysql-key": 0, "web-key": 1, "worker-key": 2}) {
+		t.Errorf("unexpected sync waves %v", waves)
+	}
+	// a dependency cycle is cut
+	ram.Components[1].DepServiceMapList = []v1alpha1.ComponentDep{{DepServiceKey: "worker-key"}}
+	if waves := syncWaves(ram); len(waves) != 3 {
+		t.Errorf("unexpected sync waves of the cycle %v", waves)
+	}
+}
+
+func TestGitOpsArgoKustomize(t *testing.T) {
+	dir := t.TempDir()
+	g := &gitOpsExporter{logger: logrus.New(), ram: testRAM(), exportPath: dir, opts: newOptions(
+		WithGitOps(GitOpsConfig{RepoURL: "https://git.example.com/apps.git"}),
+		WithEnvironmentProfiles(EnvironmentProfile{Name: "prod", Namespace: "demo-prod"}),
+	)}
+	if err := g.writeLayout(); err != nil {
+		t.Fatal(err)
+	}
+	var layout gitOpsLayout
+	content, err := os.ReadFile(path.Join(dir, gitOpsLayoutFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(content, &layout); err != nil {
+		t.Fatal(err)
+	}
+	expect := []gitOpsEnvironment{{Name: "prod", Namespace: "demo-prod", Path: "apps/demo/overlays/prod", Deploy: "clusters/prod/demo.yaml"}}
+	if layout.Tool != GitOpsArgoCD || layout.Source != "kustomize" || !reflect.DeepEqual(layout.Environments, expect) || !reflect.DeepEqual(layout.SyncWaves, map[string]int{"web": 1, "mysql": 0}) {
+		t.Errorf("unexpected layout %+v", layout)
+	}
+	app, err := os.ReadFile(path.Join(dir, "clusters/prod/demo.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"kind: Application", "path: apps/demo/overlays/prod", "targetRevision: main", "namespace: demo-prod", "namespace: argocd"} {
+		if !strings.Contains(string(app), expect) {
+			t.Errorf("expect %q in the application:\n%s", expect, app)
+		}
+	}
+	web, err := os.ReadFile(path.Join(dir, "apps/demo/base/web.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(web), `argocd.argoproj.io/sync-wave: "1"`) {
+		t.Errorf("expect the sync wave of web in the base:\n%s", web)
+	}
+	if _, err := os.Stat(path.Join(dir, "apps/demo/overlays/prod/kustomization.yaml")); err != nil {
+		t.Errorf("overlay of the environment not found")
+	}
+}
+
+func TestGitOpsFluxHelm(t *testing.T) {
+	dir := t.TempDir()
+	g := &gitOpsExporter{logger: logrus.New(), ram: testRAM(), exportPath: dir, opts: newOptions(
+		WithGitOps(GitOpsConfig{Tool: GitOpsFlux, RepoURL: "https://git.example.com/apps.git", Revision: "release", Helm: true}),
+		WithEnvironmentProfiles(EnvironmentProfile{Name: "prod", ImageRegistry: "registry.prod.example.com/wutong", Replicas: map[string]int{"web": 4}}),
+	)}
+	if err := g.writeLayout(); err != nil {
+		t.Fatal(err)
+	}
+	deploy, err := os.ReadFile(path.Join(dir, "clusters/prod/demo.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"kind: GitRepository", "branch: release", "---\n", "kind: HelmRelease", "chart: ./apps/demo/chart", "- ./apps/demo/values/prod.yaml", "namespace: flux-system"} {
+		if !strings.Contains(string(deploy), expect) {
+			t.Errorf("expect %q in the flux objects:\n%s", expect, deploy)
+		}
+	}
+	content, err := os.ReadFile(path.Join(dir, "apps/demo/values/prod.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values struct {
+		Components map[string]struct {
+			Replicas    int               `json:"replicas"`
+			Annotations map[string]string `json:"annotations"`
+			Image       struct {
+				Repository string `json:"repository"`
+			} `json:"image"`
+		} `json:"components"`
+	}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		t.Fatal(err)
+	}
+	web := values.Components["web"]
+	if web.Replicas != 4 || web.Annotations[argoSyncWaveAnnotation] != "1" || web.Image.Repository != "registry.prod.example.com/wutong/demo/web" {
+		t.Errorf("unexpected values of web %+v", web)
+	}
+	if _, err := os.Stat(path.Join(dir, "apps/demo/chart/Chart.yaml")); err != nil {
+		t.Errorf("chart not found")
+	}
+	g.opts.gitops.RepoURL = ""
+	if err := g.writeLayout(); err == nil {
+		t.Errorf("expect the repository url required")
+	}
+}
+
+func TestGitOpsSecretsOutOfLayout(t *testing.T) {
+	for _, helm := range []bool{false, true} {
+		home := t.TempDir()
+		g := &gitOpsExporter{logger: logrus.New(), ram: testRAM(), homePath: home, exportPath: path.Join(home, "demo-1.0-gitops"), opts: newOptions(
+			WithGitOps(GitOpsConfig{RepoURL: "https://git.example.com/apps.git", Helm: helm}),
+		)}
+		if _, err := g.Export(); err != nil {
+			t.Fatal(err)
+		}
+		entries := g.opts.secrets.Entries()
+		if len(entries) == 0 {
+			t.Fatal("expect the generated mysql password")
+		}
+		// the layout is checked as it is committed
+		err := filepath.Walk(g.exportPath, func(file string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if strings.Contains(string(content), entry.Value) {
+					t.Errorf("helm %v: generated secret of %s committed in %s", helm, entry.Name, file)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path.Join(home, "demo-1.0-gitops-"+secret.FileName)); err != nil {
+			t.Errorf("helm %v: expect the secrets file next to the package, %v", helm, err)
+		}
+		var layout gitOpsLayout
+		content, err := os.ReadFile(path.Join(g.exportPath, gitOpsLayoutFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := yaml.Unmarshal(content, &layout); err != nil {
+			t.Fatal(err)
+		}
+		expect := []gitOpsSecret{{Name: "web-secrets", Keys: []string{"MYSQL_PASSWORD"}}, {Name: "mysql-secrets", Keys: []string{"MYSQL_PASSWORD"}}}
+		if !reflect.DeepEqual(layout.Secrets, expect) || layout.SecretsFile != "demo-1.0-gitops-secrets.json" {
+			t.Errorf("helm %v: unexpected secrets of the layout %+v %s", helm, layout.Secrets, layout.SecretsFile)
+		}
+	}
+}
+
+func TestGitOpsSignedOutOfLayout(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := t.TempDir()
+	g := &gitOpsExporter{logger: logrus.New(), ram: testRAM(), homePath: home, exportPath: path.Join(home, "demo-1.0-gitops"), opts: newOptions(
+		WithGitOps(GitOpsConfig{RepoURL: "https://git.example.com/apps.git"}),
+		WithSigner(sign.NewEd25519Signer(priv)),
+	)}
+	if _, err := g.Export(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{sign.ManifestFileName, sign.SignatureFileName} {
+		if _, err := os.Stat(path.Join(g.exportPath, name)); !os.IsNotExist(err) {
+			t.Errorf("%s committed in the layout", name)
+		}
+	}
+	store := sign.NewTrustStore()
+	store.AddKey(pub)
+	if err := store.VerifyDirWith(g.exportPath, path.Join(home, "demo-1.0-gitops-"+sign.ManifestFileName), path.Join(home, "demo-1.0-gitops-"+sign.SignatureFileName)); err != nil {
+		t.Errorf("verify the layout with the manifest next to the package: %v", err)
+	}
+
+	g.opts.baseline = path.Join(home, "demo-0.9-gitops.tar.gz")
+	if err := g.writeLayout(); err == nil || !strings.Contains(err.Error(), "baseline") {
+		t.Errorf("expect the baseline rejected, got %v", err)
+	}
+}
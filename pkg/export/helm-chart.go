@@ -4,14 +4,12 @@ import (
 	"fmt"
 	"os"
 	"path"
-	"strings"
-	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
 	"github.com/wutong-paas/wutong-oam/pkg/util/image"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
 	"sigs.k8s.io/yaml"
 )
 
@@ -22,64 +20,91 @@ type helmChartExporter struct {
 	mode        string
 	homePath    string
 	exportPath  string
+	opts        options
+	// externalSecrets leave the values of the generated secrets out of the
+	// chart, the Secrets are created in the cluster out of the chart
+	externalSecrets bool
 }
 
 func (h *helmChartExporter) Export() (*Result, error) {
 	h.logger.Infof("start export app %s to helm chart spec", h.ram.AppName)
+	// Delete the old application group directory and then regenerate the application package
+	if err := PrepareExportDir(h.exportPath); err != nil {
+		h.logger.Errorf("prepare export dir failure %s", err.Error())
+		return nil, err
+	}
+	h.logger.Infof("success prepare export dir")
 	dependentImages, err := h.initHelmChart()
 	if err != nil {
 		return nil, err
 	}
-	if err := SaveComponents(h.ram, h.imageClient, h.exportPath, h.logger, dependentImages); err != nil {
+	if err := saveComponentImages(h.ram, h.imageClient, h.exportPath, h.logger, dependentImages, h.opts); err != nil {
 		h.logger.Errorf("helm chart export save component failure %v", err)
 		return nil, err
 	}
 	h.logger.Infof("success save components")
 	// Save plugin attachments
-	if err := SavePlugins(h.ram, h.imageClient, h.exportPath, h.logger); err != nil {
+	if err := savePluginImages(h.ram, h.imageClient, h.exportPath, h.logger, h.opts); err != nil {
 		return nil, err
 	}
 	h.logger.Infof("success save plugins")
+	if err := h.opts.secrets.WriteFile(path.Join(h.exportPath, secret.FileName)); err != nil {
+		h.logger.Errorf("write secrets file failure %s", err.Error())
+		return nil, err
+	}
 
+	// leave out what the baseline package ships
+	if err := writeDelta(h.exportPath, h.opts.baseline); err != nil {
+		h.logger.Errorf("write delta package failure %s", err.Error())
+		return nil, err
+	}
+	// write package manifest and sign it
+	if err := sign.SignDir(h.exportPath, h.opts.signer); err != nil {
+		h.logger.Errorf("sign package failure %s", err.Error())
+		return nil, err
+	}
 	packageName := fmt.Sprintf("%s-%s-helm.tar.gz", h.ram.AppName, h.ram.AppVersion)
-	name, err := Packaging(packageName, h.homePath, h.exportPath)
+	res, err := packageApp(packageName, h.homePath, h.exportPath, h.opts)
 	if err != nil {
 		err = fmt.Errorf("failed to package app %s: %s", packageName, err.Error())
 		h.logger.Error(err)
 		return nil, err
 	}
 	h.logger.Infof("success export app " + h.ram.AppName)
-	return &Result{PackagePath: path.Join(h.homePath, name), PackageName: name}, nil
+	return res, nil
 }
 
+// initHelmChart write the chart into the export dir, the images used by
+// the chart are returned
 func (h *helmChartExporter) initHelmChart() ([]string, error) {
-	helmChartPath := path.Join(h.exportPath, h.ram.AppName)
+	components, groups, err := newK8sComponents(h.ram, h.opts.secrets)
+	if err != nil {
+		return nil, err
+	}
+	return h.writeChart(path.Join(h.exportPath, h.ram.AppName), components, groups)
+}
+
+// writeChart write the chart of the components into helmChartPath, the images
+// used by the chart are returned
+func (h *helmChartExporter) writeChart(helmChartPath string, components []*k8sComponent, groups []k8sConfigGroup) ([]string, error) {
+	if err := os.MkdirAll(helmChartPath, 0755); err != nil {
+		return nil, err
+	}
 	err := h.writeChartYaml(helmChartPath)
 	if err != nil {
 		h.logger.Errorf("%v writeChartYaml failure %v", h.ram.AppName, err)
 		return nil, err
 	}
 	h.logger.Infof("writeChartYaml success")
-	for i := 0; i < 40; i++ {
-		time.Sleep(1 * time.Second)
-		if CheckFileExist(path.Join(helmChartPath, "dependent_image.txt")) {
-			h.logger.Infof("dependent_image.txt creeate success")
-			break
-		}
-	}
-
-	content, err := os.ReadFile(path.Join(helmChartPath, "dependent_image.txt"))
+	err = h.writeTemplateYaml(helmChartPath, components, groups)
 	if err != nil {
-		h.logger.Errorf("read file dependent_image.txt failure %v", err)
 		return nil, err
 	}
-	dependentImages := strings.Split(string(content), "\n")
-	err = h.writeTemplateYaml(helmChartPath)
+	manifests, err := renderManifests(h.ram, components, groups)
 	if err != nil {
 		return nil, err
 	}
-	return dependentImages, nil
-
+	return manifestImages(manifests), nil
 }
 
 type ChartYaml struct {
@@ -104,31 +129,29 @@ func (h *helmChartExporter) writeChartYaml(helmChartPath string) error {
 	if err != nil {
 		return err
 	}
-	return h.write(path.Join(helmChartPath, "Chart.yaml"), cyYaml)
+	return os.WriteFile(path.Join(helmChartPath, "Chart.yaml"), cyYaml, 0644)
 }
 
-func (h *helmChartExporter) writeTemplateYaml(helmChartPath string) error {
+func (h *helmChartExporter) writeTemplateYaml(helmChartPath string, components []*k8sComponent, groups []k8sConfigGroup) error {
 	helmChartTemplatePath := path.Join(helmChartPath, "templates")
-	for _, k8sResource := range h.ram.K8sResources {
-		var unstructuredObject unstructured.Unstructured
-		err := yaml.Unmarshal([]byte(k8sResource.Content), &unstructuredObject)
-		if err != nil {
-			return err
-		}
-		unstructuredObject.SetNamespace("")
-		unstructuredObject.SetResourceVersion("")
-		unstructuredObject.SetCreationTimestamp(metav1.Time{})
-		unstructuredObject.SetUID("")
-		unstructuredYaml, err := yaml.Marshal(&unstructuredObject)
+	if err := os.MkdirAll(helmChartTemplatePath, 0755); err != nil {
+		return err
+	}
+	objects, err := k8sResourceObjects(h.ram.K8sResources)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		unstructuredYaml, err := yaml.Marshal(obj)
 		if err != nil {
 			return err
 		}
-		err = h.write(path.Join(helmChartTemplatePath, fmt.Sprintf("%v.yaml", unstructuredObject.GetKind())), unstructuredYaml)
+		err = h.write(path.Join(helmChartTemplatePath, fmt.Sprintf("%v.yaml", obj.GetKind())), unstructuredYaml)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return h.writeComponentTemplates(helmChartPath, components, groups)
 }
 
 func (h *helmChartExporter) write(helmChartFilePath string, meta []byte) error {
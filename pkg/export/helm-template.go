@@ -0,0 +1,627 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"sigs.k8s.io/yaml"
+)
+
+// helm templates are generated with go templates, the [[ ]] delimiters keep
+// the helm {{ }} actions untouched
+var helmTemplates = template.Must(template.New("helm").Delims("[[", "]]").Funcs(template.FuncMap{
+	"quote": func(s string) string { return fmt.Sprintf("%q", s) },
+	"fields": func(s string) string {
+		body, _ := json.Marshal(strings.Fields(s))
+		return string(body)
+	},
+}).Parse(helmTemplateText))
+
+const helmTemplateText = `
+[[- define "helpers" -]]
+{{- define "wutong.labels" -}}
+app.kubernetes.io/managed-by: {{ .Release.Service }}
+app.kubernetes.io/instance: {{ .Release.Name }}
+helm.sh/chart: {{ printf "%s-%s" .Chart.Name .Chart.Version | replace "+" "_" | trunc 63 | trimSuffix "-" }}
+{{- end }}
+
+{{- define "wutong.image" -}}
+{{- if hasPrefix "sha256:" .tag -}}
+{{ .repository }}@{{ .tag }}
+{{- else -}}
+{{ .repository }}:{{ .tag }}
+{{- end -}}
+{{- end }}
+[[ end -]]
+
+[[- define "workload" -]]
+{{- $c := index .Values.components [[ quote .Name ]] }}
+apiVersion: apps/v1
+kind: [[ if .Stateful ]]StatefulSet[[ else ]]Deployment[[ end ]]
+metadata:
+  name: [[ .Name ]]
+  {{- with $c.annotations }}
+  annotations:
+    {{- toYaml . | nindent 4 }}
+  {{- end }}
+  labels:
+    {{- include "wutong.labels" . | nindent 4 }}
+    app.kubernetes.io/component: [[ .Name ]]
+spec:
+  replicas: {{ $c.replicas }}
+  [[- if .Stateful ]]
+  serviceName: [[ .Name ]]
+  [[- end ]]
+  selector:
+    matchLabels:
+      app.kubernetes.io/instance: {{ .Release.Name }}
+      app.kubernetes.io/component: [[ .Name ]]
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/instance: {{ .Release.Name }}
+        app.kubernetes.io/component: [[ .Name ]]
+    spec:
+      containers:
+      - name: [[ .Name ]]
+        image: {{ include "wutong.image" $c.image | quote }}
+        imagePullPolicy: {{ $c.image.pullPolicy }}
+        [[- if .Component.Cmd ]]
+        args: [[ fields .Component.Cmd ]]
+        [[- end ]]
+        [[- if .Ports ]]
+        ports:
+        [[- range .Ports ]]
+        - name: [[ .Name ]]
+          containerPort: [[ .Port ]]
+          protocol: [[ .Protocol ]]
+        [[- end ]]
+        [[- end ]]
+        env:
+        {{- range $name, $value := $c.env }}
+        - name: {{ $name }}
+          value: {{ $value | toString | quote }}
+        {{- end }}
+        {{- range $name, $value := $c.secretEnv }}
+        - name: {{ $name }}
+          valueFrom:
+            secretKeyRef:
+              name: [[ .Name ]]-secrets
+              key: {{ $name }}
+        {{- end }}
+        [[- if .ConfigGroups ]]
+        envFrom:
+        [[- range .ConfigGroups ]]
+        - configMapRef:
+            name: config-group-[[ . ]]
+        [[- end ]]
+        [[- end ]]
+        {{- with $c.resources }}
+        resources:
+          {{- toYaml . | nindent 10 }}
+        {{- end }}
+        [[- if or .Volumes .ConfigFiles .SharedMount ]]
+        volumeMounts:
+        [[- range .Volumes ]]
+        - name: [[ .Name ]]
+          mountPath: [[ quote .MountPath ]]
+        [[- end ]]
+        [[- range .ConfigFiles ]]
+        - name: config-files
+          mountPath: [[ quote .MountPath ]]
+          subPath: [[ .Key ]]
+        [[- end ]]
+        [[- range $i, $m := .SharedMount ]]
+        - name: shared-[[ $i ]]
+          mountPath: [[ quote $m.MountPath ]]
+        [[- end ]]
+        [[- end ]]
+      [[- if .HasPodVolumes ]]
+      volumes:
+      [[- $stateful := .Stateful ]]
+      [[- range .Volumes ]]
+      [[- if .MemoryFS ]]
+      - name: [[ .Name ]]
+        emptyDir:
+          medium: Memory
+      [[- else if not $stateful ]]
+      - name: [[ .Name ]]
+        persistentVolumeClaim:
+          claimName: [[ .ClaimName ]]
+      [[- end ]]
+      [[- end ]]
+      [[- if .ConfigFiles ]]
+      - name: config-files
+        configMap:
+          name: [[ .Name ]]-config-files
+      [[- end ]]
+      [[- range $i, $m := .SharedMount ]]
+      - name: shared-[[ $i ]]
+        persistentVolumeClaim:
+          claimName: [[ $m.ClaimName ]]
+      [[- end ]]
+      [[- end ]]
+  [[- if and .Stateful .HasPersistentVolume ]]
+  volumeClaimTemplates:
+  [[- range .Volumes ]]
+  [[- if not .MemoryFS ]]
+  {{- $p := index $c.persistence [[ quote .Name ]] }}
+  - metadata:
+      name: [[ .Name ]]
+    spec:
+      accessModes:
+      - {{ $p.accessMode }}
+      {{- with ($p.storageClass | default $.Values.global.storageClass) }}
+      storageClassName: {{ . }}
+      {{- end }}
+      resources:
+        requests:
+          storage: {{ $p.size }}
+  [[- end ]]
+  [[- end ]]
+  [[- end ]]
+[[ end -]]
+
+[[- define "service" -]]
+apiVersion: v1
+kind: Service
+metadata:
+  name: [[ .Name ]]
+  labels:
+    {{- include "wutong.labels" . | nindent 4 }}
+    app.kubernetes.io/component: [[ .Name ]]
+spec:
+  [[- if .Stateful ]]
+  clusterIP: None
+  [[- end ]]
+  selector:
+    app.kubernetes.io/instance: {{ .Release.Name }}
+    app.kubernetes.io/component: [[ .Name ]]
+  ports:
+  [[- range .Ports ]]
+  - name: [[ .Name ]]
+    port: [[ .Port ]]
+    targetPort: [[ .Port ]]
+    protocol: [[ .Protocol ]]
+  [[- end ]]
+[[ end -]]
+
+[[- define "secret" -]]
+{{- $c := index .Values.components [[ quote .Name ]] }}
+apiVersion: v1
+kind: Secret
+metadata:
+  name: [[ .Name ]]-secrets
+  labels:
+    {{- include "wutong.labels" . | nindent 4 }}
+    app.kubernetes.io/component: [[ .Name ]]
+type: Opaque
+stringData:
+  {{- range $key, $value := $c.secretEnv }}
+  {{ $key }}: {{ $value | toString | quote }}
+  {{- end }}
+[[ end -]]
+
+[[- define "pvc" -]]
+{{- $c := index .Values.components [[ quote .Name ]] }}
+[[- range .Volumes ]]
+[[- if not .MemoryFS ]]
+{{- $p := index $c.persistence [[ quote .Name ]] }}
+---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: [[ .ClaimName ]]
+  labels:
+    {{- include "wutong.labels" . | nindent 4 }}
+spec:
+  accessModes:
+  - {{ $p.accessMode }}
+  {{- with ($p.storageClass | default $.Values.global.storageClass) }}
+  storageClassName: {{ . }}
+  {{- end }}
+  resources:
+    requests:
+      storage: {{ $p.size }}
+[[- end ]]
+[[- end ]]
+[[ end -]]
+
+[[- define "configfiles" -]]
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: [[ .Name ]]-config-files
+  labels:
+    {{- include "wutong.labels" . | nindent 4 }}
+data:
+  [[- $name := .Name ]]
+  [[- range .ConfigFiles ]]
+  [[ .Key ]]: {{ .Files.Get "files/[[ $name ]]/[[ .Key ]]" | quote }}
+  [[- end ]]
+[[ end -]]
+
+[[- define "ingress" -]]
+{{- $c := index .Values.components [[ quote .Name ]] }}
+{{- if $c.ingress.enabled }}
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: [[ .Name ]]
+  labels:
+    {{- include "wutong.labels" . | nindent 4 }}
+spec:
+  {{- with $c.ingress.className }}
+  ingressClassName: {{ . }}
+  {{- end }}
+  rules:
+  {{- range $c.ingress.hosts }}
+  - http:
+      paths:
+      - path: {{ .path }}
+        pathType: Prefix
+        backend:
+          service:
+            name: [[ .Name ]]
+            port:
+              number: {{ .port }}
+    {{- with .host }}
+    host: {{ . | quote }}
+    {{- end }}
+  {{- end }}
+{{- end }}
+[[ end -]]
+
+[[- define "monitoring" -]]
+{{- if .Values.monitoring.enabled }}
+[[- range .Monitors ]]
+---
+apiVersion: monitoring.coreos.com/v1
+kind: [[ .Kind ]]
+metadata:
+  name: [[ .Name ]]
+  labels:
+    {{- include "wutong.labels" $ | nindent 4 }}
+    app.kubernetes.io/component: [[ .Component ]]
+    {{- with $.Values.monitoring.labels }}
+    {{- toYaml . | nindent 4 }}
+    {{- end }}
+spec:
+  selector:
+    matchLabels:
+      app.kubernetes.io/instance: {{ $.Release.Name }}
+      app.kubernetes.io/component: [[ .Component ]]
+  [[ .EndpointsField ]]:
+  - [[ if .Service ]]port: [[ .PortName ]][[ else ]]targetPort: [[ .Port ]][[ end ]]
+    path: [[ quote .Path ]]
+    [[- if .Interval ]]
+    interval: [[ .Interval ]]
+    [[- end ]]
+[[- end ]]
+[[- if .Dashboard ]]
+{{- if .Values.monitoring.dashboard.enabled }}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-grafana-dashboard
+  labels:
+    {{- include "wutong.labels" . | nindent 4 }}
+    grafana_dashboard: "1"
+data:
+  [[ .Dashboard ]]: |-
+    {{- .Files.Get [[ quote (print "files/" .Dashboard) ]] | nindent 4 }}
+{{- end }}
+[[- end ]]
+{{- end }}
+[[ end -]]
+
+[[- define "configgroups" -]]
+{{- range $name, $items := .Values.installParams }}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config-group-{{ $name }}
+  labels:
+    {{- include "wutong.labels" $ | nindent 4 }}
+data:
+  {{- range $key, $value := $items }}
+  {{ $key }}: {{ $value | toString | quote }}
+  {{- end }}
+{{- end }}
+[[ end -]]
+`
+
+// helmComponent the template data of a component
+type helmComponent struct {
+	*k8sComponent
+	HasPersistentVolume bool
+	// HasPodVolumes whether the pod spec declares volumes, the persistent volumes of
+	// a StatefulSet are declared by its volumeClaimTemplates instead
+	HasPodVolumes bool
+}
+
+// helmMonitoring the template data of the monitors and the grafana dashboard,
+// Dashboard is the dashboard file under the chart files dir
+type helmMonitoring struct {
+	Monitors  []k8sMonitor
+	Dashboard string
+}
+
+// writeComponentTemplates render the chart templates, values.yaml and
+// values.schema.json from the ram components
+func (h *helmChartExporter) writeComponentTemplates(helmChartPath string, components []*k8sComponent, groups []k8sConfigGroup) error {
+	templatePath := path.Join(helmChartPath, "templates")
+	if err := os.MkdirAll(templatePath, 0755); err != nil {
+		return err
+	}
+	render := func(name string, data interface{}, file string) error {
+		var buf bytes.Buffer
+		if err := helmTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+			return fmt.Errorf("render helm template %s failure %s", file, err.Error())
+		}
+		return os.WriteFile(path.Join(templatePath, file), buf.Bytes(), 0644)
+	}
+	if err := render("helpers", nil, "_helpers.tpl"); err != nil {
+		return err
+	}
+	if len(groups) > 0 {
+		if err := render("configgroups", nil, "config-groups.yaml"); err != nil {
+			return err
+		}
+	}
+	for _, kc := range components {
+		data := &helmComponent{
+			k8sComponent:        kc,
+			HasPersistentVolume: kc.hasPersistentVolume(),
+			HasPodVolumes:       len(kc.ConfigFiles) > 0 || len(kc.SharedMount) > 0 || (!kc.Stateful && len(kc.Volumes) > 0),
+		}
+		for _, vol := range kc.Volumes {
+			if vol.MemoryFS {
+				data.HasPodVolumes = true
+			}
+		}
+		if err := render("workload", data, kc.Name+"-workload.yaml"); err != nil {
+			return err
+		}
+		if len(kc.SecretEnvs) > 0 && !h.externalSecrets {
+			if err := render("secret", data, kc.Name+"-secret.yaml"); err != nil {
+				return err
+			}
+		}
+		if len(kc.Ports) > 0 {
+			if err := render("service", data, kc.Name+"-service.yaml"); err != nil {
+				return err
+			}
+		}
+		if !kc.Stateful && kc.hasPersistentVolume() {
+			if err := render("pvc", data, kc.Name+"-pvc.yaml"); err != nil {
+				return err
+			}
+		}
+		if len(kc.ConfigFiles) > 0 {
+			filesPath := path.Join(helmChartPath, "files", kc.Name)
+			if err := os.MkdirAll(filesPath, 0755); err != nil {
+				return err
+			}
+			for _, cf := range kc.ConfigFiles {
+				if err := os.WriteFile(path.Join(filesPath, cf.Key), []byte(cf.Content), 0644); err != nil {
+					return err
+				}
+			}
+			if err := render("configfiles", data, kc.Name+"-config-files.yaml"); err != nil {
+				return err
+			}
+		}
+		if len(kc.Ingresses) > 0 {
+			if err := render("ingress", data, kc.Name+"-ingress.yaml"); err != nil {
+				return err
+			}
+		}
+	}
+
+	values := buildHelmValues(components, groups, h.externalSecrets)
+	monitoring := helmMonitoring{}
+	for _, kc := range components {
+		monitoring.Monitors = append(monitoring.Monitors, componentMonitors(kc)...)
+	}
+	dashboard, err := grafanaDashboardJSON(h.ram)
+	if err != nil {
+		return err
+	}
+	if dashboard != nil {
+		monitoring.Dashboard = grafanaDashboardFile(h.ram)
+		if err := os.MkdirAll(path.Join(helmChartPath, "files"), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path.Join(helmChartPath, "files", monitoring.Dashboard), dashboard, 0644); err != nil {
+			return err
+		}
+	}
+	if len(monitoring.Monitors) > 0 || monitoring.Dashboard != "" {
+		if err := render("monitoring", monitoring, "monitoring.yaml"); err != nil {
+			return err
+		}
+		values["monitoring"] = map[string]interface{}{
+			"enabled":   true,
+			"labels":    map[string]interface{}{},
+			"dashboard": map[string]interface{}{"enabled": monitoring.Dashboard != ""},
+		}
+	}
+	valuesYaml, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path.Join(helmChartPath, "values.yaml"), valuesYaml, 0644); err != nil {
+		return err
+	}
+	schema, err := json.MarshalIndent(buildValuesSchema(values), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(helmChartPath, "values.schema.json"), schema, 0644)
+}
+
+// buildHelmValues the default values of the chart, only the keys of the
+// generated secrets are kept if the Secrets are external
+func buildHelmValues(components []*k8sComponent, groups []k8sConfigGroup, externalSecrets bool) map[string]interface{} {
+	values := map[string]interface{}{
+		"global": map[string]interface{}{
+			"storageClass": "",
+		},
+	}
+	installParams := make(map[string]interface{}, len(groups))
+	for _, group := range groups {
+		items := make(map[string]interface{}, len(group.Items))
+		for k, v := range group.Items {
+			items[k] = v
+		}
+		installParams[group.Name] = items
+	}
+	values["installParams"] = installParams
+
+	componentValues := make(map[string]interface{}, len(components))
+	for _, kc := range components {
+		// generated secrets are rendered into the Secret of the component
+		env := make(map[string]interface{}, len(kc.Envs))
+		secretEnv := make(map[string]interface{}, len(kc.SecretEnvs))
+		for k, v := range kc.Envs {
+			if containsString(kc.SecretEnvs, k) {
+				secretEnv[k] = v
+				if externalSecrets {
+					secretEnv[k] = ""
+				}
+				continue
+			}
+			env[k] = v
+		}
+		resources := make(map[string]interface{})
+		limits := make(map[string]interface{})
+		if kc.Memory > 0 {
+			limits["memory"] = fmt.Sprintf("%dMi", kc.Memory)
+		}
+		if kc.CPU > 0 {
+			limits["cpu"] = fmt.Sprintf("%dm", kc.CPU)
+		}
+		if len(limits) > 0 {
+			resources["limits"] = limits
+		}
+		persistence := make(map[string]interface{})
+		for _, vol := range kc.Volumes {
+			if vol.MemoryFS {
+				continue
+			}
+			persistence[vol.Name] = map[string]interface{}{
+				"size":         vol.Size,
+				"storageClass": "",
+				"accessMode":   vol.AccessMode,
+			}
+		}
+		hosts := []interface{}{}
+		for _, ing := range kc.Ingresses {
+			hosts = append(hosts, map[string]interface{}{
+				"host": "",
+				"path": ing.Path,
+				"port": ing.Port,
+			})
+		}
+		componentValues[kc.Name] = map[string]interface{}{
+			"image": map[string]interface{}{
+				"repository": kc.Repository,
+				"tag":        kc.Tag,
+				"pullPolicy": "IfNotPresent",
+			},
+			"replicas":    kc.Replicas,
+			"annotations": map[string]interface{}{},
+			"resources":   resources,
+			"env":         env,
+			"secretEnv":   secretEnv,
+			"persistence": persistence,
+			"ingress": map[string]interface{}{
+				"enabled":   len(hosts) > 0,
+				"className": "",
+				"hosts":     hosts,
+			},
+		}
+	}
+	values["components"] = componentValues
+	return values
+}
+
+// buildValuesSchema json schema of the values, inferred from the default values
+func buildValuesSchema(values map[string]interface{}) map[string]interface{} {
+	schema := inferSchema(values)
+	schema["$schema"] = "https://json-schema.org/draft-07/schema#"
+	return schema
+}
+
+var valuesEnums = map[string][]string{
+	"pullPolicy": {"Always", "IfNotPresent", "Never"},
+	"accessMode": {"ReadWriteOnce", "ReadWriteMany", "ReadOnlyMany"},
+}
+
+func inferSchema(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties := make(map[string]interface{}, len(v))
+		var required []string
+		for key, item := range v {
+			properties[key] = inferSchema(item)
+			if enum, ok := valuesEnums[key]; ok {
+				properties[key] = map[string]interface{}{"type": "string", "enum": enum}
+			}
+			if _, ok := item.(map[string]interface{}); ok {
+				required = append(required, key)
+			}
+		}
+		schema := map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		}
+		if len(required) > 0 {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+		return schema
+	case []interface{}:
+		schema := map[string]interface{}{"type": "array"}
+		if len(v) > 0 {
+			schema["items"] = inferSchema(v[0])
+		}
+		return schema
+	case string:
+		// helm --set parses numeric strings such as image tags as numbers
+		return map[string]interface{}{"type": []string{"string", "number"}}
+	case bool:
+		return map[string]interface{}{"type": "boolean"}
+	case int:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	default:
+		return map[string]interface{}{}
+	}
+}
@@ -0,0 +1,84 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+func TestWriteComponentTemplates(t *testing.T) {
+	chartPath := t.TempDir()
+	h := &helmChartExporter{logger: logrus.New(), ram: testRAM(), opts: newOptions()}
+	components, groups, err := newK8sComponents(h.ram, h.opts.secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.writeComponentTemplates(chartPath, components, groups); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{
+		"values.yaml",
+		"values.schema.json",
+		"templates/_helpers.tpl",
+		"templates/config-groups.yaml",
+		"templates/web-workload.yaml",
+		"templates/web-service.yaml",
+		"templates/web-secret.yaml",
+		"templates/web-pvc.yaml",
+		"templates/web-ingress.yaml",
+		"templates/web-config-files.yaml",
+		"templates/mysql-workload.yaml",
+		"files/web/etc-web-app.conf",
+	} {
+		if !CheckFileExist(path.Join(chartPath, file)) {
+			t.Errorf("chart file %s is not generated", file)
+		}
+	}
+
+	body, err := os.ReadFile(path.Join(chartPath, "values.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values struct {
+		Components map[string]struct {
+			Image struct {
+				Repository string `json:"repository"`
+				Tag        string `json:"tag"`
+			} `json:"image"`
+			Replicas  int               `json:"replicas"`
+			Env       map[string]string `json:"env"`
+			SecretEnv map[string]string `json:"secretEnv"`
+		} `json:"components"`
+	}
+	if err := yaml.Unmarshal(body, &values); err != nil {
+		t.Fatal(err)
+	}
+	web := values.Components["web"]
+	if web.Image.Repository != "hub.example.com/demo/web" || web.Image.Tag != "v1" || web.Replicas != 2 {
+		t.Errorf("unexpected web values %+v", web)
+	}
+	if _, ok := web.Env["MYSQL_PASSWORD"]; ok || web.SecretEnv["MYSQL_PASSWORD"] == "" {
+		t.Errorf("expect the generated password in secretEnv, got env %v secretEnv %v", web.Env, web.SecretEnv)
+	}
+}
@@ -0,0 +1,398 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+)
+
+// k8sComponent the kubernetes view of a ram component, shared by the exporters
+// that render kubernetes manifests
+type k8sComponent struct {
+	Name        string
+	Component   *v1alpha1.Component
+	Repository  string
+	Tag         string
+	Replicas    int
+	Stateful    bool
+	Memory      int
+	CPU         int
+	Envs        map[string]string
+	Ports       []k8sPort
+	Volumes     []k8sVolume
+	ConfigFiles []k8sConfigFile
+	SharedMount []k8sSharedMount
+	// ConfigGroups names of the app config groups injected into the component
+	ConfigGroups []string
+	// SecretEnvs names of the envs whose values are generated secrets
+	SecretEnvs []string
+	// Secrets names of the Secrets injected into the component as envs
+	Secrets   []string
+	Ingresses []k8sIngress
+}
+
+type k8sPort struct {
+	Name     string
+	Port     int
+	Protocol string
+	IsOuter  bool
+}
+
+type k8sVolume struct {
+	Name       string
+	MountPath  string
+	Size       string
+	AccessMode string
+	MemoryFS   bool
+	ClaimName  string
+}
+
+type k8sConfigFile struct {
+	Key       string
+	MountPath string
+	Content   string
+	Mode      *int
+}
+
+type k8sSharedMount struct {
+	ClaimName string
+	MountPath string
+}
+
+type k8sIngress struct {
+	Path string
+	Port int
+}
+
+// k8sConfigGroup app config group rendered as a ConfigMap
+type k8sConfigGroup struct {
+	Name  string
+	Items map[string]string
+}
+
+// newK8sComponents convert the ram components to their kubernetes view
+func newK8sComponents(ram v1alpha1.WutongApplicationConfig, secrets *secret.Store) ([]*k8sComponent, []k8sConfigGroup, error) {
+	names := make(map[string]string, len(ram.Components))
+	set := make(map[string]struct{})
+	for _, cpt := range ram.Components {
+		name := k8sName(composeName(cpt.ServiceCname))
+		if name == "" {
+			name = k8sName(cpt.ServiceAlias)
+		}
+		names[cpt.ServiceShareID] = uniqueName(name, cpt.ComponentKey, set)
+	}
+
+	var groups []k8sConfigGroup
+	componentGroups := make(map[string][]string)
+	for _, group := range ram.AppConfigGroups {
+		name := k8sName(group.Name)
+		groups = append(groups, k8sConfigGroup{Name: name, Items: group.ConfigItems})
+		for _, key := range group.ComponentKeys {
+			componentGroups[key] = append(componentGroups[key], name)
+		}
+	}
+
+	// the volume names are unique within the pod of the component, the
+	// config files and the shared mounts take the other pod volumes
+	volumeNames := make(map[string]string)
+	for _, cpt := range ram.Components {
+		set := map[string]struct{}{"config-files": {}}
+		for i := range cpt.MntReleationList {
+			set[fmt.Sprintf("shared-%d", i)] = struct{}{}
+		}
+		for _, vol := range cpt.ServiceVolumeMapList {
+			if vol.VolumeType == v1alpha1.ConfigFileVolumeType {
+				continue
+			}
+			name := k8sName(composeName(vol.VolumeName))
+			if name == "" {
+				name = "volume"
+			}
+			volumeNames[cpt.ServiceShareID+vol.VolumeName] = uniqueName(name, cpt.ComponentKey+"/"+vol.VolumeName, set)
+		}
+	}
+	// volumes owned by components of deployments can be mounted by other components,
+	// the claims of statefulsets are per pod and config files are no claims
+	claims := make(map[string]string)
+	for _, cpt := range ram.Components {
+		if cpt.DeployType == v1alpha1.StateMultipleDeployType || cpt.DeployType == v1alpha1.StateSingletonDeployType {
+			continue
+		}
+		for _, vol := range cpt.ServiceVolumeMapList {
+			if vol.VolumeType == v1alpha1.ConfigFileVolumeType || vol.VolumeType == v1alpha1.MemoryFSVolumeType {
+				continue
+			}
+			claims[cpt.ServiceShareID+vol.VolumeName] = names[cpt.ServiceShareID] + "-" + volumeNames[cpt.ServiceShareID+vol.VolumeName]
+		}
+	}
+
+	var components []*k8sComponent
+	for _, cpt := range ram.Components {
+		image := cpt.ShareImage
+		if image == "" {
+			image = cpt.Image
+		}
+		repository, tag := splitImage(image)
+		envs, secretEnvs, err := componentEnvs(cpt, ram.Components, secrets)
+		if err != nil {
+			return nil, nil, err
+		}
+		replicas := cpt.ExtendMethodRule.MinNode
+		if replicas < 1 {
+			replicas = 1
+		}
+		kc := &k8sComponent{
+			Name:         names[cpt.ServiceShareID],
+			Component:    cpt,
+			Repository:   repository,
+			Tag:          tag,
+			Replicas:     replicas,
+			Stateful:     cpt.DeployType == v1alpha1.StateMultipleDeployType || cpt.DeployType == v1alpha1.StateSingletonDeployType,
+			Memory:       cpt.Memory,
+			CPU:          cpt.CPU,
+			Envs:         envs,
+			SecretEnvs:   secretEnvs,
+			ConfigGroups: componentGroups[cpt.ComponentKey],
+		}
+		portNames := make(map[string]struct{})
+		for _, port := range cpt.Ports {
+			name := k8sPortName(port)
+			if _, exists := portNames[name]; exists {
+				name = fmt.Sprintf("port-%d", port.ContainerPort)
+			}
+			portNames[name] = struct{}{}
+			kc.Ports = append(kc.Ports, k8sPort{
+				Name:     name,
+				Port:     port.ContainerPort,
+				Protocol: k8sProtocol(port.Protocol),
+				IsOuter:  port.IsOuter,
+			})
+		}
+		for _, vol := range cpt.ServiceVolumeMapList {
+			if vol.VolumeType == v1alpha1.ConfigFileVolumeType {
+				kc.ConfigFiles = append(kc.ConfigFiles, k8sConfigFile{
+					Key:       configFileKey(vol.VolumeMountPath),
+					MountPath: vol.VolumeMountPath,
+					Content:   vol.FileConent,
+					Mode:      vol.Mode,
+				})
+				continue
+			}
+			volumeName := volumeNames[cpt.ServiceShareID+vol.VolumeName]
+			kc.Volumes = append(kc.Volumes, k8sVolume{
+				Name:       volumeName,
+				MountPath:  vol.VolumeMountPath,
+				Size:       volumeSize(vol.VolumeCapacity),
+				AccessMode: k8sAccessMode(vol.AccessMode),
+				MemoryFS:   vol.VolumeType == v1alpha1.MemoryFSVolumeType,
+				ClaimName:  kc.Name + "-" + volumeName,
+			})
+		}
+		for _, dvol := range cpt.MntReleationList {
+			claim, ok := claims[dvol.ShareServiceUUID+dvol.VolumeName]
+			if !ok {
+				logrus.Warningf("[k8sComponent] dependent volume(%s/%s) not found or not shareable", dvol.ShareServiceUUID, dvol.VolumeName)
+				continue
+			}
+			kc.SharedMount = append(kc.SharedMount, k8sSharedMount{ClaimName: claim, MountPath: dvol.VolumeMountDir})
+		}
+		for _, route := range ram.IngressHTTPRoutes {
+			if route.ComponentKey != cpt.ComponentKey {
+				continue
+			}
+			location := route.Location
+			if location == "" {
+				location = "/"
+			}
+			kc.Ingresses = append(kc.Ingresses, k8sIngress{Path: location, Port: int(route.Port)})
+		}
+		components = append(components, kc)
+	}
+	return components, groups, nil
+}
+
+// uniqueName make name unique in set and add it, the suffix is derived from
+// seed so that every export of the app gives the same names
+func uniqueName(name, seed string, set map[string]struct{}) string {
+	base := name
+	for i := 0; ; i++ {
+		if _, exists := set[name]; !exists {
+			break
+		}
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", seed, i)))
+		name = base + "-" + hex.EncodeToString(sum[:])[:4]
+	}
+	set[name] = struct{}{}
+	return name
+}
+
+// componentEnvs the component envs, its connection info and the connection info
+// of its dependencies, the names of the envs set to generated secrets are returned too
+func componentEnvs(cpt *v1alpha1.Component, components []*v1alpha1.Component, secrets *secret.Store) (map[string]string, []string, error) {
+	envs := make(map[string]string, 10)
+	generated := make(map[string]bool)
+	if len(cpt.Ports) > 0 {
+		envs["PORT"] = fmt.Sprintf("%d", cpt.Ports[0].ContainerPort)
+	}
+	for _, item := range append(cpt.Envs, cpt.ServiceConnectInfoMapList...) {
+		value, isSecret, err := secrets.Resolve(cpt.ComponentKey, item.AttrName, item.AttrValue)
+		if err != nil {
+			return nil, nil, err
+		}
+		envs[item.AttrName] = value
+		generated[item.AttrName] = isSecret
+	}
+	for _, item := range cpt.DepServiceMapList {
+		depEnvs, err := getPublicEnvByKey(item.DepServiceKey, components, secrets)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, dep := range components {
+			if dep.ComponentKey != item.DepServiceKey && dep.ServiceShareID != item.DepServiceKey {
+				continue
+			}
+			for _, info := range dep.ServiceConnectInfoMapList {
+				generated[info.AttrName] = info.AttrValue == secret.Placeholder
+			}
+		}
+		for k, v := range depEnvs {
+			envs[k] = v
+		}
+	}
+	for key, value := range envs {
+		envs[key] = util.ParseVariable(value, envs)
+	}
+	var secretEnvs []string
+	for key, isSecret := range generated {
+		if isSecret {
+			secretEnvs = append(secretEnvs, key)
+		}
+	}
+	sort.Strings(secretEnvs)
+	return envs, secretEnvs, nil
+}
+
+// hasPersistentVolume whether the component needs a persistent volume claim
+func (k *k8sComponent) hasPersistentVolume() bool {
+	for _, vol := range k.Volumes {
+		if !vol.MemoryFS {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedEnvKeys env names in a stable order
+func (k *k8sComponent) sortedEnvKeys() []string {
+	keys := make([]string, 0, len(k.Envs))
+	for key := range k.Envs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// k8sName convert the name to a DNS-1123 label
+func k8sName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	res := strings.Trim(b.String(), "-")
+	for strings.Contains(res, "--") {
+		res = strings.ReplaceAll(res, "--", "-")
+	}
+	if len(res) > 53 {
+		res = strings.TrimRight(res[:53], "-")
+	}
+	return res
+}
+
+func k8sPortName(port v1alpha1.ComponentPort) string {
+	name := k8sName(port.PortAlias)
+	if name == "" {
+		name = fmt.Sprintf("port-%d", port.ContainerPort)
+	}
+	if len(name) > 15 {
+		name = strings.TrimRight(name[:15], "-")
+	}
+	return name
+}
+
+func k8sProtocol(protocol string) string {
+	if strings.ToLower(protocol) == "udp" {
+		return "UDP"
+	}
+	return "TCP"
+}
+
+func k8sAccessMode(mode v1alpha1.AccessMode) string {
+	switch mode {
+	case v1alpha1.RWXAccessMode:
+		return "ReadWriteMany"
+	case v1alpha1.ROXAccessMode:
+		return "ReadOnlyMany"
+	default:
+		return "ReadWriteOnce"
+	}
+}
+
+// volumeSize volume capacity is in GB, an unlimited volume gets 1Gi
+func volumeSize(capacity int) string {
+	if capacity <= 0 {
+		return "1Gi"
+	}
+	return fmt.Sprintf("%dGi", capacity)
+}
+
+// configFileKey ConfigMap key of the config file mounted at mountPath
+func configFileKey(mountPath string) string {
+	key := strings.Trim(strings.ReplaceAll(mountPath, "/", "-"), "-")
+	if key == "" {
+		key = path.Base(mountPath)
+	}
+	return key
+}
+
+// splitImage split the image to repository and tag
+func splitImage(image string) (string, string) {
+	if i := strings.Index(image, "@"); i > 0 {
+		return image[:i], image[i+1:]
+	}
+	slash := strings.LastIndex(image, "/")
+	if i := strings.LastIndex(image, ":"); i > slash {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
@@ -0,0 +1,429 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+// k8sManifest kubernetes objects written into one yaml file
+type k8sManifest struct {
+	Name    string
+	Objects []*unstructured.Unstructured
+}
+
+// renderK8sManifests render the kubernetes objects of the app, one manifest
+// per component, one for the app config groups, one for the monitors and the grafana
+// dashboard and one per kind of the app k8s resources
+func renderK8sManifests(ram v1alpha1.WutongApplicationConfig, secrets *secret.Store) ([]k8sManifest, error) {
+	components, groups, err := newK8sComponents(ram, secrets)
+	if err != nil {
+		return nil, err
+	}
+	return renderManifests(ram, components, groups)
+}
+
+// renderManifests render the kubernetes objects of the converted components and config groups
+func renderManifests(ram v1alpha1.WutongApplicationConfig, components []*k8sComponent, groups []k8sConfigGroup) ([]k8sManifest, error) {
+	var manifests []k8sManifest
+	if len(groups) > 0 {
+		manifest := k8sManifest{Name: "config-groups"}
+		for _, group := range groups {
+			obj, err := toUnstructured(&corev1.ConfigMap{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+				ObjectMeta: objectMeta(ram, "config-group-"+group.Name, ""),
+				Data:       group.Items,
+			})
+			if err != nil {
+				return nil, err
+			}
+			manifest.Objects = append(manifest.Objects, obj)
+		}
+		manifests = append(manifests, manifest)
+	}
+	for _, kc := range components {
+		objects, err := renderComponent(ram, kc)
+		if err != nil {
+			return nil, fmt.Errorf("render component %s failure %s", kc.Name, err.Error())
+		}
+		manifests = append(manifests, k8sManifest{Name: kc.Name, Objects: objects})
+	}
+	if monitoring, ok, err := renderMonitoring(ram, components); err != nil {
+		return nil, err
+	} else if ok {
+		manifests = append(manifests, monitoring)
+	}
+	resources, err := k8sResourceObjects(ram.K8sResources)
+	if err != nil {
+		return nil, err
+	}
+	kinds := make(map[string]int)
+	for _, obj := range resources {
+		idx, ok := kinds[obj.GetKind()]
+		if !ok {
+			idx = len(manifests)
+			kinds[obj.GetKind()] = idx
+			manifests = append(manifests, k8sManifest{Name: obj.GetKind()})
+		}
+		manifests[idx].Objects = append(manifests[idx].Objects, obj)
+	}
+	return manifests, nil
+}
+
+// k8sResourceObjects parse the app k8s resources and strip the cluster specific fields
+func k8sResourceObjects(resources []*v1alpha1.K8sResource) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+	for _, k8sResource := range resources {
+		var obj unstructured.Unstructured
+		if err := yaml.Unmarshal([]byte(k8sResource.Content), &obj); err != nil {
+			return nil, err
+		}
+		obj.SetNamespace("")
+		obj.SetResourceVersion("")
+		obj.SetCreationTimestamp(metav1.Time{})
+		obj.SetUID("")
+		objects = append(objects, &obj)
+	}
+	return objects, nil
+}
+
+func renderComponent(ram v1alpha1.WutongApplicationConfig, kc *k8sComponent) ([]*unstructured.Unstructured, error) {
+	var objects []runtime.Object
+	labels := map[string]string{
+		"app.kubernetes.io/instance":  k8sName(ram.AppName),
+		"app.kubernetes.io/component": kc.Name,
+	}
+	container := corev1.Container{
+		Name:            kc.Name,
+		Image:           kc.Repository + imageTagSeparator(kc.Tag) + kc.Tag,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Args:            strings.Fields(kc.Component.Cmd),
+		Resources:       resourceRequirements(kc.Memory, kc.CPU),
+	}
+	for _, port := range kc.Ports {
+		container.Ports = append(container.Ports, corev1.ContainerPort{
+			Name:          port.Name,
+			ContainerPort: int32(port.Port),
+			Protocol:      corev1.Protocol(port.Protocol),
+		})
+	}
+	// generated secrets are kept in a Secret of the component and referenced by the envs
+	secretEnvs := make(map[string]string)
+	for _, key := range kc.SecretEnvs {
+		if value, ok := kc.Envs[key]; ok {
+			secretEnvs[key] = value
+		}
+	}
+	for _, key := range kc.sortedEnvKeys() {
+		if _, ok := secretEnvs[key]; ok {
+			container.Env = append(container.Env, corev1.EnvVar{Name: key, ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: kc.Name + "-secrets"},
+					Key:                  key,
+				},
+			}})
+			continue
+		}
+		container.Env = append(container.Env, corev1.EnvVar{Name: key, Value: kc.Envs[key]})
+	}
+	if len(secretEnvs) > 0 {
+		objects = append(objects, &corev1.Secret{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+			ObjectMeta: objectMeta(ram, kc.Name+"-secrets", kc.Name),
+			Type:       corev1.SecretTypeOpaque,
+			StringData: secretEnvs,
+		})
+	}
+	for _, group := range kc.ConfigGroups {
+		container.EnvFrom = append(container.EnvFrom, corev1.EnvFromSource{
+			ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "config-group-" + group}},
+		})
+	}
+	for _, secret := range kc.Secrets {
+		container.EnvFrom = append(container.EnvFrom, corev1.EnvFromSource{
+			SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: secret}},
+		})
+	}
+
+	var (
+		volumes     []corev1.Volume
+		claims      []corev1.PersistentVolumeClaim
+		claimsOwned []runtime.Object
+	)
+	for _, vol := range kc.Volumes {
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: vol.Name, MountPath: vol.MountPath})
+		if vol.MemoryFS {
+			volumes = append(volumes, corev1.Volume{
+				Name:         vol.Name,
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+			})
+			continue
+		}
+		claim := corev1.PersistentVolumeClaim{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+			ObjectMeta: metav1.ObjectMeta{Name: vol.Name},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.PersistentVolumeAccessMode(vol.AccessMode)},
+				Resources: corev1.VolumeResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(vol.Size)},
+				},
+			},
+		}
+		if kc.Stateful {
+			claim.TypeMeta = metav1.TypeMeta{}
+			claims = append(claims, claim)
+			continue
+		}
+		claim.ObjectMeta = objectMeta(ram, vol.ClaimName, kc.Name)
+		claimsOwned = append(claimsOwned, &claim)
+		volumes = append(volumes, corev1.Volume{
+			Name:         vol.Name,
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: vol.ClaimName}},
+		})
+	}
+	if len(kc.ConfigFiles) > 0 {
+		configMap := &corev1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: objectMeta(ram, kc.Name+"-config-files", kc.Name),
+			Data:       make(map[string]string, len(kc.ConfigFiles)),
+		}
+		for _, cf := range kc.ConfigFiles {
+			configMap.Data[cf.Key] = cf.Content
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: "config-files", MountPath: cf.MountPath, SubPath: cf.Key})
+		}
+		objects = append(objects, configMap)
+		volumes = append(volumes, corev1.Volume{
+			Name: "config-files",
+			VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: kc.Name + "-config-files"},
+			}},
+		})
+	}
+	for i, mount := range kc.SharedMount {
+		name := fmt.Sprintf("shared-%d", i)
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: name, MountPath: mount.MountPath})
+		volumes = append(volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: mount.ClaimName}},
+		})
+	}
+	objects = append(objects, claimsOwned...)
+
+	replicas := int32(kc.Replicas)
+	podTemplate := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: labels},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{container},
+			Volumes:    volumes,
+		},
+	}
+	if kc.Stateful {
+		objects = append(objects, &appsv1.StatefulSet{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+			ObjectMeta: objectMeta(ram, kc.Name, kc.Name),
+			Spec: appsv1.StatefulSetSpec{
+				Replicas:             &replicas,
+				ServiceName:          kc.Name,
+				Selector:             &metav1.LabelSelector{MatchLabels: labels},
+				Template:             podTemplate,
+				VolumeClaimTemplates: claims,
+			},
+		})
+	} else {
+		objects = append(objects, &appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: objectMeta(ram, kc.Name, kc.Name),
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: podTemplate,
+			},
+		})
+	}
+
+	if len(kc.Ports) > 0 {
+		service := &corev1.Service{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+			ObjectMeta: objectMeta(ram, kc.Name, kc.Name),
+			Spec:       corev1.ServiceSpec{Selector: labels},
+		}
+		if kc.Stateful {
+			service.Spec.ClusterIP = corev1.ClusterIPNone
+		}
+		for _, port := range kc.Ports {
+			service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+				Name:       port.Name,
+				Port:       int32(port.Port),
+				TargetPort: intstr.FromInt(port.Port),
+				Protocol:   corev1.Protocol(port.Protocol),
+			})
+		}
+		objects = append(objects, service)
+	}
+
+	if len(kc.Ingresses) > 0 {
+		pathType := networkingv1.PathTypePrefix
+		ingress := &networkingv1.Ingress{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "Ingress"},
+			ObjectMeta: objectMeta(ram, kc.Name, kc.Name),
+		}
+		for _, ing := range kc.Ingresses {
+			ingress.Spec.Rules = append(ingress.Spec.Rules, networkingv1.IngressRule{
+				IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{{
+						Path:     ing.Path,
+						PathType: &pathType,
+						Backend: networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{
+							Name: kc.Name,
+							Port: networkingv1.ServiceBackendPort{Number: int32(ing.Port)},
+						}},
+					}},
+				}},
+			})
+		}
+		objects = append(objects, ingress)
+	}
+
+	var res []*unstructured.Unstructured
+	for _, obj := range objects {
+		u, err := toUnstructured(obj)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, u)
+	}
+	return res, nil
+}
+
+func objectMeta(ram v1alpha1.WutongApplicationConfig, name, component string) metav1.ObjectMeta {
+	meta := metav1.ObjectMeta{
+		Name: name,
+		Labels: map[string]string{
+			"app.kubernetes.io/instance": k8sName(ram.AppName),
+		},
+	}
+	if component != "" {
+		meta.Labels["app.kubernetes.io/component"] = component
+	}
+	return meta
+}
+
+// resourceRequirements component memory is in MB and cpu in millicores, 0 means unlimited
+func resourceRequirements(memory, cpu int) corev1.ResourceRequirements {
+	var res corev1.ResourceRequirements
+	if memory <= 0 && cpu <= 0 {
+		return res
+	}
+	res.Limits = corev1.ResourceList{}
+	if memory > 0 {
+		res.Limits[corev1.ResourceMemory] = resource.MustParse(fmt.Sprintf("%dMi", memory))
+	}
+	if cpu > 0 {
+		res.Limits[corev1.ResourceCPU] = resource.MustParse(fmt.Sprintf("%dm", cpu))
+	}
+	return res
+}
+
+func imageTagSeparator(tag string) string {
+	if strings.HasPrefix(tag, "sha256:") {
+		return "@"
+	}
+	return ":"
+}
+
+// toUnstructured convert the typed object, the empty status and creation
+// timestamps of the typed object are removed
+func toUnstructured(obj runtime.Object) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	unstructured.RemoveNestedField(u.Object, "status")
+	unstructured.RemoveNestedField(u.Object, "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(u.Object, "spec", "template", "metadata", "creationTimestamp")
+	if templates, ok, _ := unstructured.NestedSlice(u.Object, "spec", "volumeClaimTemplates"); ok {
+		for _, t := range templates {
+			if m, ok := t.(map[string]interface{}); ok {
+				unstructured.RemoveNestedField(m, "status")
+				unstructured.RemoveNestedField(m, "metadata", "creationTimestamp")
+			}
+		}
+		unstructured.SetNestedSlice(u.Object, templates, "spec", "volumeClaimTemplates")
+	}
+	return u, nil
+}
+
+// manifestImages the container images referenced by the kubernetes objects
+func manifestImages(manifests []k8sManifest) []string {
+	set := make(map[string]struct{})
+	for _, manifest := range manifests {
+		for _, obj := range manifest.Objects {
+			for _, podSpec := range [][]string{
+				{"spec"},
+				{"spec", "template", "spec"},
+				{"spec", "jobTemplate", "spec", "template", "spec"},
+			} {
+				for _, field := range []string{"containers", "initContainers"} {
+					containers, _, _ := unstructured.NestedSlice(obj.Object, append(podSpec, field)...)
+					for _, c := range containers {
+						if m, ok := c.(map[string]interface{}); ok {
+							if image, ok := m["image"].(string); ok && image != "" {
+								set[image] = struct{}{}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	images := make([]string, 0, len(set))
+	for image := range set {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images
+}
+
+// marshalManifest the objects as a multi-document yaml
+func marshalManifest(manifest k8sManifest) ([]byte, error) {
+	var docs []string
+	for _, obj := range manifest.Objects {
+		body, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, string(body))
+	}
+	return []byte(strings.Join(docs, "---\n")), nil
+}
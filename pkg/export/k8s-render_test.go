@@ -0,0 +1,158 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRenderK8sManifests(t *testing.T) {
+	ram := testRAM()
+	ram.K8sResources = []*v1alpha1.K8sResource{{
+		Name: "redis",
+		Kind: "Deployment",
+		Content: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: redis
+  namespace: wt-demo
+  uid: 1234
+spec:
+  template:
+    spec:
+      containers:
+      - name: redis
+        image: redis:6
+`,
+	}}
+	manifests, err := renderK8sManifests(ram, secret.NewStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string][]string)
+	for _, manifest := range manifests {
+		for _, obj := range manifest.Objects {
+			kinds[manifest.Name] = append(kinds[manifest.Name], obj.GetKind())
+			if obj.GetNamespace() != "" || obj.GetUID() != "" {
+				t.Errorf("%s/%s keeps cluster fields", obj.GetKind(), obj.GetName())
+			}
+		}
+	}
+	expect := map[string][]string{
+		"config-groups": {"ConfigMap"},
+		"web":           {"Secret", "ConfigMap", "PersistentVolumeClaim", "Deployment", "Service", "Ingress"},
+		"mysql":         {"Secret", "StatefulSet", "Service"},
+		"Deployment":    {"Deployment"},
+	}
+	if !reflect.DeepEqual(kinds, expect) {
+		t.Errorf("expect manifests %v, got %v", expect, kinds)
+	}
+
+	// the generated password is referenced from the Secret, never inlined
+	for _, manifest := range manifests {
+		for _, obj := range manifest.Objects {
+			if obj.GetKind() != "Deployment" && obj.GetKind() != "StatefulSet" {
+				continue
+			}
+			containers, _, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+			envs, _, _ := unstructured.NestedSlice(containers[0].(map[string]interface{}), "env")
+			for _, env := range envs {
+				env := env.(map[string]interface{})
+				if env["name"] != "MYSQL_PASSWORD" {
+					continue
+				}
+				ref, _, _ := unstructured.NestedString(env, "valueFrom", "secretKeyRef", "name")
+				if _, inline := env["value"]; inline || ref != manifest.Name+"-secrets" {
+					t.Errorf("%s: MYSQL_PASSWORD is not referenced from the Secret: %v", manifest.Name, env)
+				}
+			}
+		}
+	}
+
+	images := manifestImages(manifests)
+	if !reflect.DeepEqual(images, []string{"hub.example.com/demo/web:v1", "mysql:5.7", "redis:6"}) {
+		t.Errorf("unexpected images %v", images)
+	}
+}
+
+func TestK8sComponentNamesStable(t *testing.T) {
+	ram := testRAM()
+	ram.Components[1].ServiceCname = "web"
+	names := func() []string {
+		components, _, err := newK8sComponents(ram, secret.NewStore())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res []string
+		for _, kc := range components {
+			res = append(res, kc.Name)
+		}
+		return res
+	}
+	first := names()
+	if first[0] != "web" || first[1] == "web" {
+		t.Fatalf("expect unique names, got %v", first)
+	}
+	if second := names(); !reflect.DeepEqual(first, second) {
+		t.Errorf("names differ between exports: %v and %v", first, second)
+	}
+}
+
+func TestK8sVolumes(t *testing.T) {
+	ram := testRAM()
+	web, mysql := ram.Components[0], ram.Components[1]
+	web.ServiceVolumeMapList = append(web.ServiceVolumeMapList,
+		v1alpha1.ComponentVolume{VolumeName: "数据", VolumeType: v1alpha1.ShareFileVolumeType, VolumeMountPath: "/shuju"},
+		v1alpha1.ComponentVolume{VolumeName: "data_1", VolumeType: v1alpha1.ShareFileVolumeType, VolumeMountPath: "/data1"},
+		v1alpha1.ComponentVolume{VolumeName: "data-1", VolumeType: v1alpha1.ShareFileVolumeType, VolumeMountPath: "/data2"},
+	)
+	// config files and the claims of statefulsets can not be shared
+	mysql.MntReleationList = []v1alpha1.ComponentShareVolume{
+		{ShareServiceUUID: "web-share-id", VolumeName: "conf", VolumeMountDir: "/conf"},
+		{ShareServiceUUID: "web-share-id", VolumeName: "data", VolumeMountDir: "/data"},
+	}
+	web.MntReleationList = []v1alpha1.ComponentShareVolume{{ShareServiceUUID: "mysql-share-id", VolumeName: "mysqldata", VolumeMountDir: "/mysql"}}
+	names := func() []string {
+		components, _, err := newK8sComponents(ram, secret.NewStore())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(components[0].SharedMount) != 0 || !reflect.DeepEqual(components[1].SharedMount, []k8sSharedMount{{ClaimName: "web-data", MountPath: "/data"}}) {
+			t.Errorf("unexpected shared mounts %v %v", components[0].SharedMount, components[1].SharedMount)
+		}
+		var res []string
+		for _, vol := range components[0].Volumes {
+			res = append(res, vol.Name, vol.ClaimName)
+		}
+		return res
+	}
+	first := names()
+	if first[0] != "data" || first[2] != "shuju" || first[3] != "web-shuju" || first[4] != "data-1" || first[6] == "data-1" || !strings.HasPrefix(first[6], "data-1-") {
+		t.Errorf("unexpected volume names %v", first)
+	}
+	if second := names(); !reflect.DeepEqual(first, second) {
+		t.Errorf("volume names differ between exports: %v and %v", first, second)
+	}
+}
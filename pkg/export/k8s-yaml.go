@@ -4,15 +4,12 @@ import (
 	"fmt"
 	"os"
 	"path"
-	"strings"
-	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
 	"github.com/wutong-paas/wutong-oam/pkg/util/image"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"sigs.k8s.io/yaml"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
 )
 
 type k8sYamlExporter struct {
@@ -22,102 +19,77 @@ type k8sYamlExporter struct {
 	mode        string
 	homePath    string
 	exportPath  string
+	opts        options
 }
 
 func (y *k8sYamlExporter) Export() (*Result, error) {
 	y.logger.Infof("start export app %s to k8s yaml spec", y.ram.AppName)
-	dependentImages, err := y.initK8sYaml()
+	// Delete the old application group directory and then regenerate the application package
+	if err := PrepareExportDir(y.exportPath); err != nil {
+		y.logger.Errorf("prepare export dir failure %s", err.Error())
+		return nil, err
+	}
+	y.logger.Infof("success prepare export dir")
+	dependentImages, err := y.writeK8sYaml(path.Join(y.exportPath, y.ram.AppName))
 	if err != nil {
+		y.logger.Errorf("write k8s yaml failure %v", err)
 		return nil, err
 	}
-	if err := SaveComponents(y.ram, y.imageClient, y.exportPath, y.logger, dependentImages); err != nil {
+	y.logger.Infof("success write k8s yaml")
+	if err := saveComponentImages(y.ram, y.imageClient, y.exportPath, y.logger, dependentImages, y.opts); err != nil {
 		y.logger.Errorf("k8s yaml export save component failure %v", err)
 		return nil, err
 	}
 	y.logger.Infof("success save components")
 	// Save plugin attachments
-	if err := SavePlugins(y.ram, y.imageClient, y.exportPath, y.logger); err != nil {
+	if err := savePluginImages(y.ram, y.imageClient, y.exportPath, y.logger, y.opts); err != nil {
 		return nil, err
 	}
 	y.logger.Infof("success save plugins")
+	if err := y.opts.secrets.WriteFile(path.Join(y.exportPath, secret.FileName)); err != nil {
+		y.logger.Errorf("write secrets file failure %s", err.Error())
+		return nil, err
+	}
 
+	// leave out what the baseline package ships
+	if err := writeDelta(y.exportPath, y.opts.baseline); err != nil {
+		y.logger.Errorf("write delta package failure %s", err.Error())
+		return nil, err
+	}
+	// write package manifest and sign it
+	if err := sign.SignDir(y.exportPath, y.opts.signer); err != nil {
+		y.logger.Errorf("sign package failure %s", err.Error())
+		return nil, err
+	}
 	packageName := fmt.Sprintf("%s-%s-yaml.tar.gz", y.ram.AppName, y.ram.AppVersion)
-	name, err := Packaging(packageName, y.homePath, y.exportPath)
+	res, err := packageApp(packageName, y.homePath, y.exportPath, y.opts)
 	if err != nil {
 		err = fmt.Errorf("failed to package app %s: %s", packageName, err.Error())
 		y.logger.Error(err)
 		return nil, err
 	}
 	y.logger.Infof("success export app " + y.ram.AppName)
-	return &Result{PackagePath: path.Join(y.homePath, name), PackageName: name}, nil
+	return res, nil
 }
 
-func (y *k8sYamlExporter) initK8sYaml() ([]string, error) {
-	k8sYamlPath := path.Join(y.exportPath, y.ram.AppName)
-	for i := 0; i < 40; i++ {
-		time.Sleep(1 * time.Second)
-		if CheckFileExist(path.Join(k8sYamlPath, "dependent_image.txt")) {
-			y.logger.Infof("dependent_image.txt creeate success")
-			break
-		}
-	}
-	content, err := os.ReadFile(path.Join(k8sYamlPath, "dependent_image.txt"))
-	if err != nil {
-		y.logger.Errorf("read file dependent_image.txt failure %v", err)
+// writeK8sYaml render the kubernetes manifests of the app into yamlPath,
+// the images referenced by the manifests are returned
+func (y *k8sYamlExporter) writeK8sYaml(yamlPath string) ([]string, error) {
+	if err := os.MkdirAll(yamlPath, 0755); err != nil {
 		return nil, err
 	}
-	dependentImages := strings.Split(string(content), "\n")
-	err = y.writeK8sYaml(k8sYamlPath)
+	manifests, err := renderK8sManifests(y.ram, y.opts.secrets)
 	if err != nil {
 		return nil, err
 	}
-	return dependentImages, nil
-}
-
-func (y *k8sYamlExporter) writeK8sYaml(yamlPath string) error {
-	for _, k8sResource := range y.ram.K8sResources {
-		var unstructuredObject unstructured.Unstructured
-		err := yaml.Unmarshal([]byte(k8sResource.Content), &unstructuredObject)
-		if err != nil {
-			return err
-		}
-		unstructuredObject.SetNamespace("")
-		unstructuredObject.SetResourceVersion("")
-		unstructuredObject.SetCreationTimestamp(metav1.Time{})
-		unstructuredObject.SetUID("")
-		unstructuredYaml, err := yaml.Marshal(unstructuredObject)
-		if err != nil {
-			return err
-		}
-		err = y.write(path.Join(yamlPath, fmt.Sprintf("%v.yaml", unstructuredObject.GetKind())), unstructuredYaml)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (y *k8sYamlExporter) write(yamlPath string, meta []byte) error {
-	var fl *os.File
-	var err error
-	if CheckFileExist(yamlPath) {
-		fl, err = os.OpenFile(yamlPath, os.O_APPEND|os.O_WRONLY, 0755)
+	for _, manifest := range manifests {
+		content, err := marshalManifest(manifest)
 		if err != nil {
-			return err
+			return nil, err
 		}
-	} else {
-		fl, err = os.Create(yamlPath)
-		if err != nil {
-			return err
+		if err := os.WriteFile(path.Join(yamlPath, manifest.Name+".yaml"), content, 0644); err != nil {
+			return nil, err
 		}
 	}
-	defer fl.Close()
-	n, err := fl.Write(append(meta, []byte("\n---\n")...))
-	if err != nil {
-		return err
-	}
-	if n < len(append(meta, []byte("\n---")...)) {
-		return fmt.Errorf("write insufficient length")
-	}
-	return nil
+	return manifestImages(manifests), nil
 }
@@ -0,0 +1,467 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
+	"sigs.k8s.io/yaml"
+)
+
+// EnvironmentProfile the overlay settings of a deployment environment
+type EnvironmentProfile struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	// ImageRegistry rewrite the registry of all images, eg. registry.prod.example.com/wutong
+	ImageRegistry string `json:"image_registry,omitempty"`
+	StorageClass  string `json:"storage_class,omitempty"`
+	// Replicas and Resources are keyed by the component name, key or cname
+	Replicas  map[string]int                `json:"replicas,omitempty"`
+	Resources map[string]ComponentResources `json:"resources,omitempty"`
+}
+
+// ComponentResources component resource limits, memory in MB and cpu in millicores
+type ComponentResources struct {
+	Memory int `json:"memory"`
+	CPU    int `json:"cpu"`
+}
+
+// lookupComponent find the setting of the component in the profile map
+func lookupComponent[T any](settings map[string]T, kc *k8sComponent) (T, bool) {
+	for _, key := range []string{kc.Name, kc.Component.ComponentKey, kc.Component.ServiceCname} {
+		if v, ok := settings[key]; ok {
+			return v, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// Kustomization kustomization.yaml
+type Kustomization struct {
+	APIVersion         string               `json:"apiVersion"`
+	Kind               string               `json:"kind"`
+	Namespace          string               `json:"namespace,omitempty"`
+	Resources          []string             `json:"resources,omitempty"`
+	ConfigMapGenerator []KustomizeGenerator `json:"configMapGenerator,omitempty"`
+	SecretGenerator    []KustomizeGenerator `json:"secretGenerator,omitempty"`
+	Images             []KustomizeImage     `json:"images,omitempty"`
+	Replicas           []KustomizeReplica   `json:"replicas,omitempty"`
+	Patches            []KustomizePatch     `json:"patches,omitempty"`
+	Labels             []KustomizeLabel     `json:"labels,omitempty"`
+}
+
+// KustomizeGenerator ConfigMap or Secret generator
+type KustomizeGenerator struct {
+	Name     string   `json:"name"`
+	Envs     []string `json:"envs,omitempty"`
+	Files    []string `json:"files,omitempty"`
+	Literals []string `json:"literals,omitempty"`
+}
+
+// KustomizeImage image rewrite
+type KustomizeImage struct {
+	Name    string `json:"name"`
+	NewName string `json:"newName,omitempty"`
+}
+
+// KustomizeReplica replicas override
+type KustomizeReplica struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// KustomizePatch patch of the target resources
+type KustomizePatch struct {
+	Target map[string]string `json:"target"`
+	Patch  string            `json:"patch"`
+}
+
+// KustomizeLabel common labels
+type KustomizeLabel struct {
+	Pairs            map[string]string `json:"pairs"`
+	IncludeSelectors bool              `json:"includeSelectors"`
+}
+
+type kustomizeExporter struct {
+	logger      *logrus.Logger
+	ram         v1alpha1.WutongApplicationConfig
+	imageClient image.Client
+	mode        string
+	homePath    string
+	exportPath  string
+	opts        options
+	// syncWaves the argo cd sync waves of the components, keyed by the component key
+	syncWaves map[string]int
+	// externalSecrets reference the Secrets of the generated secrets without
+	// generating them, they are created in the cluster out of the base
+	externalSecrets bool
+}
+
+func (k *kustomizeExporter) Export() (*Result, error) {
+	k.logger.Infof("start export app %s to kustomize spec", k.ram.AppName)
+	// Delete the old application group directory and then regenerate the application package
+	if err := PrepareExportDir(k.exportPath); err != nil {
+		k.logger.Errorf("prepare export dir failure %s", err.Error())
+		return nil, err
+	}
+	k.logger.Infof("success prepare export dir")
+	appPath := path.Join(k.exportPath, k.ram.AppName)
+	components, groups, err := newK8sComponents(k.ram, k.opts.secrets)
+	if err != nil {
+		return nil, err
+	}
+	dependentImages, err := k.writeBase(path.Join(appPath, "base"), components, groups)
+	if err != nil {
+		k.logger.Errorf("write kustomize base failure %v", err)
+		return nil, err
+	}
+	k.logger.Infof("success write kustomize base")
+	if err := k.writeOverlays(appPath, components, dependentImages); err != nil {
+		return nil, err
+	}
+	k.logger.Infof("success write kustomize overlays")
+	if err := k.opts.secrets.WriteFile(path.Join(k.exportPath, secret.FileName)); err != nil {
+		k.logger.Errorf("write secrets file failure %s", err.Error())
+		return nil, err
+	}
+	if k.mode == "offline" {
+		if err := saveComponentImages(k.ram, k.imageClient, k.exportPath, k.logger, dependentImages, k.opts); err != nil {
+			k.logger.Errorf("kustomize export save component failure %v", err)
+			return nil, err
+		}
+		k.logger.Infof("success save components")
+		// Save plugin attachments
+		if err := savePluginImages(k.ram, k.imageClient, k.exportPath, k.logger, k.opts); err != nil {
+			return nil, err
+		}
+		k.logger.Infof("success save plugins")
+	}
+	// leave out what the baseline package ships
+	if err := writeDelta(k.exportPath, k.opts.baseline); err != nil {
+		k.logger.Errorf("write delta package failure %s", err.Error())
+		return nil, err
+	}
+	// write package manifest and sign it
+	if err := sign.SignDir(k.exportPath, k.opts.signer); err != nil {
+		k.logger.Errorf("sign package failure %s", err.Error())
+		return nil, err
+	}
+	packageName := fmt.Sprintf("%s-%s-kustomize.tar.gz", k.ram.AppName, k.ram.AppVersion)
+	res, err := packageApp(packageName, k.homePath, k.exportPath, k.opts)
+	if err != nil {
+		err = fmt.Errorf("failed to package app %s: %s", packageName, err.Error())
+		k.logger.Error(err)
+		return nil, err
+	}
+	k.logger.Infof("success export app " + k.ram.AppName)
+	return res, nil
+}
+
+// writeBase write the base generated from the ram components and k8s resources,
+// config groups, config files and generated passwords are wired in by generators
+func (k *kustomizeExporter) writeBase(basePath string, components []*k8sComponent, groups []k8sConfigGroup) ([]string, error) {
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, err
+	}
+	kustomization := Kustomization{
+		APIVersion: "kustomize.config.k8s.io/v1beta1",
+		Kind:       "Kustomization",
+		Labels: []KustomizeLabel{{
+			Pairs: map[string]string{"app.kubernetes.io/part-of": k8sName(k.ram.AppName)},
+		}},
+	}
+	writeFile := func(name string, content []byte) error {
+		file := path.Join(basePath, name)
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(file, content, 0644)
+	}
+
+	// the values spanning multiple lines break the env files, they are literals
+	envGenerator := func(name, file string, envs map[string]string) (KustomizeGenerator, error) {
+		generator := KustomizeGenerator{Name: name, Envs: []string{file}}
+		single := make(map[string]string, len(envs))
+		for k, v := range envs {
+			single[k] = v
+		}
+		for _, key := range multilineKeys(envs) {
+			generator.Literals = append(generator.Literals, key+"="+envs[key])
+			delete(single, key)
+		}
+		return generator, writeFile(file, envFileContent(single))
+	}
+
+	for _, group := range groups {
+		generator, err := envGenerator("config-group-"+group.Name, path.Join("config-groups", group.Name+".env"), group.Items)
+		if err != nil {
+			return nil, err
+		}
+		kustomization.ConfigMapGenerator = append(kustomization.ConfigMapGenerator, generator)
+	}
+
+	var manifests []k8sManifest
+	for _, kc := range components {
+		// generated secrets are moved into a Secret of the component
+		secrets := make(map[string]string)
+		for _, key := range kc.SecretEnvs {
+			secrets[key] = kc.Envs[key]
+			delete(kc.Envs, key)
+		}
+		if len(secrets) > 0 && k.externalSecrets {
+			kc.Secrets = append(kc.Secrets, kc.Name+"-secrets")
+		} else if len(secrets) > 0 {
+			generator, err := envGenerator(kc.Name+"-secrets", path.Join("secrets", kc.Name+".env"), secrets)
+			if err != nil {
+				return nil, err
+			}
+			kustomization.SecretGenerator = append(kustomization.SecretGenerator, generator)
+			kc.Secrets = append(kc.Secrets, generator.Name)
+		}
+
+		objects, err := renderComponent(k.ram, kc)
+		if err != nil {
+			return nil, fmt.Errorf("render component %s failure %s", kc.Name, err.Error())
+		}
+		manifest := k8sManifest{Name: kc.Name}
+		for _, obj := range objects {
+			// config files are generated by the configMapGenerator
+			if obj.GetKind() == "ConfigMap" && obj.GetName() == kc.Name+"-config-files" {
+				continue
+			}
+			if wave, ok := k.syncWaves[kc.Component.ComponentKey]; ok {
+				annotations := obj.GetAnnotations()
+				if annotations == nil {
+					annotations = make(map[string]string)
+				}
+				annotations[argoSyncWaveAnnotation] = fmt.Sprint(wave)
+				obj.SetAnnotations(annotations)
+			}
+			manifest.Objects = append(manifest.Objects, obj)
+		}
+		manifests = append(manifests, manifest)
+		if len(kc.ConfigFiles) > 0 {
+			generator := KustomizeGenerator{Name: kc.Name + "-config-files"}
+			for _, cf := range kc.ConfigFiles {
+				file := path.Join("files", kc.Name, cf.Key)
+				if err := writeFile(file, []byte(cf.Content)); err != nil {
+					return nil, err
+				}
+				generator.Files = append(generator.Files, fmt.Sprintf("%s=%s", cf.Key, file))
+			}
+			kustomization.ConfigMapGenerator = append(kustomization.ConfigMapGenerator, generator)
+		}
+	}
+	if monitoring, ok, err := renderMonitoring(k.ram, components); err != nil {
+		return nil, err
+	} else if ok {
+		manifests = append(manifests, monitoring)
+	}
+	resources, err := k8sResourceObjects(k.ram.K8sResources)
+	if err != nil {
+		return nil, err
+	}
+	kinds := make(map[string]int)
+	for _, obj := range resources {
+		idx, ok := kinds[obj.GetKind()]
+		if !ok {
+			idx = len(manifests)
+			kinds[obj.GetKind()] = idx
+			manifests = append(manifests, k8sManifest{Name: obj.GetKind()})
+		}
+		manifests[idx].Objects = append(manifests[idx].Objects, obj)
+	}
+	for _, manifest := range manifests {
+		content, err := marshalManifest(manifest)
+		if err != nil {
+			return nil, err
+		}
+		file := manifest.Name + ".yaml"
+		if err := writeFile(file, content); err != nil {
+			return nil, err
+		}
+		kustomization.Resources = append(kustomization.Resources, file)
+	}
+	content, err := yaml.Marshal(kustomization)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile("kustomization.yaml", content); err != nil {
+		return nil, err
+	}
+	return manifestImages(manifests), nil
+}
+
+// writeOverlays write one overlay per environment profile, a default overlay
+// if there is no profile
+func (k *kustomizeExporter) writeOverlays(appPath string, components []*k8sComponent, images []string) error {
+	profiles := k.opts.environmentProfiles
+	if len(profiles) == 0 {
+		profiles = []EnvironmentProfile{{Name: "default"}}
+	}
+	for _, profile := range profiles {
+		if err := k.writeOverlay(path.Join(appPath, "overlays", k8sName(profile.Name)), profile, components, images); err != nil {
+			k.logger.Errorf("write kustomize overlay %s failure %v", profile.Name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOverlay write the overlay of the environment profile
+func (k *kustomizeExporter) writeOverlay(overlayPath string, profile EnvironmentProfile, components []*k8sComponent, images []string) error {
+	if err := os.MkdirAll(overlayPath, 0755); err != nil {
+		return err
+	}
+	kustomization := Kustomization{
+		APIVersion: "kustomize.config.k8s.io/v1beta1",
+		Kind:       "Kustomization",
+		Namespace:  profile.Namespace,
+		Resources:  []string{"../../base"},
+	}
+	if profile.ImageRegistry != "" {
+		for _, img := range images {
+			repository, _ := splitImage(img)
+			newName, err := rewriteRegistry(repository, profile.ImageRegistry)
+			if err != nil {
+				k.logger.Warningf("rewrite image %s registry failure %v", img, err)
+				continue
+			}
+			kustomization.Images = append(kustomization.Images, KustomizeImage{Name: repository, NewName: newName})
+		}
+	}
+	for _, kc := range components {
+		kind := "Deployment"
+		if kc.Stateful {
+			kind = "StatefulSet"
+		}
+		if replicas, ok := lookupComponent(profile.Replicas, kc); ok {
+			kustomization.Replicas = append(kustomization.Replicas, KustomizeReplica{Name: kc.Name, Count: replicas})
+		}
+		if res, ok := lookupComponent(profile.Resources, kc); ok {
+			patch, err := resourcesPatch(kind, kc.Name, res)
+			if err != nil {
+				return err
+			}
+			kustomization.Patches = append(kustomization.Patches, KustomizePatch{
+				Target: map[string]string{"kind": kind, "name": kc.Name},
+				Patch:  patch,
+			})
+		}
+		if profile.StorageClass != "" && kc.Stateful {
+			var ops []string
+			idx := 0
+			for _, vol := range kc.Volumes {
+				if vol.MemoryFS {
+					continue
+				}
+				ops = append(ops, fmt.Sprintf("- op: add\n  path: /spec/volumeClaimTemplates/%d/spec/storageClassName\n  value: %s", idx, profile.StorageClass))
+				idx++
+			}
+			if len(ops) > 0 {
+				kustomization.Patches = append(kustomization.Patches, KustomizePatch{
+					Target: map[string]string{"kind": kind, "name": kc.Name},
+					Patch:  strings.Join(ops, "\n"),
+				})
+			}
+		}
+	}
+	if profile.StorageClass != "" {
+		kustomization.Patches = append(kustomization.Patches, KustomizePatch{
+			Target: map[string]string{"kind": "PersistentVolumeClaim"},
+			Patch:  fmt.Sprintf("- op: add\n  path: /spec/storageClassName\n  value: %s", profile.StorageClass),
+		})
+	}
+	content, err := yaml.Marshal(kustomization)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(overlayPath, "kustomization.yaml"), content, 0644)
+}
+
+// resourcesPatch strategic merge patch of the container resource limits
+func resourcesPatch(kind, name string, res ComponentResources) (string, error) {
+	patch := map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": name},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name":      name,
+							"resources": resourceRequirements(res.Memory, res.CPU),
+						},
+					},
+				},
+			},
+		},
+	}
+	content, err := yaml.Marshal(patch)
+	return string(content), err
+}
+
+// rewriteRegistry replace the registry of the repository, the repository
+// path is kept, eg. mysql -> registry/library/mysql
+func rewriteRegistry(repository, registry string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(repository)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(registry, "/") + "/" + reference.Path(named), nil
+}
+
+// multilineKeys the sorted keys of the values spanning multiple lines, env
+// files hold single line values only
+func multilineKeys(envs map[string]string) []string {
+	var keys []string
+	for key, value := range envs {
+		if strings.ContainsAny(value, "\r\n") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// envFileContent KEY=VALUE lines sorted by key
+func envFileContent(envs map[string]string) []byte {
+	keys := make([]string, 0, len(envs))
+	for key := range envs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", key, envs[key])
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,138 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+func TestKustomizeBaseAndOverlay(t *testing.T) {
+	dir := t.TempDir()
+	k := &kustomizeExporter{logger: logrus.New(), ram: testRAM(), exportPath: dir, opts: newOptions()}
+	base := path.Join(dir, "base")
+	components, groups, err := newK8sComponents(k.ram, k.opts.secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := k.writeBase(base, components, groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kustomization Kustomization
+	content, err := os.ReadFile(path.Join(base, "kustomization.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(content, &kustomization); err != nil {
+		t.Fatal(err)
+	}
+	generators := make(map[string]bool)
+	for _, g := range append(kustomization.ConfigMapGenerator, kustomization.SecretGenerator...) {
+		generators[g.Name] = true
+	}
+	for _, name := range []string{"config-group-base", "web-config-files", "mysql-secrets", "web-secrets"} {
+		if !generators[name] {
+			t.Errorf("generator %s not found in %v", name, generators)
+		}
+	}
+	web, err := os.ReadFile(path.Join(base, "web.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(web), "**None**") {
+		t.Error("generated passwords leaked into the manifest")
+	}
+	if !strings.Contains(string(web), "web-secrets") {
+		t.Error("web does not reference its secrets")
+	}
+
+	overlay := path.Join(dir, "overlays", "prod")
+	profile := EnvironmentProfile{
+		Name:          "prod",
+		Namespace:     "demo-prod",
+		ImageRegistry: "registry.example.com/prod",
+		StorageClass:  "fast",
+		Replicas:      map[string]int{"web-key": 3},
+		Resources:     map[string]ComponentResources{"web": {Memory: 1024, CPU: 500}},
+	}
+	if err := k.writeOverlay(overlay, profile, components, images); err != nil {
+		t.Fatal(err)
+	}
+	content, err = os.ReadFile(path.Join(overlay, "kustomization.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kustomization = Kustomization{}
+	if err := yaml.Unmarshal(content, &kustomization); err != nil {
+		t.Fatal(err)
+	}
+	if kustomization.Namespace != "demo-prod" || len(kustomization.Replicas) != 1 || kustomization.Replicas[0].Count != 3 {
+		t.Errorf("unexpected overlay %s", content)
+	}
+	newNames := make(map[string]string)
+	for _, img := range kustomization.Images {
+		newNames[img.Name] = img.NewName
+	}
+	if newNames["mysql"] != "registry.example.com/prod/library/mysql" || newNames["hub.example.com/demo/web"] != "registry.example.com/prod/demo/web" {
+		t.Errorf("unexpected image rewrites %v", newNames)
+	}
+	// web resources, mysql claim templates and the web pvc
+	if len(kustomization.Patches) != 3 {
+		t.Errorf("expect 3 patches, got %d", len(kustomization.Patches))
+	}
+}
+
+func TestKustomizeMultilineValues(t *testing.T) {
+	dir := t.TempDir()
+	ram := testRAM()
+	cert := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----"
+	ram.AppConfigGroups[0].ConfigItems = map[string]string{"TZ": "Asia/Shanghai", "CERT": cert}
+	k := &kustomizeExporter{logger: logrus.New(), ram: ram, exportPath: dir, opts: newOptions()}
+	components, groups, err := newK8sComponents(k.ram, k.opts.secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.writeBase(dir, components, groups); err != nil {
+		t.Fatal(err)
+	}
+	env, err := os.ReadFile(path.Join(dir, "config-groups", "base.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(env) != "TZ=Asia/Shanghai\n" {
+		t.Errorf("expect only the single line values in the env file, got %q", env)
+	}
+	var kustomization Kustomization
+	content, err := os.ReadFile(path.Join(dir, "kustomization.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(content, &kustomization); err != nil {
+		t.Fatal(err)
+	}
+	if literals := kustomization.ConfigMapGenerator[0].Literals; len(literals) != 1 || literals[0] != "CERT="+cert {
+		t.Errorf("expect the certificate as a literal, got %v", literals)
+	}
+}
@@ -0,0 +1,269 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltr.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltr.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	defaultMetricsPath = "/metrics"
+	// grafanaDashboardLabel the label the grafana sidecar discovers dashboard ConfigMaps by
+	grafanaDashboardLabel = "grafana_dashboard"
+)
+
+// k8sMonitor a prometheus operator monitor of a component
+type k8sMonitor struct {
+	Name      string
+	Component string
+	// Service whether the port is a port of the component Service, the pods are
+	// scraped by a PodMonitor otherwise
+	Service  bool
+	PortName string
+	Port     int
+	Path     string
+	Interval string
+}
+
+// Kind the kind of the monitor object
+func (m k8sMonitor) Kind() string {
+	if m.Service {
+		return "ServiceMonitor"
+	}
+	return "PodMonitor"
+}
+
+// EndpointsField the spec field holding the scrape endpoints
+func (m k8sMonitor) EndpointsField() string {
+	if m.Service {
+		return "endpoints"
+	}
+	return "podMetricsEndpoints"
+}
+
+// componentMonitors the monitors of the component, monitors without a port are ignored
+func componentMonitors(kc *k8sComponent) []k8sMonitor {
+	var monitors []k8sMonitor
+	names := make(map[string]struct{})
+	for _, cm := range kc.Component.ComponentMonitor {
+		if cm.Port <= 0 {
+			continue
+		}
+		suffix := k8sName(cm.Name)
+		if suffix == "" {
+			suffix = fmt.Sprint(cm.Port)
+		}
+		name := kc.Name + "-" + suffix
+		if _, exists := names[name]; exists {
+			name = fmt.Sprintf("%s-%d", name, len(monitors))
+		}
+		names[name] = struct{}{}
+		monitor := k8sMonitor{
+			Name:      name,
+			Component: kc.Name,
+			Port:      cm.Port,
+			Path:      cm.Path,
+			Interval:  monitorInterval(cm.Interval),
+		}
+		if monitor.Path == "" {
+			monitor.Path = defaultMetricsPath
+		}
+		for _, port := range kc.Ports {
+			if port.Port == cm.Port {
+				monitor.Service = true
+				monitor.PortName = port.Name
+				break
+			}
+		}
+		monitors = append(monitors, monitor)
+	}
+	return monitors
+}
+
+// monitorInterval the prometheus duration of the interval, a bare number is
+// in seconds. Invalid intervals are dropped in favour of the prometheus default
+func monitorInterval(interval string) string {
+	interval = strings.TrimSpace(interval)
+	if interval == "" {
+		return ""
+	}
+	if strings.Trim(interval, "0123456789") == "" {
+		interval += "s"
+	}
+	if _, err := time.ParseDuration(interval); err != nil {
+		return ""
+	}
+	return interval
+}
+
+// renderMonitor the ServiceMonitor or PodMonitor object of the monitor
+func renderMonitor(ram v1alpha1.WutongApplicationConfig, monitor k8sMonitor) *unstructured.Unstructured {
+	endpoint := map[string]interface{}{"path": monitor.Path}
+	if monitor.Service {
+		endpoint["port"] = monitor.PortName
+	} else {
+		endpoint["targetPort"] = int64(monitor.Port)
+	}
+	if monitor.Interval != "" {
+		endpoint["interval"] = monitor.Interval
+	}
+	meta := objectMeta(ram, monitor.Name, monitor.Component)
+	labels := make(map[string]interface{}, len(meta.Labels))
+	for k, v := range meta.Labels {
+		labels[k] = v
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "monitoring.coreos.com/v1",
+		"kind":       monitor.Kind(),
+		"metadata": map[string]interface{}{
+			"name":   monitor.Name,
+			"labels": labels,
+		},
+		"spec": map[string]interface{}{
+			"selector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{
+					"app.kubernetes.io/instance":  k8sName(ram.AppName),
+					"app.kubernetes.io/component": monitor.Component,
+				},
+			},
+			monitor.EndpointsField(): []interface{}{endpoint},
+		},
+	}}
+}
+
+// renderMonitoring the monitors of the components and the grafana dashboard
+// ConfigMap of the app, false if the app defines neither
+func renderMonitoring(ram v1alpha1.WutongApplicationConfig, components []*k8sComponent) (k8sManifest, bool, error) {
+	manifest := k8sManifest{Name: "monitoring"}
+	for _, kc := range components {
+		for _, monitor := range componentMonitors(kc) {
+			manifest.Objects = append(manifest.Objects, renderMonitor(ram, monitor))
+		}
+	}
+	dashboard, err := grafanaDashboardJSON(ram)
+	if err != nil {
+		return manifest, false, err
+	}
+	if dashboard != nil {
+		meta := objectMeta(ram, k8sName(ram.AppName)+"-grafana-dashboard", "")
+		meta.Labels[grafanaDashboardLabel] = "1"
+		obj, err := toUnstructured(&corev1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: meta,
+			Data:       map[string]string{grafanaDashboardFile(ram): string(dashboard)},
+		})
+		if err != nil {
+			return manifest, false, err
+		}
+		manifest.Objects = append(manifest.Objects, obj)
+	}
+	return manifest, len(manifest.Objects) > 0, nil
+}
+
+// grafanaDashboardFile the file name of the app dashboard
+func grafanaDashboardFile(ram v1alpha1.WutongApplicationConfig) string {
+	return k8sName(ram.AppName) + "-dashboard.json"
+}
+
+// grafanaDashboardJSON the grafana dashboard of the component graphs, one row per
+// component with the graphs in sequence order. nil if no component has graphs
+func grafanaDashboardJSON(ram v1alpha1.WutongApplicationConfig) ([]byte, error) {
+	datasource := map[string]interface{}{"type": "prometheus", "uid": "${datasource}"}
+	var (
+		panels []interface{}
+		id, y  int
+	)
+	for _, cpt := range ram.Components {
+		graphs := make([]v1alpha1.ComponentGraph, 0, len(cpt.ComponentGraphs))
+		for _, graph := range cpt.ComponentGraphs {
+			if strings.TrimSpace(graph.PromQL) != "" {
+				graphs = append(graphs, graph)
+			}
+		}
+		if len(graphs) == 0 {
+			continue
+		}
+		sort.SliceStable(graphs, func(i, j int) bool { return graphs[i].Sequence < graphs[j].Sequence })
+		id++
+		title := cpt.ServiceCname
+		if title == "" {
+			title = cpt.ServiceAlias
+		}
+		panels = append(panels, map[string]interface{}{
+			"id":        id,
+			"type":      "row",
+			"title":     title,
+			"collapsed": false,
+			"panels":    []interface{}{},
+			"gridPos":   map[string]int{"h": 1, "w": 24, "x": 0, "y": y},
+		})
+		y++
+		for i, graph := range graphs {
+			id++
+			panels = append(panels, map[string]interface{}{
+				"id":         id,
+				"type":       "timeseries",
+				"title":      graph.Title,
+				"datasource": datasource,
+				"gridPos":    map[string]int{"h": 8, "w": 12, "x": (i % 2) * 12, "y": y + i/2*8},
+				"targets": []interface{}{map[string]interface{}{
+					"datasource": datasource,
+					"expr":       graph.PromQL,
+					"refId":      "A",
+				}},
+			})
+		}
+		y += (len(graphs) + 1) / 2 * 8
+	}
+	if len(panels) == 0 {
+		return nil, nil
+	}
+	uid := k8sName(ram.AppName)
+	if len(uid) > 40 {
+		uid = strings.TrimRight(uid[:40], "-")
+	}
+	dashboard := map[string]interface{}{
+		"uid":           uid,
+		"title":         ram.AppName,
+		"tags":          []string{"wutong", ram.AppName},
+		"editable":      true,
+		"schemaVersion": 39,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []interface{}{map[string]interface{}{
+				"name":  "datasource",
+				"label": "Data source",
+				"type":  "datasource",
+				"query": "prometheus",
+			}},
+		},
+		"panels": panels,
+	}
+	return json.MarshalIndent(dashboard, "", "  ")
+}
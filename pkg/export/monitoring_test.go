@@ -0,0 +1,182 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltr.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltr.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func monitoringRAM() v1alpha1.WutongApplicationConfig {
+	ram := testRAM()
+	ram.Components[0].ComponentMonitor = []v1alpha1.ComponentMonitor{
+		{Name: "web-metrics", Port: 8080, Path: "/actuator/prometheus", Interval: "15"},
+		{Name: "jvm", Port: 9404, Interval: "bad"},
+	}
+	ram.Components[0].ComponentGraphs = []v1alpha1.ComponentGraph{
+		{Title: "latency", PromQL: "histogram_quantile(0.99, rate(http_seconds_bucket[5m]))", Sequence: 2},
+		{Title: "requests", PromQL: "rate(http_requests_total[5m])", Sequence: 1},
+		{Title: "empty", Sequence: 0},
+	}
+	ram.Components[1].ComponentGraphs = []v1alpha1.ComponentGraph{
+		{Title: "connections", PromQL: "mysql_global_status_threads_connected", Sequence: 1},
+	}
+	return ram
+}
+
+func TestRenderMonitoring(t *testing.T) {
+	ram := monitoringRAM()
+	components, _, err := newK8sComponents(ram, newOptions().secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, ok, err := renderMonitoring(ram, components)
+	if err != nil || !ok {
+		t.Fatalf("expect monitoring manifest, got %v %v", ok, err)
+	}
+	if len(manifest.Objects) != 3 {
+		t.Fatalf("expect 2 monitors and a dashboard, got %d objects", len(manifest.Objects))
+	}
+	serviceMonitor, podMonitor, dashboard := manifest.Objects[0], manifest.Objects[1], manifest.Objects[2]
+	if serviceMonitor.GetKind() != "ServiceMonitor" || serviceMonitor.GetName() != "web-web-metrics" {
+		t.Errorf("unexpected monitor %s/%s", serviceMonitor.GetKind(), serviceMonitor.GetName())
+	}
+	endpoints, _, _ := unstructured.NestedSlice(serviceMonitor.Object, "spec", "endpoints")
+	endpoint := endpoints[0].(map[string]interface{})
+	if endpoint["port"] != components[0].Ports[0].Name || endpoint["path"] != "/actuator/prometheus" || endpoint["interval"] != "15s" {
+		t.Errorf("unexpected endpoint %v", endpoint)
+	}
+	selector, _, _ := unstructured.NestedStringMap(serviceMonitor.Object, "spec", "selector", "matchLabels")
+	if selector["app.kubernetes.io/component"] != "web" || selector["app.kubernetes.io/instance"] != "demo" {
+		t.Errorf("unexpected selector %v", selector)
+	}
+	// the port is not exposed by the service, the pods are scraped directly
+	endpoints, _, _ = unstructured.NestedSlice(podMonitor.Object, "spec", "podMetricsEndpoints")
+	endpoint = endpoints[0].(map[string]interface{})
+	if podMonitor.GetKind() != "PodMonitor" || endpoint["targetPort"] != int64(9404) || endpoint["path"] != "/metrics" {
+		t.Errorf("unexpected pod monitor %v", podMonitor.Object)
+	}
+	if _, ok := endpoint["interval"]; ok {
+		t.Errorf("invalid interval is kept")
+	}
+	if dashboard.GetLabels()[grafanaDashboardLabel] != "1" {
+		t.Errorf("dashboard ConfigMap is not labeled for the grafana sidecar")
+	}
+	if _, err := marshalManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, _ := renderMonitoring(testRAM(), components[:0]); ok {
+		t.Errorf("expect no monitoring manifest without monitors and graphs")
+	}
+}
+
+func TestGrafanaDashboard(t *testing.T) {
+	body, err := grafanaDashboardJSON(monitoringRAM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dashboard struct {
+		Panels []struct {
+			Type    string `json:"type"`
+			Title   string `json:"title"`
+			Targets []struct {
+				Expr string `json:"expr"`
+			} `json:"targets"`
+		} `json:"panels"`
+	}
+	if err := json.Unmarshal(body, &dashboard); err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, panel := range dashboard.Panels {
+		titles = append(titles, panel.Type+":"+panel.Title)
+	}
+	expect := "row:web,timeseries:requests,timeseries:latency,row:mysql,timeseries:connections"
+	if strings.Join(titles, ",") != expect {
+		t.Errorf("expect panels %s, got %s", expect, strings.Join(titles, ","))
+	}
+	if dashboard.Panels[1].Targets[0].Expr != "rate(http_requests_total[5m])" {
+		t.Errorf("unexpected target %v", dashboard.Panels[1].Targets)
+	}
+}
+
+func TestHelmMonitoringTemplate(t *testing.T) {
+	chartPath := t.TempDir()
+	h := &helmChartExporter{logger: logrus.New(), ram: monitoringRAM(), opts: newOptions()}
+	components, groups, err := newK8sComponents(h.ram, h.opts.secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.writeComponentTemplates(chartPath, components, groups); err != nil {
+		t.Fatal(err)
+	}
+	body, err := os.ReadFile(path.Join(chartPath, "templates", "monitoring.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		"kind: ServiceMonitor",
+		"kind: PodMonitor",
+		"podMetricsEndpoints:\n  - targetPort: 9404",
+		`path: "/actuator/prometheus"`,
+		`.Files.Get "files/demo-dashboard.json"`,
+	} {
+		if !strings.Contains(string(body), expect) {
+			t.Errorf("expect %q in the monitoring template:\n%s", expect, body)
+		}
+	}
+	if !CheckFileExist(path.Join(chartPath, "files", "demo-dashboard.json")) {
+		t.Errorf("dashboard is not shipped with the chart")
+	}
+}
+
+func TestComposePrometheusConfig(t *testing.T) {
+	d := &dockerComposeExporter{logger: logrus.New(), ram: monitoringRAM(), opts: newOptions()}
+	y, err := d.buildComposeProject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config PrometheusConfig
+	if err := yaml.Unmarshal(y.files["prometheus/prometheus.yml"], &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.ScrapeConfigs) != 2 {
+		t.Fatalf("expect 2 scrape configs, got %v", config.ScrapeConfigs)
+	}
+	job := config.ScrapeConfigs[0]
+	if job.JobName != "web-web-metrics" || job.MetricsPath != "/actuator/prometheus" || job.ScrapeInterval != "15s" ||
+		job.StaticConfigs[0].Targets[0] != "web:8080" {
+		t.Errorf("unexpected scrape config %+v", job)
+	}
+	if _, ok := y.files["grafana/demo-dashboard.json"]; !ok {
+		t.Errorf("dashboard is not in the project files")
+	}
+	if _, ok := y.files["gateway/nginx.conf"]; !ok {
+		t.Errorf("gateway files are dropped")
+	}
+}
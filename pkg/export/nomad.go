@@ -0,0 +1,757 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltr.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltr.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
+)
+
+// nomadWaitImage the image of the prestart tasks waiting for the dependencies
+const nomadWaitImage = "busybox:1.36"
+
+// nomadVolumeDir the dir on the nomad clients the host volumes are created in
+const nomadVolumeDir = "/opt/nomad/volumes"
+
+// nomadTemplateDelims the delimiters of the config file templates, the config
+// files are copied as they are and may contain the default ones
+var nomadTemplateDelims = [2]string{"[[wutong:", ":wutong]]"}
+
+type nomadExporter struct {
+	logger      *logrus.Logger
+	ram         v1alpha1.WutongApplicationConfig
+	imageClient image.Client
+	homePath    string
+	exportPath  string
+	opts        options
+}
+
+// nomadJob the nomad job of the app, the fields follow the nomad job api so
+// the json is accepted by nomad job run -json
+type nomadJob struct {
+	ID          string
+	Name        string
+	Type        string
+	Datacenters []string
+	TaskGroups  []*nomadTaskGroup
+	// hostVolumes the host volumes the clients running the job provide
+	hostVolumes []string
+}
+
+type nomadTaskGroup struct {
+	Name     string
+	Count    int
+	Networks []nomadNetwork         `json:",omitempty"`
+	Services []nomadService         `json:",omitempty"`
+	Volumes  map[string]nomadVolume `json:",omitempty"`
+	Tasks    []*nomadTask
+}
+
+type nomadNetwork struct {
+	ReservedPorts []nomadPort `json:",omitempty"`
+	DynamicPorts  []nomadPort `json:",omitempty"`
+}
+
+type nomadPort struct {
+	Label string
+	Value int
+	To    int
+}
+
+type nomadService struct {
+	Name      string
+	PortLabel string
+	Provider  string
+	Checks    []nomadCheck `json:",omitempty"`
+}
+
+type nomadCheck struct {
+	Name         string
+	Type         string
+	Path         string              `json:",omitempty"`
+	Header       map[string][]string `json:",omitempty"`
+	Interval     time.Duration
+	Timeout      time.Duration
+	CheckRestart *nomadCheckRestart `json:",omitempty"`
+}
+
+type nomadCheckRestart struct {
+	Limit int
+	Grace time.Duration
+}
+
+type nomadVolume struct {
+	Name     string
+	Type     string
+	Source   string
+	ReadOnly bool
+}
+
+type nomadTask struct {
+	Name         string
+	Driver       string
+	Lifecycle    *nomadLifecycle `json:",omitempty"`
+	Config       nomadDockerConfig
+	Env          map[string]string  `json:",omitempty"`
+	Resources    *nomadResources    `json:",omitempty"`
+	VolumeMounts []nomadVolumeMount `json:",omitempty"`
+	Templates    []nomadTemplate    `json:",omitempty"`
+}
+
+type nomadLifecycle struct {
+	Hook    string
+	Sidecar bool
+}
+
+// nomadDockerConfig the config of the docker driver
+type nomadDockerConfig struct {
+	Image  string       `json:"image"`
+	Args   []string     `json:"args,omitempty"`
+	Ports  []string     `json:"ports,omitempty"`
+	Mounts []nomadMount `json:"mount,omitempty"`
+}
+
+type nomadMount struct {
+	Type     string `json:"type"`
+	Target   string `json:"target"`
+	Source   string `json:"source,omitempty"`
+	ReadOnly bool   `json:"readonly,omitempty"`
+}
+
+// nomadResources cpu in MHz and memory in MB, a core counts as 1000MHz
+type nomadResources struct {
+	CPU      int `json:",omitempty"`
+	MemoryMB int `json:",omitempty"`
+}
+
+type nomadVolumeMount struct {
+	Volume      string
+	Destination string
+	ReadOnly    bool
+}
+
+type nomadTemplate struct {
+	EmbeddedTmpl string
+	DestPath     string
+	ChangeMode   string
+	Perms        string `json:",omitempty"`
+	Envvars      bool   `json:",omitempty"`
+	LeftDelim    string `json:",omitempty"`
+	RightDelim   string `json:",omitempty"`
+}
+
+func (n *nomadExporter) Export() (*Result, error) {
+	n.logger.Infof("start export app %s to nomad job spec", n.ram.AppName)
+	// Delete the old application group directory and then regenerate the application package
+	if err := PrepareExportDir(n.exportPath); err != nil {
+		n.logger.Errorf("prepare export dir failure %s", err.Error())
+		return nil, err
+	}
+	n.logger.Infof("success prepare export dir")
+	dependentImages, err := n.writeJob()
+	if err != nil {
+		n.logger.Errorf("write nomad job failure %s", err.Error())
+		return nil, err
+	}
+	n.logger.Infof("success write nomad job")
+	if err := saveComponentImages(n.ram, n.imageClient, n.exportPath, n.logger, dependentImages, n.opts); err != nil {
+		return nil, err
+	}
+	n.logger.Infof("success save components")
+	if err := n.opts.secrets.WriteFile(path.Join(n.exportPath, secret.FileName)); err != nil {
+		n.logger.Errorf("write secrets file failure %s", err.Error())
+		return nil, err
+	}
+	// leave out what the baseline package ships
+	if err := writeDelta(n.exportPath, n.opts.baseline); err != nil {
+		n.logger.Errorf("write delta package failure %s", err.Error())
+		return nil, err
+	}
+	// write package manifest and sign it
+	if err := sign.SignDir(n.exportPath, n.opts.signer); err != nil {
+		n.logger.Errorf("sign package failure %s", err.Error())
+		return nil, err
+	}
+	packageName := fmt.Sprintf("%s-%s-nomad.tar.gz", n.ram.AppName, n.ram.AppVersion)
+	res, err := packageApp(packageName, n.homePath, n.exportPath, n.opts)
+	if err != nil {
+		err = fmt.Errorf("failed to package app %s: %s", packageName, err.Error())
+		n.logger.Error(err)
+		return nil, err
+	}
+	n.logger.Infof("success export app " + n.ram.AppName)
+	return res, nil
+}
+
+// writeJob write the job file, the host volume config and the run script,
+// the images the job depends on are returned
+func (n *nomadExporter) writeJob() ([]string, error) {
+	job, err := n.buildNomadJob()
+	if err != nil {
+		return nil, err
+	}
+	jobFile := job.ID + ".nomad.hcl"
+	var content []byte
+	if n.opts.nomadJSON {
+		jobFile = job.ID + ".nomad.json"
+		content, err = json.MarshalIndent(map[string]*nomadJob{"Job": job}, "", "  ")
+	} else {
+		content, err = job.hcl()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("render nomad job failure %s", err.Error())
+	}
+	if err := os.WriteFile(path.Join(n.exportPath, jobFile), content, 0644); err != nil {
+		return nil, err
+	}
+	if len(job.hostVolumes) > 0 {
+		var b strings.Builder
+		b.WriteString("# the host volumes of the job, add them to the client config of the nomad clients\nclient {\n")
+		for _, vol := range job.hostVolumes {
+			fmt.Fprintf(&b, "  host_volume %q {\n    path      = %q\n    read_only = false\n  }\n", vol, path.Join(nomadVolumeDir, vol))
+		}
+		b.WriteString("}\n")
+		if err := os.WriteFile(path.Join(n.exportPath, "host-volumes.hcl"), []byte(b.String()), 0644); err != nil {
+			return nil, err
+		}
+	}
+	flags := ""
+	if n.opts.nomadJSON {
+		flags = "-json "
+	}
+	script := strings.NewReplacer("@JOB_RUN_FLAGS@", flags, "@JOB_FILE@", jobFile, "@JOB_ID@", job.ID).Replace(nomadRunScript)
+	if err := os.WriteFile(path.Join(n.exportPath, "run.sh"), []byte(script), 0755); err != nil {
+		return nil, err
+	}
+	var dependentImages []string
+	for _, group := range job.TaskGroups {
+		for _, task := range group.Tasks {
+			if task.Lifecycle != nil && !containsString(dependentImages, task.Config.Image) {
+				dependentImages = append(dependentImages, task.Config.Image)
+			}
+		}
+	}
+	return dependentImages, nil
+}
+
+// buildNomadJob build the job of the app, every component is a task group
+// running a docker task. The outer ports are reserved on the clients as the
+// compose services publish them, the inner ports are dynamic. The dependencies
+// are reached through the nomad services and waited for by prestart tasks.
+func (n *nomadExporter) buildNomadJob() (*nomadJob, error) {
+	components, groups, err := newK8sComponents(n.ram, n.opts.secrets)
+	if err != nil {
+		return nil, err
+	}
+	job := &nomadJob{
+		ID:          nomadJobID(n.ram.AppName),
+		Name:        n.ram.AppName,
+		Type:        "service",
+		Datacenters: []string{"*"},
+	}
+	// the service of the first port of the component is looked up by the
+	// dependents, the services of the other ports by the port envs
+	services := make(map[string]string, len(components))
+	portServices := make(map[string]map[string]string, len(components))
+	for _, kc := range components {
+		if len(kc.Ports) == 0 {
+			continue
+		}
+		byPort := make(map[string]string, len(kc.Ports))
+		for i, port := range kc.Ports {
+			byPort[strconv.Itoa(port.Port)] = nomadServiceName(kc, i)
+		}
+		for _, key := range []string{kc.Component.ComponentKey, kc.Component.ServiceShareID} {
+			services[key] = kc.Name
+			portServices[key] = byPort
+		}
+	}
+	ports := newPortAllocator(n.opts.hostPorts)
+	for _, kc := range components {
+		cpt := kc.Component
+		group := &nomadTaskGroup{Name: kc.Name, Count: kc.Replicas}
+		task := &nomadTask{
+			Name:   kc.Name,
+			Driver: "docker",
+			Config: nomadDockerConfig{Image: kc.Repository + ":" + kc.Tag, Args: strings.Fields(cpt.Cmd)},
+			Env:    make(map[string]string),
+		}
+		if strings.Contains(kc.Tag, ":") {
+			task.Config.Image = kc.Repository + "@" + kc.Tag
+		}
+		// the app config groups are overridden by the component envs
+		for _, name := range kc.ConfigGroups {
+			for _, g := range groups {
+				if g.Name != name {
+					continue
+				}
+				for k, v := range g.Items {
+					task.Env[k] = v
+				}
+			}
+		}
+		for k, v := range kc.Envs {
+			task.Env[k] = v
+		}
+		if kc.Memory > 0 || kc.CPU > 0 {
+			task.Resources = &nomadResources{CPU: kc.CPU, MemoryMB: kc.Memory}
+		}
+
+		// ports and services
+		var network nomadNetwork
+		labels := make(map[int]string, len(kc.Ports))
+		for i, port := range kc.Ports {
+			label := strings.ReplaceAll(port.Name, "-", "_")
+			if port.IsOuter {
+				hostPort := ports.hostPort(port.Port, kc.Name, cpt.ComponentKey, cpt.ServiceCname)
+				if err := ports.reserve(kc.Name, hostPort, port.Port, port.Protocol); err != nil {
+					return nil, err
+				}
+				network.ReservedPorts = append(network.ReservedPorts, nomadPort{Label: label, Value: hostPort, To: port.Port})
+			} else {
+				// the inner ports are reached through the services only
+				network.DynamicPorts = append(network.DynamicPorts, nomadPort{Label: label, To: port.Port})
+			}
+			task.Config.Ports = append(task.Config.Ports, label)
+			labels[port.Port] = label
+			group.Services = append(group.Services, nomadService{Name: nomadServiceName(kc, i), PortLabel: label, Provider: "nomad"})
+		}
+		if len(network.ReservedPorts) > 0 || len(network.DynamicPorts) > 0 {
+			group.Networks = []nomadNetwork{network}
+		}
+		for _, probe := range cpt.Probes {
+			check := nomadProbeCheck(probe)
+			label, ok := labels[probe.Port]
+			if check == nil || !ok {
+				continue
+			}
+			for i := range group.Services {
+				if group.Services[i].PortLabel == label {
+					group.Services[i].Checks = append(group.Services[i].Checks, *check)
+				}
+			}
+		}
+
+		// volumes
+		for _, vol := range kc.Volumes {
+			if vol.MemoryFS {
+				task.Config.Mounts = append(task.Config.Mounts, nomadMount{Type: "tmpfs", Target: vol.MountPath})
+				continue
+			}
+			n.mountHostVolume(job, group, task, vol.ClaimName, vol.MountPath)
+		}
+		for _, mount := range kc.SharedMount {
+			n.mountHostVolume(job, group, task, mount.ClaimName, mount.MountPath)
+		}
+		for _, file := range kc.ConfigFiles {
+			dest := path.Join("local", "config", file.Key)
+			tmpl := nomadTemplate{
+				EmbeddedTmpl: file.Content,
+				DestPath:     dest,
+				ChangeMode:   "restart",
+				LeftDelim:    nomadTemplateDelims[0],
+				RightDelim:   nomadTemplateDelims[1],
+			}
+			if file.Mode != nil {
+				tmpl.Perms = fmt.Sprintf("%o", *file.Mode)
+			}
+			task.Templates = append(task.Templates, tmpl)
+			task.Config.Mounts = append(task.Config.Mounts, nomadMount{Type: "bind", Source: dest, Target: file.MountPath, ReadOnly: true})
+		}
+
+		// dependencies
+		var depEnvs strings.Builder
+		for _, dep := range cpt.DepServiceMapList {
+			service, ok := services[dep.DepServiceKey]
+			if !ok {
+				continue
+			}
+			envs, err := getPublicEnvByKey(dep.DepServiceKey, n.ram.Components, n.opts.secrets)
+			if err != nil {
+				return nil, err
+			}
+			for _, k := range sortedKeys(envs) {
+				// the dependency runs on another client, its address and
+				// the host ports come from the services
+				if isLoopbackHost(envs[k]) {
+					delete(task.Env, k)
+					fmt.Fprintf(&depEnvs, "%s={{ with nomadService %q }}{{ (index . 0).Address }}{{ end }}\n", k, service)
+				} else if portService, ok := portServices[dep.DepServiceKey][envs[k]]; ok {
+					delete(task.Env, k)
+					fmt.Fprintf(&depEnvs, "%s={{ with nomadService %q }}{{ (index . 0).Port }}{{ end }}\n", k, portService)
+				}
+			}
+			group.Tasks = append(group.Tasks, nomadWaitTask(service))
+		}
+		if depEnvs.Len() > 0 {
+			task.Templates = append(task.Templates, nomadTemplate{
+				EmbeddedTmpl: depEnvs.String(),
+				DestPath:     path.Join("local", "dependencies.env"),
+				ChangeMode:   "restart",
+				Envvars:      true,
+			})
+		}
+		group.Tasks = append([]*nomadTask{task}, group.Tasks...)
+		job.TaskGroups = append(job.TaskGroups, group)
+	}
+	return job, nil
+}
+
+// nomadServiceName the service name of the i-th port of the component
+func nomadServiceName(kc *k8sComponent, i int) string {
+	if i == 0 {
+		return kc.Name
+	}
+	return k8sName(kc.Name + "-" + kc.Ports[i].Name)
+}
+
+// mountHostVolume mount the host volume of the claim into the task, the
+// volumes are app scoped on the clients
+func (n *nomadExporter) mountHostVolume(job *nomadJob, group *nomadTaskGroup, task *nomadTask, claim, mountPath string) {
+	source := k8sName(job.ID + "-" + claim)
+	if !containsString(job.hostVolumes, source) {
+		job.hostVolumes = append(job.hostVolumes, source)
+	}
+	name := k8sName(claim)
+	if group.Volumes == nil {
+		group.Volumes = make(map[string]nomadVolume)
+	}
+	group.Volumes[name] = nomadVolume{Name: name, Type: "host", Source: source}
+	task.VolumeMounts = append(task.VolumeMounts, nomadVolumeMount{Volume: name, Destination: mountPath})
+}
+
+// nomadProbeCheck the service check of the probe, nil if nomad services can
+// not run it. Failed liveness checks restart the task.
+func nomadProbeCheck(probe v1alpha1.ComponentProbe) *nomadCheck {
+	// the nomad service provider runs http and tcp checks only
+	if !probe.IsUsed || probe.Cmd != "" || probe.Validation() != nil {
+		return nil
+	}
+	check := &nomadCheck{
+		Name:     probe.Mode,
+		Type:     "tcp",
+		Interval: 10 * time.Second,
+		Timeout:  time.Second,
+	}
+	if check.Name == "" {
+		check.Name = "probe"
+	}
+	if strings.ToLower(probe.Scheme) == "http" {
+		check.Type = "http"
+		check.Path = "/" + strings.TrimPrefix(probe.Path, "/")
+		for _, h := range probeHeaders(probe.HTTPHeader) {
+			if check.Header == nil {
+				check.Header = make(map[string][]string)
+			}
+			check.Header[h[0]] = append(check.Header[h[0]], h[1])
+		}
+	}
+	if probe.PeriodSecond > 0 {
+		check.Interval = time.Duration(probe.PeriodSecond) * time.Second
+	}
+	if probe.TimeoutSecond > 0 {
+		check.Timeout = time.Duration(probe.TimeoutSecond) * time.Second
+	}
+	if probe.Mode == "liveness" {
+		check.CheckRestart = &nomadCheckRestart{Limit: max(probe.FailureThreshold, 1), Grace: time.Duration(probe.InitialDelaySecond) * time.Second}
+	}
+	return check
+}
+
+// nomadWaitTask the prestart task waiting until the service of the dependency accepts connections
+func nomadWaitTask(service string) *nomadTask {
+	return &nomadTask{
+		Name:      "wait-" + service,
+		Driver:    "docker",
+		Lifecycle: &nomadLifecycle{Hook: "prestart"},
+		Config: nomadDockerConfig{
+			Image: nomadWaitImage,
+			Args:  []string{"sh", "-c", "until [ -n \"$ADDR\" ] && nc -z \"$ADDR\" \"$PORT\"; do sleep 2; done"},
+		},
+		Resources: &nomadResources{CPU: 50, MemoryMB: 32},
+		Templates: []nomadTemplate{{
+			EmbeddedTmpl: fmt.Sprintf("{{ with nomadService %q }}{{ with index . 0 }}ADDR={{ .Address }}\nPORT={{ .Port }}{{ end }}{{ end }}\n", service),
+			DestPath:     path.Join("local", "wait.env"),
+			ChangeMode:   "restart",
+			Envvars:      true,
+		}},
+	}
+}
+
+// nomadJobID the job id of the app
+func nomadJobID(appName string) string {
+	id := k8sName(composeName(appName))
+	if id == "" {
+		return "app"
+	}
+	return id
+}
+
+// hcl render the job in the nomad job specification language
+func (j *nomadJob) hcl() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := nomadJobTemplate.Execute(&buf, j); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// hclString quote the string for hcl, the template sequences are escaped
+func hclString(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	quoted := strings.TrimSuffix(buf.String(), "\n")
+	return strings.NewReplacer("${", "$${", "%{", "%%{").Replace(quoted)
+}
+
+func hclList(list []string) string {
+	quoted := make([]string, len(list))
+	for i, s := range list {
+		quoted[i] = hclString(s)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+var nomadJobTemplate = template.Must(template.New("job").Funcs(template.FuncMap{
+	"hcl":     hclString,
+	"hclList": hclList,
+	"dur":     func(d time.Duration) string { return hclString(d.String()) },
+}).Parse(`job {{ hcl .ID }} {
+  name        = {{ hcl .Name }}
+  type        = {{ hcl .Type }}
+  datacenters = {{ hclList .Datacenters }}
+{{- range .TaskGroups }}
+
+  group {{ hcl .Name }} {
+    count = {{ .Count }}
+{{- range .Networks }}
+
+    network {
+{{- range .ReservedPorts }}
+      port {{ hcl .Label }} {
+        static = {{ .Value }}
+        to     = {{ .To }}
+      }
+{{- end }}
+{{- range .DynamicPorts }}
+      port {{ hcl .Label }} {
+        to = {{ .To }}
+      }
+{{- end }}
+    }
+{{- end }}
+{{- range $name, $vol := .Volumes }}
+
+    volume {{ hcl $name }} {
+      type      = {{ hcl $vol.Type }}
+      source    = {{ hcl $vol.Source }}
+      read_only = {{ $vol.ReadOnly }}
+    }
+{{- end }}
+{{- range .Services }}
+
+    service {
+      name     = {{ hcl .Name }}
+      port     = {{ hcl .PortLabel }}
+      provider = {{ hcl .Provider }}
+{{- range .Checks }}
+
+      check {
+        name     = {{ hcl .Name }}
+        type     = {{ hcl .Type }}
+{{- if .Path }}
+        path     = {{ hcl .Path }}
+{{- end }}
+        interval = {{ dur .Interval }}
+        timeout  = {{ dur .Timeout }}
+{{- with .Header }}
+        header = {
+{{- range $k, $v := . }}
+          {{ hcl $k }} = {{ hclList $v }}
+{{- end }}
+        }
+{{- end }}
+{{- with .CheckRestart }}
+
+        check_restart {
+          limit = {{ .Limit }}
+          grace = {{ dur .Grace }}
+        }
+{{- end }}
+      }
+{{- end }}
+    }
+{{- end }}
+{{- range .Tasks }}
+
+    task {{ hcl .Name }} {
+      driver = {{ hcl .Driver }}
+{{- with .Lifecycle }}
+
+      lifecycle {
+        hook    = {{ hcl .Hook }}
+        sidecar = {{ .Sidecar }}
+      }
+{{- end }}
+
+      config {
+        image = {{ hcl .Config.Image }}
+{{- with .Config.Args }}
+        args  = {{ hclList . }}
+{{- end }}
+{{- with .Config.Ports }}
+        ports = {{ hclList . }}
+{{- end }}
+{{- range .Config.Mounts }}
+
+        mount {
+          type     = {{ hcl .Type }}
+          target   = {{ hcl .Target }}
+{{- if .Source }}
+          source   = {{ hcl .Source }}
+{{- end }}
+{{- if .ReadOnly }}
+          readonly = true
+{{- end }}
+        }
+{{- end }}
+      }
+{{- with .Env }}
+
+      env = {
+{{- range $k, $v := . }}
+        {{ hcl $k }} = {{ hcl $v }}
+{{- end }}
+      }
+{{- end }}
+{{- with .Resources }}
+
+      resources {
+{{- if .CPU }}
+        cpu    = {{ .CPU }}
+{{- end }}
+{{- if .MemoryMB }}
+        memory = {{ .MemoryMB }}
+{{- end }}
+      }
+{{- end }}
+{{- range .VolumeMounts }}
+
+      volume_mount {
+        volume      = {{ hcl .Volume }}
+        destination = {{ hcl .Destination }}
+        read_only   = {{ .ReadOnly }}
+      }
+{{- end }}
+{{- range .Templates }}
+
+      template {
+        data        = {{ hcl .EmbeddedTmpl }}
+        destination = {{ hcl .DestPath }}
+        change_mode = {{ hcl .ChangeMode }}
+{{- if .Perms }}
+        perms       = {{ hcl .Perms }}
+{{- end }}
+{{- if .Envvars }}
+        env         = true
+{{- end }}
+{{- if .LeftDelim }}
+        left_delimiter  = {{ hcl .LeftDelim }}
+        right_delimiter = {{ hcl .RightDelim }}
+{{- end }}
+      }
+{{- end }}
+    }
+{{- end }}
+  }
+{{- end }}
+}
+`))
+
+var nomadRunScript = `#!/bin/bash
+cd $(dirname $0)
+cmd="$1"
+[[ x$cmd == x ]] && cmd=start
+
+eprint() {
+  echo -e "\033[0;37;41m $* \033[0m"
+}
+
+iprint() {
+  echo -e "\033[0;37;42m $* \033[0m"
+}
+
+check::dependency() {
+  which nomad &>/dev/null || {
+    eprint 'Not found nomad command!'
+    return 11
+  }
+  which docker &>/dev/null || {
+    eprint 'Not found docker command!'
+    return 12
+  }
+  return 0
+}
+
+# import::image load the images into the docker of this client, run
+# "./run.sh import::image" on every other client the job may be placed on
+import::image() {
+  [[ -d images ]] || return 0
+  tar -cC images . | docker load
+}
+
+# volume::dir create the dirs of the host volumes on this client
+volume::dir() {
+  [[ -f host-volumes.hcl ]] || return 0
+  grep -o 'path *= *"[^"]*"' host-volumes.hcl | cut -d'"' -f2 | xargs -r mkdir -p
+  iprint 'add host-volumes.hcl to the client config and restart the nomad client if the volumes are new'
+}
+
+start() {
+  import::image
+  volume::dir
+  nomad job run @JOB_RUN_FLAGS@@JOB_FILE@
+}
+
+stop() {
+  nomad job stop @JOB_ID@
+}
+
+main() {
+  check::dependency || exit $?
+
+  eval "$cmd"
+}
+
+main
+`
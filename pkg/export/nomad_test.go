@@ -0,0 +1,142 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltr.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltr.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+)
+
+func TestNomadJob(t *testing.T) {
+	ram := testRAM()
+	ram.Components[1].Probes = []v1alpha1.ComponentProbe{
+		{Scheme: "tcp", Port: 3306, Mode: "liveness", IsUsed: true, FailureThreshold: 3, InitialDelaySecond: 30},
+	}
+	ram.Components[1].ServiceConnectInfoMapList = append(ram.Components[1].ServiceConnectInfoMapList, v1alpha1.ComponentEnv{AttrName: "MYSQL_PORT", AttrValue: "3306"})
+	n := &nomadExporter{logger: logrus.New(), ram: ram, opts: newOptions(WithHostPort("web-key", 8080, 18080))}
+	job, err := n.buildNomadJob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != "demo" || len(job.TaskGroups) != 2 {
+		t.Fatalf("unexpected job %s with %d groups", job.ID, len(job.TaskGroups))
+	}
+	web, mysql := job.TaskGroups[0], job.TaskGroups[1]
+	if web.Count != 2 || web.Networks[0].ReservedPorts[0] != (nomadPort{Label: "web", Value: 18080, To: 8080}) {
+		t.Errorf("unexpected web group %+v", web)
+	}
+	task := web.Tasks[0]
+	if task.Config.Image != "hub.example.com/demo/web:v1" || strings.Join(task.Config.Args, " ") != "run --port 8080" {
+		t.Errorf("unexpected web task config %+v", task.Config)
+	}
+	if task.Env["TZ"] != "Asia/Shanghai" || task.Resources.MemoryMB != 512 || task.Resources.CPU != 250 {
+		t.Errorf("unexpected web task env %v resources %+v", task.Env, task.Resources)
+	}
+	if _, ok := task.Env["MYSQL_HOST"]; ok {
+		t.Errorf("expect the loopback dependency address replaced by the service address")
+	}
+	if _, ok := task.Env["MYSQL_PORT"]; ok {
+		t.Errorf("expect the dependency port replaced by the service port")
+	}
+	if len(mysql.Networks[0].ReservedPorts) != 0 || mysql.Networks[0].DynamicPorts[0] != (nomadPort{Label: "mysql", To: 3306}) {
+		t.Errorf("expect the inner mysql port dynamic, got %+v", mysql.Networks)
+	}
+	if web.Services[0].Checks[0].Type != "http" || web.Services[0].Checks[0].Path != "/healthz" {
+		t.Errorf("unexpected web checks %+v", web.Services[0].Checks)
+	}
+	var templates []string
+	for _, tmpl := range task.Templates {
+		templates = append(templates, tmpl.DestPath)
+	}
+	if strings.Join(templates, ",") != "local/config/etc-web-app.conf,local/dependencies.env" || !strings.Contains(task.Templates[1].EmbeddedTmpl, `MYSQL_HOST={{ with nomadService "mysql" }}`) ||
+		!strings.Contains(task.Templates[1].EmbeddedTmpl, `MYSQL_PORT={{ with nomadService "mysql" }}{{ (index . 0).Port }}{{ end }}`) {
+		t.Errorf("unexpected web templates %v", task.Templates)
+	}
+	if task.VolumeMounts[0].Volume != "web-data" || web.Volumes["web-data"].Source != "demo-web-data" {
+		t.Errorf("unexpected web volumes %v %v", task.VolumeMounts, web.Volumes)
+	}
+	if len(web.Tasks) != 2 || web.Tasks[1].Lifecycle.Hook != "prestart" || web.Tasks[1].Config.Image != nomadWaitImage {
+		t.Errorf("expect web waiting for mysql in a prestart task")
+	}
+	check := mysql.Services[0].Checks[0]
+	if check.Type != "tcp" || check.CheckRestart == nil || check.CheckRestart.Limit != 3 {
+		t.Errorf("unexpected mysql liveness check %+v", check)
+	}
+
+	content, err := job.hcl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hcl := string(content)
+	for _, expect := range []string{
+		`job "demo" {`,
+		`        static = 18080`,
+		`        to = 3306`,
+		`        data        = "listen={{port}}"`,
+		`        left_delimiter  = "[[wutong:"`,
+		`        hook    = "prestart"`,
+		`          grace = "30s"`,
+	} {
+		if !strings.Contains(hcl, expect) {
+			t.Errorf("expect %q in the job:\n%s", expect, hcl)
+		}
+	}
+}
+
+func TestNomadJobFiles(t *testing.T) {
+	dir := t.TempDir()
+	n := &nomadExporter{logger: logrus.New(), ram: testRAM(), exportPath: dir, opts: newOptions(WithNomadJSON())}
+	dependentImages, err := n.writeJob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dependentImages) != 1 || dependentImages[0] != nomadWaitImage {
+		t.Errorf("unexpected dependent images %v", dependentImages)
+	}
+	content, err := os.ReadFile(path.Join(dir, "demo.nomad.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		Job struct {
+			ID         string
+			TaskGroups []struct {
+				Tasks []struct {
+					Config map[string]interface{}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(content, &spec); err != nil || spec.Job.ID != "demo" || spec.Job.TaskGroups[0].Tasks[0].Config["image"] != "hub.example.com/demo/web:v1" {
+		t.Errorf("unexpected json job %s", content)
+	}
+	volumes, err := os.ReadFile(path.Join(dir, "host-volumes.hcl"))
+	if err != nil || !strings.Contains(string(volumes), `host_volume "demo-mysql-mysqldata"`) {
+		t.Errorf("unexpected host volumes %s", volumes)
+	}
+	script, err := os.ReadFile(path.Join(dir, "run.sh"))
+	if err != nil || !strings.Contains(string(script), "nomad job run -json demo.nomad.json") {
+		t.Errorf("unexpected run script %s", script)
+	}
+}
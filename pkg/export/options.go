@@ -0,0 +1,230 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"os"
+	"time"
+
+	"github.com/wutong-paas/wutong-oam/pkg/util/destination"
+	"github.com/wutong-paas/wutong-oam/pkg/util/registry"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
+)
+
+// Option export option
+type Option func(*options)
+
+type options struct {
+	secrets             *secret.Store
+	signer              sign.Signer
+	environmentProfiles []EnvironmentProfile
+	composeHostNetwork  bool
+	systemdUnits        bool
+	systemdRestart      string
+	dryRun              bool
+	baseline            string
+	// hostPorts host ports of the published container ports, keyed by component:port
+	hostPorts map[string]int
+	// pullWorkers the concurrent image pulls, at most registryPullLimit against one registry
+	pullWorkers       int
+	registryPullLimit int
+	pullRetries       int
+	pullBackoff       time.Duration
+	// pullTimeout the timeout of one pull in minutes
+	pullTimeout int
+	// zipPackage write the package as zip, zipStore reports the files stored without compression
+	zipPackage bool
+	zipStore   func(file string, info os.FileInfo) bool
+	// splitSize the size limit of the package parts, the package is not split if 0
+	splitSize int64
+	// nomadJSON write the nomad job as json instead of hcl
+	nomadJSON bool
+	// gitops the repository and the tool of the gitops layout
+	gitops GitOpsConfig
+	// destination where the package is streamed to instead of the home path
+	destination destination.Destination
+	// registryOpts the options of the registry clients looking up the image sizes
+	registryOpts []registry.Option
+}
+
+func newOptions(opts ...Option) options {
+	o := options{
+		pullWorkers:       defaultPullWorkers,
+		registryPullLimit: defaultRegistryPullLimit,
+		pullRetries:       defaultPullRetries,
+		pullBackoff:       defaultPullBackoff,
+		pullTimeout:       defaultPullTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.secrets == nil {
+		o.secrets = secret.NewStore()
+	}
+	return o
+}
+
+// WithSigner sign the package manifest, the detached signature is stored in the package
+func WithSigner(signer sign.Signer) Option {
+	return func(o *options) {
+		o.signer = signer
+	}
+}
+
+// WithEnvironmentProfiles the environments rendered as kustomize overlays
+func WithEnvironmentProfiles(profiles ...EnvironmentProfile) Option {
+	return func(o *options) {
+		o.environmentProfiles = append(o.environmentProfiles, profiles...)
+	}
+}
+
+// WithComposeHostNetwork run the docker compose services in the host network,
+// as the legacy installs do
+func WithComposeHostNetwork() Option {
+	return func(o *options) {
+		o.composeHostNetwork = true
+	}
+}
+
+// WithHostPort publish the container port of the component on the host port,
+// component is the compose service name, component key or component name
+func WithHostPort(component string, containerPort, hostPort int) Option {
+	return func(o *options) {
+		if o.hostPorts == nil {
+			o.hostPorts = make(map[string]int)
+		}
+		o.hostPorts[hostPortKey(component, containerPort)] = hostPort
+	}
+}
+
+// WithSecretStore generate the values of the "**None**" placeholders with the store,
+// a store with the default random generator is used if not set
+func WithSecretStore(store *secret.Store) Option {
+	return func(o *options) {
+		o.secrets = store
+	}
+}
+
+// WithSystemdUnits emit systemd units of the slug components, restart is the
+// Restart= policy of the units, on-failure by default
+func WithSystemdUnits(restart string) Option {
+	return func(o *options) {
+		o.systemdUnits = true
+		o.systemdRestart = restart
+	}
+}
+
+// WithDryRun plan the export instead of running it, the plan is returned in
+// the result and nothing is written into the export dir
+func WithDryRun() Option {
+	return func(o *options) {
+		o.dryRun = true
+	}
+}
+
+// WithBaseline export a delta package holding only the files and image layers
+// the baseline lacks, baseline is a package, an unpacked package dir or the
+// package manifest of it
+func WithBaseline(baseline string) Option {
+	return func(o *options) {
+		o.baseline = baseline
+	}
+}
+
+// WithPullConcurrency pull at most workers images at a time and at most
+// perRegistry of them from one registry
+func WithPullConcurrency(workers, perRegistry int) Option {
+	return func(o *options) {
+		o.pullWorkers = max(workers, 1)
+		o.registryPullLimit = max(perRegistry, 1)
+	}
+}
+
+// WithPullRetries retry the pulls failed with transient registry errors,
+// the backoff doubles after every retry
+func WithPullRetries(retries int, backoff time.Duration) Option {
+	return func(o *options) {
+		o.pullRetries = max(retries, 0)
+		o.pullBackoff = backoff
+	}
+}
+
+// WithPullTimeout the timeout of one image pull in minutes, 30 by default
+func WithPullTimeout(minutes int) Option {
+	return func(o *options) {
+		o.pullTimeout = max(minutes, 1)
+	}
+}
+
+// WithZipPackage write the package as zip instead of tar.gz, store reports
+// the files stored as they are, the others are deflated. The files that are
+// compressed already are stored if store is nil.
+func WithZipPackage(store func(file string, info os.FileInfo) bool) Option {
+	return func(o *options) {
+		o.zipPackage = true
+		o.zipStore = store
+	}
+}
+
+// WithSplitSize split the package into numbered parts of at most size bytes,
+// a part manifest with the checksums is written next to the parts and the
+// first part is returned as the package. A package within size is not split.
+func WithSplitSize(size int64) Option {
+	return func(o *options) {
+		o.splitSize = size
+	}
+}
+
+// WithDestination stream the package to the destination instead of writing
+// it under the home path, the result carries the location of the delivered
+// package. Split packages are delivered as parts even if they fit one.
+// The export dir, saved images included, is still staged under the home path
+// and needs the space of the unpacked package until the delivery succeeds,
+// it is removed afterwards. A failed delivery leaves it for a retry.
+func WithDestination(dest destination.Destination) Option {
+	return func(o *options) {
+		o.destination = dest
+	}
+}
+
+// WithNomadJSON write the nomad job in the json job format, accepted by
+// nomad job run -json, instead of hcl
+func WithNomadJSON() Option {
+	return func(o *options) {
+		o.nomadJSON = true
+	}
+}
+
+// WithGitOps the repository the gitops layout is committed to and the tool
+// syncing it, the environment profiles are the environments of the layout.
+// Generated secrets are written next to the package, not into the layout.
+func WithGitOps(config GitOpsConfig) Option {
+	return func(o *options) {
+		o.gitops = config
+	}
+}
+
+// WithRegistryOptions the options of the registry clients the dry run looks up
+// the image sizes with, eg. plain http or a client trusting a self-signed registry
+func WithRegistryOptions(opts ...registry.Option) Option {
+	return func(o *options) {
+		o.registryOpts = append(o.registryOpts, opts...)
+	}
+}
@@ -0,0 +1,430 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/registry"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
+)
+
+// imageExpandRatio how much larger than the compressed images the saved image
+// tars are while the package is built
+const imageExpandRatio = 2
+
+// formatSuffixes the suffix of the export dir and package name of the formats
+var formatSuffixes = map[AppFormat]string{
+	RAM:       "ram",
+	DC:        "dockercompose",
+	SLG:       "slug",
+	HELM:      "helm",
+	YAML:      "yaml",
+	KUSTOMIZE: "kustomize",
+	BUNDLE:    "bundle",
+	NOMAD:     "nomad",
+	QUADLET:   "quadlet",
+	SWARM:     "swarm",
+	GITOPS:    "gitops",
+}
+
+// Plan what an export would pull and write, the export dir is not touched
+type Plan struct {
+	Format      AppFormat              `json:"format"`
+	PackageName string                 `json:"package_name"`
+	ExportPath  string                 `json:"export_path"`
+	Images      []ImagePlan            `json:"images"`
+	Files       []FilePlan             `json:"files"`
+	Unsupported []UnsupportedComponent `json:"unsupported,omitempty"`
+	// Missing images that can not be pulled, or whose credentials are missing or denied
+	Missing []string `json:"missing,omitempty"`
+	// ImageSize the compressed size of the images
+	ImageSize int64 `json:"image_size"`
+	// EstimatedSize the estimated size of the package
+	EstimatedSize int64 `json:"estimated_size"`
+	// RequiredSpace the disk space the export needs under the home path
+	RequiredSpace int64 `json:"required_space"`
+	// AvailableSpace the free disk space under the home path, -1 if unknown
+	AvailableSpace int64 `json:"available_space"`
+	// SecretsFile the secrets file written next to the package, the gitops
+	// layout keeps the generated secrets out of the export dir
+	SecretsFile string `json:"secrets_file,omitempty"`
+}
+
+// ImagePlan an image the export pulls
+type ImagePlan struct {
+	Image string `json:"image"`
+	// Kind component, plugin, dependent or gateway
+	Kind  string `json:"kind"`
+	Owner string `json:"owner,omitempty"`
+	Size  int64  `json:"size"`
+	// SizeFrom registry, the compressed size from the manifest, or local, the size of the local image
+	SizeFrom string `json:"size_from,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// FilePlan a file written into the export dir, Estimated is set if the size is an upper bound
+type FilePlan struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Estimated bool   `json:"estimated,omitempty"`
+}
+
+// UnsupportedComponent a component the format can not represent
+type UnsupportedComponent struct {
+	Component string `json:"component"`
+	Reason    string `json:"reason"`
+}
+
+// Check fails if images are missing or the disk space is not enough
+func (p *Plan) Check() error {
+	var problems []string
+	if len(p.Missing) > 0 {
+		problems = append(problems, fmt.Sprintf("missing images: %s", strings.Join(p.Missing, "; ")))
+	}
+	if p.AvailableSpace >= 0 && p.RequiredSpace > p.AvailableSpace {
+		problems = append(problems, fmt.Sprintf("export needs %d bytes of disk space, %d bytes available", p.RequiredSpace, p.AvailableSpace))
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+type planExporter struct {
+	logger      *logrus.Logger
+	ram         v1alpha1.WutongApplicationConfig
+	imageClient image.Client
+	format      AppFormat
+	homePath    string
+	exportPath  string
+	opts        options
+}
+
+// Export build the plan, the plan is returned with the result
+func (p *planExporter) Export() (*Result, error) {
+	p.logger.Infof("start plan export of app %s to %s", p.ram.AppName, p.format)
+	plan := &Plan{
+		Format:         p.format,
+		PackageName:    p.packageName(),
+		ExportPath:     p.exportPath,
+		Unsupported:    unsupportedComponents(p.format, p.ram),
+		AvailableSpace: -1,
+	}
+	scratch, err := os.MkdirTemp("", "export-plan-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(scratch)
+	exportDir := path.Join(scratch, path.Base(p.exportPath))
+	dependentImages, err := p.renderFiles(exportDir)
+	if err != nil {
+		p.logger.Errorf("render files of the plan failure %s", err.Error())
+		return nil, err
+	}
+	if p.format == GITOPS {
+		if _, err := os.Stat(path.Join(scratch, gitOpsSecretsFile(p.ram))); err == nil {
+			plan.SecretsFile = path.Join(p.homePath, gitOpsSecretsFile(p.ram))
+		}
+	}
+	p.planImages(plan, dependentImages)
+	if err := p.planFiles(plan, exportDir); err != nil {
+		return nil, err
+	}
+	// the saved images and the package exist at the same time
+	plan.RequiredSpace = plan.ImageSize*imageExpandRatio + plan.EstimatedSize
+	if available, err := availableSpace(p.homePath); err != nil {
+		p.logger.Warningf("get available disk space of %s failure %s", p.homePath, err.Error())
+	} else {
+		plan.AvailableSpace = available
+	}
+	p.logger.Infof("success plan export of app %s, %d images, %d files, estimated size %d", p.ram.AppName, len(plan.Images), len(plan.Files), plan.EstimatedSize)
+	return &Result{PackageName: plan.PackageName, PackageFormat: string(p.format), Plan: plan}, nil
+}
+
+// renderFiles write the files of the format into dir, the images the
+// manifests depend on are returned. The images are not saved.
+func (p *planExporter) renderFiles(dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// the exporters strip the image credentials off the app, render a copy
+	ram, err := copyRAM(p.ram)
+	if err != nil {
+		return nil, err
+	}
+	opts := p.opts
+	opts.secrets = secret.NewStore()
+	var dependentImages []string
+	switch p.format {
+	case RAM, BUNDLE:
+		r := &ramExporter{logger: p.logger, ram: ram, mode: "offline", exportPath: dir, opts: opts}
+		err = r.writeMetaFile()
+	case DC:
+		d := &dockerComposeExporter{logger: p.logger, ram: ram, exportPath: dir, opts: opts}
+		if err = d.writeConfigFiles(); err == nil {
+			if err = d.buildDockerComposeYaml(); err == nil {
+				err = d.buildStartScript()
+			}
+		}
+	case SLG:
+		err = p.renderSlugFiles(ram, dir, opts)
+	case HELM:
+		h := &helmChartExporter{logger: p.logger, ram: ram, mode: "offline", exportPath: dir, opts: opts}
+		dependentImages, err = h.initHelmChart()
+	case YAML:
+		y := &k8sYamlExporter{logger: p.logger, ram: ram, mode: "offline", exportPath: dir, opts: opts}
+		dependentImages, err = y.writeK8sYaml(path.Join(dir, ram.AppName))
+	case KUSTOMIZE:
+		k := &kustomizeExporter{logger: p.logger, ram: ram, mode: "offline", exportPath: dir, opts: opts}
+		appPath := path.Join(dir, ram.AppName)
+		components, groups, cerr := newK8sComponents(ram, opts.secrets)
+		if err = cerr; err == nil {
+			if dependentImages, err = k.writeBase(path.Join(appPath, "base"), components, groups); err == nil {
+				err = k.writeOverlays(appPath, components, dependentImages)
+			}
+		}
+	case NOMAD:
+		n := &nomadExporter{logger: p.logger, ram: ram, exportPath: dir, opts: opts}
+		dependentImages, err = n.writeJob()
+	case QUADLET:
+		q := &quadletExporter{logger: p.logger, ram: ram, exportPath: dir, opts: opts}
+		err = q.writeUnits()
+	case SWARM:
+		sw := &swarmExporter{logger: p.logger, ram: ram, exportPath: dir, opts: opts}
+		err = sw.writeStack()
+	case GITOPS:
+		g := &gitOpsExporter{logger: p.logger, ram: ram, exportPath: dir, opts: opts}
+		err = g.writeLayout()
+	default:
+		return nil, fmt.Errorf("not support app format %s", p.format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch p.format {
+	case RAM, BUNDLE:
+	case GITOPS:
+		// the secrets file is written next to the export dir as the package
+		if err := opts.secrets.WriteFile(path.Join(path.Dir(dir), gitOpsSecretsFile(ram))); err != nil {
+			return nil, err
+		}
+	default:
+		if err := opts.secrets.WriteFile(path.Join(dir, secret.FileName)); err != nil {
+			return nil, err
+		}
+	}
+	// the manifest of the gitops layout is written next to the package
+	if p.format != GITOPS {
+		if _, err := sign.WriteManifest(dir); err != nil {
+			return nil, err
+		}
+	}
+	return dependentImages, nil
+}
+
+// renderSlugFiles write the scripts of the source code components, the slugs
+// come out of the images and are planned apart
+func (p *planExporter) renderSlugFiles(ram v1alpha1.WutongApplicationConfig, dir string, opts options) error {
+	s := &slugExporter{logger: p.logger, ram: ram, mode: "offline", exportPath: dir, opts: opts}
+	var components []*slugComponent
+	for _, component := range ram.Components {
+		if component.ServiceSource != sourceCode {
+			continue
+		}
+		slugPath := path.Join(dir, component.ServiceCname)
+		if err := os.MkdirAll(slugPath, 0755); err != nil {
+			return err
+		}
+		if err := s.writeEnvFile(component, slugPath, ram.AppConfigGroups); err != nil {
+			return err
+		}
+		if err := s.writeRunScript(slugPath, component.ServiceCname, ""); err != nil {
+			return err
+		}
+		components = append(components, &slugComponent{Component: component})
+	}
+	if err := s.writeAppScript(dir, ram.AppName, components); err != nil {
+		return err
+	}
+	if opts.systemdUnits {
+		return s.writeSystemdUnits(components)
+	}
+	return nil
+}
+
+// planImages look up the size of every image the export pulls, in the
+// registry first and then locally
+func (p *planExporter) planImages(plan *Plan, dependentImages []string) {
+	if !p.ram.WithImageData && p.format != SLG && p.format != BUNDLE {
+		return
+	}
+	// the gitops layout is committed without the images
+	if p.format == GITOPS {
+		return
+	}
+	seen := make(map[string]bool)
+	add := func(img ImagePlan, user, pass string) {
+		if img.Image == "" || seen[img.Image] {
+			return
+		}
+		seen[img.Image] = true
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		size, err := registry.NewClient(user, pass, p.opts.registryOpts...).ImageSize(ctx, img.Image)
+		if err == nil {
+			img.Size, img.SizeFrom = size, "registry"
+		} else {
+			img.Error = err.Error()
+			if sizer, ok := p.imageClient.(image.Sizer); ok {
+				if size, lerr := sizer.ImageSize(img.Image); lerr == nil {
+					img.Size, img.SizeFrom = size, "local"
+				}
+			}
+			// the registry may only be reachable through the daemon, eg. over plain
+			// http or with a self-signed certificate, a local image is exported as it is
+			if img.SizeFrom == "" {
+				plan.Missing = append(plan.Missing, fmt.Sprintf("%s %s image %s: %s", img.Kind, img.Owner, img.Image, err.Error()))
+			}
+		}
+		plan.ImageSize += img.Size
+		plan.Images = append(plan.Images, img)
+	}
+	for _, component := range p.ram.Components {
+		if p.format == SLG && component.ServiceSource != sourceCode {
+			continue
+		}
+		add(ImagePlan{Image: component.ShareImage, Kind: "component", Owner: component.ServiceCname}, component.AppImage.HubUser, component.AppImage.HubPassword)
+	}
+	if p.format == SLG {
+		return
+	}
+	for _, dependentImage := range dependentImages {
+		add(ImagePlan{Image: dependentImage, Kind: "dependent"}, "", "")
+	}
+	if (p.format == DC || p.format == SWARM) && hasGatewayRoutes(p.ram) {
+		add(ImagePlan{Image: gatewayImage, Kind: "gateway", Owner: gatewayServiceName}, "", "")
+	}
+	for _, plugin := range p.ram.Plugins {
+		add(ImagePlan{Image: plugin.ShareImage, Kind: "plugin", Owner: plugin.PluginName}, plugin.PluginImage.HubUser, plugin.PluginImage.HubPassword)
+	}
+}
+
+// packageName the name of the package the export writes
+func (p *planExporter) packageName() string {
+	name := fmt.Sprintf("%s-%s-%s.tar.gz", p.ram.AppName, p.ram.AppVersion, formatSuffixes[p.format])
+	if p.opts.zipPackage {
+		return zipPackageName(name)
+	}
+	return name
+}
+
+// planFiles list the rendered files and the image files, the package is
+// estimated as large as its content
+func (p *planExporter) planFiles(plan *Plan, dir string) error {
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		plan.Files = append(plan.Files, FilePlan{Path: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the shared layers are stored once in the image layout, the sum of the
+	// image sizes bounds it
+	var imagesSize int64
+	for _, img := range plan.Images {
+		if p.format == SLG {
+			// the slug is one layer of the image, the image size bounds it
+			plan.Files = append(plan.Files, FilePlan{Path: fmt.Sprintf("%s/%s-slug.tgz", img.Owner, img.Owner), Size: img.Size, Estimated: true})
+			continue
+		}
+		imagesSize += img.Size
+	}
+	if imagesSize > 0 {
+		plan.Files = append(plan.Files, FilePlan{Path: ImagesDir, Size: imagesSize, Estimated: true})
+	}
+	if p.opts.signer != nil && p.format != GITOPS {
+		plan.Files = append(plan.Files, FilePlan{Path: sign.SignatureFileName, Estimated: true})
+	}
+	sort.Slice(plan.Files, func(i, j int) bool { return plan.Files[i].Path < plan.Files[j].Path })
+	for _, f := range plan.Files {
+		plan.EstimatedSize += f.Size
+	}
+	return nil
+}
+
+// unsupportedComponents the components and resources the format can not represent
+func unsupportedComponents(format AppFormat, ram v1alpha1.WutongApplicationConfig) []UnsupportedComponent {
+	if format == RAM || format == BUNDLE {
+		return nil
+	}
+	var res []UnsupportedComponent
+	for _, component := range ram.Components {
+		switch {
+		case component.ServiceType == v1alpha1.HelmChartServiceType:
+			res = append(res, UnsupportedComponent{Component: component.ServiceCname, Reason: fmt.Sprintf("helm-chart components can not be exported in the %s format", format)})
+		case component.Endpoints.Endpoints != "":
+			res = append(res, UnsupportedComponent{Component: component.ServiceCname, Reason: "third-party components have no image to run"})
+		case format == SLG && component.ServiceSource != sourceCode:
+			res = append(res, UnsupportedComponent{Component: component.ServiceCname, Reason: "only source code components are exported as slugs"})
+		}
+	}
+	if format == DC || format == SLG || format == NOMAD || format == QUADLET || format == SWARM {
+		for _, resource := range ram.K8sResources {
+			res = append(res, UnsupportedComponent{
+				Component: fmt.Sprintf("%s/%s", resource.Kind, resource.Name),
+				Reason:    fmt.Sprintf("kubernetes resources can not be exported in the %s format", format),
+			})
+		}
+	}
+	return res
+}
+
+// copyRAM deep copy the app, the components and plugins are pointers
+func copyRAM(ram v1alpha1.WutongApplicationConfig) (v1alpha1.WutongApplicationConfig, error) {
+	var res v1alpha1.WutongApplicationConfig
+	body, err := json.Marshal(ram)
+	if err != nil {
+		return res, fmt.Errorf("copy app failure %s", err.Error())
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return res, fmt.Errorf("copy app failure %s", err.Error())
+	}
+	return res, nil
+}
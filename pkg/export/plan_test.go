@@ -0,0 +1,209 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/registry"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+)
+
+// fakeImageClient an image client with local images only
+type fakeImageClient struct {
+	sizes map[string]int64
+}
+
+func (f *fakeImageClient) ImageSave(destination string, images []string) error { return nil }
+func (f *fakeImageClient) ImageLoad(tarFile string) error                      { return nil }
+func (f *fakeImageClient) ImagePush(image, user, pass string, timeout int) error {
+	return nil
+}
+func (f *fakeImageClient) ImageTag(source, target string, timeout int) error { return nil }
+func (f *fakeImageClient) ImagePull(image string, username, password string, timeout int) (*ocispec.ImageConfig, error) {
+	return &ocispec.ImageConfig{}, nil
+}
+func (f *fakeImageClient) ImageSize(image string) (int64, error) {
+	if size, ok := f.sizes[image]; ok {
+		return size, nil
+	}
+	return 0, fmt.Errorf("image %s not found", image)
+}
+
+// hostRewriter send the requests of every host to the test server
+type hostRewriter string
+
+func (h hostRewriter) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Host = string(h)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestPlanExport(t *testing.T) {
+	manifest, _ := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{Size: 100},
+		Layers:    []ocispec.Descriptor{{Size: 1000}},
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/demo/web/manifests/v1":
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Write(manifest)
+		case "/v2/library/mysql/manifests/5.7":
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	ram := testRAM()
+	ram.WithImageData = true
+	ram.Components[1].AppImage = v1alpha1.ImageInfo{HubUser: "root", HubPassword: "secret"}
+	ram.Components = append(ram.Components, &v1alpha1.Component{ServiceCname: "chart", ComponentKey: "chart-key", ServiceType: v1alpha1.HelmChartServiceType})
+	home := t.TempDir()
+	p := &planExporter{
+		logger:      logrus.New(),
+		ram:         ram,
+		imageClient: &fakeImageClient{sizes: map[string]int64{"nginx:1.25-alpine": 500}},
+		format:      DC,
+		homePath:    home,
+		exportPath:  path.Join(home, "demo-1.0-dockercompose"),
+		opts: newOptions(WithRegistryOptions(
+			registry.WithPlainHTTP(),
+			registry.WithHTTPClient(&http.Client{Transport: hostRewriter(strings.TrimPrefix(srv.URL, "http://"))}),
+		)),
+	}
+	res, err := p.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := res.Plan
+	if _, err := os.Stat(p.exportPath); !os.IsNotExist(err) {
+		t.Errorf("the export dir must not be created, stat error %v", err)
+	}
+	if res.PackageName != "demo-1.0-dockercompose.tar.gz" {
+		t.Errorf("unexpected package name %s", res.PackageName)
+	}
+	sizes := make(map[string]ImagePlan)
+	for _, img := range plan.Images {
+		sizes[img.Image] = img
+	}
+	if web := sizes["hub.example.com/demo/web:v1"]; web.Size != 1100 || web.SizeFrom != "registry" {
+		t.Errorf("unexpected web image plan %+v", web)
+	}
+	if gateway := sizes[gatewayImage]; gateway.Kind != "gateway" || gateway.SizeFrom != "local" {
+		t.Errorf("unexpected gateway image plan %+v", gateway)
+	}
+	// the mysql credentials are denied, the gateway is not in the registry but exists locally
+	if len(plan.Missing) != 1 || !strings.Contains(plan.Missing[0], "mysql") || !strings.Contains(plan.Missing[0], "denied") {
+		t.Errorf("unexpected missing images %v", plan.Missing)
+	}
+	if len(plan.Unsupported) != 1 || plan.Unsupported[0].Component != "chart" {
+		t.Errorf("unexpected unsupported components %+v", plan.Unsupported)
+	}
+	files := make(map[string]bool)
+	for _, f := range plan.Files {
+		files[f.Path] = true
+	}
+	for _, want := range []string{"docker-compose.yaml", "run.sh", "secrets.json", "package-manifest.json", ImagesDir, "gateway/nginx.conf"} {
+		if !files[want] {
+			t.Errorf("file %s is not planned, planned %v", want, plan.Files)
+		}
+	}
+	if plan.ImageSize != 1600 || plan.EstimatedSize <= plan.ImageSize || plan.RequiredSpace != 2*plan.ImageSize+plan.EstimatedSize {
+		t.Errorf("unexpected sizes image %d estimated %d required %d", plan.ImageSize, plan.EstimatedSize, plan.RequiredSpace)
+	}
+	if plan.AvailableSpace <= 0 {
+		t.Errorf("available space is not checked")
+	}
+	if err := plan.Check(); err == nil || !strings.Contains(err.Error(), "missing images") {
+		t.Errorf("want missing images error, got %v", err)
+	}
+	// the credentials of the caller's app are kept
+	if ram.Components[1].AppImage.HubPassword != "secret" {
+		t.Errorf("the plan modified the app")
+	}
+}
+
+func TestPlanGitOps(t *testing.T) {
+	home := t.TempDir()
+	opts := newOptions(WithGitOps(GitOpsConfig{RepoURL: "https://git.example.com/apps.git"}))
+	g := &gitOpsExporter{logger: logrus.New(), ram: testRAM(), homePath: home, exportPath: path.Join(home, "demo-1.0-gitops"), opts: opts}
+	if _, err := g.Export(); err != nil {
+		t.Fatal(err)
+	}
+	exported := make(map[string]bool)
+	err := filepath.Walk(g.exportPath, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(g.exportPath, file)
+		exported[filepath.ToSlash(rel)] = true
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	planHome := t.TempDir()
+	p := &planExporter{
+		logger:      logrus.New(),
+		ram:         testRAM(),
+		imageClient: &fakeImageClient{},
+		format:      GITOPS,
+		homePath:    planHome,
+		exportPath:  path.Join(planHome, "demo-1.0-gitops"),
+		opts:        newOptions(WithGitOps(GitOpsConfig{RepoURL: "https://git.example.com/apps.git"})),
+	}
+	res, err := p.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	planned := make(map[string]bool)
+	for _, f := range res.Plan.Files {
+		if !f.Estimated {
+			planned[f.Path] = true
+		}
+	}
+	if !reflect.DeepEqual(planned, exported) {
+		t.Errorf("the plan does not match the export, planned %v exported %v", planned, exported)
+	}
+	if planned[secret.FileName] {
+		t.Errorf("the secrets file is planned in the layout")
+	}
+	if res.Plan.SecretsFile != path.Join(planHome, gitOpsSecretsFile(p.ram)) {
+		t.Errorf("unexpected secrets file %s", res.Plan.SecretsFile)
+	}
+	if _, err := os.Stat(path.Join(home, path.Base(res.Plan.SecretsFile))); err != nil {
+		t.Errorf("the planned secrets file is not exported, %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+)
+
+const (
+	defaultPullWorkers       = 4
+	defaultRegistryPullLimit = 2
+	defaultPullRetries       = 3
+	defaultPullBackoff       = 2 * time.Second
+	// defaultPullTimeout the timeout of one pull in minutes
+	defaultPullTimeout = 30
+)
+
+// PullFailure an image that failed to pull
+type PullFailure struct {
+	// Kind component, plugin or dependent
+	Kind string
+	// Owner the component or plugin name, empty for dependent images
+	Owner string
+	Image string
+	Err   error
+}
+
+// PullError the images that failed to pull, all the images are tried before it is returned
+type PullError struct {
+	Failures []PullFailure
+}
+
+func (e *PullError) Error() string {
+	var msgs []string
+	for _, f := range e.Failures {
+		msgs = append(msgs, fmt.Sprintf("%s %s image %s: %s", f.Kind, f.Owner, f.Image, f.Err.Error()))
+	}
+	return fmt.Sprintf("pull %d images failure: %s", len(e.Failures), strings.Join(msgs, "; "))
+}
+
+// Unwrap the errors of the failed pulls
+func (e *PullError) Unwrap() []error {
+	var errs []error
+	for _, f := range e.Failures {
+		errs = append(errs, f.Err)
+	}
+	return errs
+}
+
+// pullTask an image to pull and the component or plugin it belongs to
+type pullTask struct {
+	kind     string
+	owner    string
+	image    string
+	user     string
+	password string
+}
+
+// pullImages pull the images with a bounded worker pool, at most
+// registryPullLimit pulls run against one registry at a time. Transient
+// registry errors are retried with exponential backoff. The failures of all
+// tasks are returned in task order, an image shared by tasks is pulled once.
+func pullImages(imageClient image.Client, logger *logrus.Logger, o options, tasks []pullTask) []PullFailure {
+	var images []string
+	byImage := make(map[string][]int)
+	for i, task := range tasks {
+		if _, ok := byImage[task.image]; !ok {
+			images = append(images, task.image)
+		}
+		byImage[task.image] = append(byImage[task.image], i)
+	}
+	var mu sync.Mutex
+	registries := make(map[string]chan struct{})
+	registrySlot := func(img string) chan struct{} {
+		domain := img
+		if named, err := reference.ParseNormalizedNamed(img); err == nil {
+			domain = reference.Domain(named)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if registries[domain] == nil {
+			registries[domain] = make(chan struct{}, o.registryPullLimit)
+		}
+		return registries[domain]
+	}
+	errs := make([]error, len(tasks))
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < o.pullWorkers && i < len(images); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for img := range jobs {
+				task := tasks[byImage[img][0]]
+				err := pullImage(imageClient, logger, o, registrySlot(img), task)
+				if err == nil {
+					logger.Infof("pull %s %s image success", task.kind, task.owner)
+				}
+				for _, i := range byImage[img] {
+					errs[i] = err
+				}
+			}
+		}()
+	}
+	for _, img := range images {
+		jobs <- img
+	}
+	close(jobs)
+	wg.Wait()
+	var failures []PullFailure
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, PullFailure{Kind: tasks[i].kind, Owner: tasks[i].owner, Image: tasks[i].image, Err: err})
+		}
+	}
+	return failures
+}
+
+// pullImage pull the image holding a slot of its registry, the slot is
+// released while backing off
+func pullImage(imageClient image.Client, logger *logrus.Logger, o options, slot chan struct{}, task pullTask) error {
+	backoff := o.pullBackoff
+	for attempt := 0; ; attempt++ {
+		slot <- struct{}{}
+		_, err := imageClient.ImagePull(task.image, task.user, task.password, o.pullTimeout)
+		<-slot
+		if err == nil || attempt >= o.pullRetries || !isTransientPullError(err) {
+			return err
+		}
+		logger.Warningf("pull image %s failure %s, retry in %s", task.image, err.Error(), backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isTransientPullError whether the pull error is worth a retry, the daemons
+// report registry errors as plain messages
+func isTransientPullError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, permanent := range []string{"unauthorized", "denied", "not found", "manifest unknown", "does not exist", "invalid reference"} {
+		if strings.Contains(msg, permanent) {
+			return false
+		}
+	}
+	for _, transient := range []string{
+		"too many requests", "toomanyrequests", "service unavailable", "bad gateway", "gateway timeout",
+		"internal server error", "connection reset", "connection refused", "i/o timeout",
+		"tls handshake timeout", "timeout", "unexpected eof", "temporarily unavailable",
+	} {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+)
+
+// pullClient count the concurrent pulls of every registry, the scripted
+// errors are returned by the first pulls of the image
+type pullClient struct {
+	fakeImageClient
+	mu      sync.Mutex
+	errs    map[string][]error
+	pulls   map[string]int
+	running map[string]int
+	peak    map[string]int
+}
+
+func (p *pullClient) ImagePull(image string, username, password string, timeout int) (*ocispec.ImageConfig, error) {
+	named, _ := reference.ParseNormalizedNamed(image)
+	domain := reference.Domain(named)
+	p.mu.Lock()
+	p.pulls[image]++
+	p.running[domain]++
+	p.peak[domain] = max(p.peak[domain], p.running[domain])
+	var err error
+	if errs := p.errs[image]; len(errs) > 0 {
+		err, p.errs[image] = errs[0], errs[1:]
+	}
+	p.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	p.mu.Lock()
+	p.running[domain]--
+	p.mu.Unlock()
+	return &ocispec.ImageConfig{}, err
+}
+
+func TestPullImages(t *testing.T) {
+	client := &pullClient{
+		errs: map[string][]error{
+			"hub.a.com/demo/c1:v1": {errors.New("received unexpected HTTP status: 503 Service Unavailable")},
+			"hub.a.com/demo/c2:v1": {errors.New("unauthorized: authentication required")},
+			"hub.b.com/demo/c3:v1": {errors.New("toomanyrequests"), errors.New("toomanyrequests"), errors.New("toomanyrequests")},
+		},
+		pulls: map[string]int{}, running: map[string]int{}, peak: map[string]int{},
+	}
+	ram := v1alpha1.WutongApplicationConfig{WithImageData: true}
+	for i, img := range []string{"hub.a.com/demo/c1:v1", "hub.a.com/demo/c2:v1", "hub.b.com/demo/c3:v1", "hub.a.com/demo/c4:v1", "hub.a.com/demo/c5:v1", "hub.b.com/demo/c6:v1", "hub.a.com/demo/c1:v1"} {
+		ram.Components = append(ram.Components, &v1alpha1.Component{ServiceCname: "c" + string(rune('1'+i)), ShareImage: img})
+	}
+	o := newOptions(WithPullConcurrency(4, 2), WithPullRetries(2, time.Millisecond))
+	err := saveComponentImages(ram, client, t.TempDir(), logrus.New(), []string{"hub.c.com/gateway:v1"}, o)
+	var pullErr *PullError
+	if !errors.As(err, &pullErr) {
+		t.Fatalf("want PullError, got %v", err)
+	}
+	// the transient error of c1 is retried, the denied c2 is not, c3 runs out of retries
+	if len(pullErr.Failures) != 2 || pullErr.Failures[0].Owner != "c2" || pullErr.Failures[1].Owner != "c3" {
+		t.Errorf("unexpected failures %+v", pullErr.Failures)
+	}
+	if !strings.Contains(err.Error(), "component c3 image hub.b.com/demo/c3:v1") {
+		t.Errorf("unexpected error %s", err.Error())
+	}
+	if client.pulls["hub.a.com/demo/c1:v1"] != 2 || client.pulls["hub.a.com/demo/c2:v1"] != 1 || client.pulls["hub.b.com/demo/c3:v1"] != 3 {
+		t.Errorf("unexpected pulls %v", client.pulls)
+	}
+	for domain, peak := range client.peak {
+		if peak > 2 {
+			t.Errorf("%d concurrent pulls against %s", peak, domain)
+		}
+	}
+	if client.pulls["hub.c.com/gateway:v1"] != 1 {
+		t.Errorf("the dependent image is not pulled")
+	}
+}
+
+// saveClient record the saved images, the save fails to stop the export
+type saveClient struct {
+	pullClient
+	saved []string
+}
+
+func (s *saveClient) ImageSave(destination string, images []string) error {
+	s.saved = images
+	return errors.New("saved")
+}
+
+func TestSaveFailedDependentImages(t *testing.T) {
+	client := &saveClient{pullClient: pullClient{
+		fakeImageClient: fakeImageClient{sizes: map[string]int64{"hub.c.com/local:v1": 100}},
+		errs: map[string][]error{
+			"hub.c.com/local:v1": {errors.New("unauthorized: authentication required")},
+			"hub.c.com/gone:v1":  {errors.New("unauthorized: authentication required")},
+		},
+		pulls: map[string]int{}, running: map[string]int{}, peak: map[string]int{},
+	}}
+	ram := v1alpha1.WutongApplicationConfig{WithImageData: true, Components: []*v1alpha1.Component{{ServiceCname: "web", ShareImage: "hub.a.com/demo/web:v1"}}}
+	o := newOptions(WithPullRetries(0, time.Millisecond))
+	saveComponentImages(ram, client, t.TempDir(), logrus.New(), []string{"hub.c.com/local:v1", "hub.c.com/gone:v1"}, o)
+	// the local image is saved as it is, the missing one is left out
+	if strings.Join(client.saved, ",") != "hub.a.com/demo/web:v1,hub.c.com/local:v1" {
+		t.Errorf("unexpected saved images %v", client.saved)
+	}
+}
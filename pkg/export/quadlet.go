@@ -0,0 +1,444 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltr.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltr.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
+)
+
+// quadletDir the dir of the quadlet units in the package
+const quadletDir = "quadlet"
+
+type quadletExporter struct {
+	logger      *logrus.Logger
+	ram         v1alpha1.WutongApplicationConfig
+	imageClient image.Client
+	homePath    string
+	exportPath  string
+	opts        options
+}
+
+// quadletUnit a quadlet file, Name is the file name with the unit type suffix
+type quadletUnit struct {
+	Name     string
+	Sections []*quadletSection
+}
+
+type quadletSection struct {
+	Name    string
+	Entries [][2]string
+}
+
+// quadletFile a file referenced by the units, relative to the quadlet dir
+type quadletFile struct {
+	Content []byte
+	Mode    os.FileMode
+}
+
+func (q *quadletExporter) Export() (*Result, error) {
+	q.logger.Infof("start export app %s to podman quadlet spec", q.ram.AppName)
+	// Delete the old application group directory and then regenerate the application package
+	if err := PrepareExportDir(q.exportPath); err != nil {
+		q.logger.Errorf("prepare export dir failure %s", err.Error())
+		return nil, err
+	}
+	q.logger.Infof("success prepare export dir")
+	if err := q.writeUnits(); err != nil {
+		q.logger.Errorf("write quadlet units failure %s", err.Error())
+		return nil, err
+	}
+	q.logger.Infof("success write quadlet units")
+	if err := saveComponentImages(q.ram, q.imageClient, q.exportPath, q.logger, []string{}, q.opts); err != nil {
+		return nil, err
+	}
+	q.logger.Infof("success save components")
+	if err := savePluginImages(q.ram, q.imageClient, q.exportPath, q.logger, q.opts); err != nil {
+		return nil, err
+	}
+	q.logger.Infof("success save plugins")
+	if err := q.opts.secrets.WriteFile(path.Join(q.exportPath, secret.FileName)); err != nil {
+		q.logger.Errorf("write secrets file failure %s", err.Error())
+		return nil, err
+	}
+	// leave out what the baseline package ships
+	if err := writeDelta(q.exportPath, q.opts.baseline); err != nil {
+		q.logger.Errorf("write delta package failure %s", err.Error())
+		return nil, err
+	}
+	// write package manifest and sign it
+	if err := sign.SignDir(q.exportPath, q.opts.signer); err != nil {
+		q.logger.Errorf("sign package failure %s", err.Error())
+		return nil, err
+	}
+	packageName := fmt.Sprintf("%s-%s-quadlet.tar.gz", q.ram.AppName, q.ram.AppVersion)
+	res, err := packageApp(packageName, q.homePath, q.exportPath, q.opts)
+	if err != nil {
+		err = fmt.Errorf("failed to package app %s: %s", packageName, err.Error())
+		q.logger.Error(err)
+		return nil, err
+	}
+	q.logger.Infof("success export app " + q.ram.AppName)
+	return res, nil
+}
+
+// writeUnits write the units, the files they reference and the install helper into the quadlet dir
+func (q *quadletExporter) writeUnits() error {
+	units, files, err := q.buildQuadletUnits()
+	if err != nil {
+		return err
+	}
+	unitPath := path.Join(q.exportPath, quadletDir)
+	if err := os.MkdirAll(unitPath, 0755); err != nil {
+		return err
+	}
+	var pods []string
+	for _, unit := range units {
+		if err := os.WriteFile(path.Join(unitPath, unit.Name), unit.render(), 0644); err != nil {
+			return err
+		}
+		if strings.HasSuffix(unit.Name, ".pod") {
+			pods = append(pods, strings.TrimSuffix(unit.Name, ".pod")+"-pod.service")
+		}
+	}
+	for name, file := range files {
+		target := path.Join(unitPath, name)
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, file.Content, file.Mode); err != nil {
+			return err
+		}
+	}
+	script := strings.NewReplacer("@APP@", systemdName(q.ram.AppName), "@PODS@", strings.Join(pods, " ")).Replace(quadletInstallScript)
+	return os.WriteFile(path.Join(unitPath, "install.sh"), []byte(script), 0755)
+}
+
+// buildQuadletUnits build the units of the app, every component runs in a pod
+// with its plugin sidecars. The pods join the app network under the names of
+// the components, the containers start after the containers they depend on
+// are healthy.
+func (q *quadletExporter) buildQuadletUnits() ([]*quadletUnit, map[string]quadletFile, error) {
+	components, groups, err := newK8sComponents(q.ram, q.opts.secrets)
+	if err != nil {
+		return nil, nil, err
+	}
+	app := systemdName(q.ram.AppName)
+	restart := q.opts.systemdRestart
+	if restart == "" {
+		restart = "always"
+	}
+	network := app + ".network"
+	units := []*quadletUnit{{Name: network, Sections: []*quadletSection{
+		{Name: "Unit", Entries: [][2]string{{"Description", q.ram.AppName + " network"}}},
+		{Name: "Network", Entries: [][2]string{{"NetworkName", app}}},
+	}}}
+	files := make(map[string]quadletFile)
+	for _, group := range groups {
+		// podman env files hold single line values only
+		if keys := multilineKeys(group.Items); len(keys) > 0 {
+			return nil, nil, fmt.Errorf("the values of %s in config group %s span multiple lines, env files hold single line values", strings.Join(keys, ", "), group.Name)
+		}
+		files[path.Join("config-groups", group.Name+".env")] = quadletFile{Content: envFileContent(group.Items), Mode: 0644}
+	}
+	names := make(map[string]string, len(components))
+	for _, kc := range components {
+		names[kc.Component.ComponentKey] = kc.Name
+		names[kc.Component.ServiceShareID] = kc.Name
+	}
+	plugins := make(map[string]*v1alpha1.Plugin, len(q.ram.Plugins))
+	for _, plugin := range q.ram.Plugins {
+		plugins[plugin.PluginKey] = plugin
+	}
+	ports := newPortAllocator(q.opts.hostPorts)
+	volumes := make(map[string]bool)
+	for _, kc := range components {
+		cpt := kc.Component
+		unitName := app + "-" + kc.Name
+		pod := &quadletSection{Name: "Pod", Entries: [][2]string{
+			{"PodName", unitName},
+			{"Network", network},
+			{"NetworkAlias", kc.Name},
+		}}
+		for _, port := range kc.Ports {
+			if !port.IsOuter {
+				continue
+			}
+			hostPort := ports.hostPort(port.Port, kc.Name, cpt.ComponentKey, cpt.ServiceCname)
+			if err := ports.reserve(kc.Name, hostPort, port.Port, port.Protocol); err != nil {
+				return nil, nil, err
+			}
+			pod.Entries = append(pod.Entries, [2]string{"PublishPort", composePort(hostPort, port.Port, port.Protocol)})
+		}
+		units = append(units, &quadletUnit{Name: unitName + ".pod", Sections: []*quadletSection{
+			{Name: "Unit", Entries: [][2]string{{"Description", fmt.Sprintf("%s component %s", q.ram.AppName, cpt.ServiceCname)}}},
+			pod,
+			{Name: "Install", Entries: [][2]string{{"WantedBy", "default.target"}}},
+		}})
+
+		envs := make(map[string]string, len(kc.Envs))
+		for k, v := range kc.Envs {
+			envs[k] = v
+		}
+		unitSection := &quadletSection{Name: "Unit", Entries: [][2]string{{"Description", fmt.Sprintf("%s component %s container", q.ram.AppName, cpt.ServiceCname)}}}
+		for _, dep := range cpt.DepServiceMapList {
+			depName, ok := names[dep.DepServiceKey]
+			if !ok {
+				continue
+			}
+			depEnvs, err := getPublicEnvByKey(dep.DepServiceKey, q.ram.Components, q.opts.secrets)
+			if err != nil {
+				return nil, nil, err
+			}
+			for k, v := range depEnvs {
+				// the dependency is reached by its name on the app network
+				if isLoopbackHost(v) {
+					envs[k] = depName
+				}
+			}
+			service := app + "-" + depName + ".service"
+			unitSection.Entries = append(unitSection.Entries, [2]string{"Requires", service}, [2]string{"After", service})
+		}
+		container := &quadletSection{Name: "Container", Entries: [][2]string{
+			{"ContainerName", unitName},
+			{"Image", kc.Repository + ":" + kc.Tag},
+			{"Pod", unitName + ".pod"},
+		}}
+		if strings.Contains(kc.Tag, ":") {
+			container.Entries[1][1] = kc.Repository + "@" + kc.Tag
+		}
+		for _, group := range kc.ConfigGroups {
+			container.Entries = append(container.Entries, [2]string{"EnvironmentFile", path.Join("config-groups", group+".env")})
+		}
+		for _, k := range sortedKeys(envs) {
+			container.Entries = append(container.Entries, [2]string{"Environment", quadletQuote(k + "=" + envs[k])})
+		}
+		for _, vol := range kc.Volumes {
+			if vol.MemoryFS {
+				container.Entries = append(container.Entries, [2]string{"Tmpfs", vol.MountPath})
+				continue
+			}
+			units = appendQuadletVolume(units, volumes, app, vol.ClaimName)
+			container.Entries = append(container.Entries, [2]string{"Volume", fmt.Sprintf("%s-%s.volume:%s", app, vol.ClaimName, vol.MountPath)})
+		}
+		for _, mount := range kc.SharedMount {
+			units = appendQuadletVolume(units, volumes, app, mount.ClaimName)
+			container.Entries = append(container.Entries, [2]string{"Volume", fmt.Sprintf("%s-%s.volume:%s", app, mount.ClaimName, mount.MountPath)})
+		}
+		for _, file := range kc.ConfigFiles {
+			name := path.Join("config", kc.Name, file.Key)
+			mode := os.FileMode(0644)
+			if file.Mode != nil {
+				mode = os.FileMode(*file.Mode)
+			}
+			files[name] = quadletFile{Content: []byte(file.Content), Mode: mode}
+			container.Entries = append(container.Entries, [2]string{"Volume", fmt.Sprintf("./%s:%s:ro,z", name, file.MountPath)})
+		}
+		if hc := composeHealthcheck(cpt.Probes); hc != nil {
+			container.Entries = append(container.Entries, quadletHealthcheck(hc)...)
+			// the unit is started once the container is healthy, the dependents wait for it
+			container.Entries = append(container.Entries, [2]string{"Notify", "healthy"})
+		}
+		if args := quadletResources(kc.Memory, kc.CPU); args != "" {
+			container.Entries = append(container.Entries, [2]string{"PodmanArgs", args})
+		}
+		if cpt.Cmd != "" {
+			container.Entries = append(container.Entries, [2]string{"Exec", quadletEscape(cpt.Cmd)})
+		}
+		service := &quadletSection{Name: "Service", Entries: [][2]string{{"Restart", restart}}}
+		units = append(units, &quadletUnit{Name: unitName + ".container", Sections: []*quadletSection{unitSection, container, service}})
+
+		// plugin sidecars
+		for _, config := range cpt.ServicePluginConfigs {
+			plugin, ok := plugins[config.PluginKey]
+			if !ok || !config.PluginStatus {
+				continue
+			}
+			units = append(units, quadletSidecar(plugin, config, kc.Name, unitName, restart))
+		}
+	}
+	return units, files, nil
+}
+
+// appendQuadletVolume add the volume unit of the claim once
+func appendQuadletVolume(units []*quadletUnit, volumes map[string]bool, app, claim string) []*quadletUnit {
+	name := app + "-" + claim
+	if volumes[name] {
+		return units
+	}
+	volumes[name] = true
+	return append(units, &quadletUnit{Name: name + ".volume", Sections: []*quadletSection{
+		{Name: "Volume", Entries: [][2]string{{"VolumeName", name}}},
+	}})
+}
+
+// quadletSidecar the plugin container in the pod of the component
+func quadletSidecar(plugin *v1alpha1.Plugin, config v1alpha1.ComponentPluginConfig, serviceName, podName, restart string) *quadletUnit {
+	image := plugin.ShareImage
+	if image == "" {
+		image = plugin.Image
+	}
+	envs := pluginConfigEnvs(plugin, config)
+	envs["SERVICE_NAME"] = serviceName
+	envs["PLUGIN_ID"] = plugin.PluginID
+	name := podName + "-" + composeName(plugin.PluginName)
+	container := &quadletSection{Name: "Container", Entries: [][2]string{
+		{"ContainerName", name},
+		{"Image", image},
+		{"Pod", podName + ".pod"},
+	}}
+	for _, k := range sortedKeys(envs) {
+		container.Entries = append(container.Entries, [2]string{"Environment", quadletQuote(k + "=" + envs[k])})
+	}
+	if args := quadletResources(config.MemoryRequired, config.CPURequired); args != "" {
+		container.Entries = append(container.Entries, [2]string{"PodmanArgs", args})
+	}
+	return &quadletUnit{Name: name + ".container", Sections: []*quadletSection{
+		{Name: "Unit", Entries: [][2]string{{"Description", fmt.Sprintf("plugin %s of %s", plugin.PluginName, serviceName)}}},
+		container,
+		{Name: "Service", Entries: [][2]string{{"Restart", restart}}},
+	}}
+}
+
+// quadletHealthcheck the healthcheck entries of the compose healthcheck
+func quadletHealthcheck(hc *Healthcheck) [][2]string {
+	// the compose test is escaped for the compose interpolation
+	test := strings.ReplaceAll(hc.Test[len(hc.Test)-1], "$$", "$")
+	entries := [][2]string{{"HealthCmd", quadletEscape(test)}}
+	if hc.Interval != "" {
+		entries = append(entries, [2]string{"HealthInterval", hc.Interval})
+	}
+	if hc.Timeout != "" {
+		entries = append(entries, [2]string{"HealthTimeout", hc.Timeout})
+	}
+	if hc.Retries > 0 {
+		entries = append(entries, [2]string{"HealthRetries", fmt.Sprint(hc.Retries)})
+	}
+	if hc.StartPeriod != "" {
+		entries = append(entries, [2]string{"HealthStartPeriod", hc.StartPeriod})
+	}
+	return entries
+}
+
+// quadletResources the podman args limiting the memory in MB and the cpu in millicores
+func quadletResources(memory, cpu int) string {
+	deploy := composeDeploy(memory, cpu)
+	if deploy == nil {
+		return ""
+	}
+	var args []string
+	if limit := deploy.Resources.Limits.Memory; limit != "" {
+		args = append(args, "--memory="+strings.ToLower(limit))
+	}
+	if limit := deploy.Resources.Limits.CPUs; limit != "" {
+		args = append(args, "--cpus="+limit)
+	}
+	return strings.Join(args, " ")
+}
+
+// quadletEscape escape the systemd specifiers
+func quadletEscape(value string) string {
+	return strings.ReplaceAll(value, "%", "%%")
+}
+
+// quadletQuote quote the value as one word of a systemd setting
+func quadletQuote(value string) string {
+	return `"` + quadletEscape(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)) + `"`
+}
+
+func (u *quadletUnit) render() []byte {
+	var b strings.Builder
+	for i, section := range u.Sections {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "[%s]\n", section.Name)
+		for _, entry := range section.Entries {
+			fmt.Fprintf(&b, "%s=%s\n", entry[0], entry[1])
+		}
+	}
+	return []byte(b.String())
+}
+
+var quadletInstallScript = `#!/bin/bash
+###
+### install.sh — Install the podman quadlet units of the app, rootless if
+### run by a regular user.
+###
+### Usage:
+###   install.sh <install|uninstall>
+###
+set -e
+cd $(dirname $0)
+APP=@APP@
+PODS="@PODS@"
+if [[ $EUID -eq 0 ]]; then
+  UNIT_DIR=${UNIT_DIR:-/etc/containers/systemd/${APP}}
+  SYSTEMCTL="systemctl"
+else
+  UNIT_DIR=${UNIT_DIR:-${XDG_CONFIG_HOME:-$HOME/.config}/containers/systemd/${APP}}
+  SYSTEMCTL="systemctl --user"
+fi
+
+import::image() {
+  [[ -d ../images ]] || return 0
+  tar -cC ../images . | podman load
+}
+
+install() {
+  import::image
+  mkdir -p ${UNIT_DIR}
+  cp -r . ${UNIT_DIR}/
+  rm -f ${UNIT_DIR}/install.sh
+  $SYSTEMCTL daemon-reload
+  # keep the services of the user running without a login session
+  [[ $EUID -eq 0 ]] || loginctl enable-linger $(id -un) || true
+  for pod in $PODS; do
+    $SYSTEMCTL start $pod
+  done
+}
+
+uninstall() {
+  for pod in $PODS; do
+    $SYSTEMCTL stop $pod || true
+  done
+  rm -rf ${UNIT_DIR}
+  $SYSTEMCTL daemon-reload
+}
+
+case "$1" in
+install)
+  install
+  ;;
+uninstall)
+  uninstall
+  ;;
+*)
+  sed -rn -e "s/^### ?//p" $0
+  exit 1
+  ;;
+esac
+`
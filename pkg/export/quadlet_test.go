@@ -0,0 +1,90 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltr.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltr.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestQuadletUnits(t *testing.T) {
+	dir := t.TempDir()
+	ram := testRAM()
+	ram.Components[1].ServiceConnectInfoMapList[0].AttrValue = "100%"
+	q := &quadletExporter{logger: logrus.New(), ram: ram, exportPath: dir, opts: newOptions(WithHostPort("web-key", 8080, 18080))}
+	if err := q.writeUnits(); err != nil {
+		t.Fatal(err)
+	}
+	unitPath := path.Join(dir, quadletDir)
+	read := func(name string) string {
+		content, err := os.ReadFile(path.Join(unitPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	units := map[string][]string{
+		"demo.network":                {"NetworkName=demo"},
+		"demo-web.pod":                {"PodName=demo-web", "Network=demo.network", "NetworkAlias=web", "PublishPort=18080:8080", "WantedBy=default.target"},
+		"demo-mysql-mysqldata.volume": {"VolumeName=demo-mysql-mysqldata"},
+		"demo-web.container": {
+			"Requires=demo-mysql.service\nAfter=demo-mysql.service",
+			"Image=hub.example.com/demo/web:v1",
+			"Pod=demo-web.pod",
+			"EnvironmentFile=config-groups/base.env",
+			`Environment="MYSQL_HOST=mysql"`,
+			`Environment="MYSQL_PASSWORD=100%%"`,
+			"Volume=demo-web-data.volume:/data",
+			"Volume=./config/web/etc-web-app.conf:/etc/web/app.conf:ro,z",
+			"HealthInterval=10s",
+			"Notify=healthy",
+			"PodmanArgs=--memory=512m --cpus=0.25",
+			"Exec=run --port 8080",
+		},
+	}
+	for name, expects := range units {
+		content := read(name)
+		for _, expect := range expects {
+			if !strings.Contains(content, expect) {
+				t.Errorf("expect %q in %s:\n%s", expect, name, content)
+			}
+		}
+	}
+	if strings.Contains(read("demo-mysql.pod"), "PublishPort") {
+		t.Errorf("inner port of mysql is published")
+	}
+	if read("config/web/etc-web-app.conf") != "listen={{port}}" || read("config-groups/base.env") != "TZ=Asia/Shanghai\n" {
+		t.Errorf("unexpected files referenced by the units")
+	}
+	if !strings.Contains(read("install.sh"), `PODS="demo-web-pod.service demo-mysql-pod.service"`) {
+		t.Errorf("unexpected install script")
+	}
+}
+
+func TestQuadletMultilineConfigGroup(t *testing.T) {
+	ram := testRAM()
+	ram.AppConfigGroups[0].ConfigItems["CERT"] = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----"
+	q := &quadletExporter{logger: logrus.New(), ram: ram, exportPath: t.TempDir(), opts: newOptions()}
+	if err := q.writeUnits(); err == nil || !strings.Contains(err.Error(), "CERT") {
+		t.Errorf("expect the multi-line value rejected, got %v", err)
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
 	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
 )
 
 type ramExporter struct {
@@ -36,6 +37,7 @@ type ramExporter struct {
 	mode        string
 	homePath    string
 	exportPath  string
+	opts        options
 }
 
 func (r *ramExporter) Export() (*Result, error) {
@@ -48,12 +50,12 @@ func (r *ramExporter) Export() (*Result, error) {
 	r.logger.Infof("success prepare export dir")
 	if r.mode == "offline" {
 		// Save components attachments
-		if err := SaveComponents(r.ram, r.imageClient, r.exportPath, r.logger, []string{}); err != nil {
+		if err := saveComponentImages(r.ram, r.imageClient, r.exportPath, r.logger, []string{}, r.opts); err != nil {
 			return nil, err
 		}
 		r.logger.Infof("success save components")
 		// Save plugin attachments
-		if err := SavePlugins(r.ram, r.imageClient, r.exportPath, r.logger); err != nil {
+		if err := savePluginImages(r.ram, r.imageClient, r.exportPath, r.logger, r.opts); err != nil {
 			return nil, err
 		}
 	}
@@ -62,16 +64,26 @@ func (r *ramExporter) Export() (*Result, error) {
 		return nil, err
 	}
 	r.logger.Infof("success write ram spec file")
+	// leave out what the baseline package ships
+	if err := writeDelta(r.exportPath, r.opts.baseline); err != nil {
+		r.logger.Errorf("write delta package failure %s", err.Error())
+		return nil, err
+	}
+	// write package manifest and sign it
+	if err := sign.SignDir(r.exportPath, r.opts.signer); err != nil {
+		r.logger.Errorf("sign package failure %s", err.Error())
+		return nil, err
+	}
 	// packaging
 	packageName := fmt.Sprintf("%s-%s-ram.tar.gz", r.ram.AppName, r.ram.AppVersion)
-	name, err := Packaging(packageName, r.homePath, r.exportPath)
+	res, err := packageApp(packageName, r.homePath, r.exportPath, r.opts)
 	if err != nil {
 		err = fmt.Errorf("failed to package app %s: %s", packageName, err.Error())
 		r.logger.Error(err)
 		return nil, err
 	}
 	r.logger.Infof("success export app " + r.ram.AppName)
-	return &Result{PackagePath: path.Join(r.homePath, name), PackageName: name}, nil
+	return res, nil
 }
 
 func (r *ramExporter) writeMetaFile() error {
@@ -0,0 +1,427 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"gopkg.in/yaml.v2"
+)
+
+// webProcess the process type run by the component script
+const webProcess = "web"
+
+// slugComponent a source code component exported as slug
+type slugComponent struct {
+	*v1alpha1.Component
+	// Processes the process types of the slug besides web, sorted
+	Processes map[string]string
+}
+
+// processTypes the process types besides web, sorted
+func (s *slugComponent) processTypes() []string {
+	var types []string
+	for t := range s.Processes {
+		if t != webProcess {
+			types = append(types, t)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// slugProcesses read the process types of the slug from its Procfile, or from
+// .release if there is no Procfile
+func slugProcesses(slugFile string) (map[string]string, error) {
+	f, err := os.Open(slugFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var procfile, release []byte
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch path.Clean(hdr.Name) {
+		case "Procfile":
+			if procfile, err = io.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		case ".release":
+			if release, err = io.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if procfile != nil {
+		return parseProcfile(procfile), nil
+	}
+	if release != nil {
+		var r struct {
+			DefaultProcessTypes map[string]string `yaml:"default_process_types"`
+		}
+		if err := yaml.Unmarshal(release, &r); err != nil {
+			return nil, fmt.Errorf("parse .release failure %s", err.Error())
+		}
+		return r.DefaultProcessTypes, nil
+	}
+	return nil, nil
+}
+
+// parseProcfile parse the lines formatted as type: command
+func parseProcfile(content []byte) map[string]string {
+	processes := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			continue
+		}
+		processes[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return processes
+}
+
+// writeProcessRunners write a runner for every process type besides web,
+// the web process is run by the component script
+func writeProcessRunners(slugPath string, cpt *slugComponent) error {
+	for _, t := range cpt.processTypes() {
+		var buf bytes.Buffer
+		data := map[string]string{"Name": cpt.ServiceCname, "Type": t, "Cmd": shellQuote(cpt.Processes[t])}
+		if err := processRunnerTemplate.Execute(&buf, data); err != nil {
+			return err
+		}
+		file := path.Join(slugPath, fmt.Sprintf("%s-%s.sh", cpt.ServiceCname, t))
+		if err := os.WriteFile(file, buf.Bytes(), 0777); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slugStartOrder sort the components so that dependencies start first, the
+// components of a dependency cycle keep their original order
+func slugStartOrder(components []*slugComponent) []*slugComponent {
+	keys := make(map[string]*slugComponent, len(components))
+	for _, cpt := range components {
+		keys[cpt.ComponentKey] = cpt
+		keys[cpt.ServiceShareID] = cpt
+	}
+	var ordered []*slugComponent
+	state := make(map[*slugComponent]int)
+	var visit func(cpt *slugComponent)
+	visit = func(cpt *slugComponent) {
+		switch state[cpt] {
+		case 1:
+			logrus.Warningf("[slug] dependency cycle found at component %s", cpt.ServiceCname)
+			return
+		case 2:
+			return
+		}
+		state[cpt] = 1
+		for _, dep := range cpt.DepServiceMapList {
+			if d, ok := keys[dep.DepServiceKey]; ok {
+				visit(d)
+			}
+		}
+		state[cpt] = 2
+		ordered = append(ordered, cpt)
+	}
+	for _, cpt := range components {
+		visit(cpt)
+	}
+	return ordered
+}
+
+// readinessCheck the shell command telling whether the component is ready,
+// the readiness probe is preferred to the first port
+func readinessCheck(cpt *v1alpha1.Component) string {
+	var probe *v1alpha1.ComponentProbe
+	for i := range cpt.Probes {
+		if !cpt.Probes[i].IsUsed || cpt.Probes[i].Validation() != nil {
+			continue
+		}
+		if probe == nil || (cpt.Probes[i].Mode == "readiness" && probe.Mode != "readiness") {
+			probe = &cpt.Probes[i]
+		}
+	}
+	switch {
+	case probe != nil && probe.Cmd != "":
+		return probe.Cmd
+	case probe != nil && strings.ToLower(probe.Scheme) == "http":
+		return fmt.Sprintf("curl -fs -o /dev/null %shttp://127.0.0.1:%d/%s", curlHeaders(probe.HTTPHeader), probe.Port, strings.TrimPrefix(probe.Path, "/"))
+	case probe != nil:
+		return fmt.Sprintf("echo >/dev/tcp/127.0.0.1/%d", probe.Port)
+	case len(cpt.Ports) > 0:
+		return fmt.Sprintf("echo >/dev/tcp/127.0.0.1/%d", cpt.Ports[0].ContainerPort)
+	}
+	return ""
+}
+
+// shellQuote quote the string for bash
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+var processRunnerTemplate = template.Must(template.New("runner").Parse(`#!/bin/bash
+###
+### {{.Name}}-{{.Type}}.sh — Controls the {{.Type}} process of app {{.Name}}.
+###
+### Usage:
+###   {{.Name}}-{{.Type}}.sh <Options>
+###
+### Options:
+###   start   Start the process.
+###   stop    Stop the process.
+###   status  Show the process status.
+###   run     Run the process in the foreground.
+###   -h      Show this message.
+
+[ $DEBUG ] && set -x
+cd $(dirname $0)
+
+GREEN='\033[1;32m'
+RED='\033[1;31m'
+NC='\033[0m' # No Color
+
+APPNAME={{.Name}}
+PROCESS={{.Type}}
+CMD={{.Cmd}}
+HOME=$(pwd)
+
+function prepare() {
+    if [ ! -d .profile.d ]; then
+        [ -f ${APPNAME}-slug.tgz ] || {
+            echo -e "There is no slug file, ${0#*/} need it to start your app ...$RED Failure $NC"
+            exit 1
+        }
+        tar xzf ${APPNAME}-slug.tgz -C $HOME
+    fi
+    if [ -d .profile.d ]; then
+        for file in .profile.d/*; do
+            source $file
+        done
+        hash -r
+    fi
+    [ -f ${APPNAME}.env ] && source ${APPNAME}.env
+}
+
+function processRun() {
+    prepare
+    exec bash -c "exec $CMD"
+}
+
+function processStart() {
+    processStatus >/dev/null 2>&1 &&
+        echo -e "Process ${APPNAME}-${PROCESS} is already running with pid $(cat ${APPNAME}-${PROCESS}.pid)." &&
+        exit 1
+    prepare
+    nohup bash -c "exec $CMD" >${APPNAME}-${PROCESS}.log 2>&1 &
+    sleep 3
+    RES=$(ps -p $! -o pid= -o comm=)
+    if [ ! -z "$RES" ]; then
+        echo $! >${APPNAME}-${PROCESS}.pid
+        echo -e "Running process ${APPNAME}-${PROCESS} with process: $RES ... $GREEN Done $NC"
+    else
+        echo -e "Running process ${APPNAME}-${PROCESS} failed, check ${APPNAME}-${PROCESS}.log ... $RED Failure $NC"
+    fi
+}
+
+function processStop() {
+    if [ -f ${APPNAME}-${PROCESS}.pid ]; then
+        kill -15 $(cat ${APPNAME}-${PROCESS}.pid) >/dev/null 2>&1
+        rm -f ${APPNAME}-${PROCESS}.pid
+        echo -e "Stopping process ${APPNAME}-${PROCESS} ... $GREEN Done $NC"
+    fi
+}
+
+function processStatus() {
+    PID=$(cat ${APPNAME}-${PROCESS}.pid 2>/dev/null)
+    RES=$(ps -p $PID -o pid= -o comm= 2>/dev/null)
+    if [ ! -z "$RES" ]; then
+        printf "%-30s %-30s %-10s\n" AppName Status PID
+        printf "%-30s \e[1;32m%-30s\e[m %-30s\n" ${APPNAME}-${PROCESS} "Active(Running)" $PID
+        return 0
+    else
+        printf "%-30s %-30s %-30s\n" AppName Status PID
+        printf "%-30s \e[1;31m%-30s\e[m %-30s\n" ${APPNAME}-${PROCESS} "Inactive(Exited)" "N/A"
+        return 1
+    fi
+}
+
+case $1 in
+start)
+    processStart
+    ;;
+stop)
+    processStop
+    ;;
+status)
+    processStatus
+    ;;
+run)
+    processRun
+    ;;
+*)
+    sed -rn -e "s/^### ?//p" $0
+    exit 1
+    ;;
+esac
+`))
+
+var appScriptTemplate = template.Must(template.New("app").Parse(`#!/bin/bash
+###
+### app.sh — Controls app startup and stop.
+###
+### Usage:
+###   app.sh <Options>
+###
+### Options:
+###   start   Start your app.
+###   stop    Stop your app.
+###   status  Show app status.
+###   -h      Show this message.
+
+[ $DEBUG ] && set -x
+
+# make stdout colorful
+GREEN='\033[1;32m'
+YELLOW='\033[1;33m'
+RED='\033[1;31m'
+NC='\033[0m' # No Color
+
+# 定义当前应用的名字
+APPNAME=$(basename $(pwd))
+
+# 服务组件按依赖顺序排列，被依赖的组件先启动
+APPS="{{range $i, $c := .}}{{if $i}} {{end}}{{$c.ServiceCname}}{{end}}"
+
+# 等待服务组件就绪的超时时间（秒）
+WAIT_TIMEOUT=${WAIT_TIMEOUT:-120}
+
+# 检查服务组件是否就绪
+function appReady() {
+    case $1 in
+{{- range .}}
+    {{.ServiceCname}})
+        {{with .Check}}{{.}}{{else}}return 0{{end}}
+        ;;
+{{- end}}
+    esac
+}
+
+# 等待服务组件就绪
+function waitReady() {
+    for ((i = 0; i < WAIT_TIMEOUT; i++)); do
+        if appReady $1 >/dev/null 2>&1; then
+            echo -e "App $1 is ready ... $GREEN Done $NC"
+            return 0
+        fi
+        sleep 1
+    done
+    echo -e "Waiting for app $1 to be ready timed out ... $RED Failure $NC"
+    return 1
+}
+
+# 按依赖顺序启动所有的服务组件
+function allAppStart() {
+    for app in ${APPS}; do
+        pushd $app >/dev/null 2>&1
+        ./$app.sh start | sed -n '$p'
+        for runner in $app-*.sh; do
+            [ -f "$runner" ] && ./$runner start | sed -n '$p'
+        done
+        popd >/dev/null 2>&1
+        waitReady $app || exit 1
+    done
+}
+
+# 按依赖的逆序停止所有的服务组件
+function allAppStop() {
+    for app in $(echo ${APPS} | tr ' ' '\n' | tac); do
+        pushd $app >/dev/null 2>&1
+        for runner in $app-*.sh; do
+            [ -f "$runner" ] && ./$runner stop
+        done
+        ./$app.sh stop
+        popd >/dev/null 2>&1
+    done
+}
+
+function allAppStatus() {
+    printf "%-30s %-30s %-10s\n" AppName Status PID
+    for app in ${APPS}; do
+        pushd $app >/dev/null 2>&1
+        ./$app.sh status | sed '1d'
+        for runner in $app-*.sh; do
+            [ -f "$runner" ] && ./$runner status | sed '1d'
+        done
+        popd >/dev/null 2>&1
+    done
+}
+
+function showHelp() {
+    sed -rn -e "s/^### ?//p" $0 | sed "s#app.sh#${0}#g"
+}
+
+case $1 in
+start)
+    allAppStart
+    ;;
+stop)
+    allAppStop
+    ;;
+status)
+    allAppStatus
+    ;;
+*)
+    showHelp
+    exit 1
+    ;;
+esac
+`))
+
+// Check the readiness check of the component used by the app script
+func (s *slugComponent) Check() string {
+	return readinessCheck(s.Component)
+}
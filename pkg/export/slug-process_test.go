@@ -0,0 +1,150 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func writeSlug(t *testing.T, file string, files map[string]string) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	zw.Close()
+}
+
+func TestSlugProcesses(t *testing.T) {
+	dir := t.TempDir()
+	procfile := path.Join(dir, "procfile.tgz")
+	writeSlug(t, procfile, map[string]string{
+		"./Procfile": "web: bundle exec puma -p $PORT\n# comment\nworker: bundle exec sidekiq\n",
+		"./.release": "default_process_types:\n  web: ignored\n",
+	})
+	processes, err := slugProcesses(procfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{"web": "bundle exec puma -p $PORT", "worker": "bundle exec sidekiq"}
+	if !reflect.DeepEqual(processes, expect) {
+		t.Errorf("expect %v, got %v", expect, processes)
+	}
+
+	release := path.Join(dir, "release.tgz")
+	writeSlug(t, release, map[string]string{"./.release": "default_process_types:\n  web: node server.js\n  clock: node clock.js\n"})
+	processes, err = slugProcesses(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &slugComponent{Component: testRAM().Components[0], Processes: processes}
+	if !reflect.DeepEqual(sc.processTypes(), []string{"clock"}) {
+		t.Errorf("unexpected process types %v", sc.processTypes())
+	}
+	if err := writeProcessRunners(dir, sc); err != nil {
+		t.Fatal(err)
+	}
+	runner, err := os.ReadFile(path.Join(dir, "web-clock.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(runner), "CMD='node clock.js'") {
+		t.Errorf("unexpected runner:\n%s", runner)
+	}
+}
+
+func TestSlugAppScriptOrder(t *testing.T) {
+	dir := t.TempDir()
+	ram := testRAM()
+	components := []*slugComponent{{Component: ram.Components[0]}, {Component: ram.Components[1]}}
+	s := &slugExporter{logger: logrus.New(), ram: ram, exportPath: dir, opts: newOptions()}
+	if err := s.writeAppScript(dir, "demo", components); err != nil {
+		t.Fatal(err)
+	}
+	script, err := os.ReadFile(path.Join(dir, "demo.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		`APPS="mysql web"`,
+		"curl -fs -o /dev/null http://127.0.0.1:8080/healthz",
+		"echo >/dev/tcp/127.0.0.1/3306",
+	} {
+		if !strings.Contains(string(script), expect) {
+			t.Errorf("%q not found in app script:\n%s", expect, script)
+		}
+	}
+}
+
+func TestSlugWebCmd(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not found")
+	}
+	procfile := "web: bundle exec puma -p $PORT\nworker: bundle exec sidekiq\n"
+	slugPath := path.Join(t.TempDir(), "web")
+	if err := os.MkdirAll(slugPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeSlug(t, path.Join(slugPath, "web-slug.tgz"), map[string]string{"./Procfile": procfile})
+	processes, err := slugProcesses(path.Join(slugPath, "web-slug.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(slugPath, "Procfile"), []byte(procfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &slugExporter{logger: logrus.New(), ram: testRAM(), opts: newOptions()}
+	// the command parsed on export, and the one read from the Procfile at run time
+	for _, webCmd := range []string{processes[webProcess], ""} {
+		if err := s.writeRunScript(slugPath, "web", webCmd); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("bash", "-c", `eval "$(sed '/^case $1 in/,$d' web.sh)"; processCmd`)
+		cmd.Dir = slugPath
+		cmd.Env = append(os.Environ(), "PORT=5000")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("run processCmd failure %v: %s", err, out)
+		}
+		content, err := os.ReadFile(path.Join(slugPath, "web.cmd"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(content)) != "bundle exec puma -p 5000" {
+			t.Errorf("unexpected web command of %q: %q", webCmd, content)
+		}
+	}
+}
@@ -18,20 +18,24 @@
 package export
 
 import (
-	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path"
-	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
-	"github.com/wutong-paas/wutong-oam/pkg/util"
 	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
 )
 
 const sourceCode = "source_code"
 
+// slugFilePath the path of the slug in the image built from source code
+const slugFilePath = "tmp/slug/slug.tgz"
+
 type slugExporter struct {
 	logger      *logrus.Logger
 	ram         v1alpha1.WutongApplicationConfig
@@ -39,6 +43,7 @@ type slugExporter struct {
 	mode        string
 	homePath    string
 	exportPath  string
+	opts        options
 }
 
 func (s *slugExporter) Export() (*Result, error) {
@@ -51,102 +56,123 @@ func (s *slugExporter) Export() (*Result, error) {
 	s.logger.Infof("success prepare export dir")
 	if s.mode == "offline" {
 		// Save components attachments
-		if err := SaveComponents(s.ram, s.imageClient, s.exportPath, s.logger, []string{}); err != nil {
+		if err := saveComponentImages(s.ram, s.imageClient, s.exportPath, s.logger, []string{}, s.opts); err != nil {
 			return nil, err
 		}
 		s.logger.Infof("success save components")
 	}
-	// UnTar component-images
-	ciTarPath := fmt.Sprintf("%s/component-images.tar", s.exportPath)
-	ciFilePath := fmt.Sprintf("%s/component-images", s.exportPath)
-	err := os.Mkdir(ciFilePath, 0755)
+	imagesPath := path.Join(s.exportPath, ImagesDir)
+	components, err := s.extractSlugs(imagesPath)
 	if err != nil {
-		s.logger.Error("mkdir component-image error", err)
+		return nil, err
 	}
-	err = util.UnImagetar(ciTarPath, ciFilePath)
-	if err != nil {
-		s.logger.Error("component-images UnTar error", err)
+	// remove component images
+	if err := os.RemoveAll(imagesPath); err != nil {
 		return nil, err
 	}
-	// get slug and env file and run script
-	for _, component := range s.ram.Components {
-		if component.ServiceSource == sourceCode {
-			// Unmarshal manifest.json
-			mfJsonPath := fmt.Sprintf("%s/manifest.json", ciFilePath)
-			mfByte := util.ReadJson(mfJsonPath)
-			var mfs []*v1alpha1.Manifest
-			err = json.Unmarshal([]byte(mfByte), &mfs)
-			if err != nil {
-				s.logger.Error("mfs json Unmarshal error", err)
-				return nil, err
-			}
-			for _, mf := range mfs {
-				for _, tag := range mf.RepoTags {
-					if tag == component.ShareImage {
-						// Gets the Layer directory where slug is stored
-						layer := mf.Layers[len(mf.Layers)-1]
-						layerID := strings.Split(layer, "/")[0]
-						layerPath := fmt.Sprintf("%s/%s", ciFilePath, layerID)
-						layerTar := fmt.Sprintf("%s/%s", ciFilePath, layer)
-						// UnTar layer
-						err = util.UnImagetar(layerTar, layerPath)
-						if err != nil {
-							s.logger.Error("layer UnTar error", err)
-							return nil, err
-						}
-						// Create a package path to store slug
-						slugPath := fmt.Sprintf("%s/%s", s.exportPath, component.ServiceCname)
-						err = os.Mkdir(slugPath, 0755)
-						if err != nil {
-							s.logger.Error("mkdir slug error", err)
-							return nil, err
-						}
-						// Copy slug to store path
-						slugOldPath := fmt.Sprintf("%s/tmp/slug/slug.tgz", layerPath)
-						err = util.CopyDir(slugOldPath, slugPath)
-						if err != nil {
-							s.logger.Error("copy slug error", err)
-							return nil, err
-						}
-						slugName := fmt.Sprintf("%s-slug.tgz", component.ServiceCname)
-						err = os.Rename(slugPath+"/slug.tgz", fmt.Sprintf("%s/%s", slugPath, slugName))
-						if err != nil {
-							logrus.Error("slug.tgz rename error")
-						}
-						// Add an environment variable file
-						if err := s.writeEnvFile(component, slugPath, s.ram.AppConfigGroups); err != nil {
-							return nil, err
-						}
-						// Add a script to run slug
-						if err := s.writeRunScript(slugPath, component.ServiceCname); err != nil {
-							return nil, err
-						}
-					}
-				}
-			}
+	// Add a script to app
+	if err := s.writeAppScript(s.exportPath, s.ram.AppName, components); err != nil {
+		return nil, err
+	}
+	if s.opts.systemdUnits {
+		if err := s.writeSystemdUnits(components); err != nil {
+			s.logger.Errorf("write systemd units failure %s", err.Error())
+			return nil, err
 		}
+		s.logger.Infof("success write systemd units")
 	}
-	// remove component images file
-	if err = os.RemoveAll(ciTarPath); err != nil {
+	if err := s.opts.secrets.WriteFile(path.Join(s.exportPath, secret.FileName)); err != nil {
+		s.logger.Errorf("write secrets file failure %s", err.Error())
 		return nil, err
 	}
-	if err = os.RemoveAll(ciFilePath); err != nil {
+	// leave out what the baseline package ships
+	if err := writeDelta(s.exportPath, s.opts.baseline); err != nil {
+		s.logger.Errorf("write delta package failure %s", err.Error())
 		return nil, err
 	}
-	// Add a script to app
-	if err := s.writeAppScript(s.exportPath, s.ram.AppName); err != nil {
+	// write package manifest and sign it
+	if err := sign.SignDir(s.exportPath, s.opts.signer); err != nil {
+		s.logger.Errorf("sign package failure %s", err.Error())
 		return nil, err
 	}
 	// packaging
 	packageName := fmt.Sprintf("%s-%s-slug.tar.gz", s.ram.AppName, s.ram.AppVersion)
-	name, err := Packaging(packageName, s.homePath, s.exportPath)
+	res, err := packageApp(packageName, s.homePath, s.exportPath, s.opts)
 	if err != nil {
 		err = fmt.Errorf("failed to package app %s: %s", packageName, err.Error())
 		s.logger.Error(err)
 		return nil, err
 	}
 	s.logger.Infof("success export app " + s.ram.AppName)
-	return &Result{PackagePath: path.Join(s.homePath, name), PackageName: name}, nil
+	return res, nil
+}
+
+// extractSlugs stream the slug of every source code component out of the
+// image archive, the archive is indexed once and never extracted. The source
+// code components are returned.
+func (s *slugExporter) extractSlugs(archivePath string) ([]*slugComponent, error) {
+	archive, err := image.OpenArchive(archivePath)
+	if err != nil {
+		s.logger.Errorf("open component images failure %s", err.Error())
+		return nil, err
+	}
+	defer archive.Close()
+	var components []*slugComponent
+	for _, component := range s.ram.Components {
+		if component.ServiceSource != sourceCode {
+			continue
+		}
+		// Create a package path to store slug
+		slugPath := fmt.Sprintf("%s/%s", s.exportPath, component.ServiceCname)
+		if err := os.MkdirAll(slugPath, 0755); err != nil {
+			s.logger.Error("mkdir slug error", err)
+			return nil, err
+		}
+		slugFile := path.Join(slugPath, fmt.Sprintf("%s-slug.tgz", component.ServiceCname))
+		if err := extractSlug(archive, component.ShareImage, slugFile); err != nil {
+			err = fmt.Errorf("extract slug of component %s failure: %w", component.ServiceCname, err)
+			s.logger.Error(err)
+			return nil, err
+		}
+		// Add an environment variable file
+		if err := s.writeEnvFile(component, slugPath, s.ram.AppConfigGroups); err != nil {
+			return nil, err
+		}
+		processes, err := slugProcesses(slugFile)
+		if err != nil {
+			err = fmt.Errorf("read process types of component %s failure %s", component.ServiceCname, err.Error())
+			s.logger.Error(err)
+			return nil, err
+		}
+		// Add a script to run slug
+		if err := s.writeRunScript(slugPath, component.ServiceCname, processes[webProcess]); err != nil {
+			return nil, err
+		}
+		// Add a runner for every process type
+		sc := &slugComponent{Component: component, Processes: processes}
+		if err := writeProcessRunners(slugPath, sc); err != nil {
+			return nil, err
+		}
+		components = append(components, sc)
+	}
+	return components, nil
+}
+
+// extractSlug copy the slug built into the image to file
+func extractSlug(archive *image.Archive, imageName, file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := archive.ExtractFile(imageName, slugFilePath, f); err != nil {
+		f.Close()
+		os.Remove(file)
+		if errors.Is(err, image.ErrFileNotFound) {
+			return fmt.Errorf("image %s has no slug layer, it is not built from source code: %w", imageName, err)
+		}
+		return err
+	}
+	return f.Close()
 }
 
 func (s *slugExporter) writeEnvFile(component *v1alpha1.Component, slugPath string, AppConfigGroups []*v1alpha1.AppConfigGroup) error {
@@ -164,7 +190,11 @@ func (s *slugExporter) writeEnvFile(component *v1alpha1.Component, slugPath stri
 	)
 	// get env
 	for _, env := range component.Envs {
-		e := fmt.Sprintf("export %s=%s\n", env.AttrName, env.AttrValue)
+		value, _, err := s.opts.secrets.Resolve(component.ComponentKey, env.AttrName, env.AttrValue)
+		if err != nil {
+			return err
+		}
+		e := fmt.Sprintf("export %s=%s\n", env.AttrName, value)
 		envs += e
 	}
 	// get config groups
@@ -180,7 +210,11 @@ func (s *slugExporter) writeEnvFile(component *v1alpha1.Component, slugPath stri
 	}
 	// get connection information
 	for _, connectInfoMap := range component.ServiceConnectInfoMapList {
-		connInfo := fmt.Sprintf("export %s=%s\n", connectInfoMap.AttrName, connectInfoMap.AttrValue)
+		value, _, err := s.opts.secrets.Resolve(component.ComponentKey, connectInfoMap.AttrName, connectInfoMap.AttrValue)
+		if err != nil {
+			return err
+		}
+		connInfo := fmt.Sprintf("export %s=%s\n", connectInfoMap.AttrName, value)
 		connInfos += connInfo
 	}
 	// get component port
@@ -205,7 +239,9 @@ func (s *slugExporter) writeEnvFile(component *v1alpha1.Component, slugPath stri
 	return nil
 }
 
-func (s *slugExporter) writeRunScript(slugPath string, name string) error {
+// writeRunScript write the script running the web process of the component,
+// webCmd is the web command of the slug, read from the slug at run time if empty
+func (s *slugExporter) writeRunScript(slugPath string, name string, webCmd string) error {
 	shName := name + ".sh"
 	shPath := path.Join(slugPath, shName)
 	shfile, err := os.OpenFile(shPath, os.O_CREATE|os.O_WRONLY, 0777)
@@ -215,7 +251,7 @@ func (s *slugExporter) writeRunScript(slugPath string, name string) error {
 		return err
 	}
 	defer shfile.Close()
-	runScript := "#!/bin/bash\n\n###\n### app.sh — Controls app startup and stop.\n###\n### Usage:\n###   app.sh <Options>\n###\n### Options:\n###   start   Start your app.\n###   stop    Stop your app.\n###   status  Show app status.\n###   -h      Show this message.\n\n[ $DEBUG ] && set -x\n\n# make stdout colorful\nGREEN='\\033[1;32m'\nYELLOW='\\033[1;33m'\nRED='\\033[1;31m'\nNC='\\033[0m' # No Color\n\n# 定义当前服务组件的名字\nAPPNAME=$(basename $(pwd))\n\n# 定义当前工作目录\nHOME=$(pwd)\n\n\n# 解压 slug 包\nfunction processSlug() {\n    if [ -f ${APPNAME}-slug.tgz ]; then\n        tar xzf ${APPNAME}-slug.tgz -C $HOME\n    else\n        echo -e \"There is no slug file, ${0#*/} need it to start your app ...$RED Failure $NC\"\n        exit 1\n    fi\n}\n\n# 运行 .profile.d 中的所有文件\n# 这个过程会修改 PATH 环境变量\nfunction processRuntimeEnv() {\n    sleep 1\n    if [ -d .profile.d ]; then\n        echo -e \"Handling runtime environment ... $GREEN Done $NC\"\n        for file in .profile.d/*; do\n            source $file\n        done\n        hash -r\n    fi\n}\n\n# 导入用户自定义的其他环境变量\nfunction processCustomEnv() {\n    if [ -f ${APPNAME}.env ]; then\n        sleep 1\n        echo -e \"Handling custom environment ... $GREEN Done $NC\"\n        source ${APPNAME}.env\n    fi\n}\n\n# 处理启动命令\nfunction processCmd() {\n    # 从 Procfile 文件中截取\n    if [ -f Procfile ]; then\n        # 渲染启动命令中的环境变量\n        eval \"cat <<EOF\n$(<Procfile)\nEOF\n\" >${APPNAME}.cmd\n        sed -i 's/web: //' ${APPNAME}.cmd\n    elif [ ! -f Procfile ] && [ -s .release ]; then\n        eval \"cat <<EOF\n$(cat .release | grep web | sed 's/web: //')\nEOF\n\" >${APPNAME}.cmd\n    else\n        echo -e \"Can not detect start cmd, please check whether file Procfile or .release exists ... $RED Failure $NC\"\n        exit 1\n    fi\n}\n\n# 启动函数\nfunction appStart() {\n    appStatus >/dev/null 2>&1 &&\n        echo -e \"App ${APPNAME} is already running with pid $(cat ${APPNAME}.pid). Try exec $0 status\" &&\n        exit 1\n    processSlug\n    processRuntimeEnv\n    processCustomEnv\n    processCmd\n    echo \"Running app ${APPNAME}, you can check the logs in file ${APPNAME}.log\"\n    echo \"We will start your app with ==> $(cat ${APPNAME}.cmd)\"\n    nohup $(cat ${APPNAME}.cmd) >${APPNAME}.log 2>&1 &\n    # 对于进程运行过程中报错退出的，需要时间窗口来延迟检测\n    sleep 3\n    # 查询进程，来确定是否启动成功\n    RES=$(ps -p $! -o pid= -o comm=)\n    if [ ! -z \"$RES\" ]; then\n        echo -e \"Running app ${APPNAME} with process: $RES ... $GREEN Done $NC\"\n        echo $! >${APPNAME}.pid\n    else\n        echo -e \"Running app ${APPNAME} failed,check ${APPNAME}.log ... $RED Failure $NC\"\n    fi\n}\n\nfunction appStop() {\n    if [ -f ${APPNAME}.pid ]; then\n        PID=$(cat ${APPNAME}.pid)\n        if [ ! -z $PID ]; then\n            # For stopping Nginx process,SIGTERM is better than SIGKILL\n            kill -15 $PID >/dev/null 2>&1\n            if [ $? == 0 ]; then\n                echo -e \"Stopping app ${APPNAME} which running with pid ${PID} ... $GREEN Done $NC\"\n                rm -rf ${APPNAME}.pid\n            else\n                rm -rf ${APPNAME}.pid\n            fi\n        fi\n    else\n        echo \"The app ${APPNAME} is not running.Ignore the operation.\"\n    fi\n}\n\n# # TODO\n# function appRestart() {\n\n# }\n\n# 获取当前目录下的 app 是否启动\nfunction appStatus() {\n    PID=$(cat ${APPNAME}.pid 2>/dev/null)\n    RES=$(ps -p $PID -o pid= -o comm= 2>/dev/null)\n    if [ ! -z \"$RES\" ]; then\n        printf \"%-30s %-30s %-10s\\n\" AppName Status PID\n        printf \"%-30s \\e[1;32m%-30s\\e[m %-30s\\n\" ${APPNAME} \"Active(Running)\" $PID\n        return 0\n    else\n        printf \"%-30s %-30s %-30s\\n\" AppName Status PID\n        printf \"%-30s \\e[1;31m%-30s\\e[m %-30s\\n\" \"${APPNAME}\" \"Inactive(Exited)\" \"N/A\"\n        return 1\n    fi\n}\n\nfunction showHelp() {\n    sed -rn -e \"s/^### ?//p\" $0 | sed \"s#app.sh#${0}#g\"\n}\n\ncase $1 in\nstart)\n    appStart\n    ;;\nstop)\n    appStop\n    ;;\nstatus)\n    appStatus\n    ;;\n*)\n    showHelp\n    exit 1\n    ;;\nesac"
+	runScript := "#!/bin/bash\n\n###\n### app.sh — Controls app startup and stop.\n###\n### Usage:\n###   app.sh <Options>\n###\n### Options:\n###   start   Start your app.\n###   stop    Stop your app.\n###   status  Show app status.\n###   run     Run your app in the foreground.\n###   -h      Show this message.\n\n[ $DEBUG ] && set -x\n\n# make stdout colorful\nGREEN='\\033[1;32m'\nYELLOW='\\033[1;33m'\nRED='\\033[1;31m'\nNC='\\033[0m' # No Color\n\n# 定义当前服务组件的名字\nAPPNAME=$(basename $(pwd))\n\n# 定义当前工作目录\nHOME=$(pwd)\n\n# web 进程的启动命令\nWEBCMD=" + shellQuote(webCmd) + "\n\n\n# 解压 slug 包\nfunction processSlug() {\n    if [ -f ${APPNAME}-slug.tgz ]; then\n        tar xzf ${APPNAME}-slug.tgz -C $HOME\n    else\n        echo -e \"There is no slug file, ${0#*/} need it to start your app ...$RED Failure $NC\"\n        exit 1\n    fi\n}\n\n# 运行 .profile.d 中的所有文件\n# 这个过程会修改 PATH 环境变量\nfunction processRuntimeEnv() {\n    sleep 1\n    if [ -d .profile.d ]; then\n        echo -e \"Handling runtime environment ... $GREEN Done $NC\"\n        for file in .profile.d/*; do\n            source $file\n        done\n        hash -r\n    fi\n}\n\n# 导入用户自定义的其他环境变量\nfunction processCustomEnv() {\n    if [ -f ${APPNAME}.env ]; then\n        sleep 1\n        echo -e \"Handling custom environment ... $GREEN Done $NC\"\n        source ${APPNAME}.env\n    fi\n}\n\n# 处理启动命令\nfunction processCmd() {\n    # 导出时解析出的 web 进程启动命令\n    if [ -n \"$WEBCMD\" ]; then\n        # 渲染启动命令中的环境变量\n        eval \"cat <<EOF\n${WEBCMD}\nEOF\n\" >${APPNAME}.cmd\n    # 从 Procfile 文件中截取 web 进程\n    elif [ -f Procfile ]; then\n        eval \"cat <<EOF\n$(grep -E '^web:' Procfile | sed 's/^web: *//')\nEOF\n\" >${APPNAME}.cmd\n    elif [ ! -f Procfile ] && [ -s .release ]; then\n        eval \"cat <<EOF\n$(grep -E '^ *web:' .release | sed 's/^ *web: *//')\nEOF\n\" >${APPNAME}.cmd\n    else\n        echo -e \"Can not detect start cmd, please check whether file Procfile or .release exists ... $RED Failure $NC\"\n        exit 1\n    fi\n}\n\n# 启动函数\nfunction appStart() {\n    appStatus >/dev/null 2>&1 &&\n        echo -e \"App ${APPNAME} is already running with pid $(cat ${APPNAME}.pid). Try exec $0 status\" &&\n        exit 1\n    processSlug\n    processRuntimeEnv\n    processCustomEnv\n    processCmd\n    echo \"Running app ${APPNAME}, you can check the logs in file ${APPNAME}.log\"\n    echo \"We will start your app with ==> $(cat ${APPNAME}.cmd)\"\n    nohup $(cat ${APPNAME}.cmd) >${APPNAME}.log 2>&1 &\n    # 对于进程运行过程中报错退出的，需要时间窗口来延迟检测\n    sleep 3\n    # 查询进程，来确定是否启动成功\n    RES=$(ps -p $! -o pid= -o comm=)\n    if [ ! -z \"$RES\" ]; then\n        echo -e \"Running app ${APPNAME} with process: $RES ... $GREEN Done $NC\"\n        echo $! >${APPNAME}.pid\n    else\n        echo -e \"Running app ${APPNAME} failed,check ${APPNAME}.log ... $RED Failure $NC\"\n    fi\n}\n\n# 前台运行 app，由 systemd 托管\nfunction appRun() {\n    processSlug\n    processRuntimeEnv\n    processCustomEnv\n    processCmd\n    exec $(cat ${APPNAME}.cmd)\n}\n\nfunction appStop() {\n    if [ -f ${APPNAME}.pid ]; then\n        PID=$(cat ${APPNAME}.pid)\n        if [ ! -z $PID ]; then\n            # For stopping Nginx process,SIGTERM is better than SIGKILL\n            kill -15 $PID >/dev/null 2>&1\n            if [ $? == 0 ]; then\n                echo -e \"Stopping app ${APPNAME} which running with pid ${PID} ... $GREEN Done $NC\"\n                rm -rf ${APPNAME}.pid\n            else\n                rm -rf ${APPNAME}.pid\n            fi\n        fi\n    else\n        echo \"The app ${APPNAME} is not running.Ignore the operation.\"\n    fi\n}\n\n# # TODO\n# function appRestart() {\n\n# }\n\n# 获取当前目录下的 app 是否启动\nfunction appStatus() {\n    PID=$(cat ${APPNAME}.pid 2>/dev/null)\n    RES=$(ps -p $PID -o pid= -o comm= 2>/dev/null)\n    if [ ! -z \"$RES\" ]; then\n        printf \"%-30s %-30s %-10s\\n\" AppName Status PID\n        printf \"%-30s \\e[1;32m%-30s\\e[m %-30s\\n\" ${APPNAME} \"Active(Running)\" $PID\n        return 0\n    else\n        printf \"%-30s %-30s %-30s\\n\" AppName Status PID\n        printf \"%-30s \\e[1;31m%-30s\\e[m %-30s\\n\" \"${APPNAME}\" \"Inactive(Exited)\" \"N/A\"\n        return 1\n    fi\n}\n\nfunction showHelp() {\n    sed -rn -e \"s/^### ?//p\" $0 | sed \"s#app.sh#${0}#g\"\n}\n\ncase $1 in\nstart)\n    appStart\n    ;;\nrun)\n    appRun\n    ;;\nstop)\n    appStop\n    ;;\nstatus)\n    appStatus\n    ;;\n*)\n    showHelp\n    exit 1\n    ;;\nesac"
 	err = os.WriteFile(shPath, []byte(runScript), 0777)
 	if err != nil {
 		logrus.Error("write run script to sh error")
@@ -223,20 +259,16 @@ func (s *slugExporter) writeRunScript(slugPath string, name string) error {
 	return nil
 }
 
-func (s *slugExporter) writeAppScript(appPath string, name string) error {
-	shName := name + ".sh"
-	shPath := path.Join(appPath, shName)
-	shfile, err := os.OpenFile(shPath, os.O_CREATE|os.O_WRONLY, 0777)
-	if err != nil {
-
-		logrus.Error("open script error")
+// writeAppScript write the script controlling all the components, they are
+// started in dependency order and each one is waited for to be ready
+func (s *slugExporter) writeAppScript(appPath string, name string, components []*slugComponent) error {
+	var buf bytes.Buffer
+	if err := appScriptTemplate.Execute(&buf, slugStartOrder(components)); err != nil {
 		return err
 	}
-	defer shfile.Close()
-	appScript := "#!/bin/bash\n###\n### app.sh — Controls app startup and stop.\n###\n### Usage:\n###   app.sh <Options>\n###\n### Options:\n###   start   Start your app.\n###   stop    Stop your app.\n###   status  Show app status.\n###   -h      Show this message.\n\n[ $DEBUG ] && set -x\n\n# make stdout colorful\nGREEN='\\033[1;32m'\nYELLOW='\\033[1;33m'\nRED='\\033[1;31m'\nNC='\\033[0m' # No Color\n\n# 定义当前应用的名字\nAPPNAME=$(basename $(pwd))\n\n# 扫描当前应用中所有的服务组件名称\nAPPS=$(ls -d */ | sed \"s#\\/##g\")\n\n# 启动所有的服务组件\nfunction allAppStart() {\n    for app in ${APPS}; do\n        pushd $app >/dev/null 2>&1\n        ./$app.sh start | sed -n '$p'\n        popd >/dev/null 2>&1\n    done\n}\n\nfunction allAppStop() {\n    for app in ${APPS}; do\n        pushd $app >/dev/null 2>&1\n        ./$app.sh stop\n        popd >/dev/null 2>&1\n    done\n}\n\nfunction allAppStatus() {\n    printf \"%-30s %-30s %-10s\\n\" AppName Status PID\n    for app in ${APPS}; do\n        pushd $app >/dev/null 2>&1\n        ./$app.sh status | sed '1d'\n        popd >/dev/null 2>&1\n    done\n}\n\nfunction showHelp() {\n    sed -rn -e \"s/^### ?//p\" $0 | sed \"s#app.sh#${0}#g\"\n}\n\ncase $1 in\nstart)\n    allAppStart\n    ;;\nstop)\n    allAppStop\n    ;;\nstatus)\n    allAppStatus\n    ;;\n*)\n    showHelp\n    exit 1\n    ;;\nesac"
-	err = os.WriteFile(shPath, []byte(appScript), 0777)
-	if err != nil {
-		logrus.Error("write app script to sh error")
+	if err := os.WriteFile(path.Join(appPath, name+".sh"), buf.Bytes(), 0777); err != nil {
+		s.logger.Errorf("write app script failure %s", err.Error())
+		return err
 	}
 	return nil
 }
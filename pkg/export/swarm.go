@@ -0,0 +1,324 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltr.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltr.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/secret"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
+	"gopkg.in/yaml.v2"
+)
+
+// swarmStackVersion the compose file version docker stack deploy accepts
+const swarmStackVersion = "3.8"
+
+type swarmExporter struct {
+	logger      *logrus.Logger
+	ram         v1alpha1.WutongApplicationConfig
+	imageClient image.Client
+	homePath    string
+	exportPath  string
+	opts        options
+}
+
+func (s *swarmExporter) Export() (*Result, error) {
+	s.logger.Infof("start export app %s to docker swarm stack spec", s.ram.AppName)
+	// Delete the old application group directory and then regenerate the application package
+	if err := PrepareExportDir(s.exportPath); err != nil {
+		s.logger.Errorf("prepare export dir failure %s", err.Error())
+		return nil, err
+	}
+	s.logger.Infof("success prepare export dir")
+	if err := s.writeStack(); err != nil {
+		s.logger.Errorf("write docker stack failure %s", err.Error())
+		return nil, err
+	}
+	s.logger.Infof("success write docker stack")
+	var dependentImages []string
+	if hasGatewayRoutes(s.ram) {
+		dependentImages = append(dependentImages, gatewayImage)
+	}
+	if err := saveComponentImages(s.ram, s.imageClient, s.exportPath, s.logger, dependentImages, s.opts); err != nil {
+		return nil, err
+	}
+	s.logger.Infof("success save components")
+	if err := s.opts.secrets.WriteFile(path.Join(s.exportPath, secret.FileName)); err != nil {
+		s.logger.Errorf("write secrets file failure %s", err.Error())
+		return nil, err
+	}
+	// leave out what the baseline package ships
+	if err := writeDelta(s.exportPath, s.opts.baseline); err != nil {
+		s.logger.Errorf("write delta package failure %s", err.Error())
+		return nil, err
+	}
+	// write package manifest and sign it
+	if err := sign.SignDir(s.exportPath, s.opts.signer); err != nil {
+		s.logger.Errorf("sign package failure %s", err.Error())
+		return nil, err
+	}
+	packageName := fmt.Sprintf("%s-%s-swarm.tar.gz", s.ram.AppName, s.ram.AppVersion)
+	res, err := packageApp(packageName, s.homePath, s.exportPath, s.opts)
+	if err != nil {
+		err = fmt.Errorf("failed to package app %s: %s", packageName, err.Error())
+		s.logger.Error(err)
+		return nil, err
+	}
+	s.logger.Infof("success export app " + s.ram.AppName)
+	return res, nil
+}
+
+// compose the compose exporter the stack is built on, the services always
+// join the app network
+func (s *swarmExporter) compose() *dockerComposeExporter {
+	opts := s.opts
+	opts.composeHostNetwork = false
+	return &dockerComposeExporter{logger: s.logger, ram: s.ram, imageClient: s.imageClient, exportPath: s.exportPath, opts: opts}
+}
+
+// writeStack write the stack file, the files of the configs and secrets and the deploy script
+func (s *swarmExporter) writeStack() error {
+	d := s.compose()
+	if err := d.writeConfigFiles(); err != nil {
+		return err
+	}
+	if err := d.writeConfigGroups(); err != nil {
+		return err
+	}
+	y, err := s.buildStack()
+	if err != nil {
+		return err
+	}
+	for name, content := range y.files {
+		file := path.Join(s.exportPath, name)
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, content, 0644); err != nil {
+			return err
+		}
+	}
+	content, err := yaml.Marshal(y)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path.Join(s.exportPath, "docker-stack.yaml"), content, 0644); err != nil {
+		return err
+	}
+	script := strings.ReplaceAll(swarmDeployScript, "@STACK@", composeNetworkName(s.ram.AppName))
+	return os.WriteFile(path.Join(s.exportPath, "deploy.sh"), []byte(script), 0755)
+}
+
+// buildStack build the swarm stack of the app from the compose project. The
+// services are replicated over the nodes and reach each other on an overlay
+// network, the outer ports are published on the routing mesh. The files bind
+// mounted by the compose services are swarm configs, the app config groups
+// are swarm secrets besides the env files.
+func (s *swarmExporter) buildStack() (*DockerComposeYaml, error) {
+	y, err := s.compose().buildComposeProject()
+	if err != nil {
+		return nil, err
+	}
+	network := composeNetworkName(s.ram.AppName)
+	y.Version = swarmStackVersion
+	// the stack is named on deploy
+	y.Name = ""
+	y.Networks = map[string]Network{network: {Driver: "overlay", Attachable: true}}
+	y.Configs = make(map[string]StackFile)
+	y.Secrets = make(map[string]StackFile)
+	var names []string
+	for name := range y.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		service := y.Services[name]
+		if strings.HasPrefix(service.NetworkMode, "service:") {
+			// swarm services can not share the network namespace of another service
+			s.logger.Warningf("plugin sidecar %s is not supported by docker swarm, skip it", name)
+			delete(y.Services, name)
+			continue
+		}
+		// the options docker stack deploy ignores or rejects
+		service.ContainerName = ""
+		service.Restart = ""
+		service.DependsOn = nil
+		service.Expose = nil
+		service.NetworkMode = ""
+		service.Networks = []string{network}
+		service.Deploy = swarmDeploy(service.Deploy, service.component)
+
+		var volumes []string
+		for _, volume := range service.Volumes {
+			source, target, ok := bindMount(volume)
+			if !ok {
+				volumes = append(volumes, volume)
+				continue
+			}
+			if source == "./gateway/ssl" {
+				for _, file := range []string{"server.crt", "server.key"} {
+					secretName := "gateway-ssl-" + strings.TrimPrefix(path.Ext(file), ".")
+					y.Secrets[secretName] = StackFile{File: "./" + path.Join("gateway/ssl", file)}
+					service.Secrets = append(service.Secrets, ServiceFile{Source: secretName, Target: path.Join(target, file)})
+				}
+				continue
+			}
+			configName := k8sName(name + "-" + target)
+			y.Configs[configName] = StackFile{File: source}
+			service.Configs = append(service.Configs, ServiceFile{Source: configName, Target: target, Mode: configFileMode(service.component, target)})
+		}
+		service.Volumes = volumes
+		for _, envFile := range service.EnvFile {
+			secretName := "config-group-" + strings.TrimSuffix(path.Base(envFile), ".env")
+			y.Secrets[secretName] = StackFile{File: envFile}
+			service.Secrets = append(service.Secrets, ServiceFile{Source: secretName, Target: secretName + ".env"})
+		}
+	}
+	return y, nil
+}
+
+// swarmDeploy the deploy of the service, the replicas of the component come
+// from its extend rule and its node selector is turned into placement constraints
+func swarmDeploy(deploy *Deploy, component *v1alpha1.Component) *Deploy {
+	if deploy == nil {
+		deploy = &Deploy{}
+	}
+	replicas := 1
+	deploy.RestartPolicy = &RestartPolicy{Condition: "any"}
+	if component != nil {
+		if component.DeployType != v1alpha1.StateSingletonDeployType && component.ExtendMethodRule.MinNode > 1 {
+			replicas = component.ExtendMethodRule.MinNode
+		}
+		if constraints := nodeSelectorConstraints(component); len(constraints) > 0 {
+			deploy.Placement = &Placement{Constraints: constraints}
+		}
+	}
+	deploy.Replicas = &replicas
+	return deploy
+}
+
+// nodeSelectorConstraints the placement constraints of the nodeSelector k8s
+// attribute of the component, matched against the node labels
+func nodeSelectorConstraints(component *v1alpha1.Component) []string {
+	var constraints []string
+	for _, attr := range component.ComponentK8sAttributes {
+		if attr.Name != "nodeSelector" {
+			continue
+		}
+		// json is yaml too
+		selector := make(map[string]string)
+		if err := yaml.Unmarshal([]byte(attr.AttributeValue), &selector); err != nil {
+			logrus.Warningf("parse nodeSelector of component %s failure %s", component.ServiceCname, err.Error())
+			continue
+		}
+		for _, key := range sortedKeys(selector) {
+			constraints = append(constraints, fmt.Sprintf("node.labels.%s==%s", key, selector[key]))
+		}
+	}
+	return constraints
+}
+
+// bindMount the source and target of the compose volume if it bind mounts a path of the package
+func bindMount(volume string) (string, string, bool) {
+	parts := strings.Split(volume, ":")
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "./") {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// configFileMode the mode of the config file volume of the component mounted at target
+func configFileMode(component *v1alpha1.Component, target string) *int {
+	if component == nil {
+		return nil
+	}
+	for _, vol := range component.ServiceVolumeMapList {
+		if vol.VolumeType == v1alpha1.ConfigFileVolumeType && vol.VolumeMountPath == target {
+			return vol.Mode
+		}
+	}
+	return nil
+}
+
+var swarmDeployScript = `#!/bin/bash
+cd $(dirname $0)
+cmd="$1"
+[[ x$cmd == x ]] && cmd=start
+STACK=@STACK@
+
+eprint() {
+  echo -e "\033[0;37;41m $* \033[0m"
+}
+
+iprint() {
+  echo -e "\033[0;37;42m $* \033[0m"
+}
+
+check::dependency() {
+  which docker &>/dev/null || {
+    eprint 'Not found docker command!'
+    return 11
+  }
+  [[ $(docker info --format '{{.Swarm.ControlAvailable}}' 2>/dev/null) == true ]] || {
+    eprint 'Run it on a manager node of the docker swarm!'
+    return 12
+  }
+  return 0
+}
+
+# import::image load the images into the docker of this node, run
+# "./deploy.sh import::image" on every other node of the swarm
+import::image() {
+  [[ -d images ]] || return 0
+  tar -cC images . | docker load
+}
+
+gateway::cert() {
+  [[ -d gateway/ssl ]] || return 0
+  [[ -f gateway/ssl/server.crt ]] && return 0
+  iprint 'generate a self-signed placeholder certificate for the gateway'
+  openssl req -x509 -nodes -newkey rsa:2048 -days 365 -subj "/CN=localhost" \
+    -keyout gateway/ssl/server.key -out gateway/ssl/server.crt
+}
+
+start() {
+  import::image
+  gateway::cert || exit $?
+  # the images are loaded into the nodes, they are not pulled from a registry
+  docker stack deploy --resolve-image never -c docker-stack.yaml $STACK
+}
+
+stop() {
+  docker stack rm $STACK
+}
+
+main() {
+  [[ $cmd == import::image ]] || check::dependency || exit $?
+
+  eval "$cmd"
+}
+
+main
+`
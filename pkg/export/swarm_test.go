@@ -0,0 +1,71 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltr.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltr.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package export
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+)
+
+func TestSwarmStack(t *testing.T) {
+	ram := testRAM()
+	ram.Components[0].ComponentK8sAttributes = []v1alpha1.ComponentK8sAttribute{
+		{Name: "nodeSelector", SaveType: "json", AttributeValue: `{"zone":"edge","disk":"ssd"}`},
+	}
+	ram.Components[1].ExtendMethodRule.MinNode = 3
+	s := &swarmExporter{logger: logrus.New(), ram: ram, opts: newOptions(WithComposeHostNetwork())}
+	y, err := s.buildStack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if y.Version != swarmStackVersion || y.Name != "" || y.Networks["demo"] != (Network{Driver: "overlay", Attachable: true}) {
+		t.Errorf("unexpected stack version %s name %s networks %v", y.Version, y.Name, y.Networks)
+	}
+	web, mysql, gateway := y.Services["web"], y.Services["mysql"], y.Services["gateway"]
+	if *web.Deploy.Replicas != 2 || *mysql.Deploy.Replicas != 1 || *gateway.Deploy.Replicas != 1 {
+		t.Errorf("unexpected replicas %d %d %d", *web.Deploy.Replicas, *mysql.Deploy.Replicas, *gateway.Deploy.Replicas)
+	}
+	if !reflect.DeepEqual(web.Deploy.Placement.Constraints, []string{"node.labels.disk==ssd", "node.labels.zone==edge"}) {
+		t.Errorf("unexpected placement %v", web.Deploy.Placement)
+	}
+	if web.Deploy.Resources.Limits.Memory != "512M" || web.Deploy.RestartPolicy.Condition != "any" {
+		t.Errorf("unexpected web deploy %+v", web.Deploy)
+	}
+	if web.NetworkMode != "" || web.ContainerName != "" || web.Restart != "" || web.DependsOn != nil || !reflect.DeepEqual(web.Networks, []string{"demo"}) {
+		t.Errorf("unexpected options of the swarm service %+v", web)
+	}
+	if !reflect.DeepEqual(web.Ports, []string{"8080:8080"}) || len(mysql.Ports) != 0 {
+		t.Errorf("unexpected published ports %v %v", web.Ports, mysql.Ports)
+	}
+	mode := 0644
+	if !reflect.DeepEqual(web.Configs, []ServiceFile{{Source: "web-etc-web-app-conf", Target: "/etc/web/app.conf", Mode: &mode}}) || y.Configs["web-etc-web-app-conf"].File != "./web/etc/web/app.conf" {
+		t.Errorf("unexpected web configs %v %v", web.Configs, y.Configs)
+	}
+	if !reflect.DeepEqual(web.Volumes, []string{"web_data:/data"}) {
+		t.Errorf("expect the config file not bind mounted, got %v", web.Volumes)
+	}
+	if len(gateway.Configs) != 1 || gateway.Configs[0].Target != "/etc/nginx/nginx.conf" || len(gateway.Volumes) != 0 {
+		t.Errorf("unexpected gateway configs %v volumes %v", gateway.Configs, gateway.Volumes)
+	}
+	if !reflect.DeepEqual(web.Secrets, []ServiceFile{{Source: "config-group-base", Target: "config-group-base.env"}}) || y.Secrets["config-group-base"].File != "./config-groups/base.env" {
+		t.Errorf("unexpected web secrets %v %v", web.Secrets, y.Secrets)
+	}
+}
@@ -0,0 +1,222 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+)
+
+// installDirPlaceholder replaced with the directory the package is unpacked to
+// by the install helper
+const installDirPlaceholder = "@INSTALL_DIR@"
+
+type systemdUnit struct {
+	App         string
+	Name        string
+	Component   string
+	Script      string
+	Description string
+	Requires    []string
+	Restart     string
+	InstallDir  string
+}
+
+// writeSystemdUnits write one unit per process of the slug components, a target
+// of the app and the install helper into the systemd dir of the package
+func (s *slugExporter) writeSystemdUnits(components []*slugComponent) error {
+	unitPath := path.Join(s.exportPath, "systemd")
+	if err := os.MkdirAll(unitPath, 0755); err != nil {
+		return err
+	}
+	app := systemdName(s.ram.AppName)
+	restart := s.opts.systemdRestart
+	if restart == "" {
+		restart = "on-failure"
+	}
+	units := make(map[string]string, len(components))
+	for _, cpt := range components {
+		units[cpt.ComponentKey] = app + "-" + systemdName(cpt.ServiceCname) + ".service"
+		units[cpt.ServiceShareID] = units[cpt.ComponentKey]
+	}
+	var names []string
+	for _, cpt := range components {
+		var requires []string
+		for _, dep := range cpt.DepServiceMapList {
+			// only the slug components are managed by systemd
+			if name, ok := units[dep.DepServiceKey]; ok && !containsString(requires, name) {
+				requires = append(requires, name)
+			}
+		}
+		cptUnits := []systemdUnit{{
+			Name:        units[cpt.ComponentKey],
+			Script:      cpt.ServiceCname + ".sh",
+			Description: fmt.Sprintf("%s component %s", s.ram.AppName, cpt.ServiceCname),
+		}}
+		for _, t := range cpt.processTypes() {
+			cptUnits = append(cptUnits, systemdUnit{
+				Name:        fmt.Sprintf("%s-%s-%s.service", app, systemdName(cpt.ServiceCname), systemdName(t)),
+				Script:      fmt.Sprintf("%s-%s.sh", cpt.ServiceCname, t),
+				Description: fmt.Sprintf("%s component %s %s process", s.ram.AppName, cpt.ServiceCname, t),
+			})
+		}
+		for _, unit := range cptUnits {
+			unit.App = app
+			unit.Component = cpt.ServiceCname
+			unit.Requires = requires
+			unit.Restart = restart
+			unit.InstallDir = installDirPlaceholder
+			var buf bytes.Buffer
+			if err := systemdServiceTemplate.Execute(&buf, unit); err != nil {
+				return err
+			}
+			if err := os.WriteFile(path.Join(unitPath, unit.Name), buf.Bytes(), 0644); err != nil {
+				return err
+			}
+			names = append(names, unit.Name)
+		}
+		if err := s.writeSystemdEnvFile(cpt.Component); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	if err := systemdTargetTemplate.Execute(&buf, map[string]interface{}{"App": app, "Description": s.ram.AppName, "Units": names}); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path.Join(unitPath, app+".target"), buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(unitPath, "install.sh"), []byte(strings.ReplaceAll(systemdInstallScript, "@APP@", app)), 0755)
+}
+
+// writeSystemdEnvFile convert the env file of the component to the systemd
+// EnvironmentFile format
+func (s *slugExporter) writeSystemdEnvFile(cpt *v1alpha1.Component) error {
+	slugPath := path.Join(s.exportPath, cpt.ServiceCname)
+	content, err := os.ReadFile(path.Join(slugPath, cpt.ServiceCname+".env"))
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, line := range strings.Split(string(content), "\n") {
+		kv := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(line), "export "), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(kv[1])
+		fmt.Fprintf(&b, "%s=\"%s\"\n", kv[0], value)
+	}
+	return os.WriteFile(path.Join(slugPath, cpt.ServiceCname+".systemd.env"), []byte(b.String()), 0644)
+}
+
+// systemdName unit names are limited to ascii
+func systemdName(name string) string {
+	res := k8sName(composeName(name))
+	if res == "" {
+		return "app"
+	}
+	return res
+}
+
+var systemdServiceTemplate = template.Must(template.New("service").Parse(`[Unit]
+Description={{.Description}}
+PartOf={{.App}}.target
+After=network-online.target{{range .Requires}} {{.}}{{end}}
+Wants=network-online.target
+{{- if .Requires}}
+Requires={{range $i, $u := .Requires}}{{if $i}} {{end}}{{$u}}{{end}}
+{{- end}}
+
+[Service]
+Type=simple
+WorkingDirectory={{.InstallDir}}/{{.Component}}
+EnvironmentFile={{.InstallDir}}/{{.Component}}/{{.Component}}.systemd.env
+ExecStart=/bin/bash {{.InstallDir}}/{{.Component}}/{{.Script}} run
+Restart={{.Restart}}
+RestartSec=5
+StandardOutput=journal
+StandardError=journal
+SyslogIdentifier={{.Name}}
+
+[Install]
+WantedBy={{.App}}.target
+`))
+
+var systemdTargetTemplate = template.Must(template.New("target").Parse(`[Unit]
+Description={{.Description}}
+Wants={{range $i, $u := .Units}}{{if $i}} {{end}}{{$u}}{{end}}
+After=network-online.target
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var systemdInstallScript = `#!/bin/bash
+###
+### install.sh — Install the systemd units of the app.
+###
+### Usage:
+###   install.sh <install|uninstall>
+###
+set -e
+cd $(dirname $0)
+INSTALL_DIR=$(cd .. && pwd)
+UNIT_DIR=${UNIT_DIR:-/etc/systemd/system}
+APP=@APP@
+
+install() {
+  for unit in *.service *.target; do
+    sed "s#@INSTALL_DIR@#${INSTALL_DIR}#g" $unit >${UNIT_DIR}/$unit
+  done
+  systemctl daemon-reload
+  for unit in *.service; do
+    systemctl enable $unit
+  done
+  systemctl enable --now ${APP}.target
+}
+
+uninstall() {
+  systemctl disable --now ${APP}.target || true
+  for unit in *.service; do
+    systemctl disable --now $unit || true
+    rm -f ${UNIT_DIR}/$unit
+  done
+  rm -f ${UNIT_DIR}/${APP}.target
+  systemctl daemon-reload
+}
+
+case "$1" in
+install)
+  install
+  ;;
+uninstall)
+  uninstall
+  ;;
+*)
+  sed -rn -e "s/^### ?//p" $0
+  exit 1
+  ;;
+esac
+`
@@ -0,0 +1,86 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestWriteSystemdUnits(t *testing.T) {
+	dir := t.TempDir()
+	ram := testRAM()
+	s := &slugExporter{logger: logrus.New(), ram: ram, exportPath: dir, opts: newOptions(WithSystemdUnits("always"))}
+	for _, cpt := range ram.Components {
+		if err := os.MkdirAll(path.Join(dir, cpt.ServiceCname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.writeEnvFile(cpt, path.Join(dir, cpt.ServiceCname), ram.AppConfigGroups); err != nil {
+			t.Fatal(err)
+		}
+	}
+	components := []*slugComponent{
+		{Component: ram.Components[0], Processes: map[string]string{"web": "./web", "worker": "./worker"}},
+		{Component: ram.Components[1]},
+	}
+	if err := s.writeSystemdUnits(components); err != nil {
+		t.Fatal(err)
+	}
+	web, err := os.ReadFile(path.Join(dir, "systemd", "demo-web.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		"Requires=demo-mysql.service",
+		"After=network-online.target demo-mysql.service",
+		"EnvironmentFile=@INSTALL_DIR@/web/web.systemd.env",
+		"ExecStart=/bin/bash @INSTALL_DIR@/web/web.sh run",
+		"Restart=always",
+		"WantedBy=demo.target",
+	} {
+		if !strings.Contains(string(web), expect) {
+			t.Errorf("%q not found in unit:\n%s", expect, web)
+		}
+	}
+	target, err := os.ReadFile(path.Join(dir, "systemd", "demo.target"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(target), "Wants=demo-web.service demo-web-worker.service demo-mysql.service") {
+		t.Errorf("unexpected target:\n%s", target)
+	}
+	worker, err := os.ReadFile(path.Join(dir, "systemd", "demo-web-worker.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(worker), "ExecStart=/bin/bash @INSTALL_DIR@/web/web-worker.sh run") {
+		t.Errorf("unexpected worker unit:\n%s", worker)
+	}
+	env, err := os.ReadFile(path.Join(dir, "web", "web.systemd.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(env), `DB_USER="root"`) || strings.Contains(string(env), "export") {
+		t.Errorf("unexpected env file:\n%s", env)
+	}
+}
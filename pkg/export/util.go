@@ -19,11 +19,15 @@
 package export
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -32,7 +36,9 @@ import (
 	"github.com/mozillazg/go-pinyin"
 	"github.com/sirupsen/logrus"
 	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util"
 	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/parts"
 )
 
 // [a-zA-Z0-9._-]
@@ -133,32 +139,68 @@ func exportComponentConfigFile(serviceDir string, v v1alpha1.ComponentVolume) er
 	return os.WriteFile(filename, []byte(v.FileConent), 0644)
 }
 
-func SaveComponents(ram v1alpha1.WutongApplicationConfig, imageClient image.Client, exportPath string, logger *logrus.Logger, dependentImages []string) error {
+// ImagesDir the OCI image layout dir of the package the component and plugin images are saved in
+const ImagesDir = "images"
+
+// SaveComponents save the component images and the dependent images into the image layout,
+// the failed pulls of the component images are reported together in a *PullError
+func SaveComponents(ram v1alpha1.WutongApplicationConfig, imageClient image.Client, exportPath string, logger *logrus.Logger, dependentImages []string, opts ...Option) error {
+	return saveComponentImages(ram, imageClient, exportPath, logger, dependentImages, newOptions(opts...))
+}
+
+// SavePlugins save the plugin images into the image layout, the failed pulls
+// are reported together in a *PullError
+func SavePlugins(ram v1alpha1.WutongApplicationConfig, imageClient image.Client, exportPath string, logger *logrus.Logger, opts ...Option) error {
+	return savePluginImages(ram, imageClient, exportPath, logger, newOptions(opts...))
+}
+
+func saveComponentImages(ram v1alpha1.WutongApplicationConfig, imageClient image.Client, exportPath string, logger *logrus.Logger, dependentImages []string, o options) error {
 	if !ram.WithImageData {
 		return nil
 	}
 	var componentImageNames []string
+	var tasks []pullTask
 	for _, component := range ram.Components {
-		componentName := unicode2zh(component.ServiceCname)
 		if component.ShareImage != "" {
 			// app is image type
-			_, err := imageClient.ImagePull(component.ShareImage, component.AppImage.HubUser, component.AppImage.HubPassword, 30)
-			if err != nil {
-				return err
-			}
-			logger.Infof("pull component %s image success", componentName)
+			tasks = append(tasks, pullTask{kind: "component", owner: unicode2zh(component.ServiceCname), image: component.ShareImage, user: component.AppImage.HubUser, password: component.AppImage.HubPassword})
 			componentImageNames = append(componentImageNames, component.ShareImage)
 		}
 	}
-	start := time.Now()
 	for _, dependentImage := range dependentImages {
-		if dependentImage == "" {
+		if dependentImage == "" || containsString(componentImageNames, dependentImage) {
 			continue
 		}
+		tasks = append(tasks, pullTask{kind: "dependent", image: dependentImage})
 		componentImageNames = append(componentImageNames, dependentImage)
 	}
-	err := imageClient.ImageSave(fmt.Sprintf("%s/component-images.tar", exportPath), componentImageNames)
-	if err != nil {
+	start := time.Now()
+	var failures []PullFailure
+	sizer, _ := imageClient.(image.Sizer)
+	for _, failure := range pullImages(imageClient, logger, o, tasks) {
+		if failure.Kind == "dependent" {
+			// dependent images are public images or images that already exist locally,
+			// an image that is neither is left out instead of failing the save
+			if sizer != nil {
+				if _, err := sizer.ImageSize(failure.Image); err == nil {
+					logger.Warningf("pull dependent image %s failure %v, save the local image", failure.Image, failure.Err)
+					continue
+				}
+			}
+			logger.Warningf("pull dependent image %s failure %v, the image is not found locally and is left out of the package", failure.Image, failure.Err)
+			componentImageNames = removeString(componentImageNames, failure.Image)
+			continue
+		}
+		failures = append(failures, failure)
+	}
+	if len(failures) > 0 {
+		err := &PullError{Failures: failures}
+		logger.Errorf("pull component images failure %s", err.Error())
+		return err
+	}
+	logger.Infof("pull %d component images success, Take %s time", len(tasks), time.Since(start))
+	start = time.Now()
+	if err := saveImages(imageClient, exportPath, "component-images.tar", componentImageNames); err != nil {
 		logrus.Errorf("Failed to save image(%v) : %s", componentImageNames, err)
 		return err
 	}
@@ -166,26 +208,27 @@ func SaveComponents(ram v1alpha1.WutongApplicationConfig, imageClient image.Clie
 	return nil
 }
 
-func SavePlugins(ram v1alpha1.WutongApplicationConfig, imageClient image.Client, exportPath string, logger *logrus.Logger) error {
+func savePluginImages(ram v1alpha1.WutongApplicationConfig, imageClient image.Client, exportPath string, logger *logrus.Logger, o options) error {
 	if !ram.WithImageData {
 		return nil
 	}
 
 	var pluginImageNames []string
+	var tasks []pullTask
 	for _, plugin := range ram.Plugins {
 		if plugin.ShareImage != "" {
 			// app is image type
-			_, err := imageClient.ImagePull(plugin.ShareImage, plugin.PluginImage.HubUser, plugin.PluginImage.HubPassword, 30)
-			if err != nil {
-				return err
-			}
-			logger.Infof("pull plugin %s image success", plugin.PluginName)
+			tasks = append(tasks, pullTask{kind: "plugin", owner: plugin.PluginName, image: plugin.ShareImage, user: plugin.PluginImage.HubUser, password: plugin.PluginImage.HubPassword})
 			pluginImageNames = append(pluginImageNames, plugin.ShareImage)
 		}
 	}
+	if failures := pullImages(imageClient, logger, o, tasks); len(failures) > 0 {
+		err := &PullError{Failures: failures}
+		logger.Errorf("pull plugin images failure %s", err.Error())
+		return err
+	}
 	start := time.Now()
-	err := imageClient.ImageSave(fmt.Sprintf("%s/plugin-images.tar", exportPath), pluginImageNames)
-	if err != nil {
+	if err := saveImages(imageClient, exportPath, "plugin-images.tar", pluginImageNames); err != nil {
 		logrus.Errorf("Failed to save image(%v) : %s", pluginImageNames, err)
 		return err
 	}
@@ -193,6 +236,24 @@ func SavePlugins(ram v1alpha1.WutongApplicationConfig, imageClient image.Client,
 	return nil
 }
 
+// saveImages save the images into the image layout of the package, the
+// blobs the images share with the images saved before are stored once
+func saveImages(imageClient image.Client, exportPath, archiveName string, images []string) error {
+	if len(images) == 0 {
+		return nil
+	}
+	archive := path.Join(exportPath, archiveName)
+	if err := imageClient.ImageSave(archive, images); err != nil {
+		return err
+	}
+	defer os.Remove(archive)
+	layout, err := image.OpenLayout(path.Join(exportPath, ImagesDir))
+	if err != nil {
+		return err
+	}
+	return layout.AddArchive(archive)
+}
+
 func Packaging(packageName, homePath, exportPath string) (string, error) {
 	cmd := exec.Command("tar", "-czf", path.Join(homePath, packageName), path.Base(exportPath))
 	cmd.Dir = homePath
@@ -202,7 +263,149 @@ func Packaging(packageName, homePath, exportPath string) (string, error) {
 	return packageName, nil
 }
 
+// packageApp pack the export dir into the package of the format the options
+// choose, the zip package is named after the tar.gz package name. The package
+// is streamed to the destination if one is set, and the export dir is removed
+// once the package is delivered.
+func packageApp(packageName, homePath, exportPath string, o options) (*Result, error) {
+	if o.zipPackage {
+		packageName = zipPackageName(packageName)
+	}
+	if o.destination != nil {
+		res, err := deliverPackage(packageName, exportPath, o)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.RemoveAll(exportPath); err != nil {
+			return nil, fmt.Errorf("remove export dir %s failure %s", exportPath, err.Error())
+		}
+		return res, nil
+	}
+	if o.zipPackage {
+		if err := util.Zip(exportPath, path.Join(homePath, packageName), zipStore(o)); err != nil {
+			return nil, err
+		}
+	} else if _, err := Packaging(packageName, homePath, exportPath); err != nil {
+		return nil, err
+	}
+	name := packageName
+	if o.splitSize > 0 {
+		m, err := parts.Split(path.Join(homePath, packageName), o.splitSize)
+		if err != nil {
+			return nil, fmt.Errorf("split package %s failure %s", packageName, err.Error())
+		}
+		if m != nil {
+			name = m.Parts[0].Name
+		}
+	}
+	return &Result{PackagePath: path.Join(homePath, name), PackageName: name}, nil
+}
+
+// deliverPackage stream the package to the destination, the package is not
+// written to the local disk. Split packages are delivered part by part.
+func deliverPackage(packageName, exportPath string, o options) (*Result, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writePackage(pw, exportPath, o))
+	}()
+	// stop the packing if the delivery fails
+	defer pr.Close()
+	ctx := context.Background()
+	if o.splitSize > 0 {
+		var location string
+		m, err := parts.SplitStream(pr, packageName, o.splitSize, func(name string, r io.Reader) error {
+			l, err := o.destination.Put(ctx, name, r)
+			if location == "" {
+				location = l
+			}
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("deliver package %s failure %s", packageName, err.Error())
+		}
+		return &Result{PackageName: m.Parts[0].Name, Location: location}, nil
+	}
+	location, err := o.destination.Put(ctx, packageName, pr)
+	if err != nil {
+		return nil, fmt.Errorf("deliver package %s failure %s", packageName, err.Error())
+	}
+	return &Result{PackageName: packageName, Location: location}, nil
+}
+
+// writePackage stream the package of the export dir to w
+func writePackage(w io.Writer, exportPath string, o options) error {
+	if o.zipPackage {
+		return util.ZipTo(exportPath, w, zipStore(o))
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("tar", "-czf", "-", path.Base(exportPath))
+	cmd.Dir = path.Dir(exportPath)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// zipStore the files stored without compression in the zip package, the
+// files compressed already by default
+func zipStore(o options) func(file string, info os.FileInfo) bool {
+	if o.zipStore != nil {
+		return o.zipStore
+	}
+	return func(file string, info os.FileInfo) bool { return util.IsCompressed(file) }
+}
+
+func zipPackageName(packageName string) string {
+	return strings.TrimSuffix(packageName, ".tar.gz") + ".zip"
+}
+
 func CheckFileExist(fileName string) bool {
 	_, err := os.Stat(fileName)
 	return !os.IsNotExist(err)
 }
+
+// sortedKeys the keys of the map in a stable order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// removeString the list without s
+func removeString(list []string, s string) []string {
+	res := list[:0]
+	for _, item := range list {
+		if item != s {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// existingParent the nearest existing dir of p
+func existingParent(p string) string {
+	for {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+		parent := path.Dir(p)
+		if parent == p {
+			return p
+		}
+		p = parent
+	}
+}
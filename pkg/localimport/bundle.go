@@ -0,0 +1,181 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package localimport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/wutong-paas/wutong-oam/pkg/export"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/docker"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/registry"
+)
+
+// pushBundle push the component and plugin images of the package image
+// layout to the registry of the hub info over the registry HTTP API, the app
+// is pointed at the pushed images. Images the package lacks are kept as they are.
+func (r *ramImport) pushBundle(packageDir string, ram *v1alpha1.WutongApplicationConfig, hubInfo v1alpha1.ImageInfo) error {
+	layoutDir := path.Join(packageDir, export.ImagesDir)
+	if !image.IsLayout(layoutDir) {
+		return fmt.Errorf("the package has no OCI image layout, import it with a container runtime")
+	}
+	layout, err := image.OpenLayout(layoutDir)
+	if err != nil {
+		return err
+	}
+	cli := registry.NewClient(hubInfo.HubUser, hubInfo.HubPassword, r.registryOpts...)
+	ctx := context.Background()
+	pushed := make(map[string]string)
+	push := func(source string) (string, error) {
+		if target, ok := pushed[source]; ok {
+			return target, nil
+		}
+		desc, ok := layout.Image(source)
+		if !ok {
+			return "", nil
+		}
+		target, err := docker.NewImageName(source, hubInfo)
+		if err != nil {
+			return "", err
+		}
+		r.logger.Infof("start push image %s", target)
+		if err := pushImage(ctx, cli, layout, desc, target); err != nil {
+			return "", fmt.Errorf("push image %s failure %s", target, err.Error())
+		}
+		r.logger.Infof("push image %s success", target)
+		pushed[source] = target
+		return target, nil
+	}
+	for _, com := range ram.Components {
+		if com.ShareImage == "" {
+			com.ShareImage = com.Image
+		}
+		if com.ShareImage == "" {
+			continue
+		}
+		target, err := push(com.ShareImage)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			r.logger.Warningf("image %s of component %s is not in the package", com.ShareImage, com.ServiceCname)
+			continue
+		}
+		com.AppImage = hubInfo
+		com.ShareImage = target
+	}
+	for _, plugin := range ram.Plugins {
+		if plugin.ShareImage == "" {
+			plugin.ShareImage = plugin.Image
+		}
+		if plugin.ShareImage == "" {
+			continue
+		}
+		target, err := push(plugin.ShareImage)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			r.logger.Warningf("image %s of plugin %s is not in the package", plugin.ShareImage, plugin.PluginName)
+			continue
+		}
+		plugin.PluginImage = hubInfo
+		plugin.ShareImage = target
+	}
+	return nil
+}
+
+// pushImage push the image of the layout as the target image, an index is
+// pushed with its manifests. An index the layout holds only some manifests of,
+// as the runtimes export the current platform, is pushed as that manifest.
+func pushImage(ctx context.Context, cli *registry.Client, layout *image.Layout, desc ocispec.Descriptor, target string) error {
+	repo, err := registry.ParseRepository(target)
+	if err != nil {
+		return err
+	}
+	if desc.MediaType != ocispec.MediaTypeImageIndex && desc.MediaType != images.MediaTypeDockerSchema2ManifestList {
+		return pushManifest(ctx, cli, layout, repo, desc, repo.Reference)
+	}
+	body, err := layout.ReadBlob(desc.Digest)
+	if err != nil {
+		return err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(body, &index); err != nil {
+		return fmt.Errorf("read image index failure %s", err.Error())
+	}
+	var present []ocispec.Descriptor
+	for _, m := range index.Manifests {
+		if layout.HasBlob(m.Digest) {
+			present = append(present, m)
+		}
+	}
+	if len(present) == 0 {
+		return fmt.Errorf("no manifest of index %s is in the layout", desc.Digest)
+	}
+	if len(present) < len(index.Manifests) {
+		return pushManifest(ctx, cli, layout, repo, present[0], repo.Reference)
+	}
+	for _, m := range present {
+		if err := pushManifest(ctx, cli, layout, repo, m, m.Digest.String()); err != nil {
+			return err
+		}
+	}
+	return cli.PushManifest(ctx, repo, repo.Reference, desc.MediaType, body)
+}
+
+// pushManifest push the blobs the registry lacks and then the manifest
+func pushManifest(ctx context.Context, cli *registry.Client, layout *image.Layout, repo *registry.Repository, desc ocispec.Descriptor, ref string) error {
+	body, err := layout.ReadBlob(desc.Digest)
+	if err != nil {
+		return err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return fmt.Errorf("read image manifest failure %s", err.Error())
+	}
+	for _, blob := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		exists, err := cli.BlobExists(ctx, repo, blob.Digest)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if !layout.HasBlob(blob.Digest) {
+			return fmt.Errorf("blob %s is neither in the layout nor in the registry", blob.Digest)
+		}
+		d := blob.Digest
+		if err := cli.PushBlob(ctx, repo, blob, func() (io.ReadCloser, error) { return layout.OpenBlob(d) }); err != nil {
+			return err
+		}
+	}
+	mediaType := desc.MediaType
+	if mediaType == "" {
+		mediaType = manifest.MediaType
+	}
+	return cli.PushManifest(ctx, repo, ref, mediaType, body)
+}
@@ -0,0 +1,115 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package localimport
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/export"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/registry"
+	"github.com/wutong-paas/wutong-oam/pkg/util/registry/registrytest"
+)
+
+func tarball(t *testing.T, files map[string][]byte, order ...string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range order {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(files[name])
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func TestDaemonlessImport(t *testing.T) {
+	reg := registrytest.NewServer()
+	defer reg.Close()
+	reg.User, reg.Password = "admin", "secret"
+
+	// the package holds the web image in its image layout
+	dir := t.TempDir()
+	packageDir := path.Join(dir, "demo-1.0-bundle")
+	layer := tarball(t, map[string][]byte{"app/main": []byte("web")}, "app/main")
+	config, _ := json.Marshal(ocispec.Image{RootFS: ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(layer)}}})
+	manifest, _ := json.Marshal([]map[string]interface{}{{"Config": "c.json", "RepoTags": []string{"hub.example.com/demo/web:v1"}, "Layers": []string{"a/layer.tar"}}})
+	archive := path.Join(dir, "images.tar")
+	os.WriteFile(archive, tarball(t, map[string][]byte{"a/layer.tar": layer, "c.json": config, "manifest.json": manifest}, "a/layer.tar", "c.json", "manifest.json"), 0644)
+	layout, err := image.OpenLayout(path.Join(packageDir, export.ImagesDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := layout.AddArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+	ram := v1alpha1.WutongApplicationConfig{AppName: "demo", AppVersion: "1.0", Components: []*v1alpha1.Component{
+		{ServiceCname: "web", ShareImage: "hub.example.com/demo/web:v1"},
+		{ServiceCname: "redis", ShareImage: "redis:7"},
+	}}
+	meta, _ := json.Marshal(ram)
+	os.WriteFile(path.Join(packageDir, "metadata.json"), meta, 0644)
+	if _, err := export.Packaging("demo-1.0-bundle.tar.gz", dir, packageDir); err != nil {
+		t.Fatal(err)
+	}
+
+	importer, err := New(logrus.New(), nil, nil, path.Join(dir, "import"), WithDaemonless(registry.WithPlainHTTP()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hubInfo := v1alpha1.ImageInfo{HubURL: reg.Host(), Namespace: "wt", HubUser: "admin", HubPassword: "secret"}
+	res, err := importer.Import(path.Join(dir, "demo-1.0-bundle.tar.gz"), hubInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Components[0].ShareImage != reg.Host()+"/wt/web:v1" || res.Components[0].AppImage.HubUser != "admin" {
+		t.Errorf("unexpected web image %s", res.Components[0].ShareImage)
+	}
+	// the image the package lacks is kept
+	if res.Components[1].ShareImage != "redis:7" {
+		t.Errorf("unexpected redis image %s", res.Components[1].ShareImage)
+	}
+	pushed, ok := reg.Manifest("wt/web", "v1")
+	if !ok || pushed.MediaType != ocispec.MediaTypeImageManifest {
+		t.Fatalf("the manifest is not pushed %+v", pushed)
+	}
+	if body, ok := reg.Blob("wt/web", digest.FromBytes(layer)); !ok || !bytes.Equal(body, layer) {
+		t.Errorf("the layer is not pushed")
+	}
+	if reg.Uploaded != 2 {
+		t.Errorf("want the config and the layer uploaded, got %d uploads", reg.Uploaded)
+	}
+
+	// the blobs in the registry are not uploaded again
+	if _, err := importer.Import(path.Join(dir, "demo-1.0-bundle.tar.gz"), hubInfo); err != nil {
+		t.Fatal(err)
+	}
+	if reg.Uploaded != 2 {
+		t.Errorf("existing blobs are uploaded again, %d uploads", reg.Uploaded)
+	}
+}
@@ -0,0 +1,200 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package localimport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/wutong-paas/wutong-oam/pkg/export"
+	"github.com/wutong-paas/wutong-oam/pkg/util"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+)
+
+// applyDelta fill in what a delta package leaves out, from the baseline
+// package if set, otherwise the layers are saved from the baseline images
+// already loaded into the container runtime
+func (r *ramImport) applyDelta(packageDir string) error {
+	delta, err := export.ReadDelta(packageDir)
+	if err != nil || delta == nil {
+		return err
+	}
+	r.logger.Infof("apply delta package on top of baseline %s", delta.Baseline.Package)
+	baselineDir, cleanup, err := r.openBaseline()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if baselineDir != "" {
+		for _, f := range delta.Files {
+			if err := copyVerified(path.Join(baselineDir, f.Path), path.Join(packageDir, f.Path), f.SHA256); err != nil {
+				return fmt.Errorf("restore file %s from the baseline failure %s", f.Path, err.Error())
+			}
+		}
+	} else if len(delta.Files) > 0 {
+		r.logger.Warningf("%d files of the baseline are not restored without the baseline package", len(delta.Files))
+	}
+	if len(delta.Layers) == 0 {
+		return nil
+	}
+	sources, err := r.baselineArchives(baselineDir, delta)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, src := range sources {
+			src.Close()
+		}
+	}()
+	missing := make(map[string]map[string]digest.Digest)
+	for _, layer := range delta.Layers {
+		if missing[layer.Archive] == nil {
+			missing[layer.Archive] = make(map[string]digest.Digest)
+		}
+		missing[layer.Archive][layer.Layer] = digest.Digest(layer.Digest)
+	}
+	for archive, layers := range missing {
+		if err := image.FillArchive(path.Join(packageDir, archive), layers, sources...); err != nil {
+			return fmt.Errorf("fill in image archive %s failure %s", archive, err.Error())
+		}
+		r.logger.Infof("fill in %d layers of image archive %s success", len(layers), archive)
+	}
+	return nil
+}
+
+// openBaseline the unpacked baseline package dir, empty if no baseline is set
+func (r *ramImport) openBaseline() (string, func(), error) {
+	if r.baseline == "" {
+		return "", func() {}, nil
+	}
+	if info, err := os.Stat(r.baseline); err != nil {
+		return "", nil, err
+	} else if info.IsDir() {
+		return r.baseline, func() {}, nil
+	}
+	tmp, err := os.MkdirTemp(path.Dir(r.homeDir), "baseline-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+	unpack := util.Untar
+	if strings.HasSuffix(r.baseline, ".zip") {
+		unpack = util.Unzip
+	}
+	if err := unpack(r.baseline, tmp); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("unpack baseline %s failure %s", r.baseline, err.Error())
+	}
+	files, err := os.ReadDir(tmp)
+	if err != nil || len(files) != 1 {
+		cleanup()
+		return "", nil, fmt.Errorf("baseline %s is not a package", r.baseline)
+	}
+	return path.Join(tmp, files[0].Name()), cleanup, nil
+}
+
+// baselineArchives the image archives of the baseline package, or an archive
+// of the baseline images saved from the container runtime
+func (r *ramImport) baselineArchives(baselineDir string, delta *export.Delta) ([]*image.Archive, error) {
+	var sources []*image.Archive
+	if baselineDir != "" {
+		files, err := util.GetFileList(baselineDir, 1)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !strings.HasSuffix(f, ".tar") {
+				continue
+			}
+			if a, err := image.OpenArchive(f); err == nil {
+				sources = append(sources, a)
+			}
+		}
+		if layout := path.Join(baselineDir, export.ImagesDir); image.IsLayout(layout) {
+			a, err := image.OpenArchive(layout)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, a)
+		}
+		return sources, nil
+	}
+	if r.imageClient == nil {
+		return nil, fmt.Errorf("the baseline package is required to apply the delta without a container runtime")
+	}
+	var images []string
+	for _, layer := range delta.Layers {
+		if !containsString(images, layer.Image) {
+			images = append(images, layer.Image)
+		}
+	}
+	file := path.Join(r.homeDir, "baseline-images.tar")
+	if err := r.imageClient.ImageSave(file, images); err != nil {
+		return nil, fmt.Errorf("save baseline images %v failure %s, import the baseline package first", images, err.Error())
+	}
+	a, err := image.OpenArchive(file)
+	if err != nil {
+		return nil, err
+	}
+	// the archive is indexed, it is not loaded again with the package images
+	os.Remove(file)
+	return append(sources, a), nil
+}
+
+// copyVerified copy the file and check its sha256 digest
+func copyVerified(src, dst, sum string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != sum {
+		return fmt.Errorf("digest mismatch, the baseline is not the one the delta is exported against")
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
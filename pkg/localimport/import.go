@@ -33,6 +33,9 @@ import (
 	"github.com/wutong-paas/wutong-oam/pkg/util"
 	"github.com/wutong-paas/wutong-oam/pkg/util/docker"
 	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+	"github.com/wutong-paas/wutong-oam/pkg/util/parts"
+	"github.com/wutong-paas/wutong-oam/pkg/util/registry"
+	"github.com/wutong-paas/wutong-oam/pkg/util/sign"
 )
 
 // AppLocalImport import
@@ -41,23 +44,92 @@ type AppLocalImport interface {
 }
 
 // New new
-func New(logger *logrus.Logger, containerdCli *containerd.Client, dockerCli *dockercli.Client, homeDir string) (AppLocalImport, error) {
+func New(logger *logrus.Logger, containerdCli *containerd.Client, dockerCli *dockercli.Client, homeDir string, opts ...Option) (AppLocalImport, error) {
+	r := &ramImport{
+		logger:       logger,
+		homeDir:      homeDir,
+		verifyPolicy: sign.PolicyOff,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.daemonless {
+		return r, nil
+	}
 	imageClient, err := image.NewClient(containerdCli, dockerCli)
 	if err != nil {
 		logger.Errorf("create image client error: %v", err)
 		return nil, err
 	}
-	return &ramImport{
-		logger:      logger,
-		imageClient: imageClient,
-		homeDir:     homeDir,
-	}, nil
+	r.imageClient = imageClient
+	return r, nil
+}
+
+// Option import option
+type Option func(*ramImport)
+
+// WithVerification verify the package signature against the trusted keys before importing
+func WithVerification(policy sign.Policy, trustStore *sign.TrustStore) Option {
+	return func(r *ramImport) {
+		r.verifyPolicy = policy
+		r.trustStore = trustStore
+	}
+}
+
+// WithBaseline the baseline package, or its unpacked dir, a delta package is applied to.
+// Without it the layers left out of a delta package are taken from the baseline
+// images loaded into the container runtime.
+func WithBaseline(baseline string) Option {
+	return func(r *ramImport) {
+		r.baseline = baseline
+	}
+}
+
+// WithDaemonless push the images of the package image layout straight to the
+// registry of the hub info over the registry HTTP API, no container runtime is
+// needed. The registry options tune the registry client.
+func WithDaemonless(opts ...registry.Option) Option {
+	return func(r *ramImport) {
+		r.daemonless = true
+		r.registryOpts = opts
+	}
 }
 
 type ramImport struct {
-	logger      *logrus.Logger
-	imageClient image.Client
-	homeDir     string
+	logger       *logrus.Logger
+	imageClient  image.Client
+	homeDir      string
+	verifyPolicy sign.Policy
+	trustStore   *sign.TrustStore
+	baseline     string
+	daemonless   bool
+	registryOpts []registry.Option
+}
+
+// unpackParts unpack the split package from its parts, the parts are
+// verified against the part manifest before anything is extracted and then
+// streamed without joining them
+func (r *ramImport) unpackParts(part string) error {
+	p, err := parts.Open(part)
+	if err != nil {
+		return err
+	}
+	m := p.Manifest()
+	r.logger.Infof("unpack package %s from %d parts", m.Package, len(m.Parts))
+	if err := p.Verify(); err != nil {
+		return err
+	}
+	if path.Ext(m.Package) != ".zip" {
+		reader := p.Reader()
+		defer reader.Close()
+		return util.UntarReader(reader, r.homeDir)
+	}
+	ra, err := p.ReaderAt()
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	return util.UnzipReader(ra, ra.Size(), r.homeDir)
 }
 
 func (r *ramImport) Import(filePath string, hubInfo v1alpha1.ImageInfo) (*v1alpha1.WutongApplicationConfig, error) {
@@ -70,7 +142,12 @@ func (r *ramImport) Import(filePath string, hubInfo v1alpha1.ImageInfo) (*v1alph
 		return nil, err
 	}
 	ext := path.Ext(filePath)
-	if ext == ".zip" {
+	if parts.IsPart(filePath) {
+		if err := r.unpackParts(filePath); err != nil {
+			r.logger.Errorf("unpack package parts of %s failure %s", filePath, err.Error())
+			return nil, err
+		}
+	} else if ext == ".zip" {
 		if err := util.Unzip(filePath, r.homeDir); err != nil {
 			r.logger.Errorf("unzip file %s faile %s", filePath, err.Error())
 			return nil, err
@@ -87,6 +164,13 @@ func (r *ramImport) Import(filePath string, hubInfo v1alpha1.ImageInfo) (*v1alph
 	if len(files) < 1 {
 		return nil, fmt.Errorf("failed to read files in tmp dir %s", r.homeDir)
 	}
+	if err := r.verifyPackage(path.Join(r.homeDir, files[0].Name())); err != nil {
+		return nil, err
+	}
+	if err := r.applyDelta(path.Join(r.homeDir, files[0].Name())); err != nil {
+		r.logger.Errorf("apply delta package failure %s", err.Error())
+		return nil, err
+	}
 	metaFile, err := os.Open(path.Join(r.homeDir, files[0].Name(), "metadata.json"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read files in tmp dir %s: %v", r.homeDir, err)
@@ -96,6 +180,13 @@ func (r *ramImport) Import(filePath string, hubInfo v1alpha1.ImageInfo) (*v1alph
 	if err := json.NewDecoder(metaFile).Decode(&ram); err != nil {
 		return nil, fmt.Errorf("failed to read meta file : %v", err)
 	}
+	if r.daemonless {
+		if err := r.pushBundle(path.Join(r.homeDir, files[0].Name()), &ram, hubInfo); err != nil {
+			r.logger.Errorf("push package images failure %s", err.Error())
+			return nil, err
+		}
+		return &ram, nil
+	}
 	// load all component images and plugin images
 	//after v5.3 package
 	l1, err := util.GetFileList(path.Join(r.homeDir, files[0].Name()), 1)
@@ -120,6 +211,14 @@ func (r *ramImport) Import(filePath string, hubInfo v1alpha1.ImageInfo) (*v1alph
 			r.logger.Infof("load image from file %s success", f)
 		}
 	}
+	// the images are saved in one OCI image layout since the layout is introduced
+	if layout := path.Join(r.homeDir, files[0].Name(), export.ImagesDir); image.IsLayout(layout) {
+		if err := r.imageClient.ImageLoad(layout); err != nil {
+			r.logger.Errorf("load images from the image layout failure %s", err.Error())
+			return nil, err
+		}
+		r.logger.Infof("load images from the image layout success")
+	}
 	for _, com := range ram.Components {
 		if com.ShareImage == "" {
 			com.ShareImage = com.Image
@@ -232,3 +331,26 @@ func (r *ramImport) Import(filePath string, hubInfo v1alpha1.ImageInfo) (*v1alph
 	}
 	return &ram, nil
 }
+
+// verifyPackage verify the package signature and files according to the verification policy
+func (r *ramImport) verifyPackage(packageDir string) error {
+	if r.verifyPolicy == "" || r.verifyPolicy == sign.PolicyOff {
+		return nil
+	}
+	var err error
+	if r.trustStore == nil {
+		err = fmt.Errorf("no trusted keys configured")
+	} else {
+		err = r.trustStore.VerifyDir(packageDir)
+	}
+	if err == nil {
+		r.logger.Infof("verify package signature success")
+		return nil
+	}
+	if r.verifyPolicy == sign.PolicyWarn {
+		r.logger.Warningf("package signature verification failure, continue importing: %s", err.Error())
+		return nil
+	}
+	r.logger.Errorf("package signature verification failure: %s", err.Error())
+	return fmt.Errorf("reject package: %v", err)
+}
@@ -0,0 +1,77 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package localimport
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wutong-paas/wutong-oam/pkg/ram/v1alpha1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/parts"
+)
+
+func TestImportCorruptedPart(t *testing.T) {
+	// random content keeps the package from compressing into one part
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, name := range []string{"demo-1.0-ram/metadata.json", "demo-1.0-ram/images/blob"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write(data)
+	}
+	tw.Close()
+	zw.Close()
+	dir := t.TempDir()
+	pkg := path.Join(dir, "demo-1.0-ram.tar.gz")
+	if err := os.WriteFile(pkg, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := parts.Split(pkg, 32<<10)
+	if err != nil || m == nil {
+		t.Fatalf("split package failure %v", err)
+	}
+	// the last part is tampered with, the part sizes are kept
+	last := path.Join(dir, m.Parts[len(m.Parts)-1].Name)
+	content, err := os.ReadFile(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[len(content)/2] ^= 0xff
+	if err := os.WriteFile(last, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	home := path.Join(dir, "home")
+	r := &ramImport{logger: logrus.New(), homeDir: home, daemonless: true}
+	if _, err := r.Import(path.Join(dir, m.Parts[0].Name), v1alpha1.ImageInfo{HubURL: "hub.example.com"}); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("expect a checksum error, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(home, "demo-1.0-ram", "metadata.json")); !os.IsNotExist(err) {
+		t.Errorf("files of the tampered package are extracted, stat error %v", err)
+	}
+}
@@ -169,6 +169,7 @@ type Component struct {
 	ComponentGraphs           []ComponentGraph          `json:"component_graphs"`
 	Endpoints                 Endpoints                 `json:"endpoints,omitempty"`
 	Labels                    map[string]string         `json:"labels,omitempty"`
+	ComponentK8sAttributes    []ComponentK8sAttribute   `json:"component_k8s_attributes,omitempty"`
 }
 
 // HandleNullValue 处理null值
@@ -20,6 +20,7 @@ package util
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -82,6 +83,20 @@ func Unzip(archive, target string) error {
 	if err != nil {
 		return fmt.Errorf("error opening archive: %v", err)
 	}
+	defer reader.Close()
+	return unzip(&reader.Reader, target)
+}
+
+// UnzipReader unzip the archive of the size read from r
+func UnzipReader(r io.ReaderAt, size int64, target string) error {
+	reader, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("error opening archive: %v", err)
+	}
+	return unzip(reader, target)
+}
+
+func unzip(reader *zip.Reader, target string) error {
 	if err := os.MkdirAll(target, 0755); err != nil {
 		return err
 	}
@@ -137,6 +152,93 @@ func Unzip(archive, target string) error {
 	return nil
 }
 
+// Zip pack the source dir into the target zip file, the entries are named
+// under the base name of the source dir like tar does. The uid/gid of every
+// entry is recorded in the entry comment the way Unzip restores it. store
+// reports the files that are stored as they are, the others are deflated.
+// Zip64 records are written for the entries and archives beyond 4GB.
+func Zip(source, target string, store func(file string, info os.FileInfo) bool) error {
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := ZipTo(source, out, store); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// ZipTo stream the zip of the source dir to w, see Zip
+func ZipTo(source string, w io.Writer, store func(file string, info os.FileInfo) bool) error {
+	zw := zip.NewWriter(w)
+	base := filepath.Dir(source)
+	err := filepath.Walk(source, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(base, file)
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if uid, gid, ok := fileOwner(info); ok {
+			header.Comment = fmt.Sprintf("%d/%d", uid, gid)
+		}
+		if info.IsDir() {
+			header.Name += "/"
+			header.Method = zip.Store
+			_, err := zw.CreateHeader(header)
+			return err
+		}
+		header.Method = zip.Deflate
+		if store != nil && store(file, info) {
+			header.Method = zip.Store
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("zip %s failure %s", source, err.Error())
+	}
+	return zw.Close()
+}
+
+// IsCompressed whether the file starts with the magic of gzip, zstd, bzip2,
+// xz or zip, compressing it again gains nothing
+func IsCompressed(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(f, magic)
+	magic = magic[:n]
+	for _, m := range [][]byte{{0x1f, 0x8b}, {0x28, 0xb5, 0x2f, 0xfd}, {'B', 'Z', 'h'}, {0xfd, '7', 'z', 'X'}, {'P', 'K', 0x03, 0x04}} {
+		if bytes.HasPrefix(magic, m) {
+			return true
+		}
+	}
+	return false
+}
+
 // Untar tar -zxvf
 func Untar(archive, target string) error {
 	cmd := exec.Command("tar", "-xzf", archive, "-C", target)
@@ -146,6 +248,18 @@ func Untar(archive, target string) error {
 	return nil
 }
 
+// UntarReader tar -zxf the archive streamed from r
+func UntarReader(r io.Reader, target string) error {
+	cmd := exec.Command("tar", "-xzf", "-", "-C", target)
+	cmd.Stdin = r
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
 // UnImagetar image-tar
 func UnImagetar(archive, target string) error {
 	cmd := exec.Command("tar", "-xf", archive, "-C", target)
@@ -18,8 +18,59 @@
 
 package util
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wutong-paas/wutong-oam/pkg/util/zip"
+)
 
 func TestNewUUID(t *testing.T) {
 	t.Log(NewUUID())
 }
+
+func TestZip(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "demo-1.0-ram")
+	os.MkdirAll(filepath.Join(source, "images"), 0755)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("layer"))
+	zw.Close()
+	os.WriteFile(filepath.Join(source, "metadata.json"), []byte(`{"app_name":"demo"}`), 0644)
+	os.WriteFile(filepath.Join(source, "images", "layer.tgz"), gz.Bytes(), 0644)
+
+	target := filepath.Join(dir, "demo-1.0-ram.zip")
+	if err := Zip(source, target, func(file string, info os.FileInfo) bool { return IsCompressed(file) }); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods := make(map[string]uint16)
+	for _, f := range zr.File {
+		methods[f.Name] = f.Method
+		if f.Comment == "" {
+			t.Errorf("the owner of %s is not recorded", f.Name)
+		}
+	}
+	zr.Close()
+	if methods["demo-1.0-ram/metadata.json"] != zip.Deflate || methods["demo-1.0-ram/images/layer.tgz"] != zip.Store {
+		t.Errorf("unexpected entry methods %v", methods)
+	}
+	if _, ok := methods["demo-1.0-ram/images/"]; !ok {
+		t.Errorf("the dir entry is missing %v", methods)
+	}
+
+	out := filepath.Join(dir, "out")
+	if err := Unzip(target, out); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(out, "demo-1.0-ram", "images", "layer.tgz")); err != nil || !bytes.Equal(content, gz.Bytes()) {
+		t.Errorf("unexpected unzipped layer %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+// Package destination deliver exported packages to where they are kept, any
+// io.Writer, an S3-compatible object store or an HTTP upload endpoint. The
+// packages are streamed, the remote destinations buffer one part at a time
+// so that a failed part is retried without reading the package again.
+package destination
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultPartSize = 16 << 20
+	defaultRetries  = 3
+	defaultBackoff  = time.Second
+)
+
+// Destination where the packages are delivered
+type Destination interface {
+	// Put store the object streamed from r under the name, the location of
+	// the stored object is returned
+	Put(ctx context.Context, name string, r io.Reader) (string, error)
+}
+
+// Retry the retries of a failed part, the backoff doubles after every retry
+type Retry struct {
+	Retries int
+	Backoff time.Duration
+}
+
+func (r Retry) withDefaults() Retry {
+	if r.Retries == 0 {
+		r.Retries = defaultRetries
+	}
+	if r.Backoff == 0 {
+		r.Backoff = defaultBackoff
+	}
+	return r
+}
+
+// do run fn until it succeeds, fails with a permanent error or runs out of retries
+func (r Retry) do(ctx context.Context, fn func() error) error {
+	backoff := r.Backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		var status *StatusError
+		if err == nil || attempt >= r.Retries || (errors.As(err, &status) && !status.Transient()) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// StatusError the destination responded with an unexpected status
+type StatusError struct {
+	Op         string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: response code is %d %s", e.Op, e.StatusCode, e.Body)
+}
+
+// Transient whether the request is worth a retry
+func (e *StatusError) Transient() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+}
+
+func statusError(op string, res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	return &StatusError{Op: op, StatusCode: res.StatusCode, Body: string(body)}
+}
+
+// readPart read the next part of the stream into buf, the bytes read are
+// returned along with whether the stream is drained
+func readPart(r io.Reader, buf []byte) ([]byte, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case nil:
+		return buf[:n], false, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return buf[:n], true, nil
+	default:
+		return nil, false, err
+	}
+}
+
+type writerDestination struct {
+	w io.Writer
+}
+
+// NewWriter deliver the packages to the writer, the objects are written one
+// after another and the name is returned as the location
+func NewWriter(w io.Writer) Destination {
+	return &writerDestination{w: w}
+}
+
+func (d *writerDestination) Put(ctx context.Context, name string, r io.Reader) (string, error) {
+	if _, err := io.Copy(d.w, r); err != nil {
+		return "", fmt.Errorf("write %s failure %s", name, err.Error())
+	}
+	return name, nil
+}
@@ -0,0 +1,196 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package destination
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 a multipart capable object store, the first upload of part 2 fails
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	parts   map[int][]byte
+	failed  bool
+	aborted bool
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minio/") || r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>u1</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPut && query.Get("uploadId") == "u1":
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		if n == 2 && !f.failed {
+			f.failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		f.parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"etag-%d\"", n))
+	case r.Method == http.MethodPost && query.Get("uploadId") == "u1":
+		var complete struct {
+			Parts []completedPart `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		var numbers []int
+		for _, p := range complete.Parts {
+			numbers = append(numbers, p.PartNumber)
+		}
+		sort.Ints(numbers)
+		var object []byte
+		for _, n := range numbers {
+			object = append(object, f.parts[n]...)
+		}
+		f.objects[r.URL.Path] = object
+		fmt.Fprint(w, `<CompleteMultipartUploadResult></CompleteMultipartUploadResult>`)
+	case r.Method == http.MethodDelete:
+		f.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[r.URL.Path] = body
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func TestS3Destination(t *testing.T) {
+	store := &fakeS3{objects: map[string][]byte{}, parts: map[int][]byte{}}
+	srv := httptest.NewServer(store)
+	defer srv.Close()
+	dest, err := NewS3(S3Config{Endpoint: srv.URL, Bucket: "packages", Prefix: "apps", AccessKey: "minio", SecretKey: "minio123", PartSize: 1000, Retry: Retry{Backoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := randomBytes(2500)
+	location, err := dest.Put(context.Background(), "demo 1.0.tar.gz", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location != srv.URL+"/packages/apps/demo 1.0.tar.gz" {
+		t.Errorf("unexpected location %s", location)
+	}
+	if !bytes.Equal(store.objects["/packages/apps/demo 1.0.tar.gz"], content) || !store.failed || store.aborted {
+		t.Errorf("the multipart upload is not completed, failed %v aborted %v", store.failed, store.aborted)
+	}
+	// a small package is uploaded with one request
+	if _, err := dest.Put(context.Background(), "small.zip", strings.NewReader("small")); err != nil {
+		t.Fatal(err)
+	}
+	if string(store.objects["/packages/apps/small.zip"]) != "small" {
+		t.Errorf("the small package is not uploaded")
+	}
+}
+
+// fakeUpload an upload endpoint honoring Content-Range, the first chunk
+// request fails after storing half of the chunk
+type fakeUpload struct {
+	mu      sync.Mutex
+	data    []byte
+	done    bool
+	failed  bool
+	ranges  []string
+	resumed bool
+}
+
+func (f *fakeUpload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Method == http.MethodHead {
+		w.Header().Set(UploadOffsetHeader, strconv.Itoa(len(f.data)))
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	rng := r.Header.Get("Content-Range")
+	f.ranges = append(f.ranges, rng)
+	var start, end int
+	var total string
+	fmt.Sscanf(strings.Replace(rng, "/", " ", 1), "bytes %d-%d %s", &start, &end, &total)
+	if start != len(f.data) || end-start+1 != len(body) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if start > 0 && start%1000 != 0 {
+		f.resumed = true
+	}
+	if !f.failed {
+		f.failed = true
+		f.data = append(f.data, body[:len(body)/2]...)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	f.data = append(f.data, body...)
+	f.done = total != "*"
+}
+
+func TestHTTPDestination(t *testing.T) {
+	endpoint := &fakeUpload{}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+	dest, err := NewHTTP(HTTPConfig{URL: srv.URL + "/upload", ChunkSize: 1000, Retry: Retry{Backoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := randomBytes(2000)
+	if _, err := dest.Put(context.Background(), "demo.tar.gz", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(endpoint.data, content) || !endpoint.done {
+		t.Errorf("the upload is incomplete, %d bytes done %v", len(endpoint.data), endpoint.done)
+	}
+	if !endpoint.resumed || endpoint.ranges[len(endpoint.ranges)-1] != "bytes 1000-1999/2000" {
+		t.Errorf("unexpected ranges %v", endpoint.ranges)
+	}
+}
+
+func TestWriterDestination(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewWriter(&buf).Put(context.Background(), "demo.tar.gz", strings.NewReader("package")); err != nil || buf.String() != "package" {
+		t.Errorf("unexpected written package %q %v", buf.String(), err)
+	}
+}
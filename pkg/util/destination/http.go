@@ -0,0 +1,158 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package destination
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// UploadOffsetHeader the header the upload endpoint reports the bytes it
+// holds of an upload with, answering HEAD. A retried chunk resumes from it.
+const UploadOffsetHeader = "Upload-Offset"
+
+// HTTPConfig the HTTP upload endpoint the packages are PUT to, the package
+// name is appended to the URL
+type HTTPConfig struct {
+	URL    string
+	Header http.Header
+	// ChunkSize the size of the chunks, 16MB by default. A package within
+	// one chunk is sent with a plain PUT, larger ones are sent in chunks
+	// carrying Content-Range.
+	ChunkSize  int64
+	Retry      Retry
+	HTTPClient *http.Client
+}
+
+type httpDestination struct {
+	cfg HTTPConfig
+}
+
+// NewHTTP deliver the packages to the HTTP upload endpoint, a failed chunk
+// is retried from the offset the endpoint reports
+func NewHTTP(cfg HTTPConfig) (Destination, error) {
+	if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, fmt.Errorf("invalid upload url %q", cfg.URL)
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = defaultPartSize
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	cfg.Retry = cfg.Retry.withDefaults()
+	return &httpDestination{cfg: cfg}, nil
+}
+
+func (h *httpDestination) Put(ctx context.Context, name string, r io.Reader) (string, error) {
+	location := h.cfg.URL + "/" + name
+	buf := make([]byte, h.cfg.ChunkSize)
+	chunk, drained, err := readPart(r, buf)
+	if err != nil {
+		return "", err
+	}
+	if drained {
+		err := h.cfg.Retry.do(ctx, func() error { return h.put(ctx, location, chunk, "") })
+		if err != nil {
+			return "", fmt.Errorf("upload %s failure %s", name, err.Error())
+		}
+		return location, nil
+	}
+	var offset int64
+	for {
+		next, nextDrained := chunk, drained
+		if !drained {
+			// the total size is known once the last chunk is read, read ahead one chunk
+			if next, nextDrained, err = readPart(r, make([]byte, h.cfg.ChunkSize)); err != nil {
+				return "", err
+			}
+		}
+		total := "*"
+		if nextDrained && len(next) == 0 || drained {
+			total = strconv.FormatInt(offset+int64(len(chunk)), 10)
+		}
+		start, retried := offset, false
+		err := h.cfg.Retry.do(ctx, func() error {
+			// a retry resumes from what the endpoint holds of the chunk
+			sent := start
+			if retried {
+				if held, ok := h.offset(ctx, location); ok && held > start && held < start+int64(len(chunk)) {
+					sent = held
+				}
+			}
+			retried = true
+			rng := fmt.Sprintf("bytes %d-%d/%s", sent, start+int64(len(chunk))-1, total)
+			return h.put(ctx, location, chunk[sent-start:], rng)
+		})
+		if err != nil {
+			return "", fmt.Errorf("upload %s failure %s", name, err.Error())
+		}
+		offset += int64(len(chunk))
+		if total != "*" {
+			return location, nil
+		}
+		chunk, drained = next, nextDrained
+	}
+}
+
+func (h *httpDestination) put(ctx context.Context, location string, body []byte, contentRange string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, location, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range h.cfg.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if contentRange != "" {
+		req.Header.Set("Content-Range", contentRange)
+	}
+	res, err := h.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return statusError("upload "+location, res)
+	}
+	return nil
+}
+
+// offset the bytes the endpoint holds of the upload, false if it does not tell
+func (h *httpDestination) offset(ctx context.Context, location string) (int64, bool) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, location, nil)
+	if err != nil {
+		return 0, false
+	}
+	for k, v := range h.cfg.Header {
+		req.Header[k] = v
+	}
+	res, err := h.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return 0, false
+	}
+	res.Body.Close()
+	offset, err := strconv.ParseInt(res.Header.Get(UploadOffsetHeader), 10, 64)
+	return offset, err == nil
+}
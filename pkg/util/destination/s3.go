@@ -0,0 +1,299 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package destination
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config the S3-compatible object store the packages are uploaded to,
+// the objects are addressed path-style, which MinIO and most stores accept
+type S3Config struct {
+	// Endpoint the url of the store, eg. https://minio.example.com:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PartSize the size of the multipart upload parts, 16MB by default. A
+	// package within one part is uploaded with a single request.
+	PartSize   int64
+	Retry      Retry
+	HTTPClient *http.Client
+}
+
+type s3Destination struct {
+	cfg S3Config
+	// now the signing time, replaced in tests
+	now func() time.Time
+}
+
+// NewS3 deliver the packages to the S3-compatible object store with
+// multipart uploads, the failed parts are retried and the upload is aborted
+// if a part fails for good
+func NewS3(cfg S3Config) (Destination, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PartSize <= 0 {
+		cfg.PartSize = defaultPartSize
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	cfg.Retry = cfg.Retry.withDefaults()
+	return &s3Destination{cfg: cfg, now: time.Now}, nil
+}
+
+func (s *s3Destination) Put(ctx context.Context, name string, r io.Reader) (string, error) {
+	key := strings.TrimLeft(strings.TrimRight(s.cfg.Prefix, "/")+"/"+name, "/")
+	buf := make([]byte, s.cfg.PartSize)
+	part, drained, err := readPart(r, buf)
+	if err != nil {
+		return "", err
+	}
+	if drained {
+		err := s.cfg.Retry.do(ctx, func() error {
+			_, err := s.request(ctx, http.MethodPut, key, nil, part, http.StatusOK)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("upload %s failure %s", key, err.Error())
+		}
+		return s.location(key), nil
+	}
+	if err := s.multipartUpload(ctx, key, r, buf, part); err != nil {
+		return "", fmt.Errorf("upload %s failure %s", key, err.Error())
+	}
+	return s.location(key), nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// multipartUpload upload the stream in parts, first is the part read already
+func (s *s3Destination) multipartUpload(ctx context.Context, key string, r io.Reader, buf, first []byte) error {
+	var uploadID string
+	err := s.cfg.Retry.do(ctx, func() error {
+		res, err := s.request(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		var body struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.Unmarshal(res, &body); err != nil || body.UploadID == "" {
+			return fmt.Errorf("invalid create multipart upload response %s", res)
+		}
+		uploadID = body.UploadID
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		s.request(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, http.StatusNoContent)
+		return err
+	}
+	var completed []completedPart
+	part, drained := first, false
+	for number := 1; len(part) > 0; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		var etag string
+		err := s.cfg.Retry.do(ctx, func() error {
+			var err error
+			etag, err = s.uploadPart(ctx, key, query, part)
+			return err
+		})
+		if err != nil {
+			return abort(fmt.Errorf("upload part %d failure %s", number, err.Error()))
+		}
+		completed = append(completed, completedPart{PartNumber: number, ETag: etag})
+		if drained {
+			break
+		}
+		if part, drained, err = readPart(r, buf); err != nil {
+			return abort(err)
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: completed})
+	if err != nil {
+		return abort(err)
+	}
+	err = s.cfg.Retry.do(ctx, func() error {
+		res, err := s.request(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, http.StatusOK)
+		// the store reports a failed completion in the body of a 200 response
+		if err == nil && bytes.Contains(res, []byte("<Error>")) {
+			return fmt.Errorf("complete multipart upload failure %s", res)
+		}
+		return err
+	})
+	if err != nil {
+		return abort(err)
+	}
+	return nil
+}
+
+func (s *s3Destination) uploadPart(ctx context.Context, key string, query url.Values, part []byte) (string, error) {
+	req, err := s.newRequest(ctx, http.MethodPut, key, query, part)
+	if err != nil {
+		return "", err
+	}
+	res, err := s.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", statusError("upload part", res)
+	}
+	return res.Header.Get("ETag"), nil
+}
+
+// request send the signed request, the response body is returned
+func (s *s3Destination) request(ctx context.Context, method, key string, query url.Values, body []byte, expect int) ([]byte, error) {
+	req, err := s.newRequest(ctx, method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != expect {
+		return nil, statusError(method+" "+key, res)
+	}
+	return io.ReadAll(res.Body)
+}
+
+func (s *s3Destination) newRequest(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Request, error) {
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + s.cfg.Bucket + "/" + key
+	u.RawPath = "/" + uriEncode(s.cfg.Bucket, false) + "/" + uriEncode(key, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, u, body)
+	return req, nil
+}
+
+func (s *s3Destination) location(key string) string {
+	return s.cfg.Endpoint + "/" + s.cfg.Bucket + "/" + key
+}
+
+// sign sign the request with AWS signature version 4
+func (s *s3Destination) sign(req *http.Request, u *url.URL, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n" + "x-amz-content-sha256:" + payloadHash + "\n" + "x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	for _, part := range []string{s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery the query sorted by key with the values encoded the way signature v4 wants
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encode everything but the unreserved characters, the
+// slashes of object keys are kept
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
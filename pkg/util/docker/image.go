@@ -288,14 +288,18 @@ func MultiImageSave(ctx context.Context, dockerCli *client.Client, destination s
 // ImageLoad load image from  tar file
 // destination destination file name eg. /tmp/xxx.tar
 func ImageLoad(dockerCli *client.Client, tarFile string) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	reader, err := os.OpenFile(tarFile, os.O_RDONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
+	return ImageLoadReader(dockerCli, reader)
+}
+
+// ImageLoadReader load image from the image archive stream
+func ImageLoadReader(dockerCli *client.Client, reader io.Reader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	rc, err := dockerCli.ImageLoad(ctx, reader, false)
 	if err != nil {
@@ -0,0 +1,469 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrFileNotFound the file is not found in the layers of the image
+var ErrFileNotFound = errors.New("file not found in image layers")
+
+// Archive an image archive saved by ImageSave, both docker-archive (manifest.json)
+// and OCI image layout (index.json) are supported, as a tar file or an unpacked
+// dir. The archive is indexed once and the layers are read in place without
+// extracting the archive.
+type Archive struct {
+	file *os.File
+	// dir the dir of an unpacked archive
+	dir     string
+	entries map[string]archiveEntry
+	// order the entry names in archive order
+	order []string
+	// images layers of the images by image reference, bottom layer first
+	images map[string][]string
+	// names the image references as listed in the archive
+	names []string
+	// digests the digests of the layers by entry name
+	digests map[string]digest.Digest
+	// manifests the image manifests of an OCI layout by image reference
+	manifests map[string]ocispec.Descriptor
+	// dockerImages the images of a docker-archive by image reference
+	dockerImages map[string]dockerManifest
+}
+
+type archiveEntry struct {
+	// name the entry the data is stored under, the target of a link
+	name   string
+	offset int64
+	size   int64
+}
+
+// dockerManifest the item of the docker-archive manifest.json
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// OpenArchive index the image archive, file is a tar file or an unpacked dir
+func OpenArchive(file string) (*Archive, error) {
+	a := &Archive{
+		entries:      make(map[string]archiveEntry),
+		images:       make(map[string][]string),
+		digests:      make(map[string]digest.Digest),
+		manifests:    make(map[string]ocispec.Descriptor),
+		dockerImages: make(map[string]dockerManifest),
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		a.dir = file
+		err = a.indexDir()
+	} else {
+		if a.file, err = os.Open(file); err != nil {
+			return nil, err
+		}
+		err = a.indexTar()
+	}
+	if err == nil {
+		err = a.indexImages()
+	}
+	if err != nil {
+		a.Close()
+		return nil, fmt.Errorf("read image archive %s failure %s", file, err.Error())
+	}
+	return a, nil
+}
+
+// Close -
+func (a *Archive) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// Layers the layer paths of the image in the archive, bottom layer first
+func (a *Archive) Layers(image string) ([]string, error) {
+	if layers, ok := a.images[image]; ok {
+		return layers, nil
+	}
+	if named, err := reference.ParseNormalizedNamed(image); err == nil {
+		if layers, ok := a.images[reference.TagNameOnly(named).String()]; ok {
+			return layers, nil
+		}
+	}
+	return nil, fmt.Errorf("image %s not found in the archive", image)
+}
+
+// Images the references of the images in the archive
+func (a *Archive) Images() []string {
+	return a.names
+}
+
+// LayerDigest the digest of the layer entry, the digests are read from the
+// image metadata and the layer is only digested if the metadata lacks it.
+// The layers may be missing from a delta archive, their digests are still known.
+func (a *Archive) LayerDigest(layer string) (digest.Digest, error) {
+	layer = cleanEntryName(layer)
+	if d, ok := a.digests[layer]; ok {
+		return d, nil
+	}
+	r, _, err := a.Open(layer)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	d, err := digest.FromReader(r)
+	if err != nil {
+		return "", err
+	}
+	a.digests[layer] = d
+	return d, nil
+}
+
+// HasEntry whether the entry is stored in the archive
+func (a *Archive) HasEntry(name string) bool {
+	_, ok := a.entries[cleanEntryName(name)]
+	return ok
+}
+
+// Open open the entry of the archive
+func (a *Archive) Open(name string) (io.ReadCloser, int64, error) {
+	name = cleanEntryName(name)
+	entry, ok := a.entries[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("%s not found in the archive", name)
+	}
+	if a.dir != "" {
+		f, err := os.Open(filepath.Join(a.dir, filepath.FromSlash(entry.name)))
+		return f, entry.size, err
+	}
+	return io.NopCloser(io.NewSectionReader(a.file, entry.offset, entry.size)), entry.size, nil
+}
+
+// ExtractFile copy the file of the image to w, the layers are searched from
+// the top one and the file is streamed out of the layer
+func (a *Archive) ExtractFile(image, file string, w io.Writer) error {
+	layers, err := a.Layers(image)
+	if err != nil {
+		return err
+	}
+	file = cleanEntryName(file)
+	for i := len(layers) - 1; i >= 0; i-- {
+		found, err := a.extractFromLayer(layers[i], file, w)
+		if err != nil {
+			return fmt.Errorf("read layer %s of image %s failure %s", layers[i], image, err.Error())
+		}
+		if found {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s of image %s (%d layers): %w", file, image, len(layers), ErrFileNotFound)
+}
+
+func (a *Archive) extractFromLayer(layer, file string, w io.Writer) (bool, error) {
+	rc, _, err := a.Open(layer)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	r, err := decompress(rc)
+	if err != nil {
+		return false, err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if cleanEntryName(hdr.Name) != file || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+}
+
+// indexTar record the offsets of the entries. docker save before docker 25
+// stores a layer shared by the images once and links the other copies to it,
+// the links are resolved to the offset of their target.
+func (a *Archive) indexTar() error {
+	tr := tar.NewReader(a.file)
+	links := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanEntryName(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeSymlink:
+			if path.IsAbs(hdr.Linkname) {
+				links[name] = cleanEntryName(hdr.Linkname)
+			} else {
+				links[name] = cleanEntryName(path.Join(path.Dir(name), hdr.Linkname))
+			}
+			a.order = append(a.order, name)
+			continue
+		case tar.TypeLink:
+			links[name] = cleanEntryName(hdr.Linkname)
+			a.order = append(a.order, name)
+			continue
+		default:
+			continue
+		}
+		// the tar reader does not read ahead, the file is at the start of the entry data
+		offset, err := a.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		a.entries[name] = archiveEntry{name: name, offset: offset, size: hdr.Size}
+		a.order = append(a.order, name)
+	}
+	for name := range links {
+		// links to links are followed, a dangling or cyclic link is left out
+		target := name
+		for i := 0; i <= len(links); i++ {
+			next, ok := links[target]
+			if !ok {
+				break
+			}
+			target = next
+		}
+		if entry, ok := a.entries[target]; ok {
+			a.entries[name] = entry
+		}
+	}
+	order := a.order[:0]
+	for _, name := range a.order {
+		if _, ok := a.entries[name]; ok {
+			order = append(order, name)
+		}
+	}
+	a.order = order
+	return nil
+}
+
+// indexDir record the files of the unpacked archive, symlinks are followed
+// as long as their target is in the archive
+func (a *Archive) indexDir() error {
+	root, err := filepath.EvalSymlinks(a.dir)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(a.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := file
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err = filepath.EvalSymlinks(file); err != nil {
+				// a dangling link is left out
+				return nil
+			}
+			if info, err = os.Stat(target); err != nil {
+				return err
+			}
+			if rel, err := filepath.Rel(root, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return nil
+			}
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(a.dir, file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		stored := name
+		if target != file {
+			if rel, err = filepath.Rel(root, target); err != nil {
+				return err
+			}
+			stored = filepath.ToSlash(rel)
+		}
+		a.entries[name] = archiveEntry{name: stored, size: info.Size()}
+		a.order = append(a.order, name)
+		return nil
+	})
+}
+
+// indexImages read the image index of the archive, the OCI index is preferred
+// as the docker manifest.json written along with it lacks the layer digests
+func (a *Archive) indexImages() error {
+	if _, ok := a.entries[ocispec.ImageIndexFile]; ok {
+		return a.indexOCILayout()
+	}
+	if _, ok := a.entries["manifest.json"]; ok {
+		return a.indexDockerArchive()
+	}
+	return fmt.Errorf("neither manifest.json nor %s is found, not an image archive", ocispec.ImageIndexFile)
+}
+
+func (a *Archive) indexDockerArchive() error {
+	var manifests []dockerManifest
+	if err := a.readJSON("manifest.json", &manifests); err != nil {
+		return err
+	}
+	for _, mf := range manifests {
+		// the layers of docker-archive are uncompressed, their digests are the diff ids
+		var config ocispec.Image
+		if err := a.readJSON(mf.Config, &config); err == nil && len(config.RootFS.DiffIDs) == len(mf.Layers) {
+			for i, layer := range mf.Layers {
+				a.digests[cleanEntryName(layer)] = config.RootFS.DiffIDs[i]
+			}
+		}
+		for _, tag := range mf.RepoTags {
+			a.dockerImages[tag] = mf
+			a.addImage(tag, mf.Layers)
+		}
+	}
+	return nil
+}
+
+func (a *Archive) indexOCILayout() error {
+	var index ocispec.Index
+	if err := a.readJSON(ocispec.ImageIndexFile, &index); err != nil {
+		return err
+	}
+	for _, desc := range index.Manifests {
+		name := desc.Annotations["io.containerd.image.name"]
+		if name == "" {
+			name = desc.Annotations[ocispec.AnnotationRefName]
+		}
+		if name == "" {
+			continue
+		}
+		desc, manifest, err := a.resolveManifest(desc)
+		if err != nil {
+			return fmt.Errorf("resolve manifest of image %s failure %s", name, err.Error())
+		}
+		a.manifests[name] = desc
+		var layers []string
+		for _, layer := range manifest.Layers {
+			layers = append(layers, blobPath(layer))
+			a.digests[blobPath(layer)] = layer.Digest
+		}
+		a.addImage(name, layers)
+	}
+	return nil
+}
+
+// addImage the image is indexed by its normalized reference too
+func (a *Archive) addImage(name string, layers []string) {
+	for i := range layers {
+		layers[i] = cleanEntryName(layers[i])
+	}
+	a.names = append(a.names, name)
+	a.images[name] = layers
+	if named, err := reference.ParseNormalizedNamed(name); err == nil {
+		a.images[reference.TagNameOnly(named).String()] = layers
+	}
+}
+
+// resolveManifest the image manifest of the descriptor, the first manifest is
+// used if the descriptor is an index of a multi-platform image
+func (a *Archive) resolveManifest(desc ocispec.Descriptor) (ocispec.Descriptor, *ocispec.Manifest, error) {
+	for {
+		var content struct {
+			ocispec.Manifest
+			Manifests []ocispec.Descriptor `json:"manifests,omitempty"`
+		}
+		if err := a.readJSON(blobPath(desc), &content); err != nil {
+			return desc, nil, err
+		}
+		if len(content.Manifests) == 0 {
+			return desc, &content.Manifest, nil
+		}
+		next, ok := a.firstPresent(content.Manifests)
+		if !ok {
+			return desc, nil, fmt.Errorf("no platform manifest of index %s is in the archive", desc.Digest)
+		}
+		desc = next
+	}
+}
+
+func (a *Archive) firstPresent(descs []ocispec.Descriptor) (ocispec.Descriptor, bool) {
+	for _, desc := range descs {
+		if _, ok := a.entries[blobPath(desc)]; ok {
+			return desc, true
+		}
+	}
+	return ocispec.Descriptor{}, false
+}
+
+func (a *Archive) readJSON(name string, v interface{}) error {
+	r, _, err := a.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+func blobPath(desc ocispec.Descriptor) string {
+	return path.Join(ocispec.ImageBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+}
+
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// decompress layers may be saved uncompressed or gzipped
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
@@ -0,0 +1,209 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// StripArchive rewrite the image archive, or remove the blobs of an unpacked
+// archive, without the layers for which skip returns true, the image metadata is kept so that the layers can be filled
+// in again by FillArchive. The stripped layers are returned.
+func StripArchive(file string, skip func(layer string, d digest.Digest) bool) (map[string]digest.Digest, error) {
+	a, err := OpenArchive(file)
+	if err != nil {
+		return nil, err
+	}
+	stripped := make(map[string]digest.Digest)
+	for _, name := range a.names {
+		for _, layer := range a.images[name] {
+			if _, ok := stripped[layer]; ok || !a.HasEntry(layer) {
+				continue
+			}
+			d, err := a.LayerDigest(layer)
+			if err != nil {
+				a.Close()
+				return nil, err
+			}
+			if skip(layer, d) {
+				stripped[layer] = d
+			}
+		}
+	}
+	if len(stripped) == 0 {
+		return stripped, a.Close()
+	}
+	if a.dir != "" {
+		defer a.Close()
+		for layer := range stripped {
+			if err := os.Remove(filepath.Join(a.dir, filepath.FromSlash(layer))); err != nil {
+				return nil, err
+			}
+		}
+		return stripped, nil
+	}
+	err = rewriteArchive(file, func(tw *tar.Writer) error {
+		return a.copyEntries(tw, func(name string) bool {
+			_, ok := stripped[name]
+			return ok
+		})
+	})
+	a.Close()
+	if err != nil {
+		return nil, err
+	}
+	return stripped, nil
+}
+
+// FillArchive add the missing layers, keyed by entry name, to the image archive.
+// The layers are looked up by digest in the layers of the source archives.
+func FillArchive(file string, missing map[string]digest.Digest, sources ...*Archive) error {
+	a, err := OpenArchive(file)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	type source struct {
+		archive *Archive
+		layer   string
+	}
+	found := make(map[digest.Digest]source)
+	for _, src := range sources {
+		for _, name := range src.names {
+			for _, layer := range src.images[name] {
+				if !src.HasEntry(layer) {
+					continue
+				}
+				d, err := src.LayerDigest(layer)
+				if err != nil {
+					return err
+				}
+				if _, ok := found[d]; !ok {
+					found[d] = source{archive: src, layer: layer}
+				}
+			}
+		}
+	}
+	for layer, d := range missing {
+		if _, ok := found[d]; !ok {
+			return fmt.Errorf("layer %s (%s) is not found in the baseline images", layer, d)
+		}
+	}
+	if a.dir != "" {
+		for layer, d := range missing {
+			if a.HasEntry(layer) {
+				continue
+			}
+			src := found[d]
+			if err := src.archive.copyFile(src.layer, filepath.Join(a.dir, filepath.FromSlash(layer))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return rewriteArchive(file, func(tw *tar.Writer) error {
+		if err := a.copyEntries(tw, nil); err != nil {
+			return err
+		}
+		for layer, d := range missing {
+			if a.HasEntry(layer) {
+				continue
+			}
+			src := found[d]
+			if err := src.archive.copyEntry(tw, src.layer, layer); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rewriteArchive write the archive to a temp file which then replaces the file
+func rewriteArchive(file string, write func(tw *tar.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	tw := tar.NewWriter(tmp)
+	if err := write(tw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// copyEntries copy the entries in archive order, skipped entries are left out
+func (a *Archive) copyEntries(tw *tar.Writer, skip func(name string) bool) error {
+	for _, name := range a.order {
+		if skip != nil && skip(name) {
+			continue
+		}
+		if err := a.copyEntry(tw, name, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Archive) copyEntry(tw *tar.Writer, entry, name string) error {
+	r, size, err := a.Open(entry)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// copyFile copy the entry to the file
+func (a *Archive) copyFile(entry, file string) error {
+	r, _, err := a.Open(entry)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
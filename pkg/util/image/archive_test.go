@@ -0,0 +1,175 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func tarball(t *testing.T, files map[string][]byte, order ...string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range order {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeArchive(t *testing.T, content []byte) string {
+	file := path.Join(t.TempDir(), "images.tar")
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestDockerArchiveExtractFile(t *testing.T) {
+	base := tarball(t, map[string][]byte{"etc/os-release": []byte("os")}, "etc/os-release")
+	slug := tarball(t, map[string][]byte{"./tmp/slug/slug.tgz": []byte("slug")}, "./tmp/slug/slug.tgz")
+	manifest, _ := json.Marshal([]dockerManifest{{RepoTags: []string{"goodrain.me/app:v1"}, Layers: []string{"a/layer.tar", "b/layer.tar"}}})
+	// docker save writes manifest.json last
+	file := writeArchive(t, tarball(t, map[string][]byte{
+		"a/layer.tar": base, "b/layer.tar": slug, "manifest.json": manifest,
+	}, "a/layer.tar", "b/layer.tar", "manifest.json"))
+
+	archive, err := OpenArchive(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	var out bytes.Buffer
+	if err := archive.ExtractFile("goodrain.me/app:v1", "tmp/slug/slug.tgz", &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "slug" {
+		t.Errorf("unexpected slug %q", out.String())
+	}
+	if err := archive.ExtractFile("goodrain.me/app:v1", "tmp/none", &out); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("expect ErrFileNotFound, got %v", err)
+	}
+	if err := archive.ExtractFile("goodrain.me/other:v1", "tmp/slug/slug.tgz", &out); err == nil {
+		t.Error("expect image not found")
+	}
+}
+
+func TestOCILayoutExtractFile(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(tarball(t, map[string][]byte{"tmp/slug/slug.tgz": []byte("slug")}, "tmp/slug/slug.tgz"))
+	zw.Close()
+	layer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(gz.Bytes()), Size: int64(gz.Len())}
+	manifest, _ := json.Marshal(ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Layers: []ocispec.Descriptor{layer}})
+	manifestDesc := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Digest:      digest.FromBytes(manifest),
+		Size:        int64(len(manifest)),
+		Annotations: map[string]string{"io.containerd.image.name": "docker.io/library/app:v1"},
+	}
+	index, _ := json.Marshal(ocispec.Index{Manifests: []ocispec.Descriptor{manifestDesc}})
+	files := map[string][]byte{
+		blobPath(layer):         gz.Bytes(),
+		blobPath(manifestDesc):  manifest,
+		ocispec.ImageIndexFile:  index,
+		ocispec.ImageLayoutFile: []byte(`{"imageLayoutVersion":"1.0.0"}`),
+	}
+	file := writeArchive(t, tarball(t, files, ocispec.ImageLayoutFile, ocispec.ImageIndexFile, blobPath(manifestDesc), blobPath(layer)))
+
+	archive, err := OpenArchive(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	var out bytes.Buffer
+	// short references are normalized
+	if err := archive.ExtractFile("app:v1", "tmp/slug/slug.tgz", &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "slug" {
+		t.Errorf("unexpected slug %q", out.String())
+	}
+}
+
+func TestStripAndFillArchive(t *testing.T) {
+	base := tarball(t, map[string][]byte{"etc/os-release": []byte("os")}, "etc/os-release")
+	app := tarball(t, map[string][]byte{"app/main": []byte("v2")}, "app/main")
+	config, _ := json.Marshal(ocispec.Image{RootFS: ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(base), digest.FromBytes(app)}}})
+	manifest, _ := json.Marshal([]dockerManifest{{Config: "c.json", RepoTags: []string{"demo/app:v2"}, Layers: []string{"a/layer.tar", "b/layer.tar"}}})
+	files := map[string][]byte{"a/layer.tar": base, "b/layer.tar": app, "c.json": config, "manifest.json": manifest}
+	file := writeArchive(t, tarball(t, files, "a/layer.tar", "b/layer.tar", "c.json", "manifest.json"))
+	baseline := writeArchive(t, tarball(t, map[string][]byte{"x/layer.tar": base, "manifest.json": []byte(`[{"RepoTags":["demo/app:v1"],"Layers":["x/layer.tar"]}]`)}, "x/layer.tar", "manifest.json"))
+
+	stripped, err := StripArchive(file, func(layer string, d digest.Digest) bool { return d == digest.FromBytes(base) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stripped) != 1 || stripped["a/layer.tar"] != digest.FromBytes(base) {
+		t.Fatalf("unexpected stripped layers %v", stripped)
+	}
+	a, err := OpenArchive(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the digest of the stripped layer is still known from the image config
+	if a.HasEntry("a/layer.tar") {
+		t.Error("the layer is not stripped")
+	}
+	if d, err := a.LayerDigest("a/layer.tar"); err != nil || d != digest.FromBytes(base) {
+		t.Errorf("unexpected digest of stripped layer %s %v", d, err)
+	}
+	a.Close()
+
+	src, err := OpenArchive(baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if err := FillArchive(file, stripped, src); err != nil {
+		t.Fatal(err)
+	}
+	a, err = OpenArchive(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	var out bytes.Buffer
+	if err := a.ExtractFile("demo/app:v2", "etc/os-release", &out); err != nil || out.String() != "os" {
+		t.Errorf("the filled layer is not readable %q %v", out.String(), err)
+	}
+	if err := FillArchive(file, map[string]digest.Digest{"z/layer.tar": digest.FromString("none")}, src); err == nil {
+		t.Error("expect missing layer error")
+	}
+}
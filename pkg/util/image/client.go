@@ -18,6 +18,12 @@ type Client interface {
 	ImageTag(source, target string, timeout int) error
 }
 
+// Sizer is implemented by the clients that can tell the size of a local image
+type Sizer interface {
+	// ImageSize the size of the local image
+	ImageSize(image string) (int64, error)
+}
+
 func NewClient(client *containerd.Client, dockerCli *dockercli.Client) (c Client, err error) {
 	if client != nil {
 		return &containerdImageCliImpl{
@@ -131,11 +131,11 @@ func getImageConfig(ctx context.Context, image containerd.Image) (*ocispec.Image
 	}
 }
 
-// ImageLoad load image from  tar file
+// ImageLoad load image from  tar file or OCI image layout dir
 // destination destination file name eg. /tmp/xxx.tar
 func (c *containerdImageCliImpl) ImageLoad(tarFile string) error {
 	ctx := namespaces.WithNamespace(context.Background(), Namespace)
-	reader, err := os.OpenFile(tarFile, os.O_RDONLY, 0644)
+	reader, err := openImageArchive(tarFile)
 	if err != nil {
 		return err
 	}
@@ -332,3 +332,17 @@ func (c *containerdImageCliImpl) ImageTag(source, target string, timeout int) er
 	logrus.Info("change image tag success")
 	return nil
 }
+
+// ImageSize the size of the image content in the content store, the layers are compressed
+func (c *containerdImageCliImpl) ImageSize(image string) (int64, error) {
+	named, err := reference.ParseDockerRef(image)
+	if err != nil {
+		return 0, err
+	}
+	ctx := namespaces.WithNamespace(context.Background(), Namespace)
+	img, err := c.client.GetImage(ctx, named.String())
+	if err != nil {
+		return 0, err
+	}
+	return img.Size(ctx)
+}
@@ -43,7 +43,12 @@ func (d *dockerImageCliImpl) ImagePull(image string, username, password string,
 }
 
 func (d *dockerImageCliImpl) ImageLoad(tarFile string) error {
-	return docker.ImageLoad(d.client, tarFile)
+	reader, err := openImageArchive(tarFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return docker.ImageLoadReader(d.client, reader)
 }
 
 func (d *dockerImageCliImpl) ImagePush(image, user, pass string, timeout int) error {
@@ -53,3 +58,12 @@ func (d *dockerImageCliImpl) ImagePush(image, user, pass string, timeout int) er
 func (d *dockerImageCliImpl) ImageTag(source, target string, timeout int) error {
 	return docker.ImageTag(d.client, source, target, timeout)
 }
+
+// ImageSize the size of the image on disk, the layers are not compressed
+func (d *dockerImageCliImpl) ImageSize(image string) (int64, error) {
+	ins, err := docker.ImageInspectWithRaw(d.client, image)
+	if err != nil {
+		return 0, err
+	}
+	return ins.Size, nil
+}
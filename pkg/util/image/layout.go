@@ -0,0 +1,310 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// containerdImageName the annotation containerd names the imported images by
+const containerdImageName = "io.containerd.image.name"
+
+// Layout an OCI image layout dir the images of image archives are added to,
+// every blob is stored once however many images share it. A docker
+// manifest.json is written along so that docker daemons without OCI support
+// load the layout too.
+type Layout struct {
+	dir    string
+	index  ocispec.Index
+	docker []dockerManifest
+}
+
+// IsLayout whether the dir is an OCI image layout
+func IsLayout(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ocispec.ImageLayoutFile))
+	return err == nil
+}
+
+// OpenLayout open the layout dir, the layout is created if it does not exist
+func OpenLayout(dir string) (*Layout, error) {
+	if err := os.MkdirAll(filepath.Join(dir, ocispec.ImageBlobsDir, digest.SHA256.String()), 0755); err != nil {
+		return nil, err
+	}
+	l := &Layout{
+		dir:   dir,
+		index: ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageIndex},
+	}
+	if body, err := os.ReadFile(filepath.Join(dir, ocispec.ImageIndexFile)); err == nil {
+		if err := json.Unmarshal(body, &l.index); err != nil {
+			return nil, fmt.Errorf("read layout index failure %s", err.Error())
+		}
+	}
+	if body, err := os.ReadFile(filepath.Join(dir, "manifest.json")); err == nil {
+		if err := json.Unmarshal(body, &l.docker); err != nil {
+			return nil, fmt.Errorf("read layout docker manifest failure %s", err.Error())
+		}
+	}
+	return l, nil
+}
+
+// AddArchive add the images of the image archive to the layout
+func (l *Layout) AddArchive(file string) error {
+	a, err := OpenArchive(file)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	for _, name := range a.names {
+		if err := l.addImage(a, name); err != nil {
+			return fmt.Errorf("add image %s to the layout failure %s", name, err.Error())
+		}
+	}
+	return l.write()
+}
+
+func (l *Layout) addImage(a *Archive, name string) error {
+	var desc ocispec.Descriptor
+	var manifest ocispec.Manifest
+	if mfDesc, ok := a.manifests[name]; ok {
+		body, err := a.readAll(blobPath(mfDesc))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, &manifest); err != nil {
+			return err
+		}
+		for _, blob := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+			if err := l.copyBlob(a, blobPath(blob), blob.Digest); err != nil {
+				return err
+			}
+		}
+		if err := l.writeBlob(mfDesc.Digest, body); err != nil {
+			return err
+		}
+		desc = ocispec.Descriptor{MediaType: mfDesc.MediaType, Digest: mfDesc.Digest, Size: mfDesc.Size, Platform: mfDesc.Platform}
+	} else {
+		// the docker-archive image is converted to an OCI manifest, the layers are kept as they are
+		mf := a.dockerImages[name]
+		config, err := a.readAll(mf.Config)
+		if err != nil {
+			return err
+		}
+		manifest = ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		}
+		if err := l.writeBlob(manifest.Config.Digest, config); err != nil {
+			return err
+		}
+		for _, layer := range a.images[name] {
+			d, err := a.LayerDigest(layer)
+			if err != nil {
+				return err
+			}
+			mediaType, err := a.layerMediaType(layer)
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: a.entries[layer].size})
+			if err := l.copyBlob(a, layer, d); err != nil {
+				return err
+			}
+		}
+		body, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		desc = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(body), Size: int64(len(body))}
+		if err := l.writeBlob(desc.Digest, body); err != nil {
+			return err
+		}
+	}
+	if named, err := reference.ParseDockerRef(name); err == nil {
+		name = named.String()
+	}
+	desc.Annotations = map[string]string{ocispec.AnnotationRefName: name, containerdImageName: name}
+	var manifests []ocispec.Descriptor
+	for _, m := range l.index.Manifests {
+		if m.Annotations[containerdImageName] != name {
+			manifests = append(manifests, m)
+		}
+	}
+	l.index.Manifests = append(manifests, desc)
+	var images []dockerManifest
+	for _, m := range l.docker {
+		if len(m.RepoTags) != 1 || m.RepoTags[0] != name {
+			images = append(images, m)
+		}
+	}
+	item := dockerManifest{Config: blobPath(manifest.Config), RepoTags: []string{name}}
+	for _, layer := range manifest.Layers {
+		item.Layers = append(item.Layers, blobPath(layer))
+	}
+	l.docker = append(images, item)
+	return nil
+}
+
+// Image the index descriptor of the image, short names are normalized
+func (l *Layout) Image(name string) (ocispec.Descriptor, bool) {
+	if named, err := reference.ParseDockerRef(name); err == nil {
+		name = named.String()
+	}
+	for _, m := range l.index.Manifests {
+		if m.Annotations[containerdImageName] == name || m.Annotations[ocispec.AnnotationRefName] == name {
+			return m, true
+		}
+	}
+	return ocispec.Descriptor{}, false
+}
+
+// HasBlob whether the blob is stored in the layout
+func (l *Layout) HasBlob(d digest.Digest) bool {
+	_, err := os.Stat(l.blobFile(d))
+	return err == nil
+}
+
+// OpenBlob open the blob stored in the layout
+func (l *Layout) OpenBlob(d digest.Digest) (io.ReadCloser, error) {
+	return os.Open(l.blobFile(d))
+}
+
+// ReadBlob read the blob stored in the layout, for manifests and configs
+func (l *Layout) ReadBlob(d digest.Digest) ([]byte, error) {
+	return os.ReadFile(l.blobFile(d))
+}
+
+// copyBlob copy the entry of the archive into the layout unless the blob is stored
+func (l *Layout) copyBlob(a *Archive, entry string, d digest.Digest) error {
+	file := l.blobFile(d)
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	}
+	return a.copyFile(entry, file)
+}
+
+func (l *Layout) writeBlob(d digest.Digest, body []byte) error {
+	file := l.blobFile(d)
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	}
+	return os.WriteFile(file, body, 0644)
+}
+
+func (l *Layout) blobFile(d digest.Digest) string {
+	return filepath.Join(l.dir, filepath.FromSlash(blobPath(ocispec.Descriptor{Digest: d})))
+}
+
+// write the layout file, the index and the docker manifest
+func (l *Layout) write() error {
+	layout, _ := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err := os.WriteFile(filepath.Join(l.dir, ocispec.ImageLayoutFile), layout, 0644); err != nil {
+		return err
+	}
+	index, err := json.Marshal(l.index)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(l.dir, ocispec.ImageIndexFile), index, 0644); err != nil {
+		return err
+	}
+	docker, err := json.Marshal(l.docker)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(l.dir, "manifest.json"), docker, 0644)
+}
+
+// LayoutReader stream the layout dir as an image archive tar, so that it is
+// loaded without packing it into a file first
+func LayoutReader(dir string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, file)
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := tw.WriteHeader(&tar.Header{Name: filepath.ToSlash(rel), Mode: 0644, Size: info.Size(), Typeflag: tar.TypeReg}); err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// openImageArchive open the image archive tar, an OCI image layout dir is streamed as tar
+func openImageArchive(file string) (io.ReadCloser, error) {
+	if IsLayout(file) {
+		return LayoutReader(file), nil
+	}
+	return os.Open(file)
+}
+
+func (a *Archive) readAll(name string) ([]byte, error) {
+	r, _, err := a.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// layerMediaType docker-archive layers are uncompressed unless saved by containerd
+func (a *Archive) layerMediaType(layer string) (string, error) {
+	r, _, err := a.Open(layer)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	magic, err := bufio.NewReader(r).Peek(2)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return ocispec.MediaTypeImageLayerGzip, nil
+	}
+	return ocispec.MediaTypeImageLayer, nil
+}
@@ -0,0 +1,212 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// dockerArchive an archive of one image with the base layer and an app layer
+func dockerArchive(t *testing.T, name string, base, app []byte) string {
+	config, _ := json.Marshal(ocispec.Image{Config: ocispec.ImageConfig{Labels: map[string]string{"name": name}}, RootFS: ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(base), digest.FromBytes(app)}}})
+	manifest, _ := json.Marshal([]dockerManifest{{Config: "c.json", RepoTags: []string{name}, Layers: []string{"a/layer.tar", "b/layer.tar"}}})
+	files := map[string][]byte{"a/layer.tar": base, "b/layer.tar": app, "c.json": config, "manifest.json": manifest}
+	return writeArchive(t, tarball(t, files, "a/layer.tar", "b/layer.tar", "c.json", "manifest.json"))
+}
+
+func TestLayoutAddArchive(t *testing.T) {
+	base := tarball(t, map[string][]byte{"etc/os-release": []byte("os")}, "etc/os-release")
+	web := tarball(t, map[string][]byte{"app/main": []byte("web")}, "app/main")
+	worker := tarball(t, map[string][]byte{"app/main": []byte("worker")}, "app/main")
+	dir := path.Join(t.TempDir(), "images")
+	for _, archive := range []string{dockerArchive(t, "demo/web:v1", base, web), dockerArchive(t, "demo/worker:v1", base, worker)} {
+		layout, err := OpenLayout(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := layout.AddArchive(archive); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blobs, _ := os.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	// the base layer is stored once: two configs, two manifests and three layers
+	if len(blobs) != 7 {
+		t.Errorf("expect 7 blobs, got %d", len(blobs))
+	}
+	if !IsLayout(dir) {
+		t.Fatal("the dir is not an image layout")
+	}
+	a, err := OpenArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if len(a.Images()) != 2 {
+		t.Errorf("unexpected images %v", a.Images())
+	}
+	var out bytes.Buffer
+	if err := a.ExtractFile("demo/worker:v1", "app/main", &out); err != nil || out.String() != "worker" {
+		t.Errorf("unexpected worker file %q %v", out.String(), err)
+	}
+
+	// the streamed layout is an image archive as well
+	content, err := io.ReadAll(LayoutReader(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := OpenArchive(writeArchive(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer streamed.Close()
+	out.Reset()
+	if err := streamed.ExtractFile("docker.io/demo/web:v1", "etc/os-release", &out); err != nil || out.String() != "os" {
+		t.Errorf("unexpected web file %q %v", out.String(), err)
+	}
+}
+
+func TestStripAndFillLayout(t *testing.T) {
+	base := tarball(t, map[string][]byte{"etc/os-release": []byte("os")}, "etc/os-release")
+	app := tarball(t, map[string][]byte{"app/main": []byte("v2")}, "app/main")
+	dir := path.Join(t.TempDir(), "images")
+	layout, err := OpenLayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := layout.AddArchive(dockerArchive(t, "demo/app:v2", base, app)); err != nil {
+		t.Fatal(err)
+	}
+	stripped, err := StripArchive(dir, func(layer string, d digest.Digest) bool { return d == digest.FromBytes(base) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stripped) != 1 {
+		t.Fatalf("unexpected stripped layers %v", stripped)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "blobs", "sha256", digest.FromBytes(base).Encoded())); !os.IsNotExist(err) {
+		t.Errorf("the layer blob is not removed, stat error %v", err)
+	}
+	src, err := OpenArchive(dockerArchive(t, "demo/app:v1", base, tarball(t, map[string][]byte{"app/main": []byte("v1")}, "app/main")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if err := FillArchive(dir, stripped, src); err != nil {
+		t.Fatal(err)
+	}
+	a, err := OpenArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	var out bytes.Buffer
+	if err := a.ExtractFile("demo/app:v2", "etc/os-release", &out); err != nil || out.String() != "os" {
+		t.Errorf("the filled layer is not readable %q %v", out.String(), err)
+	}
+}
+
+func TestLayoutAddArchiveLinkedLayers(t *testing.T) {
+	base := tarball(t, map[string][]byte{"etc/os-release": []byte("os")}, "etc/os-release")
+	web := tarball(t, map[string][]byte{"app/main": []byte("web")}, "app/main")
+	worker := tarball(t, map[string][]byte{"app/main": []byte("worker")}, "app/main")
+	config := func(name string, app []byte) []byte {
+		body, _ := json.Marshal(ocispec.Image{Config: ocispec.ImageConfig{Labels: map[string]string{"name": name}}, RootFS: ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(base), digest.FromBytes(app)}}})
+		return body
+	}
+	manifest, _ := json.Marshal([]dockerManifest{
+		{Config: "web.json", RepoTags: []string{"demo/web:v1"}, Layers: []string{"a/layer.tar", "b/layer.tar"}},
+		{Config: "worker.json", RepoTags: []string{"demo/worker:v1"}, Layers: []string{"c/layer.tar", "d/layer.tar"}},
+		{Config: "job.json", RepoTags: []string{"demo/job:v1"}, Layers: []string{"e/layer.tar", "d/layer.tar"}},
+	})
+	// docker save before docker 25 links the shared layer to its first copy
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range []struct {
+		name, link string
+		typ        byte
+		body       []byte
+	}{
+		{name: "a/layer.tar", typ: tar.TypeReg, body: base},
+		{name: "b/layer.tar", typ: tar.TypeReg, body: web},
+		{name: "c/layer.tar", typ: tar.TypeSymlink, link: "../a/layer.tar"},
+		{name: "d/layer.tar", typ: tar.TypeReg, body: worker},
+		{name: "e/layer.tar", typ: tar.TypeLink, link: "a/layer.tar"},
+		{name: "web.json", typ: tar.TypeReg, body: config("web", web)},
+		{name: "worker.json", typ: tar.TypeReg, body: config("worker", worker)},
+		{name: "job.json", typ: tar.TypeReg, body: config("job", worker)},
+		{name: "manifest.json", typ: tar.TypeReg, body: manifest},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Linkname: entry.link, Typeflag: entry.typ, Mode: 0644, Size: int64(len(entry.body))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(entry.body)
+	}
+	tw.Close()
+
+	dir := path.Join(t.TempDir(), "images")
+	layout, err := OpenLayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := layout.AddArchive(writeArchive(t, buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	a, err := OpenArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for _, image := range []string{"demo/worker:v1", "demo/job:v1"} {
+		var out bytes.Buffer
+		if err := a.ExtractFile(image, "etc/os-release", &out); err != nil || out.String() != "os" {
+			t.Errorf("unexpected %s base layer file %q %v", image, out.String(), err)
+		}
+	}
+
+	// the same layout unpacked with a symlink
+	unpacked := t.TempDir()
+	for name, body := range map[string][]byte{"a/layer.tar": base, "d/layer.tar": worker, "worker.json": config("worker", worker), "manifest.json": manifest} {
+		os.MkdirAll(filepath.Join(unpacked, filepath.Dir(name)), 0755)
+		if err := os.WriteFile(filepath.Join(unpacked, name), body, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.MkdirAll(filepath.Join(unpacked, "c"), 0755)
+	if err := os.Symlink("../a/layer.tar", filepath.Join(unpacked, "c", "layer.tar")); err != nil {
+		t.Fatal(err)
+	}
+	u, err := OpenArchive(unpacked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	var out bytes.Buffer
+	if err := u.ExtractFile("demo/worker:v1", "etc/os-release", &out); err != nil || out.String() != "os" {
+		t.Errorf("unexpected unpacked worker base layer file %q %v", out.String(), err)
+	}
+}
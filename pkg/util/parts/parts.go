@@ -0,0 +1,320 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+// Package parts split packages into numbered parts that fit the size limit
+// of transfer channels, and read them back as one stream.
+package parts
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// ManifestSuffix the suffix of the part manifest, it is written next to the parts
+const ManifestSuffix = ".parts.json"
+
+var partRegexp = regexp.MustCompile(`^(.+)\.part[0-9]{3,}$`)
+
+// Manifest the parts of a package and their checksums
+type Manifest struct {
+	// Package the name of the package the parts are joined into
+	Package  string `json:"package"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	PartSize int64  `json:"part_size"`
+	Parts    []Part `json:"parts"`
+}
+
+// Part a part of the package
+type Part struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// PartName the name of the i-th part of the package, counted from 0
+func PartName(pkg string, i int) string {
+	return fmt.Sprintf("%s.part%03d", pkg, i+1)
+}
+
+// IsPart whether the file is a part of a split package
+func IsPart(file string) bool {
+	return partRegexp.MatchString(filepath.Base(file))
+}
+
+// Split split the package file into parts of at most partSize bytes next to
+// it and write the part manifest, the package file is removed. A package
+// that fits one part is left as it is and nil is returned.
+func Split(file string, partSize int64) (*Manifest, error) {
+	if partSize <= 0 {
+		return nil, fmt.Errorf("invalid part size %d", partSize)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() <= partSize {
+		return nil, nil
+	}
+	dir, pkg := filepath.Split(file)
+	m, err := SplitStream(f, pkg, partSize, func(name string, r io.Reader) error {
+		out, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return m, os.Remove(file)
+}
+
+// SplitStream split the package streamed from r into parts of at most
+// partSize bytes, put stores the parts one after another and then the part
+// manifest. A stream is delivered in parts even if it fits one.
+func SplitStream(r io.Reader, pkg string, partSize int64, put func(name string, r io.Reader) error) (*Manifest, error) {
+	if partSize <= 0 {
+		return nil, fmt.Errorf("invalid part size %d", partSize)
+	}
+	br := bufio.NewReader(r)
+	m := &Manifest{Package: pkg, PartSize: partSize}
+	total := sha256.New()
+	for i := 0; ; i++ {
+		part := Part{Name: PartName(pkg, i)}
+		h := sha256.New()
+		counter := &countWriter{}
+		if err := put(part.Name, io.TeeReader(io.LimitReader(br, partSize), io.MultiWriter(h, total, counter))); err != nil {
+			return nil, fmt.Errorf("write part %s failure %s", part.Name, err.Error())
+		}
+		part.Size, part.SHA256 = counter.n, hex.EncodeToString(h.Sum(nil))
+		m.Parts = append(m.Parts, part)
+		m.Size += part.Size
+		if part.Size < partSize {
+			break
+		}
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	m.SHA256 = hex.EncodeToString(total.Sum(nil))
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := put(pkg+ManifestSuffix, bytes.NewReader(body)); err != nil {
+		return nil, fmt.Errorf("write part manifest failure %s", err.Error())
+	}
+	return m, nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return len(b), nil
+}
+
+// Parts the parts of a split package found next to one of them
+type Parts struct {
+	dir      string
+	manifest *Manifest
+}
+
+// Open read the part manifest of the package the part belongs to and check
+// that every part is there with its size
+func Open(part string) (*Parts, error) {
+	match := partRegexp.FindStringSubmatch(filepath.Base(part))
+	if match == nil {
+		return nil, fmt.Errorf("%s is not a package part", part)
+	}
+	dir := filepath.Dir(part)
+	body, err := os.ReadFile(filepath.Join(dir, match[1]+ManifestSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("read part manifest failure %s", err.Error())
+	}
+	var m Manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("parse part manifest failure %s", err.Error())
+	}
+	sort.Slice(m.Parts, func(i, j int) bool { return m.Parts[i].Name < m.Parts[j].Name })
+	var size int64
+	for _, p := range m.Parts {
+		info, err := os.Stat(filepath.Join(dir, p.Name))
+		if err != nil {
+			return nil, fmt.Errorf("part %s of package %s is missing", p.Name, m.Package)
+		}
+		if info.Size() != p.Size {
+			return nil, fmt.Errorf("part %s has size %d, %d expected", p.Name, info.Size(), p.Size)
+		}
+		size += p.Size
+	}
+	if size != m.Size {
+		return nil, fmt.Errorf("the parts of package %s add up to %d bytes, %d expected", m.Package, size, m.Size)
+	}
+	return &Parts{dir: dir, manifest: &m}, nil
+}
+
+// Manifest the part manifest
+func (p *Parts) Manifest() *Manifest {
+	return p.manifest
+}
+
+// Reader stream the parts as the package, the checksum of every part is
+// verified when it is read through, a mismatch fails the read
+func (p *Parts) Reader() io.ReadCloser {
+	return &partsReader{parts: p, total: sha256.New()}
+}
+
+// Verify read every part and check its checksum
+func (p *Parts) Verify() error {
+	r := p.Reader()
+	defer r.Close()
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// ReaderAt random access to the package across the parts, the checksums are
+// not verified, call Verify first
+func (p *Parts) ReaderAt() (*ReaderAt, error) {
+	ra := &ReaderAt{}
+	for _, part := range p.manifest.Parts {
+		f, err := os.Open(filepath.Join(p.dir, part.Name))
+		if err != nil {
+			ra.Close()
+			return nil, err
+		}
+		ra.files = append(ra.files, f)
+		ra.offsets = append(ra.offsets, ra.size)
+		ra.size += part.Size
+	}
+	return ra, nil
+}
+
+type partsReader struct {
+	parts   *Parts
+	index   int
+	current *os.File
+	hash    hash.Hash
+	total   hash.Hash
+}
+
+func (r *partsReader) Read(b []byte) (int, error) {
+	parts := r.parts.manifest.Parts
+	for {
+		if r.current == nil {
+			if r.index >= len(parts) {
+				if hex.EncodeToString(r.total.Sum(nil)) != r.parts.manifest.SHA256 {
+					return 0, fmt.Errorf("package %s checksum mismatch", r.parts.manifest.Package)
+				}
+				return 0, io.EOF
+			}
+			f, err := os.Open(filepath.Join(r.parts.dir, parts[r.index].Name))
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.hash = f, sha256.New()
+		}
+		n, err := r.current.Read(b)
+		r.hash.Write(b[:n])
+		r.total.Write(b[:n])
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if hex.EncodeToString(r.hash.Sum(nil)) != parts[r.index].SHA256 {
+				return n, fmt.Errorf("part %s checksum mismatch", parts[r.index].Name)
+			}
+			r.index++
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// ReaderAt random access to the package across the part files
+type ReaderAt struct {
+	files   []*os.File
+	offsets []int64
+	size    int64
+}
+
+// Size the size of the package
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt read the package at offset, the read spans parts if needed
+func (r *ReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > off }) - 1
+	var read int
+	for ; i >= 0 && i < len(r.files) && read < len(b); i++ {
+		n, err := r.files[i].ReadAt(b[read:], off+int64(read)-r.offsets[i])
+		read += n
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+	}
+	if read < len(b) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// Close close the part files
+func (r *ReaderAt) Close() error {
+	for _, f := range r.files {
+		f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+package parts
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitAndRead(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 2500)
+	rand.New(rand.NewSource(1)).Read(content)
+	file := filepath.Join(dir, "demo-1.0-ram.tar.gz")
+	os.WriteFile(file, content, 0644)
+
+	m, err := Split(file, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Parts) != 3 || m.Parts[2].Name != "demo-1.0-ram.tar.gz.part003" || m.Parts[2].Size != 500 {
+		t.Fatalf("unexpected parts %+v", m.Parts)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("the package is not removed")
+	}
+	first := filepath.Join(dir, m.Parts[0].Name)
+	if !IsPart(first) || IsPart(file) {
+		t.Errorf("unexpected part detection")
+	}
+	p, err := Open(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := p.Reader()
+	joined, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(joined, content) {
+		t.Errorf("the joined package differs, read error %v", err)
+	}
+	ra, err := p.ReaderAt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// read across the part boundary
+	b := make([]byte, 200)
+	if n, err := ra.ReadAt(b, 900); err != nil || n != 200 || !bytes.Equal(b, content[900:1100]) {
+		t.Errorf("unexpected read at the boundary %d %v", n, err)
+	}
+	if n, err := ra.ReadAt(b, 2400); err != io.EOF || n != 100 {
+		t.Errorf("want EOF reading past the end, got %d %v", n, err)
+	}
+	ra.Close()
+
+	// a corrupted part fails the read
+	corrupted := append([]byte{}, content[1000:2000]...)
+	corrupted[10] ^= 0xff
+	os.WriteFile(filepath.Join(dir, m.Parts[1].Name), corrupted, 0644)
+	if err := p.Verify(); err == nil || !strings.Contains(err.Error(), "part002 checksum mismatch") {
+		t.Errorf("want checksum mismatch, got %v", err)
+	}
+	os.Remove(filepath.Join(dir, m.Parts[2].Name))
+	if _, err := Open(first); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("want missing part error, got %v", err)
+	}
+}
+
+func TestSplitSmallPackage(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "demo-1.0-ram.zip")
+	os.WriteFile(file, []byte("small"), 0644)
+	if m, err := Split(file, 1000); err != nil || m != nil {
+		t.Errorf("the small package is split %v %v", m, err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,486 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrUnauthorized the registry asks for credentials and none are given
+var ErrUnauthorized = errors.New("registry requires credentials")
+
+// ErrDenied the registry rejects the given credentials
+var ErrDenied = errors.New("registry denied the credentials")
+
+// ErrNotFound the manifest or blob does not exist in the registry
+var ErrNotFound = errors.New("not found in registry")
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// manifestMediaTypes the manifests the client accepts
+var manifestMediaTypes = []string{
+	ocispec.MediaTypeImageManifest,
+	ocispec.MediaTypeImageIndex,
+	mediaTypeDockerManifest,
+	mediaTypeDockerManifestList,
+}
+
+// Client a minimal client of the registry HTTP API v2
+type Client struct {
+	httpCli    *http.Client
+	user, pass string
+	plainHTTP  bool
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// Option client option
+type Option func(*Client)
+
+// WithHTTPClient send the requests with the http client
+func WithHTTPClient(cli *http.Client) Option {
+	return func(c *Client) {
+		c.httpCli = cli
+	}
+}
+
+// WithPlainHTTP talk to the registry over http instead of https
+func WithPlainHTTP() Option {
+	return func(c *Client) {
+		c.plainHTTP = true
+	}
+}
+
+// WithInsecureSkipVerify trust the certificate of the registry without
+// verification, for registries with a self-signed certificate
+func WithInsecureSkipVerify() Option {
+	return func(c *Client) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		c.httpCli = &http.Client{Transport: transport}
+	}
+}
+
+// NewClient new registry client, user and pass may be empty for anonymous access
+func NewClient(user, pass string, opts ...Option) *Client {
+	c := &Client{
+		httpCli: http.DefaultClient,
+		user:    user,
+		pass:    pass,
+		tokens:  make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Repository the registry host, repository path and tag or digest of the image
+type Repository struct {
+	Host      string
+	Path      string
+	Reference string
+}
+
+// ParseRepository parse the image reference, docker hub images are served by registry-1.docker.io
+func ParseRepository(image string) (*Repository, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, fmt.Errorf("parse image %s failure %s", image, err.Error())
+	}
+	named = reference.TagNameOnly(named)
+	repo := &Repository{Host: reference.Domain(named), Path: reference.Path(named)}
+	if repo.Host == "docker.io" {
+		repo.Host = "registry-1.docker.io"
+	}
+	if canonical, ok := named.(reference.Canonical); ok {
+		repo.Reference = canonical.Digest().String()
+	} else if tagged, ok := named.(reference.Tagged); ok {
+		repo.Reference = tagged.Tag()
+	}
+	return repo, nil
+}
+
+func (c *Client) url(repo *Repository, format string, args ...interface{}) string {
+	scheme := "https"
+	if c.plainHTTP {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/", scheme, repo.Host, repo.Path) + fmt.Sprintf(format, args...)
+}
+
+// Do send the request to the registry, authenticating with the scheme the
+// registry challenges with. A cached token the registry rejects, eg. an
+// expired bearer token, is renewed once. The request body must be replayable.
+func (c *Client) Do(req *http.Request, repo *Repository, actions string) (*http.Response, error) {
+	scope := fmt.Sprintf("repository:%s:%s", repo.Path, actions)
+	key := repo.Host + "/" + scope
+	c.mu.Lock()
+	token := c.tokens[key]
+	c.mu.Unlock()
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	res, err := c.httpCli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		return res, nil
+	}
+	res.Body.Close()
+	if token != "" {
+		c.mu.Lock()
+		if c.tokens[key] == token {
+			delete(c.tokens, key)
+		}
+		c.mu.Unlock()
+	}
+	token, err = c.authorize(req.Context(), res.Header.Get("WWW-Authenticate"), scope)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.tokens[key] = token
+	c.mu.Unlock()
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("can not replay the request body of %s", req.URL)
+		}
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", token)
+	if res, err = c.httpCli.Do(retry); err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		res.Body.Close()
+		return nil, c.unauthorized()
+	}
+	return res, nil
+}
+
+func (c *Client) unauthorized() error {
+	if c.user == "" {
+		return ErrUnauthorized
+	}
+	return ErrDenied
+}
+
+// authorize answer the challenge, the returned value is the Authorization header
+func (c *Client) authorize(ctx context.Context, challenge, scope string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "":
+		return "", c.unauthorized()
+	case "basic":
+		if c.user == "" {
+			return "", ErrUnauthorized
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.user+":"+c.pass)), nil
+	case "bearer":
+		realm, err := url.Parse(params["realm"])
+		if err != nil || params["realm"] == "" {
+			return "", fmt.Errorf("invalid bearer realm %q", params["realm"])
+		}
+		query := realm.Query()
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		query.Set("scope", scope)
+		realm.RawQuery = query.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.pass)
+		}
+		res, err := c.httpCli.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+			return "", c.unauthorized()
+		}
+		if res.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("get registry token failure, response code is %d", res.StatusCode)
+		}
+		var body struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			return "", fmt.Errorf("read registry token failure %s", err.Error())
+		}
+		if body.Token == "" {
+			body.Token = body.AccessToken
+		}
+		return "Bearer " + body.Token, nil
+	default:
+		return "", fmt.Errorf("unsupported registry auth challenge %q", challenge)
+	}
+}
+
+// parseChallenge parse the WWW-Authenticate header, eg. Bearer realm="x",service="y"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if end := strings.Index(rest, ","); end >= 0 {
+			value, rest = rest[:end], rest[end:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return parts[0], params
+}
+
+func responseError(res *http.Response, what string) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("%s %w", what, ErrNotFound)
+	case http.StatusForbidden:
+		return fmt.Errorf("%s: %w", what, ErrDenied)
+	default:
+		return fmt.Errorf("%s: response code is %d %s", what, res.StatusCode, strings.TrimSpace(string(body)))
+	}
+}
+
+// Manifest get the manifest of the image, the descriptor carries the media type,
+// digest and size of the returned body
+func (c *Client) Manifest(ctx context.Context, image string) (ocispec.Descriptor, []byte, error) {
+	repo, err := ParseRepository(image)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	return c.manifest(ctx, repo, repo.Reference)
+}
+
+func (c *Client) manifest(ctx context.Context, repo *Repository, ref string) (ocispec.Descriptor, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(repo, "manifests/%s", ref), nil)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	res, err := c.Do(req, repo, "pull")
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ocispec.Descriptor{}, nil, responseError(res, fmt.Sprintf("manifest %s/%s:%s", repo.Host, repo.Path, ref))
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	mediaType := res.Header.Get("Content-Type")
+	if i := strings.Index(mediaType, ";"); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	if mediaType == "" || mediaType == "application/json" {
+		var probe struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(body, &probe)
+		mediaType = probe.MediaType
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(body), Size: int64(len(body))}, body, nil
+}
+
+// ImageSize the compressed size of the image, the size of its config and layers.
+// For a multi-platform image the manifest of the current platform is used,
+// linux/amd64 by default.
+func (c *Client) ImageSize(ctx context.Context, image string) (int64, error) {
+	repo, err := ParseRepository(image)
+	if err != nil {
+		return 0, err
+	}
+	desc, body, err := c.manifest(ctx, repo, repo.Reference)
+	if err != nil {
+		return 0, err
+	}
+	if desc.MediaType == ocispec.MediaTypeImageIndex || desc.MediaType == mediaTypeDockerManifestList {
+		var index ocispec.Index
+		if err := json.Unmarshal(body, &index); err != nil {
+			return 0, fmt.Errorf("read index of image %s failure %s", image, err.Error())
+		}
+		m, ok := platformManifest(index.Manifests)
+		if !ok {
+			return 0, fmt.Errorf("image %s has no manifest", image)
+		}
+		if _, body, err = c.manifest(ctx, repo, m.Digest.String()); err != nil {
+			return 0, err
+		}
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return 0, fmt.Errorf("read manifest of image %s failure %s", image, err.Error())
+	}
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return size, nil
+}
+
+// platformManifest the manifest of the current platform, linux/amd64 or the first one
+func platformManifest(manifests []ocispec.Descriptor) (ocispec.Descriptor, bool) {
+	if len(manifests) == 0 {
+		return ocispec.Descriptor{}, false
+	}
+	arch := runtime.GOARCH
+	for _, want := range []string{arch, "amd64"} {
+		for _, m := range manifests {
+			if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == want {
+				return m, true
+			}
+		}
+	}
+	return manifests[0], true
+}
+
+// BlobExists whether the registry has the blob in the repository
+func (c *Client) BlobExists(ctx context.Context, repo *Repository, d digest.Digest) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.url(repo, "blobs/%s", d), nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := c.Do(req, repo, "pull,push")
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, responseError(res, fmt.Sprintf("blob %s", d))
+	}
+}
+
+// PushBlob upload the blob into the repository with a monolithic upload,
+// open is called again if the upload has to be replayed
+func (c *Client) PushBlob(ctx context.Context, repo *Repository, desc ocispec.Descriptor, open func() (io.ReadCloser, error)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(repo, "blobs/uploads/"), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.Do(req, repo, "pull,push")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		return responseError(res, fmt.Sprintf("start upload of blob %s", desc.Digest))
+	}
+	location, err := req.URL.Parse(res.Header.Get("Location"))
+	if err != nil || res.Header.Get("Location") == "" {
+		return fmt.Errorf("invalid upload location %q", res.Header.Get("Location"))
+	}
+	query := location.Query()
+	query.Set("digest", desc.Digest.String())
+	location.RawQuery = query.Encode()
+	body, err := open()
+	if err != nil {
+		return err
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPut, location.String(), body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	req.ContentLength = desc.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.GetBody = open
+	if res, err = c.Do(req, repo, "pull,push"); err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return responseError(res, fmt.Sprintf("upload blob %s", desc.Digest))
+	}
+	return nil
+}
+
+// PushManifest put the manifest into the repository under the reference, a tag or the digest
+func (c *Client) PushManifest(ctx context.Context, repo *Repository, ref string, mediaType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.url(repo, "manifests/%s", ref), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	res, err := c.Do(req, repo, "pull,push")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		return responseError(res, fmt.Sprintf("push manifest %s/%s:%s", repo.Host, repo.Path, ref))
+	}
+	return nil
+}
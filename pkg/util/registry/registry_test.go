@@ -0,0 +1,193 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/registry/registrytest"
+)
+
+// newTokenRegistry serve the manifests behind bearer token auth, only
+// demo:secret may pull
+func newTokenRegistry(t *testing.T, manifests map[string][]byte) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if user, pass, _ := r.BasicAuth(); user != "demo" || pass != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "t0ken"})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer t0ken" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, ok := manifests[strings.TrimPrefix(r.URL.Path, "/v2/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var probe struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(body, &probe)
+		w.Header().Set("Content-Type", probe.MediaType)
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestImageSize(t *testing.T) {
+	manifest, _ := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{Size: 100},
+		Layers:    []ocispec.Descriptor{{Size: 1000}, {Size: 2000}},
+	})
+	index, _ := json.Marshal(ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromBytes(manifest),
+			Platform:  &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		}},
+	})
+	srv := newTokenRegistry(t, map[string][]byte{
+		"demo/web/manifests/v1": index,
+		"demo/web/manifests/" + digest.FromBytes(manifest).String(): manifest,
+	})
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	size, err := NewClient("demo", "secret", WithPlainHTTP()).ImageSize(context.Background(), host+"/demo/web:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 3100 {
+		t.Errorf("want size 3100, got %d", size)
+	}
+	if _, err := NewClient("", "", WithPlainHTTP()).ImageSize(context.Background(), host+"/demo/web:v1"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("want ErrUnauthorized, got %v", err)
+	}
+	if _, err := NewClient("demo", "wrong", WithPlainHTTP()).ImageSize(context.Background(), host+"/demo/web:v1"); !errors.Is(err, ErrDenied) {
+		t.Errorf("want ErrDenied, got %v", err)
+	}
+	if _, err := NewClient("demo", "secret", WithPlainHTTP()).ImageSize(context.Background(), host+"/demo/web:v2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"`)
+	if scheme != "Bearer" || params["realm"] != "https://auth.docker.io/token" || params["service"] != "registry.docker.io" || params["scope"] != "repository:library/nginx:pull" {
+		t.Errorf("unexpected challenge %s %v", scheme, params)
+	}
+}
+
+func TestPush(t *testing.T) {
+	reg := registrytest.NewServer()
+	defer reg.Close()
+	reg.User, reg.Password = "demo", "secret"
+	repo, err := ParseRepository(reg.Host() + "/demo/web:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := []byte("layer")
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	open := func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(blob)), nil }
+	c := NewClient("demo", "secret", WithPlainHTTP())
+	ctx := context.Background()
+	if exists, err := c.BlobExists(ctx, repo, desc.Digest); err != nil || exists {
+		t.Fatalf("unexpected blob check %v %v", exists, err)
+	}
+	if err := c.PushBlob(ctx, repo, desc, open); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := c.BlobExists(ctx, repo, desc.Digest); err != nil || !exists {
+		t.Errorf("the pushed blob is not found %v", err)
+	}
+	manifest, _ := json.Marshal(ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Layers: []ocispec.Descriptor{desc}})
+	if err := c.PushManifest(ctx, repo, repo.Reference, ocispec.MediaTypeImageManifest, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, body, err := c.Manifest(ctx, reg.Host()+"/demo/web:v1"); err != nil || !bytes.Equal(body, manifest) {
+		t.Errorf("unexpected pushed manifest %v", err)
+	}
+	err = NewClient("demo", "wrong", WithPlainHTTP()).PushManifest(ctx, repo, repo.Reference, ocispec.MediaTypeImageManifest, manifest)
+	if !errors.Is(err, ErrDenied) {
+		t.Errorf("want ErrDenied, got %v", err)
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	manifest, _ := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{Size: 100},
+	})
+	// every token is valid for one request only
+	var (
+		srv    *httptest.Server
+		issued int
+		valid  string
+		tokens int
+	)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			issued++
+			valid = fmt.Sprintf("t0ken-%d", issued)
+			json.NewEncoder(w).Encode(map[string]string{"token": valid})
+			return
+		}
+		if valid == "" || r.Header.Get("Authorization") != "Bearer "+valid {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		valid = ""
+		tokens++
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Write(manifest)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	cli := NewClient("demo", "secret", WithPlainHTTP())
+	for i := 0; i < 3; i++ {
+		if _, err := cli.ImageSize(context.Background(), host+"/demo/web:v1"); err != nil {
+			t.Fatalf("request %d with an expired token failure %v", i, err)
+		}
+	}
+	if issued != 3 || tokens != 3 {
+		t.Errorf("expect a new token per request, issued %d served %d", issued, tokens)
+	}
+}
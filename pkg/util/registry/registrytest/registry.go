@@ -0,0 +1,156 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+// Package registrytest an in-memory registry serving the blob and manifest
+// endpoints of the registry HTTP API v2, to stand in for a registry in tests.
+package registrytest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var (
+	blobPath     = regexp.MustCompile(`^/v2/(.+)/blobs/(sha256:[a-f0-9]{64})$`)
+	uploadsPath  = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/$`)
+	uploadPath   = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([0-9]+)$`)
+	manifestPath = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+)
+
+// Manifest a manifest stored in the registry
+type Manifest struct {
+	MediaType string
+	Body      []byte
+}
+
+// Registry the in-memory registry, the blobs and manifests are keyed by
+// repository, the manifests by tag and by digest
+type Registry struct {
+	*httptest.Server
+	// User and Password the basic auth credentials required, none if empty
+	User, Password string
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string]Manifest
+	uploads   int
+	// Uploaded the count of the blob uploads completed
+	Uploaded int
+}
+
+// NewServer start the in-memory registry, close it when done
+func NewServer() *Registry {
+	r := &Registry{blobs: make(map[string][]byte), manifests: make(map[string]Manifest)}
+	r.Server = httptest.NewServer(r)
+	return r
+}
+
+// Host the host of the registry, images are named after it
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+// Blob the blob of the repository
+func (r *Registry) Blob(repo string, d digest.Digest) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.blobs[repo+"@"+d.String()]
+	return b, ok
+}
+
+// Manifest the manifest of the repository by tag or digest
+func (r *Registry) Manifest(repo, ref string) (Manifest, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.manifests[repo+":"+ref]
+	return m, ok
+}
+
+// ServeHTTP serve the registry API
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.User != "" {
+		if user, pass, ok := req.BasicAuth(); !ok || user != r.User || pass != r.Password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registrytest"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := req.URL.Path
+	switch {
+	case uploadsPath.MatchString(p) && req.Method == http.MethodPost:
+		m := uploadsPath.FindStringSubmatch(p)
+		r.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", m[1], r.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case uploadPath.MatchString(p) && req.Method == http.MethodPut:
+		m := uploadPath.FindStringSubmatch(p)
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		d, err := digest.Parse(req.URL.Query().Get("digest"))
+		if err != nil || digest.FromBytes(body) != d {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID"}]}`)
+			return
+		}
+		r.blobs[m[1]+"@"+d.String()] = body
+		r.Uploaded++
+		w.WriteHeader(http.StatusCreated)
+	case blobPath.MatchString(p) && (req.Method == http.MethodHead || req.Method == http.MethodGet):
+		m := blobPath.FindStringSubmatch(p)
+		body, ok := r.blobs[m[1]+"@"+m[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		if req.Method == http.MethodGet {
+			w.Write(body)
+		}
+	case manifestPath.MatchString(p) && req.Method == http.MethodPut:
+		m := manifestPath.FindStringSubmatch(p)
+		body, _ := io.ReadAll(req.Body)
+		manifest := Manifest{MediaType: req.Header.Get("Content-Type"), Body: body}
+		r.manifests[m[1]+":"+m[2]] = manifest
+		r.manifests[m[1]+":"+digest.FromBytes(body).String()] = manifest
+		w.WriteHeader(http.StatusCreated)
+	case manifestPath.MatchString(p) && (req.Method == http.MethodHead || req.Method == http.MethodGet):
+		m := manifestPath.FindStringSubmatch(p)
+		manifest, ok := r.manifests[m[1]+":"+m[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", manifest.MediaType)
+		if req.Method == http.MethodGet {
+			w.Write(manifest.Body)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
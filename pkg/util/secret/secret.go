@@ -0,0 +1,175 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package secret
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Placeholder the value of the variables generated at install time
+const Placeholder = "**None**"
+
+// FileName the file the generated secrets are recorded in
+const FileName = "secrets.json"
+
+// DefaultCharset -
+const DefaultCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// DefaultLength -
+const DefaultLength = 16
+
+// Generator generate a secret of length from the charset
+type Generator func(length int, charset string) (string, error)
+
+// Option secret store option
+type Option func(*Store)
+
+// WithLength the length of the generated secrets
+func WithLength(length int) Option {
+	return func(s *Store) {
+		s.length = length
+	}
+}
+
+// WithCharset the chars the generated secrets consist of
+func WithCharset(charset string) Option {
+	return func(s *Store) {
+		s.charset = charset
+	}
+}
+
+// WithGenerator replace the random generator
+func WithGenerator(generator Generator) Option {
+	return func(s *Store) {
+		s.generator = generator
+	}
+}
+
+// Entry a generated secret
+type Entry struct {
+	Component string `json:"component"`
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+}
+
+// Store generate one value per variable of a component, so the component and
+// the components depending on it get the same value
+type Store struct {
+	length    int
+	charset   string
+	generator Generator
+
+	lock    sync.Mutex
+	entries map[string]*Entry
+}
+
+// NewStore -
+func NewStore(opts ...Option) *Store {
+	s := &Store{
+		length:    DefaultLength,
+		charset:   DefaultCharset,
+		generator: Random,
+		entries:   make(map[string]*Entry),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Resolve return the value unless it is the placeholder, the generated secret
+// of the variable of the component is returned then
+func (s *Store) Resolve(component, name, value string) (string, bool, error) {
+	if value != Placeholder {
+		return value, false, nil
+	}
+	secret, err := s.Value(component, name)
+	return secret, true, err
+}
+
+// Value the secret of the variable of the component, it is generated on first use
+func (s *Store) Value(component, name string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := component + "/" + name
+	if entry, ok := s.entries[key]; ok {
+		return entry.Value, nil
+	}
+	value, err := s.generator(s.length, s.charset)
+	if err != nil {
+		return "", fmt.Errorf("generate secret %s of component %s failure %s", name, component, err.Error())
+	}
+	s.entries[key] = &Entry{Component: component, Name: name, Value: value}
+	return value, nil
+}
+
+// Entries the generated secrets sorted by component and name
+func (s *Store) Entries() []Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entries := make([]Entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Component != entries[j].Component {
+			return entries[i].Component < entries[j].Component
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// WriteFile record the generated secrets in the file, nothing is written if
+// no secret is generated
+func (s *Store) WriteFile(file string) error {
+	entries := s.Entries()
+	if len(entries) == 0 {
+		return nil
+	}
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, content, 0600)
+}
+
+// Random generate a secret with crypto/rand
+func Random(length int, charset string) (string, error) {
+	if length <= 0 || charset == "" {
+		return "", fmt.Errorf("invalid secret length %d or charset %q", length, charset)
+	}
+	chars := []rune(charset)
+	res := make([]rune, length)
+	size := big.NewInt(int64(len(chars)))
+	for i := range res {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", err
+		}
+		res[i] = chars[n.Int64()]
+	}
+	return string(res), nil
+}
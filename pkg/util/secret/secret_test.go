@@ -0,0 +1,61 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package secret
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore(WithLength(12), WithCharset("ab"))
+	value, generated, err := s.Resolve("mysql", "MYSQL_PASSWORD", Placeholder)
+	if err != nil || !generated {
+		t.Fatalf("expect generated secret, got %v %v", generated, err)
+	}
+	if len(value) != 12 || strings.Trim(value, "ab") != "" {
+		t.Errorf("unexpected secret %s", value)
+	}
+	again, _, _ := s.Resolve("mysql", "MYSQL_PASSWORD", Placeholder)
+	if again != value {
+		t.Errorf("expect the same secret for the same variable")
+	}
+	if plain, generated, _ := s.Resolve("mysql", "MYSQL_USER", "root"); plain != "root" || generated {
+		t.Errorf("plain value is replaced")
+	}
+
+	file := path.Join(t.TempDir(), FileName)
+	if err := s.WriteFile(file); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []Entry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Value != value {
+		t.Errorf("unexpected entries %v", entries)
+	}
+}
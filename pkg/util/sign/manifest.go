@@ -0,0 +1,221 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package sign
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/wutong-paas/wutong-oam/pkg/util/image"
+)
+
+const (
+	// ManifestFileName the name of the package manifest in the package root dir
+	ManifestFileName = "package-manifest.json"
+	// SignatureFileName the name of the detached manifest signature in the package root dir
+	SignatureFileName = "package-manifest.sig"
+)
+
+// Manifest lists every file of a package with its digest
+type Manifest struct {
+	Version string       `json:"version"`
+	Files   []FileDigest `json:"files"`
+	// Images the layers of the images in the image archives of the package
+	Images []ImageLayers `json:"images,omitempty"`
+}
+
+// ImageLayers the layer digests of an image in an image archive of the package,
+// the layers of a delta package are listed although they are left out
+type ImageLayers struct {
+	Archive string   `json:"archive"`
+	Name    string   `json:"name"`
+	Layers  []string `json:"layers"`
+}
+
+// FileDigest file path relative to the package root dir and its sha256 digest
+type FileDigest struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BuildManifest walks the package dir and digests every regular file,
+// the manifest and signature files themselves are skipped
+func BuildManifest(dir string) (*Manifest, error) {
+	manifest := &Manifest{Version: "v1"}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == ManifestFileName || rel == SignatureFileName {
+			return nil
+		}
+		digest, err := fileDigest(p)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, FileDigest{Path: rel, Size: info.Size(), SHA256: digest})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+	return manifest, nil
+}
+
+// WriteManifest build the manifest of the package dir and write it into the dir,
+// the written bytes are returned so that they can be signed
+func WriteManifest(dir string) ([]byte, error) {
+	return WriteManifestFile(dir, filepath.Join(dir, ManifestFileName))
+}
+
+// WriteManifestFile build the manifest of the package dir and write it into file
+func WriteManifestFile(dir, file string) ([]byte, error) {
+	manifest, err := BuildManifest(dir)
+	if err != nil {
+		return nil, fmt.Errorf("build package manifest failure %s", err.Error())
+	}
+	if manifest.Images, err = imageLayers(dir, manifest.Files); err != nil {
+		return nil, fmt.Errorf("read package images failure %s", err.Error())
+	}
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, body, 0644); err != nil {
+		return nil, fmt.Errorf("write package manifest failure %s", err.Error())
+	}
+	return body, nil
+}
+
+// ReadManifest read the package manifest from the package dir
+func ReadManifest(dir string) (*Manifest, []byte, error) {
+	return readManifestFile(filepath.Join(dir, ManifestFileName))
+}
+
+func readManifestFile(file string) (*Manifest, []byte, error) {
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("parse package manifest failure %s", err.Error())
+	}
+	return &manifest, body, nil
+}
+
+// CheckFiles compare the files in the package dir with the manifest,
+// any modified, missing or unlisted file is reported
+func (m *Manifest) CheckFiles(dir string) error {
+	current, err := BuildManifest(dir)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]FileDigest, len(m.Files))
+	for _, f := range m.Files {
+		listed[f.Path] = f
+	}
+	for _, f := range current.Files {
+		expect, ok := listed[f.Path]
+		if !ok {
+			return fmt.Errorf("file %s is not listed in the package manifest", f.Path)
+		}
+		if expect.SHA256 != f.SHA256 || expect.Size != f.Size {
+			return fmt.Errorf("file %s has been modified", f.Path)
+		}
+		delete(listed, f.Path)
+	}
+	for p := range listed {
+		return fmt.Errorf("file %s listed in the package manifest is missing", p)
+	}
+	return nil
+}
+
+// imageLayers list the layers of the images in the image archives and the
+// OCI image layouts, tar files that are not image archives are skipped
+func imageLayers(dir string, files []FileDigest) ([]ImageLayers, error) {
+	var res []ImageLayers
+	for _, f := range files {
+		archivePath := f.Path
+		switch {
+		case strings.HasSuffix(f.Path, ".tar"):
+		case path.Base(f.Path) == ocispec.ImageLayoutFile:
+			archivePath = path.Dir(f.Path)
+		default:
+			continue
+		}
+		archive, err := image.OpenArchive(filepath.Join(dir, filepath.FromSlash(archivePath)))
+		if err != nil {
+			continue
+		}
+		for _, name := range archive.Images() {
+			layers, err := archive.Layers(name)
+			if err != nil {
+				archive.Close()
+				return nil, err
+			}
+			item := ImageLayers{Archive: archivePath, Name: name}
+			for _, layer := range layers {
+				d, err := archive.LayerDigest(layer)
+				if err != nil {
+					archive.Close()
+					return nil, err
+				}
+				item.Layers = append(item.Layers, d.String())
+			}
+			res = append(res, item)
+		}
+		archive.Close()
+	}
+	return res, nil
+}
+
+func fileDigest(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,390 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrNotSigned the package does not contain a signature
+var ErrNotSigned = errors.New("package is not signed")
+
+// ErrUntrusted the package signature is not made by a trusted key
+var ErrUntrusted = errors.New("package signature is not trusted")
+
+// Policy package signature verification policy
+type Policy string
+
+var (
+	// PolicyRequire reject unsigned or tampered packages
+	PolicyRequire Policy = "require"
+	// PolicyWarn only warn about unsigned or tampered packages
+	PolicyWarn Policy = "warn"
+	// PolicyOff skip the signature verification
+	PolicyOff Policy = "off"
+)
+
+// Signature detached signature of the package manifest
+type Signature struct {
+	// ed25519 or x509
+	Type string `json:"type"`
+	// KeyID the hex sha256 of the ed25519 public key
+	KeyID string `json:"key_id,omitempty"`
+	// Certificates the PEM encoded certificate chain, leaf first
+	Certificates []string `json:"certificates,omitempty"`
+	Signature    string   `json:"signature"`
+}
+
+// Signer sign the package manifest
+type Signer interface {
+	Sign(manifest []byte) (*Signature, error)
+}
+
+type ed25519Signer struct {
+	key ed25519.PrivateKey
+}
+
+// NewEd25519Signer new signer with a ed25519 private key
+func NewEd25519Signer(key ed25519.PrivateKey) Signer {
+	return &ed25519Signer{key: key}
+}
+
+func (e *ed25519Signer) Sign(manifest []byte) (*Signature, error) {
+	return &Signature{
+		Type:      "ed25519",
+		KeyID:     keyID(e.key.Public().(ed25519.PublicKey)),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(e.key, manifest)),
+	}, nil
+}
+
+type x509Signer struct {
+	key   crypto.Signer
+	chain []*x509.Certificate
+}
+
+// NewX509Signer new signer with the private key of the leaf certificate in chain
+func NewX509Signer(key crypto.Signer, chain []*x509.Certificate) (Signer, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("certificate chain is empty")
+	}
+	return &x509Signer{key: key, chain: chain}, nil
+}
+
+func (x *x509Signer) Sign(manifest []byte) (*Signature, error) {
+	var (
+		sig []byte
+		err error
+	)
+	switch x.key.(type) {
+	case ed25519.PrivateKey:
+		sig, err = x.key.Sign(rand.Reader, manifest, crypto.Hash(0))
+	case *ecdsa.PrivateKey, *rsa.PrivateKey:
+		digest := sha256.Sum256(manifest)
+		sig, err = x.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", x.key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signature := &Signature{
+		Type:      "x509",
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	}
+	for _, cert := range x.chain {
+		signature.Certificates = append(signature.Certificates, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	}
+	return signature, nil
+}
+
+// LoadSigner load the signer from a PEM private key file, a ed25519 signer is
+// returned when the certificate chain file is empty
+func LoadSigner(keyFile, certChainFile string) (Signer, error) {
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if certChainFile == "" {
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("a certificate chain is required for %T private key", key)
+		}
+		return NewEd25519Signer(edKey), nil
+	}
+	chainPEM, err := os.ReadFile(certChainFile)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := parseCertificates(chainPEM)
+	if err != nil {
+		return nil, err
+	}
+	return NewX509Signer(key, chain)
+}
+
+// SignDir write the manifest of the package dir and a detached signature of it
+func SignDir(dir string, signer Signer) error {
+	return SignDirTo(dir, filepath.Join(dir, ManifestFileName), filepath.Join(dir, SignatureFileName), signer)
+}
+
+// SignDirTo write the manifest of the package dir and a detached signature of
+// it into the given files, the dir is left as it is
+func SignDirTo(dir, manifestFile, signatureFile string, signer Signer) error {
+	manifest, err := WriteManifestFile(dir, manifestFile)
+	if err != nil {
+		return err
+	}
+	if signer == nil {
+		return nil
+	}
+	signature, err := signer.Sign(manifest)
+	if err != nil {
+		return fmt.Errorf("sign package manifest failure %s", err.Error())
+	}
+	body, err := json.MarshalIndent(signature, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(signatureFile, body, 0644)
+}
+
+// TrustStore trusted ed25519 public keys and x509 root certificates
+type TrustStore struct {
+	keys  map[string]ed25519.PublicKey
+	roots *x509.CertPool
+}
+
+// NewTrustStore new empty trust store
+func NewTrustStore() *TrustStore {
+	return &TrustStore{
+		keys:  make(map[string]ed25519.PublicKey),
+		roots: x509.NewCertPool(),
+	}
+}
+
+// AddKey trust a ed25519 public key
+func (t *TrustStore) AddKey(key ed25519.PublicKey) {
+	t.keys[keyID(key)] = key
+}
+
+// AddCertificate trust a root certificate
+func (t *TrustStore) AddCertificate(cert *x509.Certificate) {
+	t.roots.AddCert(cert)
+}
+
+// LoadTrustStore load trusted keys from PEM files, which may contain
+// PUBLIC KEY blocks of ed25519 keys and CERTIFICATE blocks of root certificates
+func LoadTrustStore(files ...string) (*TrustStore, error) {
+	store := NewTrustStore()
+	for _, file := range files {
+		body, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for block, rest := pem.Decode(body); block != nil; block, rest = pem.Decode(rest) {
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err := x509.ParsePKIXPublicKey(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("parse public key in %s failure %s", file, err.Error())
+				}
+				edKey, ok := key.(ed25519.PublicKey)
+				if !ok {
+					return nil, fmt.Errorf("public key in %s is %T, only ed25519 keys are supported", file, key)
+				}
+				store.AddKey(edKey)
+			case "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("parse certificate in %s failure %s", file, err.Error())
+				}
+				store.AddCertificate(cert)
+			}
+		}
+	}
+	return store, nil
+}
+
+// Verify check the signature of the manifest against the trusted keys
+func (t *TrustStore) Verify(manifest []byte, signature *Signature) error {
+	sig, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if err != nil {
+		return fmt.Errorf("decode package signature failure %s", err.Error())
+	}
+	switch signature.Type {
+	case "ed25519":
+		key, ok := t.keys[signature.KeyID]
+		if !ok {
+			return fmt.Errorf("%w: unknown key %s", ErrUntrusted, signature.KeyID)
+		}
+		if !ed25519.Verify(key, manifest, sig) {
+			return fmt.Errorf("package manifest signature is invalid")
+		}
+		return nil
+	case "x509":
+		var chain []*x509.Certificate
+		for _, c := range signature.Certificates {
+			certs, err := parseCertificates([]byte(c))
+			if err != nil {
+				return err
+			}
+			chain = append(chain, certs...)
+		}
+		if len(chain) == 0 {
+			return fmt.Errorf("package signature has no certificate")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := chain[0].Verify(x509.VerifyOptions{
+			Roots:         t.roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return fmt.Errorf("%w: %s", ErrUntrusted, err.Error())
+		}
+		if err := checkSignature(chain[0], manifest, sig); err != nil {
+			return fmt.Errorf("package manifest signature is invalid: %s", err.Error())
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported package signature type %s", signature.Type)
+	}
+}
+
+// VerifyDir verify the package dir, the manifest signature must be made by a
+// trusted key and every file must match the manifest
+func (t *TrustStore) VerifyDir(dir string) error {
+	return t.VerifyDirWith(dir, filepath.Join(dir, ManifestFileName), filepath.Join(dir, SignatureFileName))
+}
+
+// VerifyDirWith verify the package dir with the manifest and signature files
+// kept out of it
+func (t *TrustStore) VerifyDirWith(dir, manifestFile, signatureFile string) error {
+	body, err := os.ReadFile(signatureFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotSigned
+		}
+		return err
+	}
+	var signature Signature
+	if err := json.Unmarshal(body, &signature); err != nil {
+		return fmt.Errorf("parse package signature failure %s", err.Error())
+	}
+	manifest, raw, err := readManifestFile(manifestFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("package is signed but the package manifest is missing")
+		}
+		return err
+	}
+	if err := t.Verify(raw, &signature); err != nil {
+		return err
+	}
+	return manifest.CheckFiles(dir)
+}
+
+// checkSignature verify the signature with the public key of the leaf certificate,
+// the algorithm follows the key type the same way x509Signer signs
+func checkSignature(cert *x509.Certificate, manifest, sig []byte) error {
+	var algo x509.SignatureAlgorithm
+	switch cert.PublicKey.(type) {
+	case ed25519.PublicKey:
+		algo = x509.PureEd25519
+	case *ecdsa.PublicKey:
+		algo = x509.ECDSAWithSHA256
+	case *rsa.PublicKey:
+		algo = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("unsupported public key type %T", cert.PublicKey)
+	}
+	return cert.CheckSignature(algo, manifest, sig)
+}
+
+func parsePrivateKey(body []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in private key file")
+	}
+	var (
+		key interface{}
+		err error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse private key failure %s", err.Error())
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func parseCertificates(body []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(body); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate failure %s", err.Error())
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return certs, nil
+}
+
+func keyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
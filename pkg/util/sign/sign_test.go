@@ -0,0 +1,163 @@
+// WUTONG, Application Management Platform
+// Copyright (C) 2020-2020 Wutong Co., Ltd.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version. For any non-GPL usage of Wutong,
+// one or multiple Commercial Licenses authorized by Wutong Co., Ltd.
+// must be obtained first.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package sign
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newPackageDir(t *testing.T) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), []byte(`{"group_name":"demo"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "images", "component-images.tar"), []byte("image data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestEd25519SignAndVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := newPackageDir(t)
+	if err := SignDir(dir, NewEd25519Signer(priv)); err != nil {
+		t.Fatal(err)
+	}
+	store := NewTrustStore()
+	store.AddKey(pub)
+	if err := store.VerifyDir(dir); err != nil {
+		t.Fatalf("verify signed package: %v", err)
+	}
+
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	other := NewTrustStore()
+	other.AddKey(otherPub)
+	if err := other.VerifyDir(dir); !errors.Is(err, ErrUntrusted) {
+		t.Fatalf("expect untrusted error, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), []byte(`{"group_name":"evil"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.VerifyDir(dir); err == nil {
+		t.Fatal("expect tampered package to be rejected")
+	}
+}
+
+func TestUnsignedPackage(t *testing.T) {
+	dir := newPackageDir(t)
+	if err := SignDir(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewTrustStore().VerifyDir(dir); !errors.Is(err, ErrNotSigned) {
+		t.Fatalf("expect not signed error, got %v", err)
+	}
+}
+
+func TestSignDirTo(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := newPackageDir(t)
+	out := t.TempDir()
+	manifestFile, signatureFile := filepath.Join(out, "demo-manifest.json"), filepath.Join(out, "demo-manifest.sig")
+	if err := SignDirTo(dir, manifestFile, signatureFile, NewEd25519Signer(priv)); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{ManifestFileName, SignatureFileName} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s written into the package dir", name)
+		}
+	}
+	store := NewTrustStore()
+	store.AddKey(pub)
+	if err := store.VerifyDirWith(dir, manifestFile, signatureFile); err != nil {
+		t.Fatalf("verify signed package: %v", err)
+	}
+	if err := store.VerifyDir(dir); !errors.Is(err, ErrNotSigned) {
+		t.Fatalf("expect not signed error, got %v", err)
+	}
+}
+
+func TestX509SignAndVerify(t *testing.T) {
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "wutong root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := x509.ParseCertificate(rootDER)
+
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "wutong exporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, root, &leafKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(leafDER)
+
+	signer, err := NewX509Signer(leafKey, []*x509.Certificate{leaf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := newPackageDir(t)
+	if err := SignDir(dir, signer); err != nil {
+		t.Fatal(err)
+	}
+	store := NewTrustStore()
+	store.AddCertificate(root)
+	if err := store.VerifyDir(dir); err != nil {
+		t.Fatalf("verify signed package: %v", err)
+	}
+	if err := NewTrustStore().VerifyDir(dir); !errors.Is(err, ErrUntrusted) {
+		t.Fatalf("expect untrusted error, got %v", err)
+	}
+}